@@ -0,0 +1,186 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	StorageClassStandard = "STANDARD"
+	StorageClassNearline = "NEARLINE"
+	StorageClassColdline = "COLDLINE"
+	StorageClassArchive  = "ARCHIVE"
+
+	// How often the archiver looks for cold objects.
+	archiveInterval = time.Hour
+)
+
+// coldness ranks storage classes from STANDARD, or the bucket default, to
+// ARCHIVE.
+func coldness(class string) int {
+	switch class {
+	case StorageClassNearline:
+		return 1
+	case StorageClassColdline:
+		return 2
+	case StorageClassArchive:
+		return 3
+	}
+	return 0
+}
+
+// runArchiver periodically moves cold objects to COLDLINE or ARCHIVE until
+// ctx is done.
+func (gd *GCSDatastore) runArchiver(ctx context.Context) {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := gd.ArchiveColdObjects(ctx); err != nil {
+				logger.Warnf("Archiving cold objects failed: %v", err)
+			}
+		}
+	}
+}
+
+// ArchiveColdObjects rewrites objects that have not been read for
+// Config.ArchiveAfter to the ARCHIVE storage class, and those not read for
+// Config.ColdlineAfter to COLDLINE. Objects are never moved to a warmer
+// class; RestoreOnRead does that. Reads are only known since the
+// datastore was opened, or since the one that saved the metadata snapshot
+// it loaded was, so a tier is skipped until that's at least its interval
+// ago. It returns the number of objects rewritten.
+func (gd *GCSDatastore) ArchiveColdObjects(ctx context.Context) (int, error) {
+	if gd.Config.ArchiveAfter <= 0 && gd.Config.ColdlineAfter <= 0 {
+		return 0, nil
+	}
+	now := time.Now()
+	watched := now.Sub(time.Unix(0, gd.accessSince.Load()))
+	cutoff := func(after time.Duration) int64 {
+		if after <= 0 {
+			return math.MinInt64
+		}
+		if watched < after {
+			logger.Debugf("Not moving objects unread for %v: reads only known for %v.", after, watched)
+			return math.MinInt64
+		}
+		return now.Add(-after).Unix()
+	}
+	archiveCutoff, coldlineCutoff := cutoff(gd.Config.ArchiveAfter), cutoff(gd.Config.ColdlineAfter)
+	sem := make(chan struct{}, gd.workers())
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	archived, coldline := 0, 0
+	next := gd.mdCache.Iterator("", 0)
+	for m := next(); m != nil; m = next() {
+		class := ""
+		switch {
+		case m.Accessed <= archiveCutoff:
+			class = StorageClassArchive
+		case m.Accessed <= coldlineCutoff:
+			class = StorageClassColdline
+		}
+		if class == "" || coldness(m.StorageClass) >= coldness(class) || gd.packs.has(m.Key) {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		key := m.Key
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			err := gd.setStorageClass(ctx, key, class)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			if class == StorageClassArchive {
+				archived++
+			} else {
+				coldline++
+			}
+		}()
+	}
+	wg.Wait()
+	gd.stats.archivedObjects.Add(int64(archived))
+	gd.stats.coldlineObjects.Add(int64(coldline))
+	if archived > 0 || coldline > 0 {
+		logger.Infof("Moved %d cold objects to ARCHIVE and %d to COLDLINE.", archived, coldline)
+	}
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return archived + coldline, firstErr
+}
+
+// restore moves a cold object back to STANDARD after it was read.
+func (gd *GCSDatastore) restore(ctx context.Context, key string) {
+	if err := gd.setStorageClass(ctx, key, StorageClassStandard); err != nil {
+		logger.Warnw("Failed to restore archived object", "key", key, "err", err)
+		gd.mdCache.SetStorageClass(key, StorageClassArchive)
+		return
+	}
+	gd.stats.restores.Add(1)
+}
+
+// setStorageClass rewrites the object for key in place with a new storage
+// class. The rewrite happens server-side; no data passes through this node.
+func (gd *GCSDatastore) setStorageClass(ctx context.Context, key string, class string) error {
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key))
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	if attrs.StorageClass != class {
+		// Don't clobber a concurrent write of the same key.
+		dst := obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
+		copier := gd.newCopier(dst, obj.Generation(attrs.Generation))
+		copier.ObjectAttrs = rewriteAttrs(attrs)
+		copier.StorageClass = class
+		if _, err := copier.Run(ctx); err != nil {
+			return err
+		}
+	}
+	gd.mdCache.SetStorageClass(key, class)
+	return nil
+}
+
+// rewriteAttrs returns destination attributes for an in-place rewrite that
+// keep the object's user-visible metadata.
+func rewriteAttrs(attrs *storage.ObjectAttrs) storage.ObjectAttrs {
+	return storage.ObjectAttrs{
+		ContentType:     attrs.ContentType,
+		ContentEncoding: attrs.ContentEncoding,
+		CacheControl:    attrs.CacheControl,
+		Metadata:        attrs.Metadata,
+		CustomTime:      attrs.CustomTime,
+	}
+}
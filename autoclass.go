@@ -0,0 +1,71 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+
+	"cloud.google.com/go/storage"
+)
+
+// autoclassEnabled reports whether GCS manages storage classes for the bucket.
+func autoclassEnabled(attrs *storage.BucketAttrs) bool {
+	return attrs != nil && attrs.Autoclass != nil && attrs.Autoclass.Enabled
+}
+
+// enableAutoclass turns Autoclass on for the bucket, unless it's on
+// already. Failures are logged: the datastore works without it.
+func (gd *GCSDatastore) enableAutoclass(ctx context.Context) {
+	if gd.bucketAttrs == nil || autoclassEnabled(gd.bucketAttrs) {
+		return
+	}
+	bucket := gd.client.Bucket(gd.Config.Bucket).If(storage.BucketConditions{MetagenerationMatch: gd.bucketAttrs.MetaGeneration})
+	attrs, err := bucket.Update(ctx, storage.BucketAttrsToUpdate{Autoclass: &storage.Autoclass{Enabled: true}})
+	if err != nil {
+		logger.Warnf("Failed to enable Autoclass on bucket %s: %v", gd.Config.Bucket, err)
+		return
+	}
+	gd.bucketAttrs = attrs
+	logger.Infof("Enabled Autoclass on bucket %s.", gd.Config.Bucket)
+}
+
+// observeClass counts the object of old, cached in one storage class and
+// found in class, as moved by Autoclass or a lifecycle rule. Objects
+// cached before their class was known don't count.
+func (gd *GCSDatastore) observeClass(old *Metadata, class string) {
+	if old.StorageClass != "" && class != "" && old.StorageClass != class {
+		gd.stats.classTransitions.Add(1)
+	}
+}
+
+// adjustForAutoclass disables settings that conflict with Autoclass. With
+// Autoclass, GCS moves objects between storage classes on its own, and
+// manual rewrites would only reset its access tracking and cost money.
+func (gd *GCSDatastore) adjustForAutoclass() {
+	if !autoclassEnabled(gd.bucketAttrs) {
+		if gd.Config.Autoclass {
+			logger.Warnf("Bucket %s does not have Autoclass enabled. Consider enabling it: "+
+				"gcloud storage buckets update gs://%s --enable-autoclass",
+				gd.Config.Bucket, gd.Config.Bucket)
+		}
+		return
+	}
+	if gd.Config.ArchiveAfter > 0 || gd.Config.ColdlineAfter > 0 || gd.Config.RestoreOnRead {
+		logger.Infof("Bucket %s has Autoclass enabled. Ignoring archive settings.", gd.Config.Bucket)
+		gd.Config.ArchiveAfter = 0
+		gd.Config.ColdlineAfter = 0
+		gd.Config.RestoreOnRead = false
+	}
+}
@@ -0,0 +1,335 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/googleapi"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	// GCS accepts at most 100 calls per batch request.
+	maxBatchCalls = 100
+	// Calls failing with a transient error are retried this many times.
+	batchRetries  = 3
+	batchEndpoint = "https://storage.googleapis.com"
+)
+
+// batchClient sends metadata calls to the JSON API batch endpoint, which
+// answers up to maxBatchCalls calls with one HTTP request. The storage
+// client doesn't support batching.
+type batchClient struct {
+	hc       *http.Client
+	endpoint string
+}
+
+// newBatchClient returns a client authenticated and throttled like
+// newClient's.
+func newBatchClient(ctx context.Context, cfg Config, th *throttle) (*batchClient, error) {
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" && cfg.Endpoint == "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return unauthenticatedBatchClient(host, th), nil
+	}
+	endpoint := batchEndpoint
+	if cfg.Endpoint != "" {
+		u, err := parseEndpoint(cfg.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		// The batch path is the same on all endpoints.
+		endpoint = u.Scheme + "://" + u.Host
+		if u.Scheme == "http" {
+			return unauthenticatedBatchClient(endpoint, th), nil
+		}
+	}
+	opts, err := credentialOptions(ctx, cfg, gcsScopes(cfg)...)
+	if err != nil {
+		return nil, err
+	}
+	var hc *http.Client
+	if th != nil {
+		hc, err = th.httpClient(ctx, opts...)
+	} else {
+		hc, _, err = htransport.NewClient(ctx, opts...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &batchClient{hc: hc, endpoint: endpoint}, nil
+}
+
+// unauthenticatedBatchClient returns a client of endpoint without
+// credentials, throttled by th if not nil.
+func unauthenticatedBatchClient(endpoint string, th *throttle) *batchClient {
+	hc := http.DefaultClient
+	if th != nil {
+		hc = &http.Client{Transport: th.transport(http.DefaultTransport)}
+	}
+	return &batchClient{hc: hc, endpoint: endpoint}
+}
+
+// batchCall is a JSON API call without a request body.
+type batchCall struct {
+	method string
+	path   string
+}
+
+// objectCall returns the call of method on the object name in bucket.
+func objectCall(method, bucket, name string, query string) batchCall {
+	p := "/storage/v1/b/" + url.PathEscape(bucket) + "/o/" + url.PathEscape(name)
+	if query != "" {
+		p += "?" + query
+	}
+	return batchCall{method: method, path: p}
+}
+
+// do makes calls in batches, and returns the error of each call, which is
+// a *googleapi.Error unless the batch request itself failed.
+func (bc *batchClient) do(ctx context.Context, calls []batchCall) []error {
+	errs := make([]error, len(calls))
+	for start := 0; start < len(calls); start += maxBatchCalls {
+		end := start + maxBatchCalls
+		if end > len(calls) {
+			end = len(calls)
+		}
+		pending := make([]int, 0, end-start)
+		for i := start; i < end; i++ {
+			pending = append(pending, i)
+		}
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			batch := make([]batchCall, len(pending))
+			for j, i := range pending {
+				batch[j] = calls[i]
+			}
+			results := bc.send(ctx, batch)
+			retry := pending[:0]
+			for j, i := range pending {
+				errs[i] = results[j]
+				if attempt < batchRetries && isTransient(results[j]) {
+					retry = append(retry, i)
+				}
+			}
+			if len(retry) == 0 {
+				break
+			}
+			pending = retry
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return errs
+			}
+			backoff *= 2
+		}
+	}
+	return errs
+}
+
+// isTransient reports whether a failed call may succeed when retried.
+func isTransient(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	return ok && (gerr.Code == http.StatusTooManyRequests || gerr.Code >= 500)
+}
+
+// send makes up to maxBatchCalls calls with one request.
+func (bc *batchClient) send(ctx context.Context, calls []batchCall) []error {
+	errs := make([]error, len(calls))
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for i, c := range calls {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {fmt.Sprintf("<%d>", i)},
+		})
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Fprintf(part, "%s %s HTTP/1.1\r\n\r\n", c.method, c.path)
+	}
+	mw.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, bc.endpoint+"/batch/storage/v1", body)
+	if err != nil {
+		return fail(err)
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	resp, err := bc.hc.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return fail(err)
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return fail(fmt.Errorf("gcsds: batch response: %w", err))
+	}
+	for i := range errs {
+		errs[i] = fmt.Errorf("gcsds: batch response without call %d", i)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(part.Header.Get("Content-ID"), "<response-"), ">")
+		i, err := strconv.Atoi(id)
+		if err != nil || i < 0 || i >= len(calls) {
+			continue
+		}
+		r, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		errs[i] = googleapi.CheckResponse(r)
+		r.Body.Close()
+	}
+	return errs
+}
+
+// getJSON makes a GET call of the JSON API, outside of a batch, for
+// features the storage client doesn't support, and decodes the response
+// into v.
+func (bc *batchClient) getJSON(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bc.endpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := bc.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// isNotFound reports whether a call failed because the object doesn't
+// exist.
+func isNotFound(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	return ok && gerr.Code == http.StatusNotFound
+}
+
+// HasMany reports for each of keys whether its object exists in GCS, with
+// one request per 100 keys. Unlike Has it doesn't consult the metadata
+// cache, so sweeps can use it to check the cache against the bucket.
+func (gd *GCSDatastore) HasMany(ctx context.Context, keys []ds.Key) ([]bool, error) {
+	has := make([]bool, len(keys))
+	// calls[j] stats keys[stated[j]], which isn't packed.
+	var calls []batchCall
+	var stated []int
+	for i, k := range keys {
+		if gd.packs.has(k.String()) {
+			has[i] = true
+			continue
+		}
+		calls = append(calls, objectCall(http.MethodGet, gd.Config.Bucket, gd.ObjectPath(k), "fields=name"))
+		stated = append(stated, i)
+	}
+	for j, err := range gd.batch.do(ctx, calls) {
+		i := stated[j]
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			err = requestError("stat", gd.ObjectPath(keys[i]), err)
+			logger.Warnw("Failed to check object", "key", keys[i], "err", err)
+			return nil, err
+		}
+		has[i] = true
+	}
+	if gd.Config.FallbackBucket != "" {
+		if err := gd.hasFallback(ctx, keys, has); err != nil {
+			return nil, err
+		}
+	}
+	return has, nil
+}
+
+// DeleteMany deletes keys like Delete, with one request per 100 keys. With
+// a TrashPrefix the keys are deleted one by one, since moving an object to
+// the trash copies it. Keys are deleted even if others fail, and the first
+// error is returned.
+func (gd *GCSDatastore) DeleteMany(ctx context.Context, keys []ds.Key) error {
+	if err := gd.checkWritable(); err != nil {
+		return err
+	}
+	if gd.Config.TrashPrefix != "" {
+		var first error
+		for _, k := range keys {
+			if err := gd.Delete(ctx, k); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+	calls := make([]batchCall, len(keys))
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		if err := gd.flushKey(ctx, k.String()); err != nil {
+			return err
+		}
+		calls[i] = objectCall(http.MethodDelete, gd.Config.Bucket, gd.ObjectPath(k), "")
+		names[i] = k.String()
+	}
+	if err := gd.packs.delete(ctx, names...); err != nil {
+		logger.Warnf("Failed to delete packed values: %v", err)
+		return err
+	}
+	var first error
+	for i, err := range gd.batch.do(ctx, calls) {
+		key := keys[i].String()
+		// Don't error for missing objects. Double deletes are OK.
+		if err != nil && !isNotFound(err) {
+			err = requestError("delete", gd.GCSPath(key), err)
+			logger.Warnw("Failed to delete object", "key", key, "err", err)
+			if first == nil {
+				first = gd.retainedError(ctx, key, err)
+			}
+			continue
+		}
+		gd.deleted(ctx, key)
+	}
+	return first
+}
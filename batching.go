@@ -0,0 +1,123 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+var _ ds.Batching = (*GCSDatastore)(nil)
+
+// BatchError holds the errors of the failed operations of a batch, of
+// PutMany, or of the keys ImportDatastore couldn't verify.
+type BatchError struct {
+	Errors map[ds.Key]error
+}
+
+func (e *BatchError) Error() string {
+	keys := make([]ds.Key, 0, len(e.Errors))
+	for k := range e.Errors {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	return fmt.Sprintf("gcsds: %d batch operations failed, first %v: %v", len(keys), keys[0], e.Errors[keys[0]])
+}
+
+// Unwrap returns the errors, for errors.Is and errors.As.
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// batchOp is the last operation on a key in a batch.
+type batchOp struct {
+	value  []byte
+	delete bool
+}
+
+// gcsBatch buffers Puts and Deletes until Commit. Only the last operation
+// on a key is applied.
+type gcsBatch struct {
+	gd  *GCSDatastore
+	mu  sync.Mutex
+	ops map[ds.Key]batchOp
+}
+
+// Batch returns a batch whose operations are applied on Commit, with up to
+// Workers in parallel.
+func (gd *GCSDatastore) Batch(_ context.Context) (ds.Batch, error) {
+	return &gcsBatch{gd: gd, ops: make(map[ds.Key]batchOp)}, nil
+}
+
+func (b *gcsBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ops[key] = batchOp{value: value}
+	return nil
+}
+
+func (b *gcsBatch) Delete(ctx context.Context, key ds.Key) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ops[key] = batchOp{delete: true}
+	return nil
+}
+
+// Commit applies the operations, and returns a BatchError if any failed.
+// Failed operations stay in the batch, so Commit can be retried.
+func (b *gcsBatch) Commit(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	errs := map[ds.Key]error{}
+	sem := make(chan struct{}, b.gd.workers())
+	for k, op := range b.ops {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(k ds.Key, op batchOp) {
+			defer func() { <-sem; wg.Done() }()
+			var err error
+			if op.delete {
+				err = b.gd.Delete(ctx, k)
+			} else {
+				err = b.gd.Put(ctx, k, op.value)
+			}
+			if err != nil {
+				errMu.Lock()
+				errs[k] = err
+				errMu.Unlock()
+			}
+		}(k, op)
+	}
+	wg.Wait()
+	for k := range b.ops {
+		if _, failed := errs[k]; !failed {
+			delete(b.ops, k)
+		}
+	}
+	if len(errs) > 0 {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"encoding/base32"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/provider/simple"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	mh "github.com/multiformats/go-multihash"
+)
+
+var _ blockstore.Blockstore = (*Blockstore)(nil)
+
+// Blockstore is a blockstore stored directly in a GCSDatastore, by default in
+// the same layout as kubo's blockstore. Keys are built from the multihashes
+// directly, without the key transforms of a datastore-backed blockstore. Has and GetSize are answered from the
+// metadata cache without GCS requests, and values are cached once, in the
+// datastore's data cache, so it shouldn't be wrapped in another caching
+// blockstore. The datastore's metadata must be loaded.
+type Blockstore struct {
+	gd *GCSDatastore
+	// prefix is the key prefix of the blocks, ending with a slash.
+	prefix string
+	rehash atomic.Bool
+}
+
+// BlockstoreOptions configure NewBlockstoreWithOptions.
+type BlockstoreOptions struct {
+	// Prefix is the key prefix of the blocks, "/blocks" by default as in
+	// kubo. "/" stores the blocks at the root, so that the object of a
+	// block is named <Config.Prefix>/<base32 multihash>.
+	Prefix string
+}
+
+// NewBlockstore returns a blockstore storing blocks in gd, in the layout
+// of kubo.
+func NewBlockstore(gd *GCSDatastore) *Blockstore {
+	return NewBlockstoreWithOptions(gd, BlockstoreOptions{})
+}
+
+// NewBlockstoreWithOptions returns a blockstore storing blocks in gd as
+// configured by opts.
+func NewBlockstoreWithOptions(gd *GCSDatastore, opts BlockstoreOptions) *Blockstore {
+	if opts.Prefix == "" {
+		opts.Prefix = blockstore.BlockPrefix.String()
+	}
+	return &Blockstore{gd: gd, prefix: strings.TrimSuffix(opts.Prefix, "/") + "/"}
+}
+
+// multihashEncoding encodes multihashes in keys, like kubo.
+var multihashEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// multihashKey returns the key of hash under prefix, which ends with a
+// slash.
+func multihashKey(prefix string, hash []byte) string {
+	b := make([]byte, len(prefix)+multihashEncoding.EncodedLen(len(hash)))
+	copy(b, prefix)
+	multihashEncoding.Encode(b[len(prefix):], hash)
+	return string(b)
+}
+
+// key returns the datastore key of the block with CID c.
+func (bs *Blockstore) key(c cid.Cid) string {
+	return multihashKey(bs.prefix, c.Hash())
+}
+
+func (bs *Blockstore) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return bs.gd.mdCache.Has(bs.key(c)), nil
+}
+
+func (bs *Blockstore) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	md, err := bs.gd.mdCache.Get(bs.key(c))
+	if err != nil {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+	return int(md.Size), nil
+}
+
+func (bs *Blockstore) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if !c.Defined() {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	data, err := bs.gd.Get(ctx, ds.RawKey(bs.key(c)))
+	if err == ds.ErrNotFound {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bs.rehash.Load() {
+		sum, err := c.Prefix().Sum(data)
+		if err != nil {
+			return nil, err
+		}
+		if !sum.Equals(c) {
+			return nil, blockstore.ErrHashMismatch
+		}
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+// Put stores block, unless a block with the same multihash is stored.
+func (bs *Blockstore) Put(ctx context.Context, block blocks.Block) error {
+	key := bs.key(block.Cid())
+	if bs.gd.mdCache.Has(key) {
+		return nil
+	}
+	return bs.gd.Put(ctx, ds.RawKey(key), block.RawData())
+}
+
+// PutMany stores the blocks that aren't stored yet in parallel.
+func (bs *Blockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	keys := make([]ds.Key, 0, len(blks))
+	values := make([][]byte, 0, len(blks))
+	for _, b := range blks {
+		key := bs.key(b.Cid())
+		if bs.gd.mdCache.Has(key) {
+			continue
+		}
+		keys = append(keys, ds.RawKey(key))
+		values = append(values, b.RawData())
+	}
+	return bs.gd.PutMany(ctx, keys, values)
+}
+
+func (bs *Blockstore) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	return bs.gd.Delete(ctx, ds.RawKey(bs.key(c)))
+}
+
+// AllKeysChan returns the CIDs of all blocks, in no particular order. Only
+// the multihash of a block is stored, so CIDs are returned as CIDv1 with
+// the raw codec.
+func (bs *Blockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	out, _ := bs.allCids(ctx)
+	return out, nil
+}
+
+// KeyChanFunc returns a function enumerating the CIDs of all blocks for a
+// boxo reprovider, like simple.NewBlockstoreProvider, from the metadata
+// cache rather than a Query. The reprovide cycle then makes no GCS
+// requests once the metadata is loaded. Enumerations ended by an error
+// other than their context's are logged.
+func (bs *Blockstore) KeyChanFunc() simple.KeyChanFunc {
+	return func(ctx context.Context) (<-chan cid.Cid, error) {
+		cids, errf := bs.allCids(ctx)
+		out := make(chan cid.Cid, dsq.KeysOnlyBufSize)
+		go func() {
+			defer close(out)
+			n := 0
+			for c := range cids {
+				select {
+				case out <- c:
+					n++
+				case <-ctx.Done():
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err := errf(); err != nil {
+				logger.Warnf("Enumerating blocks to reprovide failed after %d blocks: %v", n, err)
+			}
+		}()
+		return out, nil
+	}
+}
+
+// allCids streams the CIDs of all blocks like AllKeysChan. The returned
+// function returns the error that ended it early, if any, once the channel
+// is closed.
+func (bs *Blockstore) allCids(ctx context.Context) (<-chan cid.Cid, func() error) {
+	keys, errf := bs.gd.AllKeys(ctx, bs.prefix)
+	out := make(chan cid.Cid, dsq.KeysOnlyBufSize)
+	go func() {
+		defer close(out)
+		for key := range keys {
+			b, err := multihashEncoding.DecodeString(key.String()[len(bs.prefix):])
+			if err != nil {
+				continue
+			}
+			hash, err := mh.Cast(b)
+			if err != nil {
+				continue
+			}
+			select {
+			case out <- cid.NewCidV1(cid.Raw, hash):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, errf
+}
+
+// HashOnRead makes Get check that blocks match their CID.
+func (bs *Blockstore) HashOnRead(enabled bool) {
+	bs.rehash.Store(enabled)
+}
@@ -0,0 +1,80 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"github.com/ipfs/bbloom"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// DefaultBloomFilterFPRate is the false positive rate of the bloom filter
+// unless configured.
+const DefaultBloomFilterFPRate = 0.01
+
+// bloomIndex is a MetadataIndex behind a bloom filter of its keys, which
+// answers lookups of missing keys without consulting the index. This saves
+// disk reads with DiskMetadataCache.
+//
+// All keys added to the index are added to the filter. Deleted keys can't
+// be removed from it, so they stay false positives until the next start.
+type bloomIndex struct {
+	MetadataIndex
+	filter *bbloom.Bloom
+}
+
+// newBloomIndex wraps md in a bloom filter sized for keys keys with a
+// false positive rate of fpRate, or DefaultBloomFilterFPRate if it's 0.
+func newBloomIndex(md MetadataIndex, keys int, fpRate float64) (*bloomIndex, error) {
+	if fpRate <= 0 {
+		fpRate = DefaultBloomFilterFPRate
+	}
+	filter, err := bbloom.New(float64(keys), fpRate)
+	if err != nil {
+		return nil, err
+	}
+	return &bloomIndex{MetadataIndex: md, filter: filter}, nil
+}
+
+func (b *bloomIndex) Has(key string) bool {
+	return b.filter.HasTS([]byte(key)) && b.MetadataIndex.Has(key)
+}
+
+func (b *bloomIndex) Get(key string) (*Metadata, error) {
+	if !b.filter.HasTS([]byte(key)) {
+		return nil, ds.ErrNotFound
+	}
+	return b.MetadataIndex.Get(key)
+}
+
+func (b *bloomIndex) Put(key string, size int64) {
+	b.filter.AddTS([]byte(key))
+	b.MetadataIndex.Put(key, size)
+}
+
+func (b *bloomIndex) PutEntry(m Metadata) {
+	b.filter.AddTS([]byte(m.Key))
+	b.MetadataIndex.PutEntry(m)
+}
+
+func (b *bloomIndex) LoadEntry(m Metadata) {
+	b.filter.AddTS([]byte(m.Key))
+	b.MetadataIndex.LoadEntry(m)
+}
+
+// Close closes the wrapped index, if it needs closing.
+func (b *bloomIndex) Close() error {
+	closeIndex(b.MetadataIndex)
+	return nil
+}
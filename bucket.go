@@ -0,0 +1,83 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+)
+
+// createBucket creates Config.Bucket if missing, with uniform bucket-level
+// access, in Config.Location with Config.StorageClass.
+func (gd *GCSDatastore) createBucket(ctx context.Context) error {
+	bkt := gd.client.Bucket(gd.Config.Bucket)
+	if _, err := bkt.Attrs(ctx); err != storage.ErrBucketNotExist {
+		// Other errors are reported by CheckBucket.
+		return nil
+	}
+	project, err := gd.project(ctx)
+	if err != nil {
+		return err
+	}
+	attrs := &storage.BucketAttrs{
+		Location:     gd.Config.Location,
+		StorageClass: gd.Config.StorageClass,
+		UniformBucketLevelAccess: storage.UniformBucketLevelAccess{
+			Enabled: true,
+		},
+	}
+	err = bkt.Create(ctx, project, attrs)
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusConflict {
+		// Created concurrently, e.g. by another node.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("gcsds: creating bucket %s in project %s: %w", gd.Config.Bucket, project, err)
+	}
+	logger.Infof("Created bucket %s in project %s.", gd.Config.Bucket, project)
+	return nil
+}
+
+// project returns Config.Project, or else the project of the credentials.
+func (gd *GCSDatastore) project(ctx context.Context) (string, error) {
+	if gd.Config.Project != "" {
+		return gd.Config.Project, nil
+	}
+	var creds *google.Credentials
+	var err error
+	if gd.Config.CredentialsFile != "" {
+		var data []byte
+		if data, err = os.ReadFile(gd.Config.CredentialsFile); err == nil {
+			creds, err = google.CredentialsFromJSON(ctx, data, gcsScopes(gd.Config)...)
+		}
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, gcsScopes(gd.Config)...)
+	}
+	if err == nil && creds.ProjectID == "" {
+		err = errors.New("no project in the credentials")
+	}
+	if err != nil {
+		return "", fmt.Errorf("gcsds: finding the project to create bucket %s in, set Config.Project: %w", gd.Config.Bucket, err)
+	}
+	return creds.ProjectID, nil
+}
@@ -0,0 +1,534 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// CARContentType is the media type of exported CAR objects.
+const CARContentType = "application/vnd.ipld.car"
+
+// ErrNoRoots is returned when exporting a CAR without roots, which CARv1
+// readers reject.
+var ErrNoRoots = errors.New("gcsds: CAR export needs at least one root")
+
+// ExportCAR streams the blocks stored under the key prefix, e.g.
+// "/blocks", into a CARv1 object called dest in the bucket, with roots in
+// its header. The datastore only knows the multihash of each block, so
+// blocks are written with the raw codec, which IPFS implementations import
+// by multihash, and roots must be raw too: a dag-pb or dag-cbor root would
+// match no block, and the DAG couldn't be traversed. Use WriteCAR with
+// CIDs to export blocks with their codecs. Keys that aren't blocks are
+// skipped. It returns the number of blocks written. The metadata must be
+// loaded.
+func (gd *GCSDatastore) ExportCAR(ctx context.Context, prefix string, roots []cid.Cid, dest string) (int, error) {
+	if len(roots) == 0 {
+		return 0, ErrNoRoots
+	}
+	if strings.HasPrefix(dest, gd.Config.Prefix) {
+		return 0, fmt.Errorf("gcsds: CAR object %q must not be within prefix %q", dest, gd.Config.Prefix)
+	}
+	start := time.Now()
+	// Cancelling the writer's context aborts the upload, so a failed export
+	// leaves no truncated object behind.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := gd.newWriter(ctx, gd.BucketHandle().Object(dest))
+	w.ContentType = CARContentType
+	blocks, err := gd.writeCARv1(ctx, w, prefix, roots, nil)
+	if err != nil {
+		return blocks, err
+	}
+	if err := w.Close(); err != nil {
+		return blocks, err
+	}
+	logger.Infof("Exported %d blocks under %q to gs://%s/%s in %.2f s.",
+		blocks, prefix, gd.Config.Bucket, dest, time.Since(start).Seconds())
+	return blocks, nil
+}
+
+// CARExport configures WriteCAR.
+type CARExport struct {
+	// Prefix is the key prefix of the blocks, "/blocks" by default.
+	Prefix string
+	// Roots are the roots in the CAR header, CIDs by default.
+	Roots []cid.Cid
+	// CIDs selects the blocks to export, in order, with their codec. All
+	// the blocks under Prefix are exported, with the raw codec, if empty,
+	// and then Roots must be raw.
+	CIDs []cid.Cid
+	// Version is the CAR version, 1 by default, or 2. A CARv2 is written
+	// without index, which readers that need one build on load, and needs
+	// an io.WriteSeeker, such as an *os.File, to fill in its header.
+	Version int
+}
+
+// WriteCAR streams blocks from the bucket into a CAR written to w, e.g. a
+// local file for a backup, or the response to a request. Missing selected
+// blocks fail the export with an error wrapping ds.ErrNotFound. It returns
+// the number of blocks written. The metadata must be loaded to export all
+// the blocks under a prefix.
+func (gd *GCSDatastore) WriteCAR(ctx context.Context, w io.Writer, opts CARExport) (int, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = blockstore.BlockPrefix.String()
+	}
+	if len(opts.Roots) == 0 {
+		opts.Roots = opts.CIDs
+	}
+	if len(opts.Roots) == 0 {
+		return 0, ErrNoRoots
+	}
+	switch opts.Version {
+	case 0, 1:
+		return gd.writeCARv1(ctx, w, opts.Prefix, opts.Roots, opts.CIDs)
+	case 2:
+	default:
+		return 0, fmt.Errorf("gcsds: unsupported CAR version %d", opts.Version)
+	}
+	ws, ok := w.(io.WriteSeeker)
+	if !ok {
+		return 0, errors.New("gcsds: CARv2 export needs an io.WriteSeeker")
+	}
+	// The header holds the size of the CARv1 payload, which is only known
+	// once it is written, so it is written blank and filled in after.
+	start, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, len(carV2Pragma)+carV2HeaderSize)
+	copy(header, carV2Pragma)
+	if _, err := ws.Write(header); err != nil {
+		return 0, err
+	}
+	blocks, err := gd.writeCARv1(ctx, ws, opts.Prefix, opts.Roots, opts.CIDs)
+	if err != nil {
+		return blocks, err
+	}
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return blocks, err
+	}
+	// The characteristics are left blank, and an index offset of 0 means
+	// there is no index.
+	offset := int64(len(header))
+	binary.LittleEndian.PutUint64(header[len(carV2Pragma)+16:], uint64(offset))
+	binary.LittleEndian.PutUint64(header[len(carV2Pragma)+24:], uint64(end-start-offset))
+	if _, err := ws.Seek(start, io.SeekStart); err != nil {
+		return blocks, err
+	}
+	if _, err := ws.Write(header); err != nil {
+		return blocks, err
+	}
+	_, err = ws.Seek(end, io.SeekStart)
+	return blocks, err
+}
+
+// writeCARv1 writes a CARv1 of the blocks with the given CIDs under
+// prefix, or of all of them if cids is empty, to w.
+func (gd *GCSDatastore) writeCARv1(ctx context.Context, w io.Writer, prefix string, roots, cids []cid.Cid) (int, error) {
+	if len(cids) == 0 {
+		for _, root := range roots {
+			if root.Type() != cid.Raw {
+				return 0, fmt.Errorf("gcsds: root %s isn't raw, but blocks exported without CIDs are", root)
+			}
+		}
+	}
+	bw := bufio.NewWriterSize(w, 1<<20)
+	if err := writeCARHeader(bw, roots); err != nil {
+		return 0, err
+	}
+	next := gd.mdCache.Iterator(prefix, 0)
+	if len(cids) > 0 {
+		// Only keys are needed to fetch the values.
+		keyPrefix := queryPrefix(prefix)
+		i := 0
+		next = func() *Metadata {
+			if i == len(cids) {
+				return nil
+			}
+			i++
+			return &Metadata{Key: multihashKey(keyPrefix, cids[i-1].Hash())}
+		}
+	}
+	values, stop := gd.readAheadValues(ctx, next, gd.workers())
+	defer stop()
+	blocks := 0
+	for {
+		m, value, err := values()
+		if m == nil {
+			break
+		}
+		var c cid.Cid
+		if len(cids) > 0 {
+			c = cids[blocks]
+			if err == ds.ErrNotFound {
+				return blocks, fmt.Errorf("gcsds: block %s: %w", c, err)
+			}
+		} else if err == ds.ErrNotFound {
+			// Deleted since listed.
+			continue
+		}
+		if err != nil {
+			return blocks, err
+		}
+		if len(cids) == 0 {
+			hash, err := dshelp.DsKeyToMultihash(ds.NewKey(ds.NewKey(m.Key).BaseNamespace()))
+			if err != nil {
+				continue
+			}
+			c = cid.NewCidV1(cid.Raw, hash)
+		}
+		if err := writeCARBlock(bw, c, value); err != nil {
+			return blocks, err
+		}
+		blocks++
+	}
+	return blocks, bw.Flush()
+}
+
+// carV2Pragma starts CARv2 files. It is a CARv1 header with version 2.
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02}
+
+const (
+	// carV2HeaderSize is the size of the fixed CARv2 header that follows
+	// the pragma.
+	carV2HeaderSize = 40
+	// carRangeSize is the size of the ranges ImportCAR reads.
+	carRangeSize = 16 << 20
+	// carBatchPerWorker is the number of blocks per worker ImportCAR
+	// writes at a time.
+	carBatchPerWorker = 4
+	// maxCARSection bounds the memory a corrupt section length can claim.
+	maxCARSection = 32 << 20
+)
+
+// CARImport configures ImportCAR and ReadCAR.
+type CARImport struct {
+	// Prefix is the key prefix the blocks are stored under. It is the root
+	// by default, as when the datastore is mounted at /blocks in kubo. Use
+	// "/blocks" for a datastore mounted at /.
+	Prefix string
+}
+
+// ImportCAR stores the blocks of the CARv1 or CARv2 object src in the
+// bucket under opts.Prefix, skipping blocks that are already stored. The
+// object is read in large ranges, the next one while the current one is
+// parsed, and blocks are written in parallel through PutMany. A block that
+// doesn't match its CID fails the import. It returns the number of blocks
+// written. The metadata must be loaded for deduplication.
+func (gd *GCSDatastore) ImportCAR(ctx context.Context, src string, opts CARImport) (int, error) {
+	start := time.Now()
+	obj := gd.BucketHandle().Object(src)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// The CARv2 header locates the CARv1 payload. The index is skipped.
+	offset, size, err := carPayload(ctx, obj, attrs.Size)
+	if err != nil {
+		return 0, fmt.Errorf("gcsds: invalid CAR %s: %w", src, err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := bufio.NewReaderSize(newRangeReader(ctx, obj, offset, size), 1<<20)
+	imported, err := gd.importCARv1(ctx, r, opts.Prefix, src)
+	if err != nil {
+		return imported, err
+	}
+	logger.Infof("Imported %d blocks from gs://%s/%s in %.2f s.",
+		imported, gd.Config.Bucket, src, time.Since(start).Seconds())
+	return imported, nil
+}
+
+// ReadCAR stores the blocks of the CARv1 or CARv2 read from r, e.g. a
+// local file, like ImportCAR, for bulk ingestion without going through the
+// daemon. r is read once, in order, so it can be a pipe.
+func (gd *GCSDatastore) ReadCAR(ctx context.Context, r io.Reader, opts CARImport) (int, error) {
+	start := time.Now()
+	br := bufio.NewReaderSize(r, 1<<20)
+	pragma, err := br.Peek(len(carV2Pragma))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if bytes.Equal(pragma, carV2Pragma) {
+		header := make([]byte, len(carV2Pragma)+carV2HeaderSize)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return 0, fmt.Errorf("gcsds: invalid CARv2 header: %w", err)
+		}
+		offset := int64(binary.LittleEndian.Uint64(header[len(carV2Pragma)+16:]))
+		size := int64(binary.LittleEndian.Uint64(header[len(carV2Pragma)+24:]))
+		if offset < int64(len(header)) || size < 0 {
+			return 0, errors.New("gcsds: invalid CAR: CARv2 data range out of bounds")
+		}
+		if _, err := br.Discard(int(offset) - len(header)); err != nil {
+			return 0, fmt.Errorf("gcsds: invalid CAR: %w", err)
+		}
+		br = bufio.NewReaderSize(io.LimitReader(br, size), 1<<20)
+	}
+	imported, err := gd.importCARv1(ctx, br, opts.Prefix, "input")
+	if err != nil {
+		return imported, err
+	}
+	logger.Infof("Imported %d blocks in %.2f s.", imported, time.Since(start).Seconds())
+	return imported, nil
+}
+
+// importCARv1 stores the blocks of the CARv1 read from r under prefix. r
+// is called src in errors.
+func (gd *GCSDatastore) importCARv1(ctx context.Context, r *bufio.Reader, prefix, src string) (int, error) {
+	header, err := readCARSection(r)
+	if err != nil {
+		return 0, fmt.Errorf("gcsds: invalid CAR header in %s: %w", src, err)
+	}
+	if !bytes.HasSuffix(header, []byte("version\x01")) {
+		return 0, fmt.Errorf("gcsds: unsupported CAR version in %s", src)
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	imported := 0
+	batch := carBatchPerWorker * gd.workers()
+	keys := make([]ds.Key, 0, batch)
+	values := make([][]byte, 0, batch)
+	flush := func() error {
+		if err := gd.PutMany(ctx, keys, values); err != nil {
+			return err
+		}
+		imported += len(keys)
+		keys, values = keys[:0], values[:0]
+		return nil
+	}
+	for i := 1; ; i++ {
+		section, err := readCARSection(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return imported, fmt.Errorf("gcsds: invalid CAR section in %s: %w", src, err)
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return imported, fmt.Errorf("gcsds: invalid CID in %s: %w", src, err)
+		}
+		// The CAR is untrusted, and a corrupt block would never be
+		// replaced, since stored blocks are skipped.
+		sum, err := c.Prefix().Sum(section[n:])
+		if err != nil {
+			return imported, fmt.Errorf("gcsds: block %s in section %d of %s: %w", c, i, src, err)
+		}
+		if !sum.Equals(c) {
+			return imported, fmt.Errorf("gcsds: block %s in section %d of %s doesn't match its CID", c, i, src)
+		}
+		key := multihashKey(prefix, c.Hash())
+		if gd.mdCache.Has(key) {
+			continue
+		}
+		keys = append(keys, ds.RawKey(key))
+		values = append(values, section[n:])
+		if len(keys) == batch {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	return imported, flush()
+}
+
+// carPayload returns the range of the CARv1 data in obj, which is all of
+// it unless obj is a CARv2.
+func carPayload(ctx context.Context, obj *storage.ObjectHandle, objSize int64) (int64, int64, error) {
+	headerSize := int64(len(carV2Pragma) + carV2HeaderSize)
+	if objSize < headerSize {
+		return 0, objSize, nil
+	}
+	r, err := obj.NewRangeReader(ctx, 0, headerSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.Equal(header[:len(carV2Pragma)], carV2Pragma) {
+		return 0, objSize, nil
+	}
+	offset := int64(binary.LittleEndian.Uint64(header[len(carV2Pragma)+16:]))
+	size := int64(binary.LittleEndian.Uint64(header[len(carV2Pragma)+24:]))
+	if offset < headerSize || size < 0 || offset+size > objSize {
+		return 0, 0, errors.New("CARv2 data range out of bounds")
+	}
+	return offset, size, nil
+}
+
+// readCARSection reads a length-prefixed CAR section. It returns io.EOF at
+// the end of the input.
+func readCARSection(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxCARSection {
+		return nil, fmt.Errorf("section of %d bytes exceeds limit", size)
+	}
+	section := make([]byte, size)
+	if _, err := io.ReadFull(r, section); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return section, nil
+}
+
+// rangeChunk is a range of an object being read.
+type rangeChunk struct {
+	data []byte
+	err  error
+}
+
+// rangeReader reads a range of an object in carRangeSize chunks, fetching
+// the next chunk while the current one is consumed.
+type rangeReader struct {
+	ctx    context.Context
+	obj    *storage.ObjectHandle
+	offset int64
+	end    int64
+	cur    []byte
+	next   chan rangeChunk
+}
+
+func newRangeReader(ctx context.Context, obj *storage.ObjectHandle, offset, length int64) *rangeReader {
+	rr := &rangeReader{ctx: ctx, obj: obj, offset: offset, end: offset + length}
+	rr.fetch()
+	return rr
+}
+
+// fetch starts reading the chunk at rr.offset.
+func (rr *rangeReader) fetch() {
+	if rr.offset >= rr.end {
+		rr.next = nil
+		return
+	}
+	size := rr.end - rr.offset
+	if size > carRangeSize {
+		size = carRangeSize
+	}
+	next := make(chan rangeChunk, 1)
+	go func(offset int64) {
+		r, err := rr.obj.NewRangeReader(rr.ctx, offset, size)
+		if err != nil {
+			next <- rangeChunk{err: err}
+			return
+		}
+		defer r.Close()
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		next <- rangeChunk{data: data, err: err}
+	}(rr.offset)
+	rr.offset += size
+	rr.next = next
+}
+
+func (rr *rangeReader) Read(p []byte) (int, error) {
+	for len(rr.cur) == 0 {
+		if rr.next == nil {
+			return 0, io.EOF
+		}
+		chunk := <-rr.next
+		if chunk.err != nil {
+			return 0, chunk.err
+		}
+		rr.cur = chunk.data
+		rr.fetch()
+	}
+	n := copy(p, rr.cur)
+	rr.cur = rr.cur[n:]
+	return n, nil
+}
+
+// writeCARHeader writes the CARv1 header: the length-prefixed DAG-CBOR map
+// {"roots": [...], "version": 1}.
+func writeCARHeader(w io.Writer, roots []cid.Cid) error {
+	header := []byte{0xa2}
+	header = appendCBORHead(header, 3, uint64(len("roots")))
+	header = append(header, "roots"...)
+	header = appendCBORHead(header, 4, uint64(len(roots)))
+	for _, c := range roots {
+		// Tag 42 with the CID bytes behind the multibase identity prefix.
+		header = append(header, 0xd8, 42)
+		header = appendCBORHead(header, 2, uint64(c.ByteLen()+1))
+		header = append(header, 0)
+		header = append(header, c.Bytes()...)
+	}
+	header = appendCBORHead(header, 3, uint64(len("version")))
+	header = append(header, "version"...)
+	header = appendCBORHead(header, 0, 1)
+	return writeCARSection(w, header)
+}
+
+// writeCARBlock writes a CARv1 block section: the length-prefixed CID and
+// block data.
+func writeCARBlock(w io.Writer, c cid.Cid, data []byte) error {
+	return writeCARSection(w, c.Bytes(), data)
+}
+
+func writeCARSection(w io.Writer, parts ...[]byte) error {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	if _, err := w.Write(buf[:binary.PutUvarint(buf, uint64(size))]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendCBORHead appends the head of a CBOR data item of the major type
+// with argument n in its shortest form, as DAG-CBOR requires.
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= 0xff:
+		return append(b, major|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major|27), n)
+}
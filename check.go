@@ -0,0 +1,98 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/iterator"
+)
+
+var _ ds.CheckedDatastore = (*GCSDatastore)(nil)
+
+// Keys of the metadata cache Check looks up in the bucket.
+const checkSampleSize = 100
+
+// ErrInconsistent is returned by Check when keys in the metadata cache are
+// missing from the bucket.
+var ErrInconsistent = errors.New("gcsds: metadata cache is inconsistent with the bucket")
+
+// Check verifies that the bucket is reachable, that the credentials have
+// the required permissions, that objects under the prefix can be listed,
+// and that a random sample of the keys in the metadata cache exist in the
+// bucket. All failures are returned, joined.
+func (gd *GCSDatastore) Check(ctx context.Context) error {
+	if _, err := gd.client.Bucket(gd.Config.Bucket).Attrs(ctx); err != nil {
+		return fmt.Errorf("gcsds: bucket %s is unreachable: %w", gd.Config.Bucket, err)
+	}
+	var errs []error
+	if err := gd.checkPermissions(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, &storage.Query{Prefix: gd.listPrefix()})
+	if _, err := it.Next(); err != nil && err != iterator.Done {
+		errs = append(errs, fmt.Errorf("gcsds: failed to list %s: %w", gd.listPrefix(), err))
+	}
+	if err := gd.checkSample(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// checkSample looks up a random sample of the cached keys in the bucket.
+// Keys not uploaded yet, and expired ones, are skipped.
+func (gd *GCSDatastore) checkSample(ctx context.Context) error {
+	if gd.metadataPending() {
+		return nil
+	}
+	// Reservoir sampling, since the cache can't be indexed.
+	sample := make([]ds.Key, 0, checkSampleSize)
+	seen := 0
+	next := gd.mdCache.Iterator("", 0)
+	for m := next(); m != nil; m = next() {
+		if _, ok := gd.pendingValue(m.Key); ok || expired(m.Expiration) {
+			continue
+		}
+		seen++
+		if len(sample) < checkSampleSize {
+			sample = append(sample, ds.RawKey(m.Key))
+		} else if i := rand.Intn(seen); i < checkSampleSize {
+			sample[i] = ds.RawKey(m.Key)
+		}
+	}
+	if len(sample) == 0 {
+		return nil
+	}
+	has, err := gd.HasMany(ctx, sample)
+	if err != nil {
+		return err
+	}
+	missing := []ds.Key{}
+	for i, ok := range has {
+		if !ok {
+			missing = append(missing, sample[i])
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %d of %d sampled keys are missing, e.g. %v",
+			ErrInconsistent, len(missing), len(sample), missing[0])
+	}
+	return nil
+}
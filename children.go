@@ -0,0 +1,113 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Children returns the keys directly under prefix, and the namespaces
+// under it that hold more keys, in key order. For example, the children of
+// / in kubo are namespaces such as /blocks and /pins. Unless names are
+// sharded, the bucket is listed with a delimiter, so that the keys under
+// the namespaces aren't listed.
+func (gd *GCSDatastore) Children(ctx context.Context, prefix ds.Key) (keys, namespaces []ds.Key, err error) {
+	base := prefix.String()
+	if base != "/" {
+		base += "/"
+	}
+	children, subspaces := map[string]bool{}, map[string]bool{}
+	add := func(key string) {
+		rel := strings.TrimPrefix(key, base)
+		if rel == key || rel == "" {
+			return
+		}
+		if i := strings.IndexByte(rel, '/'); i >= 0 {
+			subspaces[base+rel[:i]] = true
+		} else {
+			children[key] = true
+		}
+	}
+	if gd.shard != nil {
+		// Shard directories aren't namespaces.
+		next, listErr := gd.listMetadata(ctx, base)
+		for m := next(); m != nil; m = next() {
+			if !expired(m.Expiration) {
+				add(m.Key)
+			}
+		}
+		err = listErr()
+	} else {
+		err = gd.listChildren(ctx, gd.listPrefix()+strings.TrimPrefix(escapeKey(base), "/"), add)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	next := gd.localMetadata(base)
+	for m := next(); m != nil; m = next() {
+		add(m.Key)
+	}
+	return sortedKeys(children), sortedKeys(subspaces), nil
+}
+
+// listChildren lists the objects and directories directly under the
+// directory p with a delimiter. It passes add the keys of the objects, and
+// the key of each directory followed by a slash.
+func (gd *GCSDatastore) listChildren(ctx context.Context, p string, add func(key string)) error {
+	query := &storage.Query{Prefix: p, Delimiter: "/"}
+	if err := query.SetAttrSelection([]string{"Name", "CustomTime", "Metadata"}); err != nil {
+		return err
+	}
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return requestError("list", p, err)
+		}
+		switch {
+		case attrs.Prefix == "":
+			if !expired(objectExpiration(attrs)) {
+				add(gd.keyOf(attrs.Name))
+			}
+		case strings.HasSuffix(attrs.Prefix, "%/"):
+			// A long segment split by escapeKey continues in the
+			// directory.
+			if err := gd.listChildren(ctx, attrs.Prefix, add); err != nil {
+				return err
+			}
+		default:
+			add(gd.keyOf(attrs.Prefix))
+		}
+	}
+}
+
+// sortedKeys returns the keys of set in order.
+func sortedKeys(set map[string]bool) []ds.Key {
+	keys := make([]ds.Key, 0, len(set))
+	for key := range set {
+		keys = append(keys, ds.RawKey(key))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	return keys
+}
@@ -0,0 +1,619 @@
+package main
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/storage"
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: gcsds-admin -bucket BUCKET [-prefix PREFIX] COMMAND [ARGS]
+
+Commands:
+  export-car [-cids CIDS] [-file] [-car-version 2] KEYPREFIX ROOTS DEST
+        Write the blocks under KEYPREFIX, / for a datastore mounted at
+        /blocks, to a CAR object called DEST in the bucket, or with -file
+        to the local file DEST, - for standard output. ROOTS is a comma separated list of root CIDs,
+        and -cids of the CIDs of the blocks to export, or @FILE to read
+        them from FILE, one per line. Without -cids blocks are exported
+        with the raw codec, and ROOTS must be raw. -car-version 2 writes a
+        CARv2 file.
+  import-car [-file] [-keyprefix KEYPREFIX] SRC...
+        Store the blocks of CARv1 or CARv2 objects in the bucket, or with
+        -file of local files, - for standard input, under KEYPREFIX, / by
+        default for a datastore mounted at /blocks.
+  import-flatfs [-verify] [-keyprefix KEYPREFIX] DIR
+        Store the blocks of the flatfs datastore in DIR, e.g. the blocks
+        directory of a kubo repo, under KEYPREFIX, / by default for a
+        datastore mounted at /blocks, skipping blocks already stored.
+        -verify then checks that every block is stored with its size.
+  import-repo [-verify] REPO
+        Store the values of every datastore of the kubo repo in REPO, as
+        mounted by its datastore_spec: flatfs, levelds and badgerds. Stop
+        the node first. -verify then checks that every value is stored
+        with its size.
+  ls [KEYPREFIX]
+        List the keys and namespaces directly under KEYPREFIX, / by
+        default. Namespaces end with a slash.
+  get KEY
+        Write the value of KEY to standard output.
+  put KEY [FILE]
+        Store the content of FILE, or standard input, under KEY.
+  rm KEY...
+        Delete the values of the keys.
+  stat KEY
+        Print the object of KEY and its attributes.
+  du [KEYPREFIX]
+        Print the number of keys under KEYPREFIX, / by default, and the
+        total size of their values.
+  repo-stat [KEYPREFIX]
+        List the values under KEYPREFIX, / by default, and print their
+        number and size by kind, size, storage class and namespace.
+  verify
+        Check every object against its CRC32C and, for blocks, the
+        multihash in its key, and list the corrupt ones.
+  copy-repo [-dest-prefix PREFIX] [-kms-key KEY] [-progress FILE] BUCKET
+        Copy the repo to BUCKET, under PREFIX or -prefix, with server-side
+        rewrites. -progress saves the progress to FILE, and resumes from
+        it. Stop the node first, or writes during the copy may be missed.
+  fsck [-quarantine PREFIX] [-delete] [KEYPREFIX]
+        Check the blocks under KEYPREFIX, /blocks by default, against the
+        multihash in their key, and list the corrupt ones. -quarantine
+        moves them under the object name PREFIX, outside -prefix, and
+        -delete deletes them.
+  mark-unpinned [-except FILE] [FILE]
+        Mark the values of the keys or block CIDs listed in FILE, or
+        standard input, one per line, unpinned, except those listed in
+        -except. The lifecycle rule of gclifecycledays deletes them.
+  mark-pinned [-except FILE] [FILE]
+        Undo mark-unpinned.
+  hold [-release] [-except FILE] [FILE]
+        Place event-based holds on the values of the keys or block CIDs
+        listed like for mark-unpinned, so that they can't be deleted or
+        overwritten, or release them with -release.
+  undelete [-since WHEN] [-n] [KEYPREFIX]
+        Restore the values deleted under KEYPREFIX, / by default, since
+        WHEN, a duration ago like 24h or an RFC 3339 time, from noncurrent
+        versions or soft-deleted objects. Keys with a value are skipped.
+        -n only lists them.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	bucket := flag.String("bucket", "", "GCS bucket name.")
+	prefix := flag.String("prefix", "ipfs/", "IPFS prefix in GCS bucket.")
+	workers := flag.Int("workers", 100, "Number of parallel GCS requests.")
+	flag.Usage = usage
+	flag.Parse()
+	if *bucket == "" || flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	// Interrupting aborts the requests in flight.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	gd, err := gcsds.NewGCSDatastoreContext(ctx, gcsds.Config{
+		Bucket:         *bucket,
+		Prefix:         *prefix,
+		Workers:        *workers,
+		DataCacheItems: 1000,
+	})
+	if err != nil {
+		log.Fatalf("Failed to open datastore: %v", err)
+	}
+	defer gd.Close()
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "export-car":
+		err = exportCAR(ctx, gd, args)
+	case "import-car":
+		err = importCAR(ctx, gd, args)
+	case "import-flatfs":
+		err = importFlatfs(ctx, gd, args)
+	case "import-repo":
+		err = importRepo(ctx, gd, args)
+	case "ls":
+		err = list(ctx, gd, args)
+	case "get":
+		err = get(ctx, gd, args)
+	case "put":
+		err = put(ctx, gd, args)
+	case "rm":
+		err = remove(ctx, gd, args)
+	case "stat":
+		err = stat(ctx, gd, args)
+	case "du":
+		err = diskUsage(ctx, gd, args)
+	case "repo-stat":
+		err = repoStat(ctx, gd, args)
+	case "verify":
+		err = verify(ctx, gd, args)
+	case "copy-repo":
+		err = copyRepo(ctx, gd, args)
+	case "fsck":
+		err = fsck(ctx, gd, args)
+	case "mark-unpinned":
+		err = mark(ctx, gd, args, false)
+	case "mark-pinned":
+		err = mark(ctx, gd, args, true)
+	case "hold":
+		err = hold(ctx, gd, args)
+	case "undelete":
+		err = undelete(ctx, gd, args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", cmd, err)
+	}
+}
+
+func exportCAR(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	flags := flag.NewFlagSet("export-car", flag.ContinueOnError)
+	cidList := flags.String("cids", "", "Comma separated CIDs of the blocks to export, or @FILE.")
+	file := flags.Bool("file", false, "Write DEST as a local file.")
+	version := flags.Int("car-version", 1, "The CAR version, 1 or 2.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 3 {
+		return fmt.Errorf("expected [-cids CIDS] [-file] [-car-version 2] KEYPREFIX ROOTS DEST")
+	}
+	prefix, dest := flags.Arg(0), flags.Arg(2)
+	roots, err := parseCIDs(strings.Split(flags.Arg(1), ","))
+	if err != nil {
+		return err
+	}
+	var cids []cid.Cid
+	if *cidList != "" {
+		list := strings.Split(*cidList, ",")
+		if strings.HasPrefix(*cidList, "@") {
+			data, err := os.ReadFile((*cidList)[1:])
+			if err != nil {
+				return err
+			}
+			list = strings.Fields(string(data))
+		}
+		if cids, err = parseCIDs(list); err != nil {
+			return err
+		}
+	}
+	if !*file {
+		if cids != nil || *version != 1 {
+			return fmt.Errorf("-cids and -car-version need -file")
+		}
+		if err := gd.LoadMetadataContext(ctx); err != nil {
+			return err
+		}
+		_, err := gd.ExportCAR(ctx, prefix, roots, dest)
+		return err
+	}
+	if cids == nil {
+		if err := gd.LoadMetadataContext(ctx); err != nil {
+			return err
+		}
+	}
+	out := os.Stdout
+	if dest != "-" {
+		if out, err = os.Create(dest); err != nil {
+			return err
+		}
+	}
+	opts := gcsds.CARExport{Prefix: prefix, Roots: roots, CIDs: cids, Version: *version}
+	n, err := gd.WriteCAR(ctx, out, opts)
+	if err == nil && out != os.Stdout {
+		err = out.Close()
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d blocks to %s.", n, dest)
+	return nil
+}
+
+func parseCIDs(list []string) ([]cid.Cid, error) {
+	cids := make([]cid.Cid, 0, len(list))
+	for _, s := range list {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CID %q: %w", s, err)
+		}
+		cids = append(cids, c)
+	}
+	return cids, nil
+}
+
+func importCAR(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	flags := flag.NewFlagSet("import-car", flag.ContinueOnError)
+	file := flags.Bool("file", false, "Read local files.")
+	keyPrefix := flags.String("keyprefix", "/", "The key prefix of the blocks.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("expected [-file] [-keyprefix KEYPREFIX] SRC...")
+	}
+	opts := gcsds.CARImport{Prefix: *keyPrefix}
+	if err := gd.LoadMetadataContext(ctx); err != nil {
+		return err
+	}
+	for _, src := range flags.Args() {
+		if !*file {
+			if _, err := gd.ImportCAR(ctx, src, opts); err != nil {
+				return fmt.Errorf("%s: %w", src, err)
+			}
+			continue
+		}
+		if err := importCARFile(ctx, gd, src, opts); err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+	}
+	return nil
+}
+
+func importCARFile(ctx context.Context, gd *gcsds.GCSDatastore, name string, opts gcsds.CARImport) error {
+	in := os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	n, err := gd.ReadCAR(ctx, in, opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d blocks from %s.", n, name)
+	return nil
+}
+
+func importFlatfs(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	flags := flag.NewFlagSet("import-flatfs", flag.ContinueOnError)
+	verify := flags.Bool("verify", false, "Check that every block is stored once imported.")
+	keyPrefix := flags.String("keyprefix", "/", "The key prefix of the blocks.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected [-verify] [-keyprefix KEYPREFIX] DIR")
+	}
+	src, err := flatfs.Open(flags.Arg(0), false)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if err := gd.LoadMetadataContext(ctx); err != nil {
+		return err
+	}
+	res, err := gd.ImportDatastore(ctx, src, gcsds.ImportOptions{Prefix: *keyPrefix, Verify: *verify})
+	log.Printf("Imported %d blocks, skipped %d already stored, verified %d.", res.Imported, res.Skipped, res.Verified)
+	return err
+}
+
+func list(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected [KEYPREFIX]")
+	}
+	prefix := "/"
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	keys, namespaces, err := gd.Children(ctx, ds.NewKey(prefix))
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		fmt.Printf("%s/\n", ns)
+	}
+	for _, key := range keys {
+		fmt.Println(key)
+	}
+	return nil
+}
+
+func get(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected KEY")
+	}
+	r, err := gd.GetReader(ctx, ds.NewKey(args[0]))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(os.Stdout, r)
+	return err
+}
+
+func put(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("expected KEY [FILE]")
+	}
+	var value []byte
+	var err error
+	if len(args) == 2 {
+		value, err = os.ReadFile(args[1])
+	} else {
+		value, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	return gd.Put(ctx, ds.NewKey(args[0]), value)
+}
+
+func remove(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected KEY...")
+	}
+	for _, key := range args {
+		if err := gd.Delete(ctx, ds.NewKey(key)); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func stat(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected KEY")
+	}
+	k := ds.NewKey(args[0])
+	size, err := gd.GetSize(ctx, k)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Key:          %s\n", k)
+	fmt.Printf("Size:         %d\n", size)
+	if expiration, err := gd.GetExpiration(ctx, k); err == nil && !expiration.IsZero() {
+		fmt.Printf("Expiration:   %s\n", expiration.Format(time.RFC3339))
+	}
+	attrs, err := gd.BucketHandle().Object(gd.ObjectPath(k)).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		// Packed values have no object of their own.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Object:       gs://%s/%s\n", attrs.Bucket, attrs.Name)
+	fmt.Printf("Object size:  %d\n", attrs.Size)
+	if attrs.ContentEncoding != "" {
+		fmt.Printf("Encoding:     %s\n", attrs.ContentEncoding)
+	}
+	fmt.Printf("Storage:      %s\n", attrs.StorageClass)
+	fmt.Printf("Generation:   %d\n", attrs.Generation)
+	fmt.Printf("CRC32C:       %08x\n", attrs.CRC32C)
+	fmt.Printf("Updated:      %s\n", attrs.Updated.Format(time.RFC3339))
+	return nil
+}
+
+func diskUsage(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected [KEYPREFIX]")
+	}
+	prefix := "/"
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	if err := gd.LoadMetadataContext(ctx); err != nil {
+		return err
+	}
+	res, err := gd.Query(ctx, dsq.Query{Prefix: prefix, KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	var keys, bytes int64
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		keys++
+		bytes += int64(r.Size)
+	}
+	fmt.Printf("%d keys, %d bytes\n", keys, bytes)
+	return nil
+}
+
+func repoStat(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected [KEYPREFIX]")
+	}
+	prefix := "/"
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	stats, err := gd.RepoStats(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Keys:    %d (%d bytes)\n", stats.Keys, stats.Bytes)
+	fmt.Printf("Blocks:  %d (%d bytes)\n", stats.Blocks, stats.BlockBytes)
+	fmt.Println("Sizes:")
+	for _, b := range stats.Sizes {
+		if b.UpperBound == math.MaxInt64 {
+			fmt.Printf("  larger   %d\n", b.Count)
+		} else {
+			fmt.Printf("  <= %-5s %d\n", humanSize(b.UpperBound), b.Count)
+		}
+	}
+	printUsage := func(title string, usage map[string]gcsds.Usage, empty string) {
+		fmt.Println(title)
+		names := make([]string, 0, len(usage))
+		for name := range usage {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			label := name
+			if label == "" {
+				label = empty
+			}
+			fmt.Printf("  %s\t%d\t%d bytes\n", label, usage[name].Objects, usage[name].Bytes)
+		}
+	}
+	printUsage("Storage classes:", stats.StorageClasses, "(default)")
+	printUsage("Namespaces:", stats.Namespaces, "")
+	return nil
+}
+
+// humanSize formats a power of two size, e.g. 4kB.
+func humanSize(n int64) string {
+	if n >= 1<<20 {
+		return fmt.Sprintf("%dMB", n>>20)
+	}
+	return fmt.Sprintf("%dkB", n>>10)
+}
+
+func verify(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("expected no arguments")
+	}
+	err := gd.Scrub(ctx)
+	var corrupt *gcsds.CorruptError
+	if errors.As(err, &corrupt) {
+		for _, key := range corrupt.Keys {
+			fmt.Println(key)
+		}
+	}
+	return err
+}
+
+func copyRepo(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	var opts gcsds.CopyOptions
+	flags := flag.NewFlagSet("copy-repo", flag.ContinueOnError)
+	flags.StringVar(&opts.Prefix, "dest-prefix", "", "IPFS prefix in the destination bucket, -prefix by default.")
+	flags.StringVar(&opts.KMSKeyName, "kms-key", "", "Cloud KMS key encrypting the copies.")
+	progress := flags.String("progress", "", "File to save the progress to, and resume from.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected [-dest-prefix PREFIX] [-kms-key KEY] [-progress FILE] BUCKET")
+	}
+	opts.Bucket = flags.Arg(0)
+	if *progress != "" {
+		token, err := os.ReadFile(*progress)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if opts.Token = strings.TrimSpace(string(token)); opts.Token != "" {
+			log.Printf("Resuming from %s.", *progress)
+		}
+	}
+	var saveErr error
+	opts.Progress = func(copied int, token string) {
+		log.Printf("Copied %d objects.", copied)
+		if *progress != "" && saveErr == nil {
+			saveErr = os.WriteFile(*progress, []byte(token), 0o644)
+		}
+	}
+	if _, err := gd.CopyRepo(ctx, opts); err != nil {
+		return err
+	}
+	return saveErr
+}
+
+func fsck(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	var opts gcsds.FsckOptions
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.StringVar(&opts.Quarantine, "quarantine", "", "Object name prefix to move corrupt blocks to.")
+	flags.BoolVar(&opts.Delete, "delete", false, "Delete corrupt blocks.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("expected [-quarantine PREFIX] [-delete] [KEYPREFIX]")
+	}
+	opts.Prefix = flags.Arg(0)
+	if err := gd.LoadMetadataContext(ctx); err != nil {
+		return err
+	}
+	res, err := gd.Fsck(ctx, opts)
+	for _, key := range res.Corrupt {
+		fmt.Println(key)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Checked %d blocks: %d corrupt.\n", res.Checked, len(res.Corrupt))
+	if len(res.Corrupt) > 0 && opts.Quarantine == "" && !opts.Delete {
+		return fmt.Errorf("%d corrupt blocks", len(res.Corrupt))
+	}
+	return nil
+}
+
+func undelete(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	flags := flag.NewFlagSet("undelete", flag.ContinueOnError)
+	sinceFlag := flags.String("since", "", "Only restore values deleted since, a duration ago or an RFC 3339 time.")
+	dryRun := flags.Bool("n", false, "List the values without restoring them.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("expected [-since WHEN] [-n] [KEYPREFIX]")
+	}
+	var since time.Time
+	if *sinceFlag != "" {
+		if d, err := time.ParseDuration(*sinceFlag); err == nil {
+			since = time.Now().Add(-d)
+		} else if since, err = time.Parse(time.RFC3339, *sinceFlag); err != nil {
+			return fmt.Errorf("invalid -since %q: %w", *sinceFlag, err)
+		}
+	}
+	prefix := flags.Arg(0)
+	if prefix == "" {
+		prefix = "/"
+	}
+	deleted, err := gd.ListDeleted(ctx, prefix, since)
+	if err != nil {
+		return err
+	}
+	for _, v := range deleted {
+		fmt.Printf("%s\t%d\t%s\n", v.Key, v.Size, v.Deleted.Format(time.RFC3339))
+	}
+	if *dryRun {
+		return nil
+	}
+	n, err := gd.Undelete(ctx, deleted)
+	fmt.Fprintf(os.Stderr, "Restored %d of %d deleted values.\n", n, len(deleted))
+	return err
+}
@@ -0,0 +1,156 @@
+package main
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// markBatchSize is the number of keys marked at a time.
+const markBatchSize = 1000
+
+// mark marks the values of the keys listed in a file or standard input
+// pinned or unpinned.
+func mark(ctx context.Context, gd *gcsds.GCSDatastore, args []string, pinned bool) error {
+	name := "mark-unpinned"
+	markKeys := gd.MarkUnpinned
+	if pinned {
+		name = "mark-pinned"
+		markKeys = gd.MarkPinned
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	marked, err := forListedKeys(ctx, flags, args, markKeys)
+	if err != nil {
+		return err
+	}
+	log.Printf("Marked %d values %s.", marked, strings.TrimPrefix(name, "mark-"))
+	return nil
+}
+
+// hold places or releases event-based holds on the values of the keys
+// listed in a file or standard input.
+func hold(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	flags := flag.NewFlagSet("hold", flag.ContinueOnError)
+	release := flags.Bool("release", false, "Release the holds instead.")
+	held, err := forListedKeys(ctx, flags, args, func(ctx context.Context, keys []ds.Key) error {
+		return gd.SetEventBasedHold(ctx, keys, !*release)
+	})
+	if err != nil {
+		return err
+	}
+	if *release {
+		log.Printf("Released the holds of %d values.", held)
+	} else {
+		log.Printf("Held %d values.", held)
+	}
+	return nil
+}
+
+// forListedKeys parses args with flags and an -except flag, and calls f
+// with batches of the keys listed in the file they name or standard input,
+// but not in the file of -except. It returns the number of keys.
+func forListedKeys(ctx context.Context, flags *flag.FlagSet, args []string, f func(context.Context, []ds.Key) error) (int, error) {
+	except := flags.String("except", "", "A file listing CIDs or keys to leave alone.")
+	if err := flags.Parse(args); err != nil {
+		return 0, err
+	}
+	if flags.NArg() > 1 {
+		return 0, fmt.Errorf("expected [-except FILE] [FILE]")
+	}
+	skip := map[ds.Key]bool{}
+	if *except != "" {
+		file, err := os.Open(*except)
+		if err != nil {
+			return 0, err
+		}
+		err = readKeys(file, func(k ds.Key) error {
+			skip[k] = true
+			return nil
+		})
+		file.Close()
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", *except, err)
+		}
+	}
+	in := os.Stdin
+	if flags.NArg() == 1 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		in = file
+	}
+	n := 0
+	keys := make([]ds.Key, 0, markBatchSize)
+	flush := func() error {
+		if err := f(ctx, keys); err != nil {
+			return err
+		}
+		n += len(keys)
+		keys = keys[:0]
+		return nil
+	}
+	err := readKeys(in, func(k ds.Key) error {
+		if skip[k] {
+			return nil
+		}
+		keys = append(keys, k)
+		if len(keys) < markBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	return n, err
+}
+
+// readKeys calls f with the keys listed in r, one per line, as keys or as
+// CIDs of blocks in the layout of kubo.
+func readKeys(r io.Reader, f func(ds.Key) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		k := ds.NewKey(line)
+		if !strings.HasPrefix(line, "/") {
+			c, err := cid.Decode(line)
+			if err != nil {
+				return fmt.Errorf("invalid CID %q: %w", line, err)
+			}
+			k = ds.NewKey("/blocks").Child(dshelp.MultihashToDsKey(c.Hash()))
+		}
+		if err := f(k); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
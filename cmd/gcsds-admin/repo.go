@@ -0,0 +1,108 @@
+package main
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	ds "github.com/ipfs/go-datastore"
+	badgerds "github.com/ipfs/go-ds-badger"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+)
+
+// datastoreSpec is the datastore_spec file of a kubo repo, or one of its
+// mounts.
+type datastoreSpec struct {
+	Type       string          `json:"type"`
+	Path       string          `json:"path"`
+	Mountpoint string          `json:"mountpoint"`
+	Mounts     []datastoreSpec `json:"mounts"`
+}
+
+// mounts returns the datastores of spec.
+func (spec datastoreSpec) mounts() []datastoreSpec {
+	if spec.Type != "mount" {
+		spec.Mountpoint = "/"
+		return []datastoreSpec{spec}
+	}
+	return spec.Mounts
+}
+
+// openDatastore opens the datastore of a mount of the repo in dir for
+// reading.
+func openDatastore(dir string, spec datastoreSpec) (ds.Datastore, io.Closer, error) {
+	path := filepath.Join(dir, spec.Path)
+	switch spec.Type {
+	case "flatfs":
+		d, err := flatfs.Open(path, false)
+		return d, d, err
+	case "levelds":
+		d, err := leveldb.NewDatastore(path, &leveldb.Options{ReadOnly: true})
+		return d, d, err
+	case "badgerds":
+		opts := badgerds.DefaultOptions
+		opts.ReadOnly = true
+		opts.GcInterval = 0
+		d, err := badgerds.NewDatastore(path, &opts)
+		return d, d, err
+	}
+	return nil, nil, fmt.Errorf("unsupported datastore type %q at %s", spec.Type, spec.Mountpoint)
+}
+
+func importRepo(ctx context.Context, gd *gcsds.GCSDatastore, args []string) error {
+	flags := flag.NewFlagSet("import-repo", flag.ContinueOnError)
+	verify := flags.Bool("verify", false, "Check that every value is stored once imported.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected [-verify] REPO")
+	}
+	dir := flags.Arg(0)
+	data, err := os.ReadFile(filepath.Join(dir, "datastore_spec"))
+	if err != nil {
+		return err
+	}
+	var spec datastoreSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("invalid datastore_spec: %w", err)
+	}
+	if err := gd.LoadMetadataContext(ctx); err != nil {
+		return err
+	}
+	for _, mount := range spec.mounts() {
+		src, closer, err := openDatastore(dir, mount)
+		if err != nil {
+			return err
+		}
+		res, err := gd.ImportDatastore(ctx, src, gcsds.ImportOptions{Prefix: mount.Mountpoint, Verify: *verify})
+		closer.Close()
+		log.Printf("%s (%s): imported %d values, skipped %d already stored, verified %d.",
+			mount.Mountpoint, mount.Type, res.Imported, res.Skipped, res.Verified)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
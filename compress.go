@@ -0,0 +1,242 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression codecs, see Config.Compression.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// DefaultCompressionMinSize is the size from which values are compressed
+// if Config.CompressionMinSize isn't set.
+const DefaultCompressionMinSize = 512
+
+// sizeMetadataKey is the object metadata key of the size of a compressed
+// value.
+const sizeMetadataKey = "size"
+
+// zstdDecoder decodes values compressed with zstd, whatever the
+// configured codec. Its DecodeAll is safe for concurrent use.
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// compression returns the configured codec.
+func (gd *GCSDatastore) compression() string {
+	if gd.Config.Compression == "" {
+		return CompressionNone
+	}
+	return gd.Config.Compression
+}
+
+// initCompression validates the configured codec and level, and creates
+// the encoder.
+func (gd *GCSDatastore) initCompression() error {
+	level := gd.Config.CompressionLevel
+	switch gd.compression() {
+	case CompressionNone:
+		return nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		} else if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return fmt.Errorf("gcsds: gzip compression level %d not in [%d, %d]", level, gzip.BestSpeed, gzip.BestCompression)
+		}
+		gd.gzipWriters.New = func() interface{} {
+			zw, _ := gzip.NewWriterLevel(nil, level)
+			return zw
+		}
+		return nil
+	case CompressionZstd:
+		zlevel := zstd.SpeedDefault
+		if level != 0 {
+			if level < 1 || level > 22 {
+				return fmt.Errorf("gcsds: zstd compression level %d not in [1, 22]", level)
+			}
+			zlevel = zstd.EncoderLevelFromZstd(level)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zlevel))
+		if err != nil {
+			return err
+		}
+		gd.zstdEncoder = enc
+		return nil
+	}
+	return fmt.Errorf("gcsds: unknown compression %q", gd.Config.Compression)
+}
+
+// encodeValue returns the data to store for value and its content
+// encoding, empty if it isn't compressed. Values are compressed if they
+// are large enough and compression makes them smaller.
+func (gd *GCSDatastore) encodeValue(value []byte) ([]byte, string) {
+	minSize := gd.Config.CompressionMinSize
+	if minSize <= 0 {
+		minSize = DefaultCompressionMinSize
+	}
+	codec := gd.compression()
+	if codec == CompressionNone || len(value) < minSize {
+		return value, ""
+	}
+	var data []byte
+	switch codec {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gd.gzipWriters.Get().(*gzip.Writer)
+		defer gd.gzipWriters.Put(zw)
+		zw.Reset(&buf)
+		if _, err := zw.Write(value); err != nil {
+			return value, ""
+		}
+		if err := zw.Close(); err != nil {
+			return value, ""
+		}
+		data = buf.Bytes()
+	case CompressionZstd:
+		data = gd.zstdEncoder.EncodeAll(value, make([]byte, 0, len(value)))
+	}
+	if len(data) >= len(value) {
+		return value, ""
+	}
+	return data, codec
+}
+
+// writeValue writes the value of key to w, compressed and encrypted if
+// configured, with its CRC32C and the metadata of ObjectMetadata.
+func (gd *GCSDatastore) writeValue(w *storage.Writer, key string, value []byte) {
+	data, encoding := gd.encodeStored(key, value)
+	if encoding != "" {
+		w.ContentEncoding = encoding
+		if w.Metadata == nil {
+			w.Metadata = map[string]string{}
+		}
+		w.Metadata[sizeMetadataKey] = strconv.Itoa(len(value))
+	}
+	gd.annotate(w, key, encoding)
+	gd.markEphemeral(w, key)
+	setChecksum(w, data)
+	w.Write(data)
+}
+
+// encodeStored returns the data to store for the value of key, compressed
+// and encrypted as configured, and its content encoding.
+func (gd *GCSDatastore) encodeStored(key string, value []byte) ([]byte, string) {
+	data, encoding := gd.encodeValue(value)
+	if gd.aead != nil {
+		data = gd.seal(key, data)
+		if encoding == "" {
+			encoding = EncryptionAES256GCM
+		} else {
+			encoding += ", " + EncryptionAES256GCM
+		}
+	}
+	return data, encoding
+}
+
+// decoder returns a reader of the value of key stored in r with encoding,
+// a list of the codings applied in order, whatever the configured ones.
+func (gd *GCSDatastore) decoder(encoding, key string, r io.Reader) (io.Reader, error) {
+	if encoding == "" {
+		return r, nil
+	}
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch coding := strings.TrimSpace(codings[i]); coding {
+		case CompressionGzip:
+			r, err = gzip.NewReader(r)
+		case CompressionZstd:
+			// Values are small enough to be decoded at once, by the
+			// shared decoder.
+			var data []byte
+			if data, err = io.ReadAll(r); err == nil {
+				data, err = zstdDecoder.DecodeAll(data, nil)
+				r = bytes.NewReader(data)
+			}
+		case EncryptionAES256GCM:
+			r, err = gd.decrypter(key, r)
+		default:
+			err = fmt.Errorf("gcsds: unsupported content encoding %q", encoding)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// decodeValue returns the value of key stored as data with encoding.
+func (gd *GCSDatastore) decodeValue(encoding, key string, data []byte) ([]byte, error) {
+	if encoding == "" {
+		return data, nil
+	}
+	r, err := gd.decoder(encoding, key, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// readerFunc is a Read method as an io.Reader.
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// decodeObject makes r read length bytes from offset of the value for key
+// stored with encoding, or the rest if length is negative.
+func (gd *GCSDatastore) decodeObject(r *objectReader, key, encoding string, offset, length int64) error {
+	dec, err := gd.decoder(encoding, key, readerFunc(r.readStored))
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		_, err := io.CopyN(io.Discard, dec, offset)
+		if err == io.EOF {
+			return fmt.Errorf("gcsds: offset %d beyond the value of %s", offset, r.name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if length >= 0 {
+		dec = io.LimitReader(dec, length)
+	}
+	r.decoded = dec
+	return nil
+}
+
+// objectSize returns the size of the value stored in the object with
+// attrs.
+func objectSize(attrs *storage.ObjectAttrs) int64 {
+	if attrs.ContentEncoding != "" {
+		if size, err := strconv.ParseInt(attrs.Metadata[sizeMetadataKey], 10, 64); err == nil {
+			return size
+		}
+	}
+	return attrs.Size
+}
@@ -0,0 +1,133 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// copyPageSize is the number of objects CopyRepo lists at a time, and
+// copies before reporting progress.
+const copyPageSize = 1000
+
+// CopyOptions configure CopyRepo.
+type CopyOptions struct {
+	// Bucket is the bucket to copy to. It may be in another project or
+	// location, if the datastore's credentials can write to it.
+	Bucket string
+	// Prefix is the prefix to copy to, Config.Prefix by default.
+	Prefix string
+	// KMSKeyName, if set, is the Cloud KMS key that encrypts the copies,
+	// as in Config.KMSKeyName. Without it, copies use the destination
+	// bucket's default key, if any.
+	KMSKeyName string
+	// Token resumes a copy from the last token passed to Progress.
+	Token string
+	// Progress, if set, is called after each page of objects is copied,
+	// with the number of objects copied so far and the token to resume
+	// from, "" once done. Save the token to resume an interrupted copy.
+	Progress func(copied int, token string)
+}
+
+// CopyRepo copies the objects of the datastore to another bucket or
+// prefix with server-side rewrites, so that repos move between buckets,
+// projects or regions without downloading their data. The values are
+// copied with the packs, layout, data key and metadata snapshot next to
+// them, but not the lock and heartbeats. Up to Workers objects are copied
+// in parallel. Values written or deleted during the copy may be missed,
+// so copy from a stopped or read-only node. It returns the number of
+// objects copied.
+func (gd *GCSDatastore) CopyRepo(ctx context.Context, opts CopyOptions) (int, error) {
+	if opts.Bucket == "" {
+		return 0, fmt.Errorf("gcsds: no bucket to copy to")
+	}
+	src := strings.TrimSuffix(path.Join(gd.Config.Prefix), "/")
+	dst := src
+	if opts.Prefix != "" {
+		dst = strings.TrimSuffix(path.Join(opts.Prefix), "/")
+	}
+	if opts.Bucket == gd.Config.Bucket && dst == src {
+		return 0, fmt.Errorf("gcsds: can't copy gs://%s/%s onto itself", opts.Bucket, src)
+	}
+	query := &storage.Query{Prefix: src}
+	if err := query.SetAttrSelection([]string{"Name", "Generation"}); err != nil {
+		return 0, err
+	}
+	bkt := gd.client.Bucket(gd.Config.Bucket)
+	pager := iterator.NewPager(bkt.Objects(ctx, query), copyPageSize, opts.Token)
+	copied := 0
+	for {
+		var objects []*storage.ObjectAttrs
+		token, err := pager.NextPage(&objects)
+		if err != nil {
+			return copied, requestError("list", src, err)
+		}
+		var mu sync.Mutex
+		var firstErr error
+		sem := make(chan struct{}, gd.workers())
+		var wg sync.WaitGroup
+		for _, attrs := range objects {
+			if !gd.repoObject(attrs.Name) {
+				continue
+			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(attrs *storage.ObjectAttrs) {
+				defer func() { <-sem; wg.Done() }()
+				name := dst + strings.TrimPrefix(attrs.Name, src)
+				copier := gd.client.Bucket(opts.Bucket).Object(name).CopierFrom(bkt.Object(attrs.Name).Generation(attrs.Generation))
+				copier.DestinationKMSKeyName = opts.KMSKeyName
+				_, err := copier.Run(ctx)
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == storage.ErrObjectNotExist:
+					// Overwritten or deleted since it was listed.
+				case err != nil:
+					if firstErr == nil {
+						firstErr = requestError("copy", attrs.Name, err)
+					}
+				default:
+					copied++
+				}
+			}(attrs)
+		}
+		wg.Wait()
+		if firstErr != nil {
+			return copied, firstErr
+		}
+		if opts.Progress != nil {
+			opts.Progress(copied, token)
+		}
+		if token == "" {
+			return copied, nil
+		}
+	}
+}
+
+// repoObject reports whether the object called name is copied by CopyRepo.
+func (gd *GCSDatastore) repoObject(name string) bool {
+	if strings.HasPrefix(name, gd.listPrefix()) || strings.HasPrefix(name, gd.packDir()) {
+		return true
+	}
+	return name == gd.layoutPath() || name == gd.dataKeyPath() || name == gd.snapshotPath()
+}
@@ -0,0 +1,86 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// gcsScopes returns the OAuth scopes requested for GCS.
+func gcsScopes(cfg Config) []string {
+	if len(cfg.Scopes) > 0 {
+		return cfg.Scopes
+	}
+	return []string{storage.ScopeFullControl}
+}
+
+// credentialOptions returns the client options that authenticate as
+// configured: with Config.TokenSource, or Config.CredentialsFile, or
+// Application Default Credentials, possibly impersonating
+// Config.ImpersonateServiceAccount. Tokens are requested for scopes.
+func credentialOptions(ctx context.Context, cfg Config, scopes ...string) ([]option.ClientOption, error) {
+	if cfg.TokenSource != nil {
+		return []option.ClientOption{option.WithTokenSource(cfg.TokenSource)}, nil
+	}
+	if cfg.ImpersonateServiceAccount != "" {
+		ts, err := impersonatedTokenSource(ctx, cfg, scopes...)
+		if err != nil {
+			return nil, err
+		}
+		return []option.ClientOption{option.WithTokenSource(ts)}, nil
+	}
+	opts, err := credentialsFileOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, option.WithScopes(scopes...)), nil
+}
+
+// credentialsFileOptions returns the client options for
+// Config.CredentialsFile, if set.
+func credentialsFileOptions(cfg Config) ([]option.ClientOption, error) {
+	if cfg.CredentialsFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(cfg.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("gcsds: reading credentials: %w", err)
+	}
+	return []option.ClientOption{option.WithCredentialsJSON(data)}, nil
+}
+
+// impersonatedTokenSource returns tokens of Config.ImpersonateServiceAccount
+// for scopes, obtained with the other credentials.
+func impersonatedTokenSource(ctx context.Context, cfg Config, scopes ...string) (oauth2.TokenSource, error) {
+	opts, err := credentialsFileOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: cfg.ImpersonateServiceAccount,
+		Scopes:          scopes,
+	}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("gcsds: impersonating %s: %w", cfg.ImpersonateServiceAccount, err)
+	}
+	return ts, nil
+}
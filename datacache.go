@@ -0,0 +1,259 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// DataCache is an in-memory LRU cache of object values.
+//
+// The cache holds at most a number of values, and at most maxBytes bytes of
+// them, so that memory use is bounded whatever the sizes of the values.
+// Values larger than maxValueSize are never cached. With the admission filter
+// enabled, a new value only displaces the least recently used entry when its
+// key has been requested more often than the victim's (TinyLFU). This keeps a
+// scan of cold or large objects from flushing the working set.
+type DataCache struct {
+	lru          *lru.Cache
+	items        int
+	maxBytes     int64
+	maxValueSize int
+	freq         *frequencySketch
+
+	// mu serializes changes to the cache, so that bytes, the total size
+	// of the cached values, is kept by the eviction callback.
+	mu    sync.Mutex
+	bytes int64
+
+	hits, misses, evictions, rejections atomic.Int64
+}
+
+// DataCacheStats reports the usage and effectiveness of a DataCache.
+type DataCacheStats struct {
+	// Items and Bytes are the number and total size of the cached values,
+	// MaxItems and MaxBytes their limits. A MaxBytes of 0 is unlimited.
+	Items    int
+	MaxItems int
+	Bytes    int64
+	MaxBytes int64
+	// Hits and Misses count lookups. Evictions counts the values removed
+	// to make room for others, and Rejections the values not cached, as
+	// too large or by the admission filter.
+	Hits       int64
+	Misses     int64
+	Evictions  int64
+	Rejections int64
+}
+
+// HitRate returns the fraction of lookups that were hits, or 0 before any.
+func (s DataCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// NewDataCache creates a data cache holding up to items values, of up to
+// maxBytes bytes in total. A maxBytes of 0 only limits the number of values,
+// and a maxValueSize of 0 disables the size threshold.
+func NewDataCache(items int, maxBytes int64, maxValueSize int, admission bool) (*DataCache, error) {
+	dc := &DataCache{
+		items:        items,
+		maxBytes:     maxBytes,
+		maxValueSize: maxValueSize,
+	}
+	c, err := lru.NewWithEvict(items, func(_, value interface{}) {
+		dc.bytes -= int64(len(value.([]byte)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	dc.lru = c
+	if admission {
+		dc.freq = newFrequencySketch(items)
+	}
+	return dc, nil
+}
+
+// Get returns the cached value for key, if any.
+func (dc *DataCache) Get(key string) ([]byte, bool) {
+	if dc.freq != nil {
+		dc.freq.increment(key)
+	}
+	v, ok := dc.lru.Get(key)
+	if !ok {
+		dc.misses.Add(1)
+		return nil, false
+	}
+	dc.hits.Add(1)
+	b, ok := v.([]byte)
+	return b, ok
+}
+
+// Add offers value to the cache. It returns false if the admission policy
+// rejected the value.
+func (dc *DataCache) Add(key string, value []byte) bool {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	size := int64(len(value))
+	if (dc.maxValueSize > 0 && len(value) > dc.maxValueSize) || (dc.maxBytes > 0 && size > dc.maxBytes) {
+		// Drop any stale, smaller value for the same key.
+		dc.lru.Remove(key)
+		dc.rejections.Add(1)
+		return false
+	}
+	if dc.freq != nil && !dc.lru.Contains(key) && dc.full(size) {
+		victim, _, ok := dc.lru.GetOldest()
+		if ok && dc.freq.estimate(key) <= dc.freq.estimate(victim.(string)) {
+			dc.rejections.Add(1)
+			return false
+		}
+	}
+	// Replacing a value doesn't evict it.
+	dc.lru.Remove(key)
+	for dc.maxBytes > 0 && dc.bytes+size > dc.maxBytes {
+		dc.lru.RemoveOldest()
+		dc.evictions.Add(1)
+	}
+	if dc.lru.Add(key, value) {
+		dc.evictions.Add(1)
+	}
+	dc.bytes += size
+	return true
+}
+
+// full reports whether adding a value of size bytes evicts others.
+func (dc *DataCache) full(size int64) bool {
+	return dc.lru.Len() >= dc.items || (dc.maxBytes > 0 && dc.bytes+size > dc.maxBytes)
+}
+
+// Remove removes key from the cache.
+func (dc *DataCache) Remove(key string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.lru.Remove(key)
+}
+
+// Bytes returns the total size of the cached values.
+func (dc *DataCache) Bytes() int64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.bytes
+}
+
+// Len returns the number of cached values.
+func (dc *DataCache) Len() int {
+	return dc.lru.Len()
+}
+
+// Stats returns the usage and effectiveness of the cache.
+func (dc *DataCache) Stats() DataCacheStats {
+	return DataCacheStats{
+		Items:      dc.Len(),
+		MaxItems:   dc.items,
+		Bytes:      dc.Bytes(),
+		MaxBytes:   dc.maxBytes,
+		Hits:       dc.hits.Load(),
+		Misses:     dc.misses.Load(),
+		Evictions:  dc.evictions.Load(),
+		Rejections: dc.rejections.Load(),
+	}
+}
+
+// frequencySketch is a count-min sketch with 4-bit saturating counters that
+// estimates how often a key was accessed recently. All counters are halved
+// after a sample period so old popularity fades out.
+type frequencySketch struct {
+	mu           sync.Mutex
+	seed         maphash.Seed
+	table        []uint64 // 16 counters of 4 bits per word.
+	mask         uint64
+	additions    int
+	samplePeriod int
+}
+
+// sketchSeeds derive an independent counter position per row from a key hash.
+var sketchSeeds = [4]uint64{
+	0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325,
+}
+
+func newFrequencySketch(items int) *frequencySketch {
+	// At least 64 words (1024 counters) keeps collisions rare for tiny caches.
+	size := 64
+	for size < items {
+		size <<= 1
+	}
+	return &frequencySketch{
+		seed:         maphash.MakeSeed(),
+		table:        make([]uint64, size),
+		mask:         uint64(size - 1),
+		samplePeriod: 10 * size,
+	}
+}
+
+// counter returns the word index and bit offset of the i'th counter for h.
+func (fs *frequencySketch) counter(h uint64, i int) (uint64, uint64) {
+	// Murmur3 finalizer.
+	h += sketchSeeds[i]
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h & fs.mask, (h >> 60) * 4
+}
+
+func (fs *frequencySketch) increment(key string) {
+	h := maphash.String(fs.seed, key)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for i := 0; i < 4; i++ {
+		idx, offset := fs.counter(h, i)
+		if (fs.table[idx]>>offset)&0xF < 15 {
+			fs.table[idx] += 1 << offset
+		}
+	}
+	fs.additions++
+	if fs.additions >= fs.samplePeriod {
+		fs.reset()
+	}
+}
+
+func (fs *frequencySketch) estimate(key string) uint64 {
+	h := maphash.String(fs.seed, key)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	min := uint64(15)
+	for i := 0; i < 4; i++ {
+		idx, offset := fs.counter(h, i)
+		if c := (fs.table[idx] >> offset) & 0xF; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// reset halves every counter.
+func (fs *frequencySketch) reset() {
+	for i := range fs.table {
+		fs.table[i] = (fs.table[i] >> 1) & 0x7777777777777777
+	}
+	fs.additions /= 2
+}
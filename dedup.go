@@ -0,0 +1,69 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"cloud.google.com/go/storage"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// isBlockKey reports whether key is a block key, which ends in the
+// multihash of its content, as written by kubo's blockstore.
+func isBlockKey(key string) bool {
+	hash, err := dshelp.DsKeyToMultihash(ds.NewKey(ds.RawKey(key).BaseNamespace()))
+	if err != nil {
+		return false
+	}
+	_, err = mh.Decode(hash)
+	return err == nil
+}
+
+// skipBlock reports whether Put can skip writing value for key, with
+// SkipExistingBlocks, because key is a block of the same size that's
+// already stored. Blocks are content-addressed, so the stored value is the
+// same.
+func (gd *GCSDatastore) skipBlock(key string, value []byte) bool {
+	if !gd.Config.SkipExistingBlocks || !isBlockKey(key) {
+		return false
+	}
+	md, err := gd.mdCache.Get(key)
+	if err != nil || md.Size != int64(len(value)) || !md.Expiration.IsZero() {
+		return false
+	}
+	gd.stats.skippedWrites.Add(1)
+	return true
+}
+
+// ifMissing makes writes of blocks to obj fail if it exists, with
+// SkipExistingBlocks, so that blocks unknown to the metadata cache aren't
+// overwritten with the same content. See isExisting.
+func (gd *GCSDatastore) ifMissing(key string, obj *storage.ObjectHandle) *storage.ObjectHandle {
+	if !gd.Config.SkipExistingBlocks || !isBlockKey(key) {
+		return obj
+	}
+	return obj.If(storage.Conditions{DoesNotExist: true})
+}
+
+// isExisting reports whether a write failed because of ifMissing, which
+// means the block is stored already.
+func (gd *GCSDatastore) isExisting(key string, err error) bool {
+	if !gd.Config.SkipExistingBlocks || !isBlockKey(key) || !isPreconditionFailed(err) {
+		return false
+	}
+	gd.stats.skippedWrites.Add(1)
+	return true
+}
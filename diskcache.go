@@ -0,0 +1,275 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// DefaultDiskCacheMaxBytes bounds the disk cache unless configured.
+const DefaultDiskCacheMaxBytes = 10 << 30
+
+// diskCacheTrailer is the size of the CRC32C appended to cached values.
+const diskCacheTrailer = 4
+
+// DiskCache is an LRU cache of object values in files on local disk, which
+// survives restarts. It sits between the in-memory data cache and GCS, so
+// that hot content isn't downloaded again after a restart.
+//
+// Each value is a file named after a hash of its key, followed by its
+// CRC32C. Files are written under a temporary name and renamed, so a crash
+// never leaves a partial value, and values that fail the checksum are
+// dropped. Writes and reads update the file times, which order the files
+// on open.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	// mu serializes changes to the cache, so that bytes, the total size
+	// of the files, is kept by the eviction callback.
+	mu    sync.Mutex
+	lru   *lru.Cache
+	bytes int64
+	// lastUsed is the latest file time set or loaded.
+	lastUsed time.Time
+}
+
+// OpenDiskCache opens the disk cache in dir, creating dir if needed, with
+// up to maxBytes bytes of files. A maxBytes of 0 means
+// DefaultDiskCacheMaxBytes.
+func OpenDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if maxBytes <= 0 {
+		maxBytes = DefaultDiskCacheMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	dc := &DiskCache{dir: dir, maxBytes: maxBytes}
+	c, err := lru.NewWithEvict(math.MaxInt32, func(name, size interface{}) {
+		dc.bytes -= size.(int64)
+		os.Remove(dc.path(name.(string)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	dc.lru = c
+	if err := dc.load(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// load indexes the files left by earlier runs, least recently used first,
+// and removes temporary files of interrupted writes.
+func (dc *DiskCache) load() error {
+	type file struct {
+		name string
+		size int64
+		used time.Time
+	}
+	files := []file{}
+	err := filepath.WalkDir(dc.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(p, ".tmp") {
+			return os.Remove(p)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{name: d.Name(), size: info.Size(), used: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if !files[i].used.Equal(files[j].used) {
+			return files[i].used.Before(files[j].used)
+		}
+		return files[i].name < files[j].name
+	})
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for _, f := range files {
+		dc.add(f.name, f.size)
+		if f.used.After(dc.lastUsed) {
+			dc.lastUsed = f.used
+		}
+	}
+	return nil
+}
+
+// touch sets the file times of name after all those set before, so that
+// uses within one tick of the clock keep their order. The caller holds mu.
+func (dc *DiskCache) touch(name string) {
+	t := time.Now().Round(0)
+	if !t.After(dc.lastUsed) {
+		t = dc.lastUsed.Add(time.Nanosecond)
+	}
+	dc.lastUsed = t
+	os.Chtimes(dc.path(name), t, t)
+}
+
+// diskCacheName returns the file name of key.
+func diskCacheName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// path returns the path of the file called name, in a directory of the
+// first two characters of the name to keep directories small.
+func (dc *DiskCache) path(name string) string {
+	return filepath.Join(dc.dir, name[:2], name)
+}
+
+// Get returns the cached value for key, if any.
+func (dc *DiskCache) Get(key string) ([]byte, bool) {
+	name := diskCacheName(key)
+	if !dc.lru.Contains(name) {
+		return nil, false
+	}
+	data, err := os.ReadFile(dc.path(name))
+	if err != nil {
+		dc.Remove(key)
+		return nil, false
+	}
+	n := len(data) - diskCacheTrailer
+	if n < 0 || crc32.Checksum(data[:n], castagnoli) != binary.BigEndian.Uint32(data[n:]) {
+		dc.Remove(key)
+		return nil, false
+	}
+	dc.mu.Lock()
+	dc.lru.Get(name)
+	dc.touch(name)
+	dc.mu.Unlock()
+	return data[:n], true
+}
+
+// Add stores value for key, evicting least recently used values to make
+// room. Values larger than the cache are not stored.
+func (dc *DiskCache) Add(key string, value []byte) error {
+	size := int64(len(value) + diskCacheTrailer)
+	if size > dc.maxBytes {
+		dc.Remove(key)
+		return nil
+	}
+	name := diskCacheName(key)
+	p := dc.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	var trailer [diskCacheTrailer]byte
+	binary.BigEndian.PutUint32(trailer[:], crc32.Checksum(value, castagnoli))
+	_, err = f.Write(append(value[:len(value):len(value)], trailer[:]...))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	// Replacing a value doesn't evict it.
+	dc.lru.Remove(name)
+	if err := os.Rename(f.Name(), p); err != nil {
+		return err
+	}
+	dc.add(name, size)
+	dc.touch(name)
+	return nil
+}
+
+// add indexes the file called name, evicting others to make room. The
+// caller holds mu.
+func (dc *DiskCache) add(name string, size int64) {
+	for dc.bytes+size > dc.maxBytes && dc.lru.Len() > 0 {
+		dc.lru.RemoveOldest()
+	}
+	dc.lru.Add(name, size)
+	dc.bytes += size
+}
+
+// Remove removes key from the cache.
+func (dc *DiskCache) Remove(key string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.lru.Remove(diskCacheName(key))
+}
+
+// Len returns the number of cached values.
+func (dc *DiskCache) Len() int {
+	return dc.lru.Len()
+}
+
+// Bytes returns the total size of the cache files.
+func (dc *DiskCache) Bytes() int64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.bytes
+}
+
+// getDisk looks key up in the disk cache.
+func (gd *GCSDatastore) getDisk(key string) ([]byte, bool) {
+	if gd.diskCache == nil {
+		return nil, false
+	}
+	value, ok := gd.diskCache.Get(key)
+	if ok {
+		gd.stats.diskCacheHits.Add(1)
+	} else {
+		gd.stats.diskCacheMisses.Add(1)
+	}
+	return value, ok
+}
+
+// addDisk stores value for key in the disk cache, if it fits the data
+// cache size threshold.
+func (gd *GCSDatastore) addDisk(key string, value []byte) {
+	if gd.diskCache == nil || !gd.sharedCacheable(value) {
+		return
+	}
+	if err := gd.diskCache.Add(key, value); err != nil {
+		gd.stats.diskCacheErrors.Add(1)
+		logger.Warnw("Failed to add value to disk cache", "key", key, "err", err)
+	}
+}
+
+// removeDisk removes key from the disk cache, once its value changed.
+func (gd *GCSDatastore) removeDisk(key string) {
+	if gd.diskCache != nil {
+		gd.diskCache.Remove(key)
+	}
+}
@@ -0,0 +1,408 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ MetadataIndex = (*DiskMetadataCache)(nil)
+
+const (
+	// Listed entries are written in transactions of this many.
+	diskLoadBatch = 1000
+	// Iterators read this many entries per transaction, so that no read
+	// transaction stays open while the caller consumes them.
+	diskIteratorChunk = 1000
+	// Touch doesn't rewrite entries accessed more recently than this.
+	diskTouchResolution = time.Hour
+)
+
+var diskBucket = []byte("metadata")
+
+// newMetadataIndex returns the metadata index cfg selects.
+func newMetadataIndex(cfg Config) (MetadataIndex, error) {
+	var md MetadataIndex = NewMetadataCache()
+	if cfg.MetadataIndexPath != "" {
+		disk, err := OpenDiskMetadataCache(cfg.MetadataIndexPath)
+		if err != nil {
+			return nil, err
+		}
+		md = disk
+	}
+	if cfg.BloomFilterKeys <= 0 {
+		return md, nil
+	}
+	b, err := newBloomIndex(md, cfg.BloomFilterKeys, cfg.BloomFilterFPRate)
+	if err != nil {
+		closeIndex(md)
+		return nil, err
+	}
+	return b, nil
+}
+
+// closeIndex closes md, if it needs closing.
+func closeIndex(md MetadataIndex) {
+	if c, ok := md.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logger.Warnf("Failed to close metadata index: %v", err)
+		}
+	}
+}
+
+// DiskMetadataCache is a MetadataIndex in a bbolt database on local disk.
+// Only the usage totals are kept in RAM. The database is a cache of the
+// bucket listing: it is recreated on open, and removed on Close.
+type DiskMetadataCache struct {
+	db   *bolt.DB
+	path string
+
+	// mu guards the fields below. Writes to db hold it, so that usage is
+	// updated consistently with the entries.
+	mu       sync.Mutex
+	objects  int64
+	bytes    int64
+	prefixes map[string]*Usage
+	deleted  map[string]bool
+	// loaded holds listed entries not written to db yet.
+	loaded []Metadata
+}
+
+// OpenDiskMetadataCache creates an empty index in the file path, replacing
+// any existing file.
+func OpenDiskMetadataCache(path string) (*DiskMetadataCache, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// The index is rebuilt from the bucket, so it needn't survive crashes.
+	db, err := bolt.Open(path, 0o600, &bolt.Options{NoSync: true, NoFreelistSync: true, Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(diskBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DiskMetadataCache{db: db, path: path, prefixes: make(map[string]*Usage)}, nil
+}
+
+// Close closes and removes the database.
+func (md *DiskMetadataCache) Close() error {
+	if err := md.db.Close(); err != nil {
+		return err
+	}
+	return os.Remove(md.path)
+}
+
+// encodeMetadata encodes m without its key: size, access time and
+// expiration in unix nanoseconds (0 if none), then the storage class.
+func encodeMetadata(m *Metadata) []byte {
+	b := make([]byte, 24, 24+len(m.StorageClass))
+	binary.BigEndian.PutUint64(b, uint64(m.Size))
+	binary.BigEndian.PutUint64(b[8:], uint64(m.Accessed))
+	if !m.Expiration.IsZero() {
+		binary.BigEndian.PutUint64(b[16:], uint64(m.Expiration.UnixNano()))
+	}
+	return append(b, m.StorageClass...)
+}
+
+func decodeMetadata(key, b []byte) *Metadata {
+	if len(b) < 24 {
+		return nil
+	}
+	m := &Metadata{
+		Key:          string(key),
+		Size:         int64(binary.BigEndian.Uint64(b)),
+		Accessed:     int64(binary.BigEndian.Uint64(b[8:])),
+		StorageClass: string(b[24:]),
+	}
+	if ns := int64(binary.BigEndian.Uint64(b[16:])); ns != 0 {
+		m.Expiration = time.Unix(0, ns)
+	}
+	return m
+}
+
+// get reads the entry for key in tx.
+func get(tx *bolt.Tx, key string) *Metadata {
+	b := tx.Bucket(diskBucket).Get([]byte(key))
+	if b == nil {
+		return nil
+	}
+	return decodeMetadata([]byte(key), b)
+}
+
+func (md *DiskMetadataCache) Has(key string) bool {
+	found := false
+	md.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(diskBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return found
+}
+
+// Get returns a copy of the metadata for key.
+func (md *DiskMetadataCache) Get(key string) (*Metadata, error) {
+	var m *Metadata
+	md.db.View(func(tx *bolt.Tx) error {
+		m = get(tx, key)
+		return nil
+	})
+	if m == nil {
+		return nil, ds.ErrNotFound
+	}
+	return m, nil
+}
+
+func (md *DiskMetadataCache) Put(key string, size int64) {
+	md.PutEntry(Metadata{Key: key, Size: size, Accessed: time.Now().Unix()})
+}
+
+// PutEntry stores m under m.Key.
+func (md *DiskMetadataCache) PutEntry(m Metadata) {
+	md.update(func(tx *bolt.Tx) error {
+		return md.put(tx, &m)
+	})
+}
+
+// update runs f in a write transaction, holding mu.
+func (md *DiskMetadataCache) update(f func(tx *bolt.Tx) error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.db.Update(f)
+}
+
+// put writes m in tx and updates the usage. Callers hold mu.
+func (md *DiskMetadataCache) put(tx *bolt.Tx, m *Metadata) error {
+	if old := get(tx, m.Key); old != nil {
+		md.account(old, -1)
+	}
+	md.account(m, 1)
+	return tx.Bucket(diskBucket).Put([]byte(m.Key), encodeMetadata(m))
+}
+
+// account adds (sign 1) or removes (sign -1) m from the usage totals.
+// Callers hold mu.
+func (md *DiskMetadataCache) account(m *Metadata, sign int64) {
+	md.objects += sign
+	md.bytes += sign * m.Size
+	for prefix, u := range md.prefixes {
+		if strings.HasPrefix(m.Key, prefix) {
+			u.Objects += sign
+			u.Bytes += sign * m.Size
+		}
+	}
+}
+
+// StartLoading prepares for LoadEntry calls from a bucket listing that
+// runs concurrently with Put and Delete.
+func (md *DiskMetadataCache) StartLoading() {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.deleted = make(map[string]bool)
+}
+
+// LoadEntry stores m from a listing, unless the key was written or deleted
+// since StartLoading. Entries are written in batches, so they may be
+// missing until DoneLoading.
+func (md *DiskMetadataCache) LoadEntry(m Metadata) {
+	md.mu.Lock()
+	md.loaded = append(md.loaded, m)
+	full := len(md.loaded) >= diskLoadBatch
+	md.mu.Unlock()
+	if full {
+		md.flushLoaded()
+	}
+}
+
+// flushLoaded writes the listed entries.
+func (md *DiskMetadataCache) flushLoaded() {
+	md.update(func(tx *bolt.Tx) error {
+		for i := range md.loaded {
+			m := &md.loaded[i]
+			if md.deleted[m.Key] || tx.Bucket(diskBucket).Get([]byte(m.Key)) != nil {
+				continue
+			}
+			if err := md.put(tx, m); err != nil {
+				return err
+			}
+		}
+		md.loaded = md.loaded[:0]
+		return nil
+	})
+}
+
+// DoneLoading writes the remaining listed entries and ends loading.
+func (md *DiskMetadataCache) DoneLoading() {
+	md.flushLoaded()
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.deleted = nil
+	md.loaded = nil
+}
+
+// TrackPrefix starts accounting the usage of entries under prefix.
+func (md *DiskMetadataCache) TrackPrefix(prefix string) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if _, ok := md.prefixes[prefix]; ok {
+		return
+	}
+	u := &Usage{}
+	md.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(diskBucket).Cursor()
+		p := []byte(prefix)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if m := decodeMetadata(k, v); m != nil {
+				u.Objects++
+				u.Bytes += m.Size
+			}
+		}
+		return nil
+	})
+	md.prefixes[prefix] = u
+}
+
+// PrefixUsage returns the usage of a prefix passed to TrackPrefix.
+func (md *DiskMetadataCache) PrefixUsage(prefix string) Usage {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if u, ok := md.prefixes[prefix]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+// Touch records an access to key. Accesses within diskTouchResolution of
+// the recorded one are ignored, to save writes.
+func (md *DiskMetadataCache) Touch(key string) {
+	now := time.Now()
+	m, err := md.Get(key)
+	if err != nil || now.Sub(time.Unix(m.Accessed, 0)) < diskTouchResolution {
+		return
+	}
+	md.modify(key, func(m *Metadata) { m.Accessed = now.Unix() })
+}
+
+// SetStorageClass records the storage class of key.
+func (md *DiskMetadataCache) SetStorageClass(key string, class string) {
+	md.modify(key, func(m *Metadata) { m.StorageClass = class })
+}
+
+// modify applies f to the entry for key, if any.
+func (md *DiskMetadataCache) modify(key string, f func(m *Metadata)) {
+	md.update(func(tx *bolt.Tx) error {
+		m := get(tx, key)
+		if m == nil {
+			return nil
+		}
+		f(m)
+		return tx.Bucket(diskBucket).Put([]byte(key), encodeMetadata(m))
+	})
+}
+
+// StorageClasses counts entries per storage class.
+func (md *DiskMetadataCache) StorageClasses() map[string]int {
+	classes := map[string]int{}
+	md.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(diskBucket).ForEach(func(k, v []byte) error {
+			if m := decodeMetadata(k, v); m != nil {
+				classes[m.StorageClass]++
+			}
+			return nil
+		})
+	})
+	return classes
+}
+
+func (md *DiskMetadataCache) Delete(key string) {
+	md.update(func(tx *bolt.Tx) error {
+		if md.deleted != nil {
+			md.deleted[key] = true
+		}
+		old := get(tx, key)
+		if old == nil {
+			return nil
+		}
+		md.account(old, -1)
+		return tx.Bucket(diskBucket).Delete([]byte(key))
+	})
+}
+
+// Bytes returns the total size of all entries.
+func (md *DiskMetadataCache) Bytes() int64 {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return md.bytes
+}
+
+func (md *DiskMetadataCache) Size() int {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	return int(md.objects)
+}
+
+// Iterator returns the entries under prefix in key order. Entries written
+// during the iteration may or may not be returned.
+func (md *DiskMetadataCache) Iterator(prefix string, limit int) func() *Metadata {
+	p := []byte(prefix)
+	var chunk []*Metadata
+	var last []byte
+	done := false
+	count := 0
+	return func() *Metadata {
+		if len(chunk) == 0 && !done {
+			md.db.View(func(tx *bolt.Tx) error {
+				c := tx.Bucket(diskBucket).Cursor()
+				k, v := c.Seek(p)
+				if last != nil {
+					k, v = c.Seek(last)
+					if bytes.Equal(k, last) {
+						k, v = c.Next()
+					}
+				}
+				for ; k != nil && bytes.HasPrefix(k, p) && len(chunk) < diskIteratorChunk; k, v = c.Next() {
+					if m := decodeMetadata(k, v); m != nil {
+						chunk = append(chunk, m)
+					}
+				}
+				done = k == nil || !bytes.HasPrefix(k, p)
+				return nil
+			})
+			if len(chunk) > 0 {
+				last = []byte(chunk[len(chunk)-1].Key)
+			}
+		}
+		if len(chunk) == 0 || (limit > 0 && count >= limit) {
+			return nil
+		}
+		m := chunk[0]
+		chunk = chunk[1:]
+		count++
+		return m
+	}
+}
@@ -21,10 +21,13 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/storage"
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/iterator"
@@ -62,9 +65,9 @@ func exit() {
 	os.Exit(1)
 }
 
-func getStorageClient() {
+func getStorageClient(ctx context.Context) {
 	var err error
-	client, err = storage.NewClient(context.Background())
+	client, err = storage.NewClient(ctx)
 	if err != nil {
 		log.Printf("Failed to create GCS client: %v", err)
 		exit()
@@ -72,9 +75,8 @@ func getStorageClient() {
 }
 
 // GetProject gets the GCP project ID from GCP crecentials.
-func getProject() string {
+func getProject(ctx context.Context) string {
 	log.Printf("Get project from GCP credentials.")
-	ctx := context.Background()
 	credentials, err :=
 		google.FindDefaultCredentials(ctx, compute.ComputeScope)
 	// TODO(leffler): Explain how to specify credentials.
@@ -92,8 +94,8 @@ func getProject() string {
 }
 
 // listBuckets lists buckets in a project.
-func listBuckets(projectID string) (buckets []string, err error) {
-	it := client.Buckets(context.Background(), projectID)
+func listBuckets(ctx context.Context, projectID string) (buckets []string, err error) {
+	it := client.Buckets(ctx, projectID)
 	for {
 		battrs, err := it.Next()
 		if err == iterator.Done {
@@ -113,8 +115,7 @@ func listBuckets(projectID string) (buckets []string, err error) {
 	return buckets, nil
 }
 
-func foundPrefixInGCS(project, bucket, prefix string) bool {
-	ctx := context.Background()
+func foundPrefixInGCS(ctx context.Context, project, bucket, prefix string) bool {
 	q := storage.Query{Prefix: prefix}
 	it := client.Bucket(bucket).Objects(ctx, &q)
 	_, err := it.Next()
@@ -128,9 +129,9 @@ func foundPrefixInGCS(project, bucket, prefix string) bool {
 	return true
 }
 
-func chooseProject(cfg *Config) {
+func chooseProject(ctx context.Context, cfg *Config) {
 	if cfg.Project == "" {
-		cfg.Project = getProject()
+		cfg.Project = getProject(ctx)
 	}
 	if cfg.Project == "" {
 		log.Printf("Failed to get project name. Please specify project with -project")
@@ -139,14 +140,14 @@ func chooseProject(cfg *Config) {
 }
 
 // checkBucket chooses an appropriate bucket to use for IPFS.
-func chooseBucket(cfg *Config) {
+func chooseBucket(ctx context.Context, cfg *Config) {
 	if cfg.Bucket == "" {
 		// List all available buckets in GCP project.
-		buckets, _ := listBuckets(cfg.Project)
+		buckets, _ := listBuckets(ctx, cfg.Project)
 		if len(buckets) > 0 {
 			// Pick any bucket with existing contents
 			for _, b := range buckets {
-				if foundPrefixInGCS(cfg.Project, b, cfg.Prefix) {
+				if foundPrefixInGCS(ctx, cfg.Project, b, cfg.Prefix) {
 					cfg.Bucket = b
 					return
 				}
@@ -162,8 +163,7 @@ func chooseBucket(cfg *Config) {
 }
 
 // checkBucket checks that the chosen bucket is writeable.
-func checkBucket(cfg *Config) {
-	ctx := context.Background()
+func checkBucket(ctx context.Context, cfg *Config) {
 	object := cfg.Prefix + "test"
 	o := client.Bucket(cfg.Bucket).Object(object)
 	w := o.NewWriter(ctx)
@@ -181,6 +181,15 @@ func checkBucket(cfg *Config) {
 	}
 }
 
+// diagnose runs the datastore's preflight checks and prints the report.
+func diagnose(ctx context.Context, cfg *Config) {
+	report := gcsds.Doctor(ctx, gcsds.Config{Bucket: cfg.Bucket, Prefix: cfg.Prefix})
+	log.Printf("Preflight checks:\n%s", report)
+	if !report.OK() {
+		exit()
+	}
+}
+
 func run(args []string, env ...string) {
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Env = append(cmd.Env, env...)
@@ -225,24 +234,31 @@ func startIPFS(cfg *Config) {
 
 func main() {
 	cfg := parseArgs()
-	getStorageClient()
+	// Stopping the container aborts the checks. The daemon handles signals
+	// itself.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	getStorageClient(ctx)
 
 	// 1. Choose a GCP project.
-	chooseProject(&cfg)
+	chooseProject(ctx, &cfg)
 	log.Printf("Using IPFS Path: '%v'", cfg.IpfsPath)
 	log.Printf("Using GCP project: '%v'", cfg.Project)
 
 	// 2. Choose a GCS bucket.
-	chooseBucket(&cfg)
+	chooseBucket(ctx, &cfg)
 	log.Printf("Using GCS bucket: '%v'", cfg.Bucket)
 
 	// 3. Check that GCS Bucket is writable.
-	checkBucket(&cfg)
+	checkBucket(ctx, &cfg)
 	log.Printf("GCS bucket %v is writeable.", cfg.Bucket)
 
-	// 4. Configure IPFS. Once only.
+	// 4. Check permissions, location and bucket settings.
+	diagnose(ctx, &cfg)
+	stop()
+
+	// 5. Configure IPFS. Once only.
 	configureIPFS(&cfg)
 
-	// 5. Start IPFS server.
+	// 6. Start IPFS server.
 	startIPFS(&cfg)
 }
@@ -0,0 +1,302 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+)
+
+// CheckStatus is the outcome of a Doctor check.
+type CheckStatus int
+
+const (
+	CheckOK CheckStatus = iota
+	CheckWarning
+	CheckFailed
+)
+
+func (s CheckStatus) String() string {
+	switch s {
+	case CheckOK:
+		return "OK"
+	case CheckWarning:
+		return "WARNING"
+	}
+	return "FAILED"
+}
+
+// Check is one finding of Doctor.
+type Check struct {
+	Name   string
+	Status CheckStatus
+	// Detail describes what was found.
+	Detail string
+	// Remedy says how to fix a warning or failure.
+	Remedy string
+}
+
+// Report is the result of Doctor.
+type Report struct {
+	Checks []Check
+}
+
+// OK reports whether no check failed. Warnings are OK.
+func (r *Report) OK() bool {
+	for _, c := range r.Checks {
+		if c.Status == CheckFailed {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) String() string {
+	var b strings.Builder
+	for _, c := range r.Checks {
+		fmt.Fprintf(&b, "[%s] %s: %s\n", c.Status, c.Name, c.Detail)
+		if c.Remedy != "" && c.Status != CheckOK {
+			fmt.Fprintf(&b, "    Fix: %s\n", c.Remedy)
+		}
+	}
+	return b.String()
+}
+
+func (r *Report) add(name string, status CheckStatus, detail, remedy string) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: status, Detail: detail, Remedy: remedy})
+}
+
+// Doctor checks that the environment can run a datastore with cfg:
+// credentials, bucket access and IAM permissions, bucket location relative
+// to the node, uniform bucket-level access, conflicting lifecycle rules, the
+// bucket layout, the KMS key and endpoint settings. Unlike NewGCSDatastore
+// it doesn't stop at the first problem, and it says how to fix each one.
+func Doctor(ctx context.Context, cfg Config) *Report {
+	r := &Report{}
+	emulator := os.Getenv("STORAGE_EMULATOR_HOST")
+	switch {
+	case cfg.Endpoint != "":
+		u, err := parseEndpoint(cfg.Endpoint)
+		if err != nil {
+			r.add("endpoint", CheckFailed, err.Error(), "Set the endpoint to the URL of the JSON API, ending in /storage/v1/.")
+			return r
+		}
+		if u.Scheme == "http" {
+			r.add("endpoint", CheckWarning, "Using the unauthenticated endpoint "+cfg.Endpoint+".",
+				"Use an https endpoint outside of development.")
+		} else {
+			r.add("endpoint", CheckOK, "Using the endpoint "+cfg.Endpoint+".", "")
+			doctorCredentials(ctx, cfg, r)
+		}
+	case emulator != "":
+		r.add("emulator", CheckWarning, "Using the storage emulator at "+emulator+".",
+			"Unset STORAGE_EMULATOR_HOST to use GCS.")
+	default:
+		doctorCredentials(ctx, cfg, r)
+	}
+
+	client, err := newClient(ctx, cfg, nil)
+	if err != nil {
+		r.add("client", CheckFailed, fmt.Sprintf("Failed to create GCS client: %v", err),
+			"Check the credential configuration.")
+		return r
+	}
+	defer client.Close()
+	gd := &GCSDatastore{Config: cfg, client: client}
+	attrs, err := client.Bucket(cfg.Bucket).Attrs(ctx)
+	if err == storage.ErrBucketNotExist {
+		r.add("bucket", CheckFailed, fmt.Sprintf("Bucket %s does not exist.", cfg.Bucket),
+			fmt.Sprintf("Create it: gcloud storage buckets create gs://%s --uniform-bucket-level-access", cfg.Bucket))
+		return r
+	}
+	if err != nil {
+		r.add("bucket", CheckFailed, fmt.Sprintf("Failed to get attributes of bucket %s: %v", cfg.Bucket, err),
+			"Grant the storage.buckets.get permission, e.g. with roles/storage.legacyBucketReader, and check the VM or node pool access scopes.")
+		return r
+	}
+	gd.bucketAttrs = attrs
+	r.add("bucket", CheckOK, fmt.Sprintf("Bucket %s in %s (%s).", cfg.Bucket, attrs.Location, attrs.LocationType), "")
+
+	doctorPermissions(ctx, gd, r)
+	doctorLocality(attrs, r)
+	if attrs.UniformBucketLevelAccess.Enabled {
+		r.add("uniform access", CheckOK, "Uniform bucket-level access is enabled.", "")
+	} else {
+		r.add("uniform access", CheckWarning, "The bucket uses fine-grained ACLs.",
+			fmt.Sprintf("gcloud storage buckets update gs://%s --uniform-bucket-level-access", cfg.Bucket))
+	}
+	doctorLifecycle(gd, r)
+	doctorLayout(ctx, gd, r)
+	doctorEncryption(gd, r)
+	if rp := attrs.RetentionPolicy; rp != nil {
+		r.add("retention", CheckWarning,
+			fmt.Sprintf("Objects are retained for %v. Deletes, including repo GC, fail until then.", rp.RetentionPeriod),
+			"Expected for archival deployments. Otherwise remove the retention policy.")
+	}
+	return r
+}
+
+func doctorLayout(ctx context.Context, gd *GCSDatastore, r *Report) {
+	found, _, err := gd.readLayout(ctx)
+	switch {
+	case err == storage.ErrObjectNotExist:
+		r.add("layout", CheckOK, "No layout manifest yet. It is written on start.", "")
+	case err != nil:
+		r.add("layout", CheckFailed, fmt.Sprintf("Failed to read the layout manifest gs://%s/%s: %v", gd.Config.Bucket, gd.layoutPath(), err),
+			"Grant the storage.objects.get permission, or remove a corrupt manifest.")
+	case found != gd.layout():
+		remedy := "Use the configuration the bucket was written with."
+		if _, ok := findMigration(found, gd.layout()); ok {
+			remedy += " Or enable MigrateLayout to migrate the bucket."
+		}
+		r.add("layout", CheckFailed, fmt.Sprintf("Bucket layout %+v does not match the configured layout %+v.", found, gd.layout()), remedy)
+	default:
+		r.add("layout", CheckOK, fmt.Sprintf("Bucket layout version %d.", found.Version), "")
+	}
+}
+
+func doctorEncryption(gd *GCSDatastore, r *Report) {
+	if gd.Config.KMSKeyName == "" {
+		return
+	}
+	if err := gd.checkKMSKey(); err != nil {
+		r.add("encryption", CheckFailed, err.Error(),
+			"Use a key in the bucket's location, named projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY.")
+		return
+	}
+	r.add("encryption", CheckOK, "Objects are encrypted with "+gd.Config.KMSKeyName+".", "")
+}
+
+func doctorCredentials(ctx context.Context, cfg Config, r *Report) {
+	switch {
+	case cfg.TokenSource != nil:
+		r.add("credentials", CheckOK, "Using the configured token source.", "")
+		return
+	case cfg.ImpersonateServiceAccount != "":
+		ts, err := impersonatedTokenSource(ctx, cfg, gcsScopes(cfg)...)
+		if err == nil {
+			_, err = ts.Token()
+		}
+		if err != nil {
+			r.add("credentials", CheckFailed, err.Error(),
+				"Grant roles/iam.serviceAccountTokenCreator on "+cfg.ImpersonateServiceAccount+" to the node's credentials.")
+			return
+		}
+		r.add("credentials", CheckOK, "Impersonating "+cfg.ImpersonateServiceAccount+".", "")
+		return
+	case cfg.CredentialsFile != "":
+		data, err := os.ReadFile(cfg.CredentialsFile)
+		if err == nil {
+			_, err = google.CredentialsFromJSON(ctx, data, gcsScopes(cfg)...)
+		}
+		if err != nil {
+			r.add("credentials", CheckFailed, fmt.Sprintf("Invalid credentials file %s: %v", cfg.CredentialsFile, err),
+				"Point the credentials file to a service account key, e.g. from `gcloud iam service-accounts keys create`.")
+			return
+		}
+		r.add("credentials", CheckOK, "Using credentials from "+cfg.CredentialsFile+".", "")
+		return
+	}
+	creds, err := google.FindDefaultCredentials(ctx, storage.ScopeReadWrite)
+	if err != nil {
+		r.add("credentials", CheckFailed, fmt.Sprintf("No default credentials: %v", err),
+			"On GCE and GKE, check the VM service account. Elsewhere set GOOGLE_APPLICATION_CREDENTIALS "+
+				"or run `gcloud auth application-default login`.")
+		return
+	}
+	detail := "Found default credentials."
+	if creds.ProjectID != "" {
+		detail = fmt.Sprintf("Found default credentials for project %s.", creds.ProjectID)
+	}
+	r.add("credentials", CheckOK, detail, "")
+}
+
+func doctorPermissions(ctx context.Context, gd *GCSDatastore, r *Report) {
+	missing, err := gd.missingPermissions(ctx)
+	if err != nil {
+		r.add("permissions", CheckWarning, fmt.Sprintf("Unable to test IAM permissions: %v", err),
+			"Make sure the credentials have "+strings.Join(RequiredPermissions, ", ")+".")
+		return
+	}
+	if len(missing) > 0 {
+		r.add("permissions", CheckFailed, "Missing "+strings.Join(missing, ", ")+".",
+			fmt.Sprintf("Grant roles/storage.objectAdmin on gs://%s. On GKE and GCE also check the "+
+				"storage read/write access scope.", gd.Config.Bucket))
+		return
+	}
+	r.add("permissions", CheckOK, "All required permissions granted.", "")
+}
+
+func doctorLocality(attrs *storage.BucketAttrs, r *Report) {
+	region := nodeRegion()
+	if region == "" {
+		r.add("locality", CheckOK, "Not running on GCE. Skipped.", "")
+		return
+	}
+	for _, br := range bucketRegions(attrs) {
+		if br == region {
+			r.add("locality", CheckOK, "The bucket stores data in the node's region "+region+".", "")
+			return
+		}
+	}
+	r.add("locality", CheckWarning,
+		fmt.Sprintf("The node runs in %s but the bucket is in %s. Reads cross regions.", region, attrs.Location),
+		"Run the node in the bucket's region, or configure a mirror bucket in "+region+".")
+}
+
+// doctorLifecycle flags lifecycle rules that act on objects under the
+// datastore prefix.
+func doctorLifecycle(gd *GCSDatastore, r *Report) {
+	conflicts := 0
+	for _, rule := range gd.bucketAttrs.Lifecycle.Rules {
+		if !lifecycleCoversPrefix(rule.Condition, gd.Config.Prefix) || isTTLLifecycleRule(rule) {
+			continue
+		}
+		switch {
+		case rule.Action.Type == storage.DeleteAction && rule.Condition.Liveness != storage.Archived:
+			conflicts++
+			r.add("lifecycle", CheckWarning,
+				fmt.Sprintf("A lifecycle rule deletes live objects under %q. Blocks disappear behind the datastore's back.", gd.Config.Prefix),
+				"Scope the rule to another prefix with matchesPrefix, or remove it.")
+		case rule.Action.Type == storage.SetStorageClassAction && (gd.Config.ArchiveAfter > 0 || gd.Config.ColdlineAfter > 0 || autoclassEnabled(gd.bucketAttrs)):
+			conflicts++
+			r.add("lifecycle", CheckWarning,
+				"A lifecycle rule changes storage classes, as does the archive policy or Autoclass.",
+				"Use one mechanism to manage storage classes.")
+		}
+	}
+	if conflicts == 0 {
+		r.add("lifecycle", CheckOK, "No conflicting lifecycle rules.", "")
+	}
+}
+
+// lifecycleCoversPrefix reports whether a rule with condition c can match
+// objects under prefix.
+func lifecycleCoversPrefix(c storage.LifecycleCondition, prefix string) bool {
+	if len(c.MatchesPrefix) == 0 {
+		return true
+	}
+	for _, p := range c.MatchesPrefix {
+		if strings.HasPrefix(prefix, p) || strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
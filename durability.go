@@ -0,0 +1,391 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Durability is when Put returns relative to the value reaching GCS.
+type Durability string
+
+const (
+	// DurabilityStrict returns once the value is stored in GCS.
+	DurabilityStrict Durability = "strict"
+	// DurabilityBuffered returns once the value is in the local write-ahead
+	// log, and uploads it in the background. Values survive a crash of the
+	// node, but not the loss of its disk.
+	DurabilityBuffered Durability = "buffered"
+	// DurabilityAsync returns immediately and uploads the value in the
+	// background. Values not yet uploaded are lost if the node crashes.
+	DurabilityAsync Durability = "async"
+)
+
+const (
+	// Pending uploads per worker before Put blocks.
+	uploadQueuePerWorker = 100
+	// Longest delay between retries of a failed upload.
+	maxUploadBackoff = 30 * time.Second
+	// How long Close waits for pending uploads, and then for releasing the
+	// lock and heartbeat.
+	closeFlushTimeout = time.Minute
+)
+
+// durability returns the mode for key: that of the longest configured
+// prefix of key, or strict.
+func (gd *GCSDatastore) durability(key string) Durability {
+	mode, longest := DurabilityStrict, -1
+	k := ds.RawKey(key)
+	for prefix, m := range gd.Config.Durability {
+		p := ds.NewKey(prefix)
+		if (k.Equal(p) || k.IsDescendantOf(p)) && len(p.String()) > longest {
+			mode, longest = m, len(p.String())
+		}
+	}
+	return mode
+}
+
+// checkDurability validates the configured modes.
+func (gd *GCSDatastore) checkDurability() error {
+	for prefix, m := range gd.Config.Durability {
+		switch m {
+		case DurabilityStrict, DurabilityAsync:
+		case DurabilityBuffered:
+			if gd.Config.WALDir == "" {
+				return fmt.Errorf("gcsds: durability %q for prefix %q requires WALDir", m, prefix)
+			}
+		default:
+			return fmt.Errorf("gcsds: unknown durability %q for prefix %q", m, prefix)
+		}
+	}
+	return nil
+}
+
+// pendingWrite is a value acknowledged to the writer but not yet uploaded.
+type pendingWrite struct {
+	value []byte
+	seq   uint64
+	// first is the seq of the earliest write of the key not yet in GCS,
+	// superseded by value. Writes before it are stored.
+	first uint64
+	// segment is the WAL segment holding the value, if buffered.
+	segment *walSegment
+}
+
+// uploadOp asks the upload workers to store the pending write of key.
+type uploadOp struct {
+	key string
+}
+
+// writeBehind tracks the values Put acknowledged before storing them.
+type writeBehind struct {
+	mu      sync.Mutex
+	seq     uint64
+	pending map[string]*pendingWrite
+	// uploading holds the keys being uploaded.
+	uploading map[string]bool
+	// changed is closed, and replaced, whenever a write completes.
+	changed chan struct{}
+	queue   chan uploadOp
+	wal     *wal
+}
+
+// startWriteBehind opens the WAL, if needed, and starts the upload workers.
+// Values left in the WAL by a previous run are uploaded first.
+func (gd *GCSDatastore) startWriteBehind() error {
+	if err := gd.checkDurability(); err != nil {
+		return err
+	}
+	wb := &writeBehind{
+		pending:   make(map[string]*pendingWrite),
+		uploading: make(map[string]bool),
+		changed:   make(chan struct{}),
+	}
+	needed := false
+	for _, m := range gd.Config.Durability {
+		needed = needed || m != DurabilityStrict
+	}
+	if !needed && gd.Config.WALDir == "" {
+		return nil
+	}
+	var recovered []walRecord
+	if gd.Config.WALDir != "" {
+		var err error
+		if wb.wal, recovered, err = openWAL(gd.Config.WALDir); err != nil {
+			return err
+		}
+	}
+	for _, r := range recovered {
+		wb.seq = r.seq
+		pw := &pendingWrite{value: r.value, seq: r.seq, first: r.seq, segment: r.segment}
+		if old, ok := wb.pending[r.key]; ok {
+			wb.wal.release(old.segment)
+			pw.first = old.first
+		}
+		wb.pending[r.key] = pw
+		gd.mdCache.Put(r.key, int64(len(r.value)))
+	}
+	wb.wal.dropUnused()
+	queueSize := uploadQueuePerWorker * gd.workers()
+	if len(wb.pending) > queueSize {
+		queueSize = len(wb.pending)
+	}
+	wb.queue = make(chan uploadOp, queueSize)
+	for key := range wb.pending {
+		wb.queue <- uploadOp{key: key}
+	}
+	if len(recovered) > 0 {
+		logger.Infof("Recovered %d pending writes from %s.", len(wb.pending), gd.Config.WALDir)
+	}
+	gd.writeBehind = wb
+	for i := 0; i < gd.workers(); i++ {
+		gd.background(gd.runUploads)
+	}
+	return nil
+}
+
+// putBehind acknowledges a Put of key before it is stored in GCS.
+func (gd *GCSDatastore) putBehind(ctx context.Context, key string, value []byte, mode Durability) error {
+	wb := gd.writeBehind
+	wb.mu.Lock()
+	wb.seq++
+	pw := &pendingWrite{value: value, seq: wb.seq, first: wb.seq}
+	if mode == DurabilityBuffered {
+		segment, err := wb.wal.append(walRecord{seq: pw.seq, key: key, value: value})
+		if err != nil {
+			wb.mu.Unlock()
+			logger.Warnw("Failed to append to WAL", "key", key, "err", err)
+			return err
+		}
+		pw.segment = segment
+	}
+	if old, ok := wb.pending[key]; ok {
+		wb.wal.release(old.segment)
+		pw.first = old.first
+	}
+	wb.pending[key] = pw
+	wb.mu.Unlock()
+
+	gd.forgetUnlisted(key)
+	gd.mdCache.Put(key, int64(len(value)))
+	gd.dataCache.Add(key, value)
+	gd.removeDisk(key)
+	gd.forgetMissing(key)
+	gd.stats.written.observe(len(value))
+	op := uploadOp{key: key}
+	select {
+	case wb.queue <- op:
+	case <-ctx.Done():
+		// The write is acknowledged by now, so it must be queued anyway.
+		gd.background(func(ctx context.Context) {
+			select {
+			case wb.queue <- op:
+			case <-ctx.Done():
+			}
+		})
+	}
+	return nil
+}
+
+// pendingValue returns the value of key if it's not uploaded yet.
+func (gd *GCSDatastore) pendingValue(key string) ([]byte, bool) {
+	wb := gd.writeBehind
+	if wb == nil {
+		return nil, false
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if pw, ok := wb.pending[key]; ok {
+		return pw.value, true
+	}
+	return nil, false
+}
+
+func (gd *GCSDatastore) runUploads(ctx context.Context) {
+	wb := gd.writeBehind
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case op := <-wb.queue:
+			gd.upload(ctx, op)
+		}
+	}
+}
+
+// upload stores the pending write of op.key, retrying until it succeeds or
+// the datastore is closed. Each key is uploaded by one worker at a time,
+// which uploads the latest value until none is pending, so an older value
+// never overwrites a newer one.
+func (gd *GCSDatastore) upload(ctx context.Context, op uploadOp) {
+	wb := gd.writeBehind
+	wb.mu.Lock()
+	pw, ok := wb.pending[op.key]
+	if !ok || wb.uploading[op.key] {
+		wb.mu.Unlock()
+		return
+	}
+	wb.uploading[op.key] = true
+	wb.mu.Unlock()
+	backoff := time.Second
+	for pw != nil {
+		if err := gd.writeObject(ctx, op.key, pw.value, time.Time{}); err != nil {
+			err = requestError("write", gd.GCSPath(op.key), err)
+			gd.stats.uploadErrors.Add(1)
+			logger.Warnw("Failed to upload pending write", "key", op.key, "retry", backoff, "err", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				wb.mu.Lock()
+				delete(wb.uploading, op.key)
+				wb.mu.Unlock()
+				return
+			}
+			if backoff *= 2; backoff > maxUploadBackoff {
+				backoff = maxUploadBackoff
+			}
+			continue
+		}
+		gd.setShared(ctx, op.key, pw.value)
+		wb.mu.Lock()
+		if wb.pending[op.key] == pw {
+			delete(wb.pending, op.key)
+			delete(wb.uploading, op.key)
+			wb.wal.release(pw.segment)
+			pw = nil
+		} else {
+			// Overwritten during the upload, so writes up to pw are stored.
+			uploaded := pw.seq
+			pw = wb.pending[op.key]
+			pw.first = uploaded + 1
+		}
+		close(wb.changed)
+		wb.changed = make(chan struct{})
+		wb.mu.Unlock()
+	}
+	if gd.Config.MirrorCopy {
+		gd.enqueueMirror(ctx, mirrorOp{key: op.key})
+	}
+}
+
+// waitPending waits until the writes acknowledged so far of the keys for
+// which match returns true are stored. Later writes aren't waited for, so
+// that steady writers can't delay it indefinitely.
+func (gd *GCSDatastore) waitPending(ctx context.Context, match func(key string) bool) error {
+	wb := gd.writeBehind
+	if wb == nil {
+		return nil
+	}
+	wb.mu.Lock()
+	last := wb.seq
+	wb.mu.Unlock()
+	for {
+		wb.mu.Lock()
+		pending := false
+		for key, pw := range wb.pending {
+			if pw.first <= last && match(key) {
+				pending = true
+				break
+			}
+		}
+		changed := wb.changed
+		wb.mu.Unlock()
+		if !pending {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-gd.ctx.Done():
+			return ErrClosed
+		}
+	}
+}
+
+// flushKey waits for a pending write of key, so that a direct write or
+// delete isn't overtaken by it.
+func (gd *GCSDatastore) flushKey(ctx context.Context, key string) error {
+	if _, ok := gd.pendingValue(key); !ok {
+		return nil
+	}
+	return gd.waitPending(ctx, func(k string) bool { return k == key })
+}
+
+// flushAll waits up to closeFlushTimeout for all pending writes.
+func (gd *GCSDatastore) flushAll() {
+	if gd.writeBehind == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closeFlushTimeout)
+	defer cancel()
+	if err := gd.waitPending(ctx, func(string) bool { return true }); err != nil {
+		gd.writeBehind.mu.Lock()
+		n := len(gd.writeBehind.pending)
+		gd.writeBehind.mu.Unlock()
+		logger.Warnf("Closing with %d writes not uploaded: %v", n, err)
+	}
+}
+
+// pendingMetadata returns the metadata of the pending writes under prefix,
+// whose values aren't stored in GCS yet.
+func (gd *GCSDatastore) pendingMetadata(prefix string) []*Metadata {
+	wb := gd.writeBehind
+	if wb == nil {
+		return nil
+	}
+	wb.mu.Lock()
+	keys := map[string]int64{}
+	for key, pw := range wb.pending {
+		if strings.HasPrefix(key, prefix) {
+			keys[key] = int64(len(pw.value))
+		}
+	}
+	wb.mu.Unlock()
+	entries := make([]*Metadata, 0, len(keys))
+	for key, size := range keys {
+		m, err := gd.mdCache.Get(key)
+		if err != nil {
+			m = &Metadata{Key: key, Size: size}
+		}
+		entries = append(entries, m)
+	}
+	return entries
+}
+
+// pendingUsage returns the number and size of pending writes.
+func (gd *GCSDatastore) pendingUsage() Usage {
+	u := Usage{}
+	if gd.writeBehind == nil {
+		return u
+	}
+	gd.writeBehind.mu.Lock()
+	defer gd.writeBehind.mu.Unlock()
+	for _, pw := range gd.writeBehind.pending {
+		u.Objects++
+		u.Bytes += int64(len(pw.value))
+	}
+	return u
+}
+
+// ErrClosed is returned by operations on a closed datastore.
+var ErrClosed = errors.New("gcsds: datastore closed")
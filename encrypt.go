@@ -0,0 +1,181 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+// Encryption schemes of values, see Config.EncryptionKey.
+const (
+	EncryptionNone      = "none"
+	EncryptionAES256GCM = "aes-256-gcm"
+)
+
+// encryption returns the configured scheme.
+func (gd *GCSDatastore) encryption() string {
+	if len(gd.Config.EncryptionKey) == 0 && gd.Config.EncryptionKMSKeyName == "" {
+		return EncryptionNone
+	}
+	return EncryptionAES256GCM
+}
+
+// initEncryption sets up the key values are encrypted with, if any.
+func (gd *GCSDatastore) initEncryption(ctx context.Context) error {
+	key := gd.Config.EncryptionKey
+	switch {
+	case len(key) != 0 && gd.Config.EncryptionKMSKeyName != "":
+		return fmt.Errorf("gcsds: both EncryptionKey and EncryptionKMSKeyName are set")
+	case gd.Config.EncryptionKMSKeyName != "":
+		if _, err := kmsKeyLocation(gd.Config.EncryptionKMSKeyName); err != nil {
+			return err
+		}
+		var err error
+		if key, err = gd.loadDataKey(ctx); err != nil {
+			logger.Warnf("Failed to load the data encryption key: %v", err)
+			return err
+		}
+	case len(key) == 0:
+		return nil
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("gcsds: encryption key of %d bytes, expected 32", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gd.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// seal encrypts the data stored for key. The nonce goes first, and the key
+// is authenticated so that objects can't be swapped.
+func (gd *GCSDatastore) seal(key string, data []byte) []byte {
+	nonce := make([]byte, gd.aead.NonceSize(), gd.aead.NonceSize()+len(data)+gd.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("gcsds: no randomness for a nonce: %v", err))
+	}
+	return gd.aead.Seal(nonce, nonce, data, []byte(key))
+}
+
+// open decrypts the data stored for key. Data that fails authentication is
+// ErrCorrupt.
+func (gd *GCSDatastore) open(key string, data []byte) ([]byte, error) {
+	if gd.aead == nil {
+		return nil, fmt.Errorf("gcsds: %s is encrypted, but no encryption key is configured", key)
+	}
+	if len(data) < gd.aead.NonceSize() {
+		return nil, fmt.Errorf("%w: encrypted value of %s is truncated", ErrCorrupt, key)
+	}
+	nonce, sealed := data[:gd.aead.NonceSize()], data[gd.aead.NonceSize():]
+	value, err := gd.aead.Open(nil, nonce, sealed, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: decrypting %s: %v", ErrCorrupt, key, err)
+	}
+	return value, nil
+}
+
+// decrypter returns a reader of the data stored encrypted in r for key.
+func (gd *GCSDatastore) decrypter(key string, r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err = gd.open(key, data)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// dataKeyPath returns the name of the object holding the data encryption
+// key wrapped by Config.EncryptionKMSKeyName, next to the prefix like the
+// layout manifest.
+func (gd *GCSDatastore) dataKeyPath() string {
+	return strings.TrimSuffix(path.Join(gd.Config.Prefix), "/") + ".datakey"
+}
+
+// loadDataKey unwraps the data encryption key of the datastore, first
+// generating and storing it if there is none.
+func (gd *GCSDatastore) loadDataKey(ctx context.Context) ([]byte, error) {
+	credOpts, err := credentialOptions(ctx, gd.Config, cloudkms.CloudkmsScope)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := cloudkms.NewService(ctx, credOpts...)
+	if err != nil {
+		return nil, err
+	}
+	keys := cloudkms.NewProjectsLocationsKeyRingsCryptoKeysService(svc)
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.dataKeyPath())
+	r, err := obj.NewReader(ctx)
+	if err == nil {
+		defer r.Close()
+		wrapped, err := io.ReadAll(r)
+		if err != nil {
+			return nil, requestError("read", obj.ObjectName(), err)
+		}
+		resp, err := keys.Decrypt(gd.Config.EncryptionKMSKeyName, &cloudkms.DecryptRequest{
+			Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+		}).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("gcsds: unwrapping the data key with %s: %w", gd.Config.EncryptionKMSKeyName, err)
+		}
+		return base64.StdEncoding.DecodeString(resp.Plaintext)
+	}
+	if err != storage.ErrObjectNotExist {
+		return nil, requestError("read", obj.ObjectName(), err)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	resp, err := keys.Encrypt(gd.Config.EncryptionKMSKeyName, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(key),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("gcsds: wrapping a data key with %s: %w", gd.Config.EncryptionKMSKeyName, err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	w := obj.If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	w.Write(wrapped)
+	err = w.Close()
+	if isPreconditionFailed(err) {
+		// Another node stored its key first.
+		return gd.loadDataKey(ctx)
+	}
+	if err != nil {
+		return nil, requestError("write", obj.ObjectName(), err)
+	}
+	logger.Infof("Generated a data encryption key wrapped by %s.", gd.Config.EncryptionKMSKeyName)
+	return key, nil
+}
@@ -0,0 +1,52 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"google.golang.org/api/option"
+)
+
+// parseEndpoint parses Config.Endpoint, a JSON API URL such as
+// "https://storage.example.p.googleapis.com/storage/v1/".
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("gcsds: endpoint %q is not an http or https URL", endpoint)
+	}
+	return u, nil
+}
+
+// endpointOptions returns the client options for Config.Endpoint, and
+// whether requests are authenticated. Requests to plain http endpoints,
+// such as fake-gcs-server, aren't, so as not to send tokens in the clear,
+// nor are requests to STORAGE_EMULATOR_HOST.
+func endpointOptions(cfg Config) ([]option.ClientOption, bool, error) {
+	if cfg.Endpoint == "" {
+		return nil, os.Getenv("STORAGE_EMULATOR_HOST") == "", nil
+	}
+	u, err := parseEndpoint(cfg.Endpoint)
+	if err != nil {
+		return nil, false, err
+	}
+	opts := []option.ClientOption{option.WithEndpoint(cfg.Endpoint)}
+	if u.Scheme == "http" {
+		return append(opts, option.WithoutAuthentication()), false, nil
+	}
+	return opts, true, nil
+}
@@ -0,0 +1,198 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Keys is how object names are derived from keys, recorded in the Layout.
+const (
+	// KeysPrefix appends keys to the Prefix as they are.
+	KeysPrefix = "prefix"
+	// KeysEscaped appends keys to the Prefix escaped by escapeKey.
+	KeysEscaped = "escaped"
+)
+
+// maxNameSegment is the length of the longest segment of an escaped object
+// name. Longer segments are split, for tools mapping names to files.
+const maxNameSegment = 255
+
+// escapedBytes are the bytes escaped besides control characters, which GCS
+// recommends against in object names.
+const escapedBytes = "%#[]*?"
+
+// escapeKey returns key with the bytes that are invalid or awkward in
+// object names escaped as %XX, like invalid UTF-8, control characters and
+// "." and ".." segments. Segments longer than maxNameSegment are split,
+// each part but the last ending in an unescaped "%". unescapeKey reverses
+// it.
+func escapeKey(key string) string {
+	segments := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	var b strings.Builder
+	for _, seg := range segments {
+		b.WriteByte('/')
+		seg = escapeSegment(seg)
+		for len(seg) > maxNameSegment {
+			cut := maxNameSegment - 1
+			// Escapes and UTF-8 sequences aren't split.
+			if seg[cut-1] == '%' {
+				cut--
+			} else if seg[cut-2] == '%' {
+				cut -= 2
+			}
+			for !utf8.RuneStart(seg[cut]) {
+				cut--
+			}
+			b.WriteString(seg[:cut])
+			b.WriteString("%/")
+			seg = seg[cut:]
+		}
+		b.WriteString(seg)
+	}
+	return b.String()
+}
+
+// escapeSegment escapes a segment of a key.
+func escapeSegment(seg string) string {
+	switch seg {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	var b strings.Builder
+	for i := 0; i < len(seg); {
+		r, size := utf8.DecodeRuneInString(seg[i:])
+		if r == utf8.RuneError && size == 1 || r < 0x20 || r == 0x7f || strings.ContainsRune(escapedBytes, r) {
+			fmt.Fprintf(&b, "%%%02X", seg[i])
+		} else {
+			b.WriteString(seg[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// unescapeKey returns the key escaped by escapeKey.
+func unescapeKey(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i+2 < len(name) && isHex(name[i+1]) && isHex(name[i+2]) {
+			b.WriteByte(unhex(name[i+1])<<4 | unhex(name[i+2]))
+			i += 2
+			continue
+		}
+		// A split segment continues after the slash.
+		if i+1 < len(name) && name[i+1] == '/' {
+			i++
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'A' <= c && c <= 'F' || 'a' <= c && c <= 'f'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// objectName returns the name of the object for key, escaped or not.
+func (gd *GCSDatastore) objectName(key string, escape bool) string {
+	return path.Join(gd.Config.Prefix, gd.relativeName(key, escape))
+}
+
+// relativeName returns the name of the object for key relative to the
+// prefix, escaped or not.
+func (gd *GCSDatastore) relativeName(key string, escape bool) string {
+	if escape {
+		key = escapeKey(key)
+	}
+	if gd.shard != nil {
+		return gd.shardPath(key)
+	}
+	return key
+}
+
+// escapeNames renames the objects written before keys were escaped, whose
+// names differ once escaped.
+func escapeNames(ctx context.Context, gd *GCSDatastore) error {
+	bkt := gd.client.Bucket(gd.Config.Bucket)
+	// names maps the objects to rename to their new names.
+	names := map[string]string{}
+	it := bkt.Objects(ctx, &storage.Query{Prefix: gd.listPrefix()})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return requestError("list", gd.listPrefix(), err)
+		}
+		name := attrs.Name
+		if gd.shard != nil {
+			name = unshard(name)
+		}
+		key := "/" + strings.TrimPrefix(strings.TrimPrefix(name, gd.Config.Prefix), "/")
+		if escaped := gd.objectName(key, true); escaped != attrs.Name {
+			names[attrs.Name] = escaped
+		}
+	}
+	// Escaping only makes names longer, so renaming the longest first
+	// never overwrites an object still to rename.
+	old := make([]string, 0, len(names))
+	for name := range names {
+		old = append(old, name)
+	}
+	sort.Slice(old, func(i, j int) bool { return len(old[i]) > len(old[j]) })
+	for _, name := range old {
+		src := bkt.Object(name)
+		attrs, err := src.Attrs(ctx)
+		if err != nil {
+			return requestError("stat", name, err)
+		}
+		copier := gd.newCopier(bkt.Object(names[name]), src.Generation(attrs.Generation))
+		copier.ObjectAttrs = rewriteAttrs(attrs)
+		if _, err := copier.Run(ctx); err != nil {
+			return requestError("copy", name, err)
+		}
+		if err := src.Generation(attrs.Generation).Delete(ctx); err != nil {
+			return requestError("delete", name, err)
+		}
+	}
+	logger.Infof("Escaped the names of %d objects.", len(old))
+	return nil
+}
@@ -0,0 +1,102 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"net/http"
+	"path"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// fallbackPath returns the name of the object for key in the
+// FallbackBucket.
+func (gd *GCSDatastore) fallbackPath(key string) string {
+	return path.Join(gd.Config.FallbackPrefix, gd.relativeName(key, true))
+}
+
+// fallbackObject returns the object for key in the FallbackBucket.
+func (gd *GCSDatastore) fallbackObject(key string) *storage.ObjectHandle {
+	return gd.retryer(gd.readClient.Bucket(gd.Config.FallbackBucket).Object(gd.fallbackPath(key)), key)
+}
+
+// openFallback opens the value of key in the FallbackBucket like
+// openValue.
+func (gd *GCSDatastore) openFallback(ctx context.Context, key string, offset, length int64) (*objectReader, error) {
+	r, err := gd.openObject(ctx, gd.fallbackObject(key), key, offset, length, true)
+	if err == nil {
+		gd.stats.fallbackReads.Add(1)
+	}
+	return r, err
+}
+
+// statFallback gets the metadata of key from the FallbackBucket. It isn't
+// cached, since the key isn't in Bucket.
+func (gd *GCSDatastore) statFallback(ctx context.Context, key string) (*Metadata, error) {
+	attrs, err := gd.fallbackObject(key).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, requestError("stat", gd.fallbackPath(key), err)
+	}
+	m := objectMetadata(key, attrs)
+	return &m, nil
+}
+
+// fallbackHas reports whether key, missing from the loaded metadata, is in
+// the FallbackBucket.
+func (gd *GCSDatastore) fallbackHas(ctx context.Context, key string) (bool, error) {
+	if gd.knownMissing(key) {
+		return false, nil
+	}
+	md, err := gd.statFallback(ctx, key)
+	if err == ds.ErrNotFound {
+		gd.rememberMissing(key)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !expired(md.Expiration), nil
+}
+
+// hasFallback sets has[i] for the keys missing from Bucket that are in the
+// FallbackBucket, with one request per 100 keys.
+func (gd *GCSDatastore) hasFallback(ctx context.Context, keys []ds.Key, has []bool) error {
+	var calls []batchCall
+	var missing []int
+	for i, k := range keys {
+		if !has[i] {
+			calls = append(calls, objectCall(http.MethodGet, gd.Config.FallbackBucket, gd.fallbackPath(k.String()), "fields=name"))
+			missing = append(missing, i)
+		}
+	}
+	for j, err := range gd.batch.do(ctx, calls) {
+		i := missing[j]
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			err = requestError("stat", gd.fallbackPath(keys[i].String()), err)
+			logger.Warnw("Failed to check fallback object", "key", keys[i], "err", err)
+			return err
+		}
+		has[i] = true
+	}
+	return nil
+}
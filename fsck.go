@@ -0,0 +1,165 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/boxo/blockstore"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// FsckOptions configure Fsck.
+type FsckOptions struct {
+	// Prefix is the key prefix of the blocks to check, "/blocks" by
+	// default.
+	Prefix string
+	// Quarantine, if set, is the object name prefix corrupt blocks are
+	// moved to before they're deleted, to be inspected later. Like
+	// Config.TrashPrefix, it must be outside Config.Prefix.
+	Quarantine string
+	// Delete deletes corrupt blocks. Without Delete or Quarantine, they
+	// are only reported.
+	Delete bool
+}
+
+// FsckResult reports what Fsck found.
+type FsckResult struct {
+	// Checked is the number of values read.
+	Checked int
+	// Corrupt are the keys, in order, of the blocks whose value doesn't
+	// match the multihash in their key, or fails its CRC32C or decoding.
+	Corrupt []string
+}
+
+// Fsck reads every block under opts.Prefix, recomputes its multihash, and
+// reports those that don't match the multihash in their key, e.g. after a
+// bug or an operator wrote to the bucket. Unlike Scrub it only checks
+// blocks, including packed ones, and can quarantine the corrupt ones.
+// Values not uploaded yet are skipped. The metadata must be loaded.
+func (gd *GCSDatastore) Fsck(ctx context.Context, opts FsckOptions) (FsckResult, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = blockstore.BlockPrefix.String()
+	}
+	if opts.Quarantine != "" && strings.HasPrefix(opts.Quarantine, gd.Config.Prefix) {
+		return FsckResult{}, fmt.Errorf("gcsds: quarantine prefix %q must not be within prefix %q",
+			opts.Quarantine, gd.Config.Prefix)
+	}
+	var res FsckResult
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, gd.workers())
+	var wg sync.WaitGroup
+	keys, keysErr := gd.AllKeys(ctx, queryPrefix(opts.Prefix))
+	for k := range keys {
+		key := k.String()
+		if _, ok := gd.pendingValue(key); ok {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			err := gd.fsckValue(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == ds.ErrNotFound {
+				// Deleted since it was listed.
+				return
+			}
+			res.Checked++
+			if errors.Is(err, ErrCorrupt) {
+				logger.Warnw("Fsck found corrupt block", "key", key, "err", err)
+				res.Corrupt = append(res.Corrupt, key)
+			} else if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = keysErr()
+	}
+	sort.Strings(res.Corrupt)
+	logger.Infof("Checked %d blocks: %d corrupt.", res.Checked, len(res.Corrupt))
+	if firstErr != nil || (opts.Quarantine == "" && !opts.Delete) {
+		return res, firstErr
+	}
+	for _, key := range res.Corrupt {
+		if opts.Quarantine != "" {
+			if err := gd.quarantine(ctx, key, opts.Quarantine); err != nil {
+				return res, err
+			}
+		}
+		if err := gd.Delete(ctx, ds.RawKey(key)); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// fsckValue reads the value of key from GCS, bypassing the caches, and
+// checks it against the multihash in key. A failed check is ErrCorrupt.
+func (gd *GCSDatastore) fsckValue(ctx context.Context, key string) error {
+	r, err := gd.openValue(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := readAll(r)
+	if isBadCRC(err) || errors.Is(err, ErrCorrupt) {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if err != nil {
+		return requestError("read", gd.GCSPath(key), err)
+	}
+	if err := VerifyMultihash(ds.RawKey(key), data); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return nil
+}
+
+// quarantine copies the object for key under the prefix quarantine, or
+// writes the value of a packed key there.
+func (gd *GCSDatastore) quarantine(ctx context.Context, key, quarantine string) error {
+	dst := path.Join(quarantine, escapeKey(key))
+	if _, ok := gd.packs.lookup(key); !ok {
+		if err := gd.copyObject(ctx, key, dst); err != nil {
+			return requestError("copy", gd.GCSPath(key), err)
+		}
+		return nil
+	}
+	r, err := gd.openValue(ctx, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w := gd.client.Bucket(gd.Config.Bucket).Object(dst).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return requestError("write", dst, err)
+	}
+	if err := w.Close(); err != nil {
+		return requestError("write", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	defaultRedirectExpiry = 15 * time.Minute
+	rawBlockContentType   = "application/vnd.ipld.raw"
+)
+
+// RedirectOptions configure RedirectHandler.
+type RedirectOptions struct {
+	// Expiry is how long signed URLs stay valid. Defaults to 15 minutes.
+	Expiry time.Duration
+	// MinSize is the smallest block, in bytes, worth redirecting. Smaller
+	// blocks are cheaper to serve directly than to redirect.
+	MinSize int64
+	// GoogleAccessID and PrivateKey (PEM) sign URLs when the client's
+	// credentials can't sign on their own. Optional.
+	GoogleAccessID string
+	PrivateKey     []byte
+}
+
+// RedirectHandler returns middleware for an IPFS gateway that answers raw
+// block requests (/ipfs/<cid>?format=raw, or Accept: application/vnd.ipld.raw)
+// with a 302 to a signed GCS URL, so block bytes don't flow through the node.
+// Blocks not known to the metadata cache, expired or stored in packs, and
+// all other requests, are passed to next.
+//
+// Block keys are expected at the datastore root, as when the datastore is
+// mounted at /blocks in kubo. Nothing is redirected if values are
+// encrypted or compressed with zstd, which clients can't decode.
+func (gd *GCSDatastore) RedirectHandler(next http.Handler, opts RedirectOptions) http.Handler {
+	if opts.Expiry <= 0 {
+		opts.Expiry = defaultRedirectExpiry
+	}
+	layout := gd.layout()
+	redirect := layout.Encryption == EncryptionNone && layout.Compression != CompressionZstd
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := rawBlockRequest(r)
+		if !ok || !redirect {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := dshelp.MultihashToDsKey(c.Hash()).String()
+		md, err := gd.mdCache.Get(key)
+		if err != nil || md.Size < opts.MinSize || gd.packs.has(key) || expired(md.Expiration) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		url, err := gd.client.Bucket(gd.Config.Bucket).SignedURL(gd.GCSPath(key), &storage.SignedURLOptions{
+			GoogleAccessID: opts.GoogleAccessID,
+			PrivateKey:     opts.PrivateKey,
+			Method:         r.Method,
+			Expires:        time.Now().Add(opts.Expiry),
+			Scheme:         storage.SigningSchemeV4,
+			QueryParameters: map[string][]string{
+				"response-content-type": {rawBlockContentType},
+			},
+		})
+		if err != nil {
+			logger.Warnw("Failed to sign URL. Serving block directly", "key", key, "err", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, url, http.StatusFound)
+	})
+}
+
+// rawBlockRequest returns the CID of a gateway request for a single raw block.
+func rawBlockRequest(r *http.Request) (cid.Cid, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return cid.Undef, false
+	}
+	if r.URL.Query().Get("format") != "raw" &&
+		!strings.Contains(r.Header.Get("Accept"), rawBlockContentType) {
+		return cid.Undef, false
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/ipfs/")
+	if p == r.URL.Path {
+		return cid.Undef, false
+	}
+	p = strings.TrimSuffix(p, "/")
+	if strings.Contains(p, "/") {
+		// A path within a DAG, not a single block.
+		return cid.Undef, false
+	}
+	c, err := cid.Decode(p)
+	if err != nil {
+		return cid.Undef, false
+	}
+	return c, true
+}
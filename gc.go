@@ -0,0 +1,120 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/iterator"
+)
+
+var _ ds.GCDatastore = (*GCSDatastore)(nil)
+
+// Heartbeats of nodes dead for this long are removed by CollectGarbage.
+const deadNodeRetention = 24 * time.Hour
+
+// ErrMetadataNotLoaded is returned by operations that need the metadata of
+// all objects before LoadMetadata completed.
+var ErrMetadataNotLoaded = errors.New("gcsds: metadata not loaded")
+
+// CollectGarbage deletes the objects under the prefix that hold no value:
+// expired values, and objects missing from the metadata cache that were
+// created before the metadata was loaded, such as leftovers of writes that
+// failed halfway. Objects created since, possibly by other nodes, are kept.
+// It also removes the heartbeats of nodes dead for a day. The metadata must
+// be loaded.
+func (gd *GCSDatastore) CollectGarbage(ctx context.Context) error {
+	if err := gd.checkWritable(); err != nil {
+		return err
+	}
+	gd.loadMu.Lock()
+	loadedFrom := gd.loadedFrom
+	gd.loadMu.Unlock()
+	if loadedFrom.IsZero() {
+		return ErrMetadataNotLoaded
+	}
+	garbage := []*storage.ObjectAttrs{}
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, &storage.Query{Prefix: gd.listPrefix()})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return requestError("list", gd.listPrefix(), err)
+		}
+		orphan := attrs.Created.Before(loadedFrom) && !gd.mdCache.Has(gd.keyOf(attrs.Name))
+		if orphan || expired(objectExpiration(attrs)) {
+			garbage = append(garbage, attrs)
+		}
+	}
+	// Don't delete objects rewritten since they were listed.
+	calls := make([]batchCall, len(garbage))
+	for i, attrs := range garbage {
+		calls[i] = objectCall(http.MethodDelete, gd.Config.Bucket, attrs.Name,
+			fmt.Sprintf("ifGenerationMatch=%d", attrs.Generation))
+	}
+	var first error
+	deleted := 0
+	for i, err := range gd.batch.do(ctx, calls) {
+		key := gd.keyOf(garbage[i].Name)
+		if isPreconditionFailed(err) {
+			continue
+		}
+		if err != nil && !isNotFound(err) {
+			err = requestError("delete", garbage[i].Name, err)
+			logger.Warnw("Failed to delete garbage object", "key", key, "err", err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		gd.deleted(ctx, key)
+		deleted++
+	}
+	if deleted > 0 {
+		logger.Infof("Collected %d garbage objects.", deleted)
+	}
+	if err := gd.removeDeadNodes(ctx); err != nil && first == nil {
+		first = err
+	}
+	return first
+}
+
+// removeDeadNodes deletes the heartbeats of nodes not seen for
+// deadNodeRetention.
+func (gd *GCSDatastore) removeDeadNodes(ctx context.Context) error {
+	nodes, err := gd.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		if time.Since(n.LastSeen) < deadNodeRetention {
+			continue
+		}
+		err := gd.client.Bucket(gd.Config.Bucket).Object(gd.heartbeatDir() + n.Node).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+		logger.Infof("Removed heartbeat of node %s, last seen %s.", n.Node, n.LastSeen.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -17,219 +17,1376 @@ package gcsds
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
 	lru "github.com/hashicorp/golang-lru"
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 var _ ds.Datastore = (*GCSDatastore)(nil)
 
+// Content types of the objects of values, see Config.ContentType.
+const (
+	DefaultContentType = "application/octet-stream"
+	ContentTypeDetect  = "detect"
+)
+
 type Config struct {
 	Bucket         string
 	Prefix         string
 	Workers        int
 	DataCacheItems int
+	// Endpoint, if set, is the URL of the GCS JSON API to use, such as
+	// "https://storage-ENDPOINT.p.googleapis.com/storage/v1/" for Private
+	// Service Connect, or "http://localhost:4443/storage/v1/" for
+	// fake-gcs-server. Requests to http endpoints aren't authenticated.
+	// STORAGE_EMULATOR_HOST also selects an emulator.
+	Endpoint string
+	// DataCacheMaxBytes bounds the total size of the values in the data
+	// cache. 0 only bounds their number, by DataCacheItems.
+	DataCacheMaxBytes int64
+	// DataCacheMaxValueSize is the largest value, in bytes, admitted to the
+	// data cache. 0 means no limit.
+	DataCacheMaxValueSize int
+	// DiskCacheDir, if set, is the directory of a cache of values on local
+	// disk, consulted after the data cache. Unlike the data cache, it
+	// survives restarts. See DiskCache.
+	DiskCacheDir string
+	// DiskCacheMaxBytes bounds the total size of the disk cache. 0 means
+	// DefaultDiskCacheMaxBytes.
+	DiskCacheMaxBytes int64
+	// DataCacheAdmission enables the frequency-based admission filter.
+	DataCacheAdmission bool
+	// SkipExistingBlocks makes Put skip blocks that are already stored,
+	// which have the same content since blocks are content-addressed.
+	// Blocks in the metadata cache aren't uploaded again, and others are
+	// written only if missing, so they aren't overwritten.
+	SkipExistingBlocks bool
+	// VerifyPut checks that block values hash to the multihash in their key
+	// before uploading them.
+	VerifyPut bool
+	// ArchiveAfter moves objects not read for this long to the ARCHIVE
+	// storage class. 0 disables archiving.
+	ArchiveAfter time.Duration
+	// ColdlineAfter moves objects not read for this long, shorter than
+	// ArchiveAfter, to the COLDLINE storage class. 0 disables it. Objects
+	// moved again within 90 days, Coldline's minimum storage duration,
+	// incur early deletion charges.
+	ColdlineAfter time.Duration
+	// ArchiveReadTimeout bounds reads of archived objects. 0 means no
+	// timeout beyond the caller's.
+	ArchiveReadTimeout time.Duration
+	// RestoreOnRead moves objects in COLDLINE or ARCHIVE back to STANDARD
+	// when read.
+	RestoreOnRead bool
+	// Autoclass recommends enabling Autoclass on buckets without it.
+	Autoclass bool
+	// EnableAutoclass enables Autoclass on the bucket if it's off, which
+	// requires permission to update the bucket.
+	EnableAutoclass bool
+	// TurboReplication enables turbo replication on a dual-region bucket
+	// without it, which requires permission to update the bucket.
+	// RequireTurboReplication fails to start unless the bucket has it, for
+	// nodes whose recovery point objective depends on it.
+	TurboReplication        bool
+	RequireTurboReplication bool
+	// RegionalEndpoint is the GCS endpoint to read from when the node runs
+	// in one of the bucket's regions. "%s" is replaced by the node region.
+	RegionalEndpoint string
+	// MirrorBucket, if set, serves reads of the keys in the metadata
+	// cache whose mirror object has the cached size. Other keys, keys with
+	// a pending MirrorCopy, and keys missing from the mirror are read from
+	// Bucket. Writes always go to Bucket.
+	MirrorBucket string
+	// FallbackBucket, if set, is read when a key is missing from Bucket,
+	// e.g. a shared snapshot under a private bucket, or the old bucket of a
+	// staged migration. It is never written to. Its objects are under
+	// FallbackPrefix, in the same layout. Has and GetSize check it for keys
+	// missing from the metadata, which costs a request per key until
+	// NegativeCacheTTL remembers it missing.
+	FallbackBucket string
+	FallbackPrefix string
+	// MirrorCopy copies writes and deletes to MirrorBucket in the
+	// background. Leave unset if the mirror is maintained externally, e.g.
+	// by Storage Transfer Service.
+	MirrorCopy bool
+	// QueryReadAhead is the number of values fetched ahead of the consumer
+	// by queries that return values. 0 fetches each value when asked for.
+	QueryReadAhead int
+	// MaxBytes caps the total size of stored values. Put fails with a
+	// QuotaError beyond it. 0 means no limit.
+	MaxBytes int64
+	// MaxObjects caps the number of stored values. 0 means no limit.
+	MaxObjects int64
+	// Quotas limit the values stored under specific key prefixes.
+	Quotas []Quota
+	// TrashPrefix, if set, is where Delete copies objects before deleting
+	// them, so they can be recovered. It must be outside Prefix.
+	TrashPrefix string
+	// KMSKeyName, if set, is the Cloud KMS key that encrypts the objects
+	// written, as "projects/PROJECT/locations/LOCATION/keyRings/RING/
+	// cryptoKeys/KEY". It must be in the bucket's location, and the GCS
+	// service agent of the project needs permission to use it. Without it,
+	// objects use the bucket's default key, if any.
+	KMSKeyName string
+	// RetryInitialBackoff, RetryMaxBackoff and RetryMultiplier shape the
+	// exponential backoff between attempts of failed requests. Zero values
+	// keep the client library defaults: 1s, 30s and 2.
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryMultiplier     float64
+	// RetryMaxAttempts bounds the attempts of reads, writes and deletes of
+	// values. 0 retries until the request's context is done.
+	RetryMaxAttempts int
+	// RetryBlockWrites retries failed writes and deletes of blocks, which
+	// are idempotent since blocks are content-addressed. The client library
+	// only retries writes with preconditions, see SkipExistingBlocks.
+	RetryBlockWrites bool
+	// RetryAlways retries all failed requests, including writes of values
+	// other than blocks, which may then overwrite a concurrent write.
+	RetryAlways bool
+	// MaxRequestsPerSecond, if positive, limits the rate of GCS requests,
+	// so that bursts such as reprovides or large adds stay under the
+	// project's quotas instead of getting 429 responses.
+	MaxRequestsPerSecond float64
+	// MaxConcurrentRequests, if positive, limits the GCS requests in
+	// flight. Requests over either limit wait for their turn.
+	MaxConcurrentRequests int
+	// TokenSource, if set, authenticates requests instead of Application
+	// Default Credentials, e.g. with downscoped or federated tokens. It
+	// can't be set from the plugin configuration.
+	TokenSource oauth2.TokenSource
+	// CredentialsFile, if set, is a service account key or other JSON
+	// credentials file to use instead of Application Default Credentials.
+	CredentialsFile string
+	// ImpersonateServiceAccount, if set, is the email of a service account
+	// to act as. The credentials need roles/iam.serviceAccountTokenCreator
+	// on it.
+	ImpersonateServiceAccount string
+	// Scopes are the OAuth scopes requested for GCS. The default is full
+	// control, which updating the bucket for TTLLifecycle, GCLifecycleDays
+	// and EnableAutoclass needs; devstorage.read_write is enough otherwise.
+	Scopes []string
+	// SharedCache, if set, is a cache shared with other nodes serving the
+	// bucket, consulted after the data cache. See NewRedisCache.
+	SharedCache SharedCache
+	// WriterLock makes the datastore hold the writer lock on Prefix while
+	// open, see AcquireLock. Opening fails while another writer holds it,
+	// and writes fail if it is lost.
+	WriterLock bool
+	// WriterLockTTL is how long the lock survives the writer. 0 means
+	// DefaultLockTTL.
+	WriterLockTTL time.Duration
+	// Durability maps key prefixes to when Put returns. The mode of the
+	// longest prefix of a key applies, and DurabilityStrict if none.
+	Durability map[string]Durability
+	// WALDir is the directory of the write-ahead log of buffered writes.
+	// Writes left there by a previous run are uploaded on start.
+	WALDir string
+	// MetadataIndexPath, if set, keeps the metadata in a database file on
+	// local disk instead of in RAM, for buckets with too many objects.
+	MetadataIndexPath string
+	// LazyMetadata is for datastores that don't load the metadata of all
+	// objects before serving, or at all. Until a load completes, Has and
+	// GetSize look up keys missing from the metadata cache in GCS and
+	// cache them, and Query lists GCS rather than wait for the load.
+	LazyMetadata bool
+	// MetadataSnapshot saves the metadata cache to an object next to the
+	// prefix on Close, and every MetadataSnapshotInterval, so that the
+	// next start can serve from it while the bucket is listed. See
+	// LoadMetadataSnapshot.
+	MetadataSnapshot bool
+	// MetadataSnapshotInterval is how often to save a metadata snapshot
+	// while open. 0 only saves on Close.
+	MetadataSnapshotInterval time.Duration
+	// MetadataRefreshInterval is how often to list the bucket again once
+	// the metadata is loaded, so that objects written and deleted by other
+	// nodes are added to and removed from the metadata cache. 0 never
+	// refreshes. See RefreshMetadata.
+	MetadataRefreshInterval time.Duration
+	// NotificationSubscription, if set, is a Pub/Sub subscription, as
+	// "projects/PROJECT/subscriptions/NAME", to the notifications of the
+	// bucket. Objects written and deleted by other nodes are updated in
+	// the caches as they are notified. Each node needs a subscription of
+	// its own.
+	NotificationSubscription string
+	// BloomFilterKeys, if set, puts a bloom filter sized for this many
+	// keys in front of the metadata index, which answers Has for missing
+	// keys without consulting the index. It's mostly useful with
+	// MetadataIndexPath.
+	BloomFilterKeys int
+	// BloomFilterFPRate is the false positive rate of the bloom filter
+	// with BloomFilterKeys keys. 0 means DefaultBloomFilterFPRate.
+	BloomFilterFPRate float64
+	// Heartbeat maintains a heartbeat object for this node next to the
+	// prefix, and warns when another node writes to the same prefix.
+	Heartbeat bool
+	// HeartbeatTTL is how long a node is considered live after its last
+	// heartbeat. 0 means DefaultHeartbeatTTL.
+	HeartbeatTTL time.Duration
+	// ReadOnlyOnConflict makes the node that started later read-only when
+	// two live writers are detected.
+	ReadOnlyOnConflict bool
+	// ScrubRepair makes Scrub delete the corrupt objects it finds, so that
+	// kubo fetches the blocks again, rather than only report them.
+	ScrubRepair bool
+	// StrictHas makes Has check GCS for keys missing from the metadata
+	// cache, such as blocks written by other nodes since the metadata was
+	// loaded, rather than report them missing.
+	StrictHas bool
+	// NegativeCacheTTL is how long Has, GetSize and Get remember that a
+	// key is missing from GCS, so that repeated requests for blocks the
+	// node doesn't have, e.g. from bitswap, are answered from memory.
+	// Writes by other nodes are seen after up to this long. 0 checks GCS
+	// every time.
+	NegativeCacheTTL time.Duration
+	// TTLLifecycle adds a lifecycle rule to the bucket that deletes values
+	// written with PutWithTTL a day or two after they expired.
+	TTLLifecycle bool
+	// MigrateLayout migrates the objects of a bucket in an older layout on
+	// start, rather than refusing to start. See Layout.
+	MigrateLayout bool
+	// Compression, if "gzip" or "zstd", compresses values of at least
+	// CompressionMinSize bytes, DefaultCompressionMinSize if 0, before
+	// upload, when that makes them smaller. The codec is recorded in the
+	// object's Content-Encoding, and values are decompressed on read
+	// whatever the configuration. Compressing the values of an existing
+	// bucket, or changing the codec, needs MigrateLayout, which leaves the
+	// values already stored as they are; it can't be turned off again.
+	Compression        string
+	CompressionMinSize int
+	// CompressionLevel is the level of the codec, 1 to 9 for gzip and 1 to
+	// 22 for zstd. 0 is the codec's default.
+	CompressionLevel int
+	// EncryptionKey, if set, is a 32-byte key that values are encrypted
+	// with, with AES-256-GCM, after compression and before upload, so that
+	// their data is opaque to whoever can read the bucket. Encryption is
+	// recorded in the object's Content-Encoding, and values are decrypted
+	// on read. Encrypting the values of an existing bucket needs
+	// MigrateLayout, which leaves the values already stored in plain text;
+	// it can't be turned off again.
+	EncryptionKey []byte
+	// EncryptionKMSKeyName, instead of EncryptionKey, is the name of a
+	// Cloud KMS key that wraps a data key, generated on first use and
+	// stored next to the prefix. Unlike KMSKeyName, GCS never sees the key.
+	EncryptionKMSKeyName string
+	// PackBlocks stores blocks of up to PackMaxValueSize bytes in pack
+	// objects of about PackSize bytes, next to the prefix, instead of one
+	// object each, which saves on the per-object costs of GCS. Puts
+	// arriving within PackFlushDelay share a pack. The index of the packs
+	// is loaded on start, so only one datastore may write them. Packed
+	// values aren't mirrored, archived, scrubbed or moved to the trash.
+	PackBlocks bool
+	// PackSize is the size from which a pack is stored,
+	// DefaultPackSize if 0.
+	PackSize int
+	// PackMaxValueSize is the size of the largest packed value,
+	// DefaultPackMaxValueSize if 0.
+	PackMaxValueSize int
+	// PackFlushDelay is how long a pack stays open for more values,
+	// DefaultPackFlushDelay if 0.
+	PackFlushDelay time.Duration
+	// PackCompactInterval is how often packs holding mostly deleted
+	// values are rewritten, see CompactPacks. 0 disables compaction.
+	PackCompactInterval time.Duration
+	// Sharding inserts a directory derived from the last element of each
+	// key before it in the object name, like flatfs, e.g. "next-to-last/2"
+	// stores /CIQAB...XYZ in <prefix>/XY/CIQAB...XYZ. Metadata loads list
+	// the shard directories in parallel. It is recorded in the layout
+	// manifest and can't be changed once values are stored. Empty or
+	// "none" doesn't shard.
+	Sharding string
+	// ContentType is the Content-Type of the objects of values,
+	// DefaultContentType if empty. ContentTypeDetect leaves it to the
+	// client library to detect from each value.
+	ContentType string
+	// ObjectMetadata lists the custom metadata recorded on the objects of
+	// values, among ObjectMetadataKey, ObjectMetadataNode,
+	// ObjectMetadataWritten and ObjectMetadataCodec, so that tools can
+	// tell what a bucket holds without this package. Packed values have
+	// none.
+	ObjectMetadata []string
+	// NodeID identifies this node in ObjectMetadataNode, e.g. its peer ID.
+	NodeID string
+	// MetricsInterval is how often the cache statistics are published as
+	// IPFS metrics, e.g. on the Prometheus endpoint of kubo, or never if 0.
+	MetricsInterval time.Duration
+	// HealthMaxErrorRate is the fraction of recent requests that may fail
+	// before Healthy does, DefaultHealthMaxErrorRate if 0.
+	HealthMaxErrorRate float64
+	// HealthAddr, e.g. ":8081", serves HealthHandler at /healthz for
+	// liveness probes. Empty doesn't.
+	HealthAddr string
+	// QueryConsistency is QueryConsistencyCached, the default, to answer
+	// queries from the metadata cache, or QueryConsistencyListed to list
+	// the bucket for each query instead, so that queries see the writes
+	// and deletes of other nodes, and don't wait for the metadata to load.
+	// Packed values are those of the pack indexes loaded on start.
+	QueryConsistency string
+	// GCLifecycleDays, if positive, adds a lifecycle rule to the bucket
+	// that deletes values that many days after they were marked unpinned,
+	// see MarkUnpinned and EphemeralPrefixes, for a garbage collection done
+	// by GCS without listing or delete requests. The rule also deletes
+	// values written with PutWithTTL that many days after they expired,
+	// and replaces the one of TTLLifecycle, which would delete unpinned
+	// values after a day.
+	GCLifecycleDays int
+	// EphemeralPrefixes are key prefixes, e.g. "/blocks" for a gateway
+	// cache, under which values are marked unpinned as they are written,
+	// and never packed. MarkPinned keeps them.
+	EphemeralPrefixes []string
+	// TouchInterval, if positive, refreshes the CustomTime of values
+	// marked unpinned when Get returns them, in the background, if older
+	// than TouchInterval, so that the lifecycle rule of GCLifecycleDays
+	// deletes the values least recently read, like an LRU cache. The
+	// CustomTime of values with a TTL is left alone.
+	TouchInterval time.Duration
+	// TouchMaxPerSecond bounds the refreshes of TouchInterval, which take
+	// two requests each, DefaultTouchMaxPerSecond if 0. Reads beyond it
+	// don't refresh.
+	TouchMaxPerSecond float64
+	// HoldPinned makes MarkPinned place event-based holds on the objects
+	// of the values, and MarkUnpinned release them, so that pinned values
+	// can't be deleted or overwritten. On a bucket with a retention
+	// policy, the values are then retained for its period after being
+	// unpinned.
+	HoldPinned bool
+	// CreateBucket creates Bucket if it doesn't exist, with uniform
+	// bucket-level access, instead of failing.
+	CreateBucket bool
+	// Project is the project CreateBucket creates the bucket in, that of
+	// the credentials if empty.
+	Project string
+	// Location and StorageClass are those of the bucket CreateBucket
+	// creates, e.g. "US-CENTRAL1" and StorageClassStandard. GCS defaults
+	// to the US multi-region and STANDARD.
+	Location     string
+	StorageClass string
 }
 
 type GCSDatastore struct {
 	Config
-	client    *storage.Client
-	mdCache   *MetadataCache
-	dataCache *lru.Cache
+	client *storage.Client
+	// readClient serves reads. It is client unless reads are redirected.
+	readClient *storage.Client
+	mdCache    MetadataIndex
+	dataCache  *DataCache
+	stats      counters
+	requests   requestCounts
+	// misses are the keys found missing from GCS, until when.
+	misses    *lru.Cache
+	toucher   *toucher
+	diskCache *DiskCache
+	// bucketAttrs are the bucket attributes read by CheckBucket.
+	bucketAttrs *storage.BucketAttrs
+	locality    Locality
+
+	// ctx is cancelled on Close to stop background jobs.
+	ctx    context.Context
+	cancel context.CancelFunc
+	bgMu   sync.Mutex
+	wg     sync.WaitGroup
+
+	batch    *batchClient
+	throttle *throttle
+	// gzipWriters and zstdEncoder compress values, see Compression.
+	gzipWriters sync.Pool
+	zstdEncoder *zstd.Encoder
+	// aead encrypts values, see EncryptionKey.
+	aead cipher.AEAD
+	// packs stores small blocks, see PackBlocks.
+	packs *packStore
+	// shard returns the shard directory of object names, see Sharding.
+	shard shardFunc
+	// node is recorded as ObjectMetadataNode.
+	node string
+
+	mirrorQueue chan mirrorOp
+	// mirrorPending counts the operations of MirrorCopy queued or failed
+	// per key, whose mirror objects may be stale.
+	mirrorMu      sync.Mutex
+	mirrorPending map[string]int
+	lock          *Lock
+	writeBehind   *writeBehind
+	heartbeat     *heartbeat
+	// readOnly fails writes with ErrReadOnly.
+	readOnly atomic.Bool
+
+	// metadataLoaded is set once LoadMetadata completed. metadataLoading
+	// is closed when a background load ends.
+	metadataLoaded  atomic.Bool
+	metadataLoading chan struct{}
+	// loadMu serializes metadata loads, which resume from loadResume.
+	loadMu     sync.Mutex
+	loadResume loadCheckpoint
+	// loadedFrom is when the last complete load started listing. Objects
+	// created before then are in the metadata cache unless deleted.
+	loadedFrom time.Time
+	// accessSince is the unix time in nanoseconds since when the reads of
+	// cached keys are known: when the datastore was opened, or earlier for
+	// the access times of a metadata snapshot. Before, the access time of
+	// a key is when its object was last written.
+	accessSince atomic.Int64
+	// unlisted are the keys cached before the running load, from a
+	// metadata snapshot or a refresh, that it hasn't listed yet.
+	unlistedMu sync.Mutex
+	unlisted   map[string]struct{}
+}
+
+// newClient creates a GCS client for cfg, throttled by th if not nil. opts
+// override Config.Endpoint.
+func newClient(ctx context.Context, cfg Config, th *throttle, opts ...option.ClientOption) (*storage.Client, error) {
+	endpointOpts, auth, err := endpointOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(endpointOpts, opts...)
+	if auth {
+		credOpts, err := credentialOptions(ctx, cfg, gcsScopes(cfg)...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, credOpts...)
+	}
+	if th != nil {
+		transOpts := append([]option.ClientOption{}, opts...)
+		if !auth {
+			transOpts = append(transOpts, option.WithoutAuthentication())
+		}
+		hc, err := th.httpClient(ctx, transOpts...)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithHTTPClient(hc))
+	}
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	setRetry(client, cfg)
+	return client, nil
 }
 
 func NewGCSDatastore(cfg Config) (*GCSDatastore, error) {
-	ctx := context.Background()
-	client, err := storage.NewClient(ctx)
+	return NewGCSDatastoreContext(context.Background(), cfg)
+}
+
+// NewGCSDatastoreContext is NewGCSDatastore with a context, which bounds
+// the requests made while opening the datastore. The datastore is open
+// until Close, whatever happens to ctx.
+func NewGCSDatastoreContext(ctx context.Context, cfg Config) (*GCSDatastore, error) {
+	th := newThrottle(cfg)
+	client, err := newClient(ctx, cfg, th)
+	if err != nil {
+		logger.Errorf("Failed to create GCS client: %v", err)
+		return nil, err
+	}
+	batch, err := newBatchClient(ctx, cfg, th)
+	if err != nil {
+		logger.Errorf("Failed to create GCS batch client: %v", err)
+		return nil, err
+	}
+	dataCache, err := NewDataCache(cfg.DataCacheItems, cfg.DataCacheMaxBytes, cfg.DataCacheMaxValueSize, cfg.DataCacheAdmission)
 	if err != nil {
-		log.Printf("Failed to create GCS client: %v\n", err)
+		logger.Errorf("Failed to create LRU cache err: %v", err)
 		return nil, err
 	}
-	dataCache, err := lru.New(cfg.DataCacheItems)
+	misses, err := newMissCache(cfg)
 	if err != nil {
-		log.Printf("Failed to create LRU cache err: %v\n", err)
+		logger.Errorf("Failed to create LRU cache err: %v", err)
+		return nil, err
+	}
+	var diskCache *DiskCache
+	if cfg.DiskCacheDir != "" {
+		if diskCache, err = OpenDiskCache(cfg.DiskCacheDir, cfg.DiskCacheMaxBytes); err != nil {
+			logger.Errorf("Failed to open disk cache err: %v", err)
+			return nil, err
+		}
+	}
+	mdCache, err := newMetadataIndex(cfg)
+	if err != nil {
+		logger.Errorf("Failed to open metadata index err: %v", err)
 		return nil, err
 	}
 	gd := &GCSDatastore{
-		Config:    cfg,
-		client:    client,
-		mdCache:   NewMetadataCache(),
-		dataCache: dataCache,
+		Config:     cfg,
+		client:     client,
+		readClient: client,
+		batch:      batch,
+		throttle:   th,
+		mdCache:    mdCache,
+		dataCache:  dataCache,
+		misses:     misses,
+		diskCache:  diskCache,
 	}
-	if err = gd.CheckBucket(); err != nil {
+	gd.accessSince.Store(time.Now().UnixNano())
+	defer func() {
+		// Release the lock and stop what was started before the failure,
+		// so that the caller can retry right away.
+		if err != nil {
+			gd.stopBackground()
+			ctx, cancel := context.WithTimeout(context.Background(), closeFlushTimeout)
+			defer cancel()
+			if rerr := gd.release(ctx); rerr != nil {
+				logger.Warnf("Failed to release writer lock: %v", rerr)
+			}
+		}
+	}()
+	gd.trackQuotas()
+	if gd.Config.CreateBucket {
+		if err = gd.createBucket(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err = gd.CheckBucketContext(ctx); err != nil {
+		return nil, err
+	}
+	if err = gd.checkRetention(); err != nil {
+		return nil, err
+	}
+	if err = gd.checkKMSKey(); err != nil {
+		return nil, err
+	}
+	if err = gd.checkLocality(ctx); err != nil {
+		return nil, err
+	}
+	if gd.Config.EnableAutoclass {
+		gd.enableAutoclass(ctx)
+	}
+	gd.adjustForAutoclass()
+	if err = gd.checkReplication(ctx); err != nil {
+		return nil, err
+	}
+	if gd.Config.GCLifecycleDays > 0 {
+		gd.ensureCustomTimeLifecycle(ctx, gd.Config.GCLifecycleDays)
+	} else if gd.Config.TTLLifecycle {
+		gd.ensureCustomTimeLifecycle(ctx, 1)
+	}
+	if gd.Config.WriterLock {
+		if gd.lock, err = gd.AcquireLock(ctx, lockOwner(), gd.Config.WriterLockTTL); err != nil {
+			logger.Errorf("Failed to acquire writer lock: %v", err)
+			return nil, err
+		}
+	}
+	if err = gd.initCompression(); err != nil {
+		return nil, err
+	}
+	if err = gd.initEncryption(ctx); err != nil {
 		return nil, err
 	}
+	if err = gd.checkQueryConsistency(); err != nil {
+		return nil, err
+	}
+	if err = gd.initSharding(); err != nil {
+		return nil, err
+	}
+	if err = gd.initObjectMetadata(); err != nil {
+		return nil, err
+	}
+	if err = gd.checkLayout(ctx); err != nil {
+		return nil, err
+	}
+	gd.ctx, gd.cancel = context.WithCancel(context.Background())
+	if err = gd.initPacks(ctx); err != nil {
+		return nil, err
+	}
+	if err = gd.startWriteBehind(); err != nil {
+		return nil, err
+	}
+	if gd.Config.Heartbeat {
+		if err = gd.startHeartbeat(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if gd.Config.ArchiveAfter > 0 || gd.Config.ColdlineAfter > 0 {
+		gd.background(gd.runArchiver)
+	}
+	if err = gd.startTouching(); err != nil {
+		return nil, err
+	}
+	if gd.Config.NotificationSubscription != "" {
+		if err = gd.startNotifications(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if gd.Config.MetadataRefreshInterval > 0 {
+		gd.background(gd.runRefresh)
+	}
+	if gd.Config.MetadataSnapshot && gd.Config.MetadataSnapshotInterval > 0 {
+		gd.background(func(ctx context.Context) {
+			gd.runSnapshots(ctx, gd.Config.MetadataSnapshotInterval)
+		})
+	}
+	if gd.Config.MirrorBucket != "" {
+		if err = gd.startMirror(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if gd.Config.MetricsInterval > 0 {
+		gd.background(gd.runMetrics)
+	}
+	if gd.Config.HealthAddr != "" {
+		if err = gd.serveHealth(); err != nil {
+			return nil, err
+		}
+	}
 	return gd, nil
 }
 
-// CheckBucket checks that the GCS bucket exists and is accessible.
+// background runs f in a goroutine. The context passed to f is cancelled,
+// and f waited for, when the datastore is closed.
+func (gd *GCSDatastore) background(f func(ctx context.Context)) {
+	gd.bgMu.Lock()
+	defer gd.bgMu.Unlock()
+	if gd.ctx.Err() != nil {
+		return
+	}
+	gd.wg.Add(1)
+	go func() {
+		defer gd.wg.Done()
+		f(gd.ctx)
+	}()
+}
+
+// workers returns the number of concurrent GCS operations to use.
+func (gd *GCSDatastore) workers() int {
+	if gd.Config.Workers > 0 {
+		return gd.Config.Workers
+	}
+	return 1
+}
+
+// CheckBucket checks that the GCS bucket exists and is accessible, and that
+// the datastore has the IAM permissions it needs.
 func (gd *GCSDatastore) CheckBucket() error {
+	return gd.CheckBucketContext(context.Background())
+}
+
+// CheckBucketContext is CheckBucket with a context.
+func (gd *GCSDatastore) CheckBucketContext(ctx context.Context) error {
 	bkt := gd.client.Bucket(gd.Config.Bucket)
-	_, err := bkt.Attrs(context.Background())
+	attrs, err := bkt.Attrs(ctx)
+	if err == storage.ErrBucketNotExist {
+		return fmt.Errorf("gcsds: bucket %s doesn't exist, see Config.CreateBucket: %w", gd.Config.Bucket, err)
+	}
 	if err != nil {
 		// TODO(leffler): Better explanation.
-		log.Printf("Failed to get attributes for bucket %s. Missing credentials? %v", gd.Config.Bucket, err)
+		logger.Errorf("Failed to get attributes for bucket %s. Missing credentials? %v", gd.Config.Bucket, err)
 		return err
 	}
-	return nil
+	gd.bucketAttrs = attrs
+	gd.checkUniformAccess()
+	return gd.checkPermissions(ctx)
 }
 
-// LoadMetadata pre-loads metadata for all objects in the ipfs prefix.
+// LoadMetadata pre-loads metadata for all objects in the ipfs prefix. The
+// listing is split into ranges of object names listed in parallel.
 func (gd *GCSDatastore) LoadMetadata() error {
-	listed := 0
+	return gd.LoadMetadataContext(context.Background())
+}
+
+// LoadMetadataContext is LoadMetadata with a context. A load that fails or
+// is cancelled is resumed by the next call from the last object listed,
+// rather than starting over.
+func (gd *GCSDatastore) LoadMetadataContext(ctx context.Context) error {
+	return gd.loadMetadata(ctx)
+}
+
+func (gd *GCSDatastore) loadMetadata(ctx context.Context) error {
+	gd.loadMu.Lock()
+	defer gd.loadMu.Unlock()
+	return gd.loadMetadataLocked(ctx)
+}
+
+// loadMetadataLocked is loadMetadata with loadMu held.
+func (gd *GCSDatastore) loadMetadataLocked(ctx context.Context) error {
+	resumed := gd.loadResume.listed
 	start := time.Now()
-	ctx := context.Background()
-	query := &storage.Query{Prefix: gd.Config.Prefix}
+	if gd.loadResume.started.IsZero() {
+		gd.loadResume.started = start
+	}
+	gd.mdCache.StartLoading()
+	defer gd.mdCache.DoneLoading()
+	if gd.loadResume.shards == nil {
+		shards, err := gd.loadShards(ctx)
+		if err != nil {
+			err = requestError("list", gd.listPrefix(), err)
+			logger.Warnf("Failed to split metadata load for bucket: %v. err: %v", gd.Config.Bucket, err)
+			return err
+		}
+		gd.loadResume.shards = shards
+	} else {
+		logger.Infof("Resuming metadata load after %d objects.", resumed)
+	}
+	var listed atomic.Int64
+	listed.Store(int64(resumed))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, gd.workers())
+	for _, shard := range gd.loadResume.shards {
+		if shard.done {
+			continue
+		}
+		wg.Add(1)
+		go func(shard *loadShard) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := gd.loadShard(ctx, shard, &listed); err != nil {
+				once.Do(func() { firstErr = err })
+				cancel()
+			}
+		}(shard)
+	}
+	wg.Wait()
+	gd.loadResume.listed = int(listed.Load())
+	if firstErr != nil {
+		err := requestError("list", gd.listPrefix(), firstErr)
+		logger.Errorf("Failed to load metadata for bucket: %v after %d objects. err: %v",
+			gd.Config.Bucket, gd.loadResume.listed, err)
+		return err
+	}
+	gd.dropUnlisted()
+	total := gd.loadResume.listed
+	gd.loadedFrom = gd.loadResume.started
+	gd.loadResume = loadCheckpoint{}
+	gd.metadataLoaded.Store(true)
+	elapsed := time.Since(start)
+	rate := float64(total-resumed) / elapsed.Seconds()
+	logger.Infof("Loaded metadata for %d object in %.2f s (%.2f objects/s)",
+		total, elapsed.Seconds(), rate)
+	return nil
+}
+
+// loadShard lists the objects of shard into the metadata cache, counting
+// them in listed.
+func (gd *GCSDatastore) loadShard(ctx context.Context, shard *loadShard, listed *atomic.Int64) error {
+	// Listing starts at the checkpoint, inclusive. LoadEntry skips the
+	// object listed twice.
+	query := &storage.Query{Prefix: gd.listPrefix(), StartOffset: shard.start, EndOffset: shard.end}
+	if shard.next != "" {
+		query.StartOffset = shard.next
+	}
 	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, query)
 	for {
 		attrs, err := it.Next()
 		if err == iterator.Done {
 			break
 		}
+		if err == nil {
+			// Next only checks ctx between pages.
+			err = ctx.Err()
+		}
 		if err != nil {
-			log.Printf("Failed to load metadata for bucket: %v err: %v",
-				gd.Config.Bucket, err)
 			return err
 		}
 		// Add to cache
-		key := strings.TrimPrefix(attrs.Name, gd.Config.Prefix)
-		gd.mdCache.Put(key, attrs.Size)
-		listed = listed + 1
+		key := gd.keyOf(attrs.Name)
+		gd.loadListed(objectMetadata(key, attrs))
+		shard.next = attrs.Name
+		gd.stats.metadataListed.Store(listed.Add(1))
 	}
-	elapsed := time.Since(start)
-	rate := float64(listed) / elapsed.Seconds()
-	log.Printf("Loaded metadata for %d object in %.2f s (%.2f objects/s)\n",
-		listed, elapsed.Seconds(), rate)
+	shard.done = true
 	return nil
 }
 
+// loadCheckpoint is the progress of an incomplete metadata load.
+type loadCheckpoint struct {
+	// shards are the ranges of object names listed in parallel.
+	shards []*loadShard
+	listed int
+	// started is when the load started listing.
+	started time.Time
+}
+
 func (gd *GCSDatastore) Put(ctx context.Context, k ds.Key, value []byte) error {
+	return gd.put(ctx, k, value, time.Time{})
+}
+
+// put stores value under k, expiring at expiration unless it's zero.
+func (gd *GCSDatastore) put(ctx context.Context, k ds.Key, value []byte, expiration time.Time) (err error) {
+	defer gd.requests.observe(&err)
 	key := k.String()
-	// log.Printf("PUT key: %v size: %d.\n", key, len(value))
-	bucket := gd.client.Bucket(gd.Config.Bucket)
-	path := gd.GCSPath(key)
-	w := bucket.Object(path).NewWriter(ctx)
-	w.ContentType = "text/plain"
-	w.Metadata = map[string]string{}
-	w.Write(value)
-	if err := w.Close(); err != nil {
-		log.Printf("Unable to close file key: %v size: %v err: %v",
-			k, len(value), err)
+	logger.Debugw("Put", "key", key, "size", len(value))
+	if gd.Config.VerifyPut {
+		if err := VerifyMultihash(k, value); err != nil {
+			logger.Errorf("Refusing to store corrupt block: %v", err)
+			return err
+		}
+	}
+	if err := gd.checkWritable(); err != nil {
+		return err
+	}
+	if expiration.IsZero() && gd.skipBlock(key, value) {
+		return nil
+	}
+	if err := gd.checkQuota(key, int64(len(value))); err != nil {
+		logger.Error(err)
+		return err
+	}
+	if mode := gd.durability(key); mode != DurabilityStrict && expiration.IsZero() {
+		return gd.putBehind(ctx, key, value, mode)
+	}
+	if err := gd.flushKey(ctx, key); err != nil {
 		return err
 	}
+	if err := gd.writeObject(ctx, key, value, expiration); err != nil {
+		err = requestError("write", gd.GCSPath(key), err)
+		logger.Errorw("Failed to write value", "key", k, "size", len(value), "err", err)
+		return err
+	}
+	gd.stored(ctx, key, value)
+	if !expiration.IsZero() {
+		gd.cacheExpiration(key, expiration)
+	}
+	return nil
+}
+
+// writeObject stores value in the object for key, expiring at expiration
+// unless it's zero.
+func (gd *GCSDatastore) writeObject(ctx context.Context, key string, value []byte, expiration time.Time) error {
+	if gd.packable(key, value, expiration) {
+		return gd.packs.put(ctx, key, value)
+	}
+	obj := gd.retryer(gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key)), key)
+	if expiration.IsZero() {
+		obj = gd.ifMissing(key, obj)
+	}
+	w := gd.valueWriter(ctx, obj)
+	if !expiration.IsZero() {
+		w.Metadata = map[string]string{expirationMetadataKey: expiration.UTC().Format(time.RFC3339Nano)}
+		w.CustomTime = expiration
+	}
+	gd.writeValue(w, key, value)
+	if err := w.Close(); err != nil && !gd.isExisting(key, err) {
+		return checksumError(obj.ObjectName(), err)
+	}
+	// The object replaces a packed value.
+	return gd.packs.delete(ctx, key)
+}
+
+// valueWriter returns a writer of a value to obj, with the configured
+// Content-Type.
+func (gd *GCSDatastore) valueWriter(ctx context.Context, obj *storage.ObjectHandle) *storage.Writer {
+	w := gd.newWriter(ctx, obj)
+	switch gd.Config.ContentType {
+	case "":
+		w.ContentType = DefaultContentType
+	case ContentTypeDetect:
+		// The client library detects it from the value.
+	default:
+		w.ContentType = gd.Config.ContentType
+	}
+	return w
+}
+
+// stored updates the caches, stats and mirror after value was written to
+// the object for key.
+func (gd *GCSDatastore) stored(ctx context.Context, key string, value []byte) {
+	gd.forgetUnlisted(key)
 	gd.mdCache.Put(key, int64(len(value)))
 	gd.dataCache.Add(key, value)
-	return nil
+	gd.removeDisk(key)
+	gd.forgetMissing(key)
+	gd.setShared(ctx, key, value)
+	gd.stats.written.observe(len(value))
+	if gd.Config.MirrorCopy {
+		gd.enqueueMirror(ctx, mirrorOp{key: key})
+	}
 }
 
+// Sync waits until the writes of keys under prefix that Put acknowledged
+// before storing them, see Durability, are stored in GCS. Writes
+// acknowledged after Sync was called aren't waited for. With strict
+// durability there is nothing to wait for.
 func (gd *GCSDatastore) Sync(ctx context.Context, prefix ds.Key) error {
-	// log.Printf("SYNC prefix: %v\n", prefix)
+	logger.Debugw("Sync", "prefix", prefix)
+	return gd.waitPending(ctx, func(key string) bool {
+		return ds.RawKey(key).Equal(prefix) || ds.RawKey(key).IsDescendantOf(prefix)
+	})
+}
+
+// PutMany stores values[i] under keys[i], with up to Workers writes in
+// flight, such as the blocks of a DAG or CAR import. Once all writes have
+// finished, it returns a BatchError with the error of each key that failed.
+// Writes not started when ctx is done fail with its error.
+func (gd *GCSDatastore) PutMany(ctx context.Context, keys []ds.Key, values [][]byte) error {
+	if len(keys) != len(values) {
+		return fmt.Errorf("gcsds: PutMany got %d keys but %d values", len(keys), len(values))
+	}
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	errs := map[ds.Key]error{}
+	fail := func(k ds.Key, err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		errs[k] = err
+	}
+	sem := make(chan struct{}, gd.workers())
+	for i := range keys {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			fail(keys[i], ctx.Err())
+			continue
+		}
+		wg.Add(1)
+		go func(k ds.Key, value []byte) {
+			defer func() { <-sem; wg.Done() }()
+			if err := gd.Put(ctx, k, value); err != nil {
+				fail(k, err)
+			}
+		}(keys[i], values[i])
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return &BatchError{Errors: errs}
+	}
 	return nil
 }
 
 func (gd *GCSDatastore) Get(ctx context.Context, k ds.Key) ([]byte, error) {
-	// log.Printf("GET key: %v\n", k)
+	value, err := gd.get(ctx, k)
+	if err == nil {
+		gd.touchOnRead(k.String())
+	}
+	return value, err
+}
+
+// get is Get without TouchInterval, for reads of many values at once, such
+// as queries, that say nothing about their use.
+func (gd *GCSDatastore) get(ctx context.Context, k ds.Key) (_ []byte, err error) {
+	defer gd.requests.observe(&err)
+	logger.Debugw("Get", "key", k)
 	key := k.String()
+	if gd.expired(key) {
+		return nil, ds.ErrNotFound
+	}
+	if value, ok := gd.localValue(ctx, key); ok {
+		return value, nil
+	}
+	if gd.knownMissing(key) {
+		return nil, ds.ErrNotFound
+	}
+	r, err := gd.openValue(ctx, key, 0, -1)
+	if err == ds.ErrNotFound {
+		gd.rememberMissing(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := readAll(r)
+	if err != nil {
+		err = requestError("read", gd.GCSPath(key), err)
+		logger.Errorf("Problem reading file from GCS: %v", err)
+		return nil, err
+	}
+	gd.dataCache.Add(key, data)
+	if (gd.diskCache != nil || gd.Config.SharedCache != nil) && gd.sharedCacheable(data) {
+		gd.background(func(ctx context.Context) {
+			gd.addDisk(key, data)
+			gd.setShared(ctx, key, data)
+		})
+	}
+	return data, nil
+}
+
+// localValue returns the value of key if it's cached or not uploaded yet.
+func (gd *GCSDatastore) localValue(ctx context.Context, key string) ([]byte, bool) {
 	if value, ok := gd.dataCache.Get(key); ok {
-		if b, ok := value.([]byte); ok {
-			// log.Printf("Got value from datacache. key: %s size: %d", key, len(b))
-			return b, nil
+		logger.Debugw("Got value from data cache", "key", key, "size", len(value))
+		gd.mdCache.Touch(key)
+		gd.stats.read.observe(len(value))
+		return value, true
+	}
+	if value, ok := gd.pendingValue(key); ok {
+		gd.stats.read.observe(len(value))
+		return value, true
+	}
+	if value, ok := gd.getDisk(key); ok {
+		gd.dataCache.Add(key, value)
+		gd.mdCache.Touch(key)
+		gd.stats.read.observe(len(value))
+		return value, true
+	}
+	if value, ok := gd.getShared(ctx, key); ok {
+		gd.dataCache.Add(key, value)
+		if gd.diskCache != nil {
+			gd.background(func(context.Context) {
+				gd.addDisk(key, value)
+			})
+		}
+		gd.mdCache.Touch(key)
+		gd.stats.read.observe(len(value))
+		return value, true
+	}
+	return nil, false
+}
+
+// openValue opens length bytes from offset of the object for key, or the
+// rest if length is negative, in the mirror bucket if it's up to date. A
+// missing or expired object is ds.ErrNotFound.
+func (gd *GCSDatastore) openValue(ctx context.Context, key string, offset, length int64) (*objectReader, error) {
+	md, _ := gd.mdCache.Get(key)
+	archived := md != nil && md.StorageClass == StorageClassArchive
+	cold := md != nil && coldness(md.StorageClass) >= coldness(StorageClassColdline)
+	cancel := context.CancelFunc(func() {})
+	if archived {
+		gd.stats.archivedReads.Add(1)
+		if gd.Config.ArchiveReadTimeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, gd.Config.ArchiveReadTimeout)
 		}
-		log.Printf("Failed to read cached data value. Fetching from GCS. key: %v", key)
 	}
+	// The expiration of cached keys was checked by the caller, so only
+	// other keys need a stat before the read.
+	stat := md == nil
 	path := gd.GCSPath(key)
-	obj := gd.client.Bucket(gd.Config.Bucket).Object(path)
-	_, err := obj.Attrs(ctx)
+	var r *objectReader
+	var err error
+	if loc, ok := gd.packs.lookup(key); ok {
+		r, err = gd.openPacked(ctx, key, loc, offset, length)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	} else if gd.Config.MirrorBucket != "" && md != nil && !gd.mirrorStale(key) {
+		r, err = gd.openMirror(ctx, key, md.Size, offset, length)
+		if err != nil {
+			// The mirror may lag behind the primary.
+			gd.stats.mirrorFallbacks.Add(1)
+		}
+	}
+	if r == nil {
+		r, err = gd.openObject(ctx, gd.retryer(gd.readClient.Bucket(gd.Config.Bucket).Object(path), key), key, offset, length, stat)
+		if err == ds.ErrNotFound && gd.Config.FallbackBucket != "" {
+			r, err = gd.openFallback(ctx, key, offset, length)
+		}
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	r.cancel = cancel
+	gd.mdCache.Touch(key)
+	gd.stats.read.observe(int(r.Remain()))
+	if cold && gd.Config.RestoreOnRead {
+		// Mark restored up front so concurrent reads don't restore again.
+		gd.mdCache.SetStorageClass(key, StorageClassStandard)
+		gd.background(func(ctx context.Context) {
+			gd.restore(ctx, key)
+		})
+	}
+	return r, nil
+}
+
+// objectReader reads an object opened by openObject.
+type objectReader struct {
+	*storage.Reader
+	cancel context.CancelFunc
+	// name is the object's. If verify is set, crc is the CRC32C of the
+	// data read so far, checked against want at the end.
+	name   string
+	verify bool
+	crc    uint32
+	want   uint32
+	// decoded reads the value of a compressed object.
+	decoded io.Reader
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.decoded != nil {
+		n, err := r.decoded.Read(p)
+		return n, checksumError(r.name, err)
+	}
+	return r.readStored(p)
+}
+
+func (r *objectReader) Close() error {
+	err := r.Reader.Close()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	return err
+}
+
+// openObject opens length bytes from offset of obj, the value of key, or
+// the rest if length is negative. Missing and expired objects are
+// ds.ErrNotFound. Without stat the expiration isn't checked. Compressed
+// values are decompressed before the range is cut.
+func (gd *GCSDatastore) openObject(ctx context.Context, obj *storage.ObjectHandle, key string, offset, length int64, stat bool) (*objectReader, error) {
+	if length == 0 {
+		offset = 0
+	}
+	obj = obj.ReadCompressed(true)
+	var want uint32
+	var verify bool
+	var skip, limit int64 = 0, -1
+	if stat {
+		attrs, err := obj.Attrs(ctx)
+		if err == storage.ErrObjectNotExist {
+			return nil, ds.ErrNotFound
+		}
+		if err != nil {
+			err = requestError("stat", obj.ObjectName(), err)
+			logger.Errorf("Problem getting file from GCS: %v", err)
+			return nil, err
+		}
+		if expired(objectExpiration(attrs)) {
+			return nil, ds.ErrNotFound
+		}
+		size := objectSize(attrs)
+		if offset > size {
+			return nil, fmt.Errorf("gcsds: offset %d beyond the %d bytes of %s", offset, size, obj.ObjectName())
+		}
+		if offset == size {
+			// GCS rejects empty ranges.
+			offset, length = 0, 0
+		}
+		if attrs.ContentEncoding != "" && length != 0 {
+			skip, limit = offset, length
+			offset, length = 0, -1
+		}
+		// Read the generation just stat'ed, which the expiration applies to.
+		obj = obj.Generation(attrs.Generation)
+		want = attrs.CRC32C
+		verify = offset == 0 && length < 0
+	}
+	r, err := obj.NewRangeReader(ctx, offset, length)
 	if err == storage.ErrObjectNotExist {
 		return nil, ds.ErrNotFound
 	}
+	if !stat && isRangeNotSatisfiable(err) {
+		// The offset is at or past the end, which the stat tells apart.
+		return gd.openObject(ctx, obj, key, offset, length, true)
+	}
 	if err != nil {
-		log.Printf("Problem getting file from GCS: %v\n", err)
+		err = requestError("read", obj.ObjectName(), err)
+		logger.Errorf("Problem reading file from GCS: %v", err)
 		return nil, err
 	}
-	// Read file.
-	r, err := obj.NewReader(ctx)
-	if err != nil {
-		log.Printf("Problem reading file from GCS: %v\n", err)
+	reader := &objectReader{Reader: r, name: obj.ObjectName()}
+	if verify {
+		reader.verifyChecksum(want)
+	}
+	encoding := r.Attrs.ContentEncoding
+	if encoding == "" || length == 0 {
+		return reader, nil
+	}
+	if offset != 0 || length >= 0 {
+		// The range is of the compressed data. The stat finds the size.
+		r.Close()
+		return gd.openObject(ctx, obj.Generation(r.Attrs.Generation), key, offset, length, true)
+	}
+	if err := gd.decodeObject(reader, key, encoding, skip, limit); err != nil {
+		reader.Close()
+		err = checksumError(obj.ObjectName(), err)
+		logger.Errorf("Problem reading file from GCS: %v", err)
 		return nil, err
 	}
-	defer r.Close()
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(r)
-	data := buf.Bytes()
-	gd.dataCache.Add(key, data)
-	return data, nil
+	return reader, nil
+}
+
+func isRangeNotSatisfiable(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusRequestedRangeNotSatisfiable
+}
+
+// readAll reads r into a buffer of the size to read, so that it isn't
+// grown, and copied, while reading.
+func readAll(r *objectReader) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, r.Remain()+bytes.MinRead))
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func (gd *GCSDatastore) Has(ctx context.Context, k ds.Key) (exists bool, err error) {
-	// log.Printf("HAS key: %v\n", k)
-	return gd.mdCache.Has(k.String()), nil
+	defer gd.requests.observe(&err)
+	logger.Debugw("Has", "key", k)
+	if md, err := gd.mdCache.Get(k.String()); err == nil {
+		return !expired(md.Expiration), nil
+	}
+	if gd.metadataPending() || gd.Config.StrictHas {
+		return gd.statHas(ctx, k.String())
+	}
+	if gd.Config.FallbackBucket != "" {
+		return gd.fallbackHas(ctx, k.String())
+	}
+	return false, nil
 }
 
 func (gd *GCSDatastore) GetSize(ctx context.Context, k ds.Key) (size int, err error) {
-	// log.Printf("GETSIZE key: %v\n", k)
+	defer gd.requests.observe(&err)
+	logger.Debugw("GetSize", "key", k)
 	md, err := gd.mdCache.Get(k.String())
 	if err != nil {
-		// TODO: Handle not found error.
+		// The key may have been written by another node since the
+		// metadata was loaded.
+		md, err = gd.statUncached(ctx, k.String())
+	}
+	if err == nil && expired(md.Expiration) {
+		err = ds.ErrNotFound
+	}
+	if err != nil {
 		return -1, err
 	}
 	return int(md.Size), nil
 }
 
-func (gd *GCSDatastore) Delete(ctx context.Context, k ds.Key) error {
-	// log.Printf("DELETE key: %v\n", k)
+func (gd *GCSDatastore) Delete(ctx context.Context, k ds.Key) (err error) {
+	defer gd.requests.observe(&err)
+	logger.Debugw("Delete", "key", k)
 	bucket := gd.client.Bucket(gd.Config.Bucket)
 	key := k.String()
 	path := gd.GCSPath(key)
-	err := bucket.Object(path).Delete(ctx)
+	if err := gd.checkWritable(); err != nil {
+		return err
+	}
+	if err := gd.flushKey(ctx, key); err != nil {
+		return err
+	}
+	if gd.Config.TrashPrefix != "" {
+		if err := gd.moveToTrash(ctx, key); err != nil {
+			logger.Warnw("Failed to move object to trash", "key", key, "err", err)
+			return err
+		}
+	}
+	if err := gd.packs.delete(ctx, key); err != nil {
+		logger.Warnw("Failed to delete packed value", "key", key, "err", err)
+		return err
+	}
+	err = gd.retryer(bucket.Object(path), key).Delete(ctx)
 	// Don't error for missing objects. Double deletes are OK.
 	if err != nil && err != storage.ErrObjectNotExist {
-		return err
+		return gd.retainedError(ctx, key, requestError("delete", path, err))
 	}
+	gd.deleted(ctx, key)
+	return nil
+}
+
+// deleted updates the caches and mirror after the object for key was
+// deleted.
+func (gd *GCSDatastore) deleted(ctx context.Context, key string) {
+	gd.forgetUnlisted(key)
 	gd.mdCache.Delete(key)
 	gd.dataCache.Remove(key)
-	return nil
+	gd.removeDisk(key)
+	gd.deleteShared(ctx, key)
+	if gd.Config.MirrorCopy {
+		gd.enqueueMirror(ctx, mirrorOp{key: key, delete: true})
+	}
 }
 
 func (gd *GCSDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
-	if len(q.Orders) > 0 || len(q.Filters) > 0 {
-		msg := "GCSDatastore: Orders and Filters not supported"
-		log.Print(msg)
-		return nil, fmt.Errorf(msg)
+	// With LazyMetadata, queries list GCS until the metadata is loaded
+	// rather than wait for it.
+	listed := gd.Config.LazyMetadata && gd.metadataPending()
+	strict := gd.Config.QueryConsistency == QueryConsistencyListed
+	if !listed && !strict {
+		if err := gd.waitMetadata(ctx); err != nil {
+			return nil, err
+		}
+	}
+	q.Prefix = queryPrefix(q.Prefix)
+	var keep func(*Metadata) bool
+	if len(q.Filters) > 0 {
+		var byKey bool
+		if keep, byKey = keyFilter(q.Filters); !byKey {
+			return gd.naiveQuery(ctx, q)
+		}
+	}
+	descending, byKey := false, false
+	if len(q.Orders) > 0 {
+		if descending, byKey = keyOrder(q.Orders[0]); !byKey {
+			return gd.naiveQuery(ctx, q)
+		}
 	}
 	if !q.KeysOnly {
-		log.Printf("GCSDatastore: Requested all values for prefix '%v'. This could be expensive.", q.Prefix)
+		logger.Warnf("Requested all values for prefix '%v'. This could be expensive.", q.Prefix)
 	}
 
-	metadata := gd.mdCache.Iterator(q.Prefix, q.Limit)
+	// The metadata is iterated in key order, so pages of results from
+	// Offset and Limit are consistent.
+	metadata := gd.mdCache.Iterator(q.Prefix, 0)
+	if strict {
+		// The listing has all other entries, and not those deleted by
+		// other nodes since they were cached.
+		metadata = gd.localMetadata(q.Prefix)
+	}
+	listErr := func() error { return nil }
+	if listed || strict {
+		// Cached entries include writes not stored in GCS yet.
+		var listing func() *Metadata
+		listing, listErr = gd.listMetadata(ctx, q.Prefix)
+		metadata = mergeMetadata(metadata, listing)
+	}
+	if keep != nil {
+		metadata = filtered(metadata, keep)
+	}
+	if byKey && descending {
+		metadata = reversed(metadata)
+	}
+	metadata = unexpired(metadata, q.Offset, q.Limit)
+	var values valueFunc
+	stop := func() {}
+	if !q.KeysOnly {
+		if gd.Config.QueryReadAhead > 0 {
+			values, stop = gd.readAheadValues(ctx, metadata, gd.Config.QueryReadAhead)
+		} else {
+			values = gd.serialValues(ctx, metadata)
+		}
+	}
 	nextValue := func() (dsq.Result, bool) {
-		v := metadata()
+		var v *Metadata
+		var value []byte
+		var err error
+		if q.KeysOnly {
+			v = metadata()
+		} else {
+			v, value, err = values()
+		}
 		if v == nil {
+			if err := listErr(); err != nil {
+				return dsq.Result{Error: err}, false
+			}
 			return dsq.Result{Error: ds.ErrNotFound}, false
 		}
+		if err != nil {
+			logger.Errorf("Failed to get value for query: %v", err)
+			return dsq.Result{Error: err}, false
+		}
 		// Always return size, whether it was requested or not.
-		entry := dsq.Entry{Key: v.Key, Size: int(v.Size)}
-		if !q.KeysOnly {
-			value, err := gd.Get(ctx, ds.NewKey(v.Key))
-			if err != nil {
-				log.Printf("GCSDatastore: Error getting value. err: %v", err)
-				return dsq.Result{Error: err}, false
-			}
-			entry.Value = value
+		entry := dsq.Entry{Key: v.Key, Size: int(v.Size), Value: value}
+		if q.ReturnExpirations {
+			entry.Expiration = v.Expiration
 		}
 		return dsq.Result{Entry: entry}, true
 	}
 
 	res := dsq.ResultsFromIterator(q, dsq.Iterator{
 		Close: func() error {
+			stop()
 			return nil
 		},
 		Next: nextValue,
@@ -237,15 +1394,87 @@ func (gd *GCSDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, er
 	return res, nil
 }
 
-func (gd *GCSDatastore) Batch(_ context.Context) (ds.Batch, error) {
-	log.Printf("BATCH.\n")
-	return nil, nil
+func (gd *GCSDatastore) Close() error {
+	gd.flushAll()
+	gd.packs.flush()
+	gd.stopBackground()
+	ctx, cancel := context.WithTimeout(context.Background(), closeFlushTimeout)
+	defer cancel()
+	if gd.Config.MetadataSnapshot && gd.metadataLoaded.Load() {
+		if err := gd.SaveMetadataSnapshot(ctx); err != nil {
+			logger.Warnf("Failed to save metadata snapshot: %v", err)
+		}
+	}
+	return gd.release(ctx)
 }
 
-func (gd *GCSDatastore) Close() error {
+// stopBackground stops the background jobs and waits for them.
+func (gd *GCSDatastore) stopBackground() {
+	gd.bgMu.Lock()
+	if gd.cancel != nil {
+		gd.cancel()
+	}
+	gd.bgMu.Unlock()
+	gd.wg.Wait()
+	if gd.writeBehind != nil {
+		gd.writeBehind.wal.close()
+	}
+}
+
+// release closes the metadata index and removes the heartbeat and writer
+// lock of the datastore.
+func (gd *GCSDatastore) release(ctx context.Context) error {
+	closeIndex(gd.mdCache)
+	gd.stopHeartbeat(ctx)
+	if gd.lock != nil {
+		return gd.lock.Release(ctx)
+	}
 	return nil
 }
 
+// checkWritable fails writes once the writer lock is lost, or the
+// datastore went read-only.
+func (gd *GCSDatastore) checkWritable() error {
+	if gd.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if gd.lock == nil {
+		return nil
+	}
+	return gd.lock.Err()
+}
+
 func (gd *GCSDatastore) GCSPath(key string) string {
-	return path.Join(gd.Config.Prefix, key)
+	return gd.objectName(key, true)
+}
+
+// listPrefix returns the prefix of all object names GCSPath returns. Unlike
+// Prefix, it excludes neighbours like "ipfs.lock" of the prefix "ipfs".
+func (gd *GCSDatastore) listPrefix() string {
+	p := path.Join(gd.Config.Prefix, "/")
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+// keyOf is the inverse of GCSPath: it returns the key stored in the object
+// called name. It handles prefixes with and without a trailing slash.
+func (gd *GCSDatastore) keyOf(name string) string {
+	if gd.shard != nil {
+		name = unshard(name)
+	}
+	return unescapeKey("/" + strings.TrimPrefix(strings.TrimPrefix(name, gd.Config.Prefix), "/"))
+}
+
+// BucketHandle returns the handle of the bucket values are stored in, for
+// operations this package doesn't wrap. Use ObjectPath to find the object
+// of a key.
+func (gd *GCSDatastore) BucketHandle() *storage.BucketHandle {
+	return gd.client.Bucket(gd.Config.Bucket)
+}
+
+// ObjectPath returns the name of the object that stores the value of k.
+func (gd *GCSDatastore) ObjectPath(k ds.Key) string {
+	return gd.GCSPath(k.String())
 }
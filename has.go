@@ -0,0 +1,90 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// missCacheItems bounds the keys remembered as missing.
+const missCacheItems = 100000
+
+// newMissCache creates the negative cache of keys missing from GCS, or nil
+// if it's disabled.
+func newMissCache(cfg Config) (*lru.Cache, error) {
+	if cfg.NegativeCacheTTL <= 0 {
+		return nil, nil
+	}
+	return lru.New(missCacheItems)
+}
+
+// knownMissing reports whether key was found missing from GCS less than
+// NegativeCacheTTL ago.
+func (gd *GCSDatastore) knownMissing(key string) bool {
+	if gd.misses == nil {
+		return false
+	}
+	until, ok := gd.misses.Get(key)
+	return ok && time.Now().Before(until.(time.Time))
+}
+
+// rememberMissing remembers that key was found missing from GCS.
+func (gd *GCSDatastore) rememberMissing(key string) {
+	if gd.misses != nil {
+		gd.misses.Add(key, time.Now().Add(gd.Config.NegativeCacheTTL))
+	}
+}
+
+// forgetMissing forgets that key was missing, once it was found or written.
+func (gd *GCSDatastore) forgetMissing(key string) {
+	if gd.misses != nil {
+		gd.misses.Remove(key)
+	}
+}
+
+// statHas reports whether key exists in GCS, for keys missing from the
+// metadata cache.
+func (gd *GCSDatastore) statHas(ctx context.Context, key string) (bool, error) {
+	md, err := gd.statUncached(ctx, key)
+	if err == ds.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !expired(md.Expiration), nil
+}
+
+// statUncached gets the metadata of a key missing from the metadata cache
+// from GCS, or from the FallbackBucket, unless it's known to be missing.
+func (gd *GCSDatastore) statUncached(ctx context.Context, key string) (*Metadata, error) {
+	if gd.knownMissing(key) {
+		return nil, ds.ErrNotFound
+	}
+	md, err := gd.statObject(ctx, key)
+	if err == ds.ErrNotFound && gd.Config.FallbackBucket != "" {
+		md, err = gd.statFallback(ctx, key)
+	}
+	if err == ds.ErrNotFound {
+		gd.rememberMissing(key)
+	} else if err == nil {
+		gd.forgetMissing(key)
+	}
+	return md, err
+}
@@ -0,0 +1,150 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+const (
+	// DefaultHealthMaxErrorRate is the fraction of recent requests that may
+	// fail before Healthy does.
+	DefaultHealthMaxErrorRate = 0.5
+
+	// Requests are counted in windows of healthWindow. Healthy looks at
+	// the current and previous ones, if they have at least
+	// healthMinRequests requests.
+	healthWindow      = time.Minute
+	healthMinRequests = 20
+
+	// healthTimeout bounds the requests of HealthHandler.
+	healthTimeout = 10 * time.Second
+)
+
+// ErrUnhealthy is returned by Healthy when the datastore can't serve
+// requests.
+var ErrUnhealthy = errors.New("gcsds: unhealthy")
+
+// requestCounts counts the requests to the datastore and their failures
+// over the last windows of healthWindow.
+type requestCounts struct {
+	mu    sync.Mutex
+	start time.Time
+	// cur and prev hold requests and failures of the current and previous
+	// windows.
+	cur, prev [2]int64
+}
+
+// observe counts a request that returned *errp. Missing keys and requests
+// cancelled by the caller aren't failures.
+func (rc *requestCounts) observe(errp *error) {
+	err := *errp
+	failed := err != nil && !errors.Is(err, ds.ErrNotFound) && !errors.Is(err, context.Canceled)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.rotate(time.Now())
+	rc.cur[0]++
+	if failed {
+		rc.cur[1]++
+	}
+}
+
+func (rc *requestCounts) rotate(now time.Time) {
+	switch elapsed := now.Sub(rc.start); {
+	case elapsed >= 2*healthWindow:
+		rc.cur, rc.prev = [2]int64{}, [2]int64{}
+		rc.start = now
+	case elapsed >= healthWindow:
+		rc.prev, rc.cur = rc.cur, [2]int64{}
+		rc.start = rc.start.Add(healthWindow)
+	}
+}
+
+// recent returns the number of requests and failures in the current and
+// previous windows.
+func (rc *requestCounts) recent() (requests, failures int64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.rotate(time.Now())
+	return rc.cur[0] + rc.prev[0], rc.cur[1] + rc.prev[1]
+}
+
+// Healthy checks that the datastore can serve requests, cheaply enough for
+// liveness probes: that it's open and still holds its writer lock, that
+// the bucket is reachable, and that at most HealthMaxErrorRate of the
+// requests of the last minute or two failed. It doesn't list the bucket,
+// unlike Check.
+func (gd *GCSDatastore) Healthy(ctx context.Context) error {
+	if gd.ctx.Err() != nil {
+		return fmt.Errorf("%w: closed", ErrUnhealthy)
+	}
+	if gd.lock != nil {
+		if err := gd.lock.Err(); err != nil {
+			return fmt.Errorf("%w: %w", ErrUnhealthy, err)
+		}
+	}
+	if _, err := gd.client.Bucket(gd.Config.Bucket).Attrs(ctx); err != nil {
+		return fmt.Errorf("%w: bucket %s is unreachable: %w", ErrUnhealthy, gd.Config.Bucket, err)
+	}
+	maxRate := gd.Config.HealthMaxErrorRate
+	if maxRate <= 0 {
+		maxRate = DefaultHealthMaxErrorRate
+	}
+	requests, failures := gd.requests.recent()
+	if requests >= healthMinRequests && float64(failures) > maxRate*float64(requests) {
+		return fmt.Errorf("%w: %d of the last %d requests failed", ErrUnhealthy, failures, requests)
+	}
+	return nil
+}
+
+// HealthHandler returns an HTTP handler for liveness probes, answering 200
+// when Healthy and 503 with the reason otherwise.
+func (gd *GCSDatastore) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		defer cancel()
+		if err := gd.Healthy(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// serveHealth serves HealthHandler at /healthz on HealthAddr until the
+// datastore is closed.
+func (gd *GCSDatastore) serveHealth() error {
+	l, err := net.Listen("tcp", gd.Config.HealthAddr)
+	if err != nil {
+		return fmt.Errorf("gcsds: failed to listen on %s: %w", gd.Config.HealthAddr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", gd.HealthHandler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: healthTimeout}
+	go srv.Serve(l)
+	gd.background(func(ctx context.Context) {
+		<-ctx.Done()
+		srv.Close()
+	})
+	return nil
+}
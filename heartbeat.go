@@ -0,0 +1,207 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultHeartbeatTTL is how long a node is considered live after its last
+// heartbeat when Config.HeartbeatTTL is unset.
+const DefaultHeartbeatTTL = time.Minute
+
+// ErrReadOnly is returned by writes to a read-only datastore.
+var ErrReadOnly = errors.New("gcsds: datastore is read-only")
+
+// Node modes recorded in heartbeats.
+const (
+	modeWriter   = "writer"
+	modeReadOnly = "read-only"
+)
+
+// NodeHeartbeat is the last heartbeat of a node using the datastore.
+type NodeHeartbeat struct {
+	Node string
+	// Mode is "writer" or "read-only".
+	Mode     string
+	Started  time.Time
+	LastSeen time.Time
+	TTL      time.Duration
+}
+
+// Live reports whether the node sent a heartbeat within its TTL.
+func (n *NodeHeartbeat) Live() bool {
+	return time.Since(n.LastSeen) < n.TTL
+}
+
+// heartbeat is the state of this node's heartbeat.
+type heartbeat struct {
+	node    string
+	started time.Time
+	ttl     time.Duration
+	// warned holds the nodes already warned about.
+	warned map[string]bool
+}
+
+// heartbeatDir returns the directory of the heartbeat objects, next to the
+// prefix like the lock object.
+func (gd *GCSDatastore) heartbeatDir() string {
+	return strings.TrimSuffix(path.Join(gd.Config.Prefix), "/") + ".nodes/"
+}
+
+// nodeID identifies this datastore instance: the host, the process and a
+// random suffix for instances in the same process.
+func nodeID() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// startHeartbeat writes the first heartbeat, checks for other writers and
+// renews the heartbeat every TTL/3 until the datastore is closed.
+func (gd *GCSDatastore) startHeartbeat(ctx context.Context) error {
+	ttl := gd.Config.HeartbeatTTL
+	if ttl <= 0 {
+		ttl = DefaultHeartbeatTTL
+	}
+	gd.heartbeat = &heartbeat{node: nodeID(), started: time.Now(), ttl: ttl, warned: map[string]bool{}}
+	if err := gd.beat(ctx); err != nil {
+		logger.Warnf("Failed to write heartbeat: %v", err)
+		return err
+	}
+	gd.background(func(ctx context.Context) {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := gd.beat(ctx); err != nil && ctx.Err() == nil {
+				logger.Warnf("Failed to renew heartbeat: %v", err)
+			}
+		}
+	})
+	return nil
+}
+
+// beat writes this node's heartbeat, then checks the others.
+func (gd *GCSDatastore) beat(ctx context.Context) error {
+	hb := gd.heartbeat
+	mode := modeWriter
+	if gd.readOnly.Load() {
+		mode = modeReadOnly
+	}
+	w := gd.client.Bucket(gd.Config.Bucket).Object(gd.heartbeatDir() + hb.node).NewWriter(ctx)
+	w.ContentType = "text/plain"
+	w.Metadata = map[string]string{
+		"node":      hb.node,
+		"mode":      mode,
+		"started":   hb.started.UTC().Format(time.RFC3339Nano),
+		"heartbeat": time.Now().UTC().Format(time.RFC3339Nano),
+		"ttl":       hb.ttl.String(),
+	}
+	w.Write([]byte(hb.node))
+	if err := w.Close(); err != nil {
+		return err
+	}
+	nodes, err := gd.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		if n.Node == hb.node || n.Mode != modeWriter || !n.Live() || mode != modeWriter {
+			continue
+		}
+		gd.otherWriter(n)
+	}
+	return nil
+}
+
+// otherWriter handles another live writer: it warns once per node, and
+// with ReadOnlyOnConflict makes this node read-only if it started later.
+func (gd *GCSDatastore) otherWriter(n NodeHeartbeat) {
+	hb := gd.heartbeat
+	if !hb.warned[n.Node] {
+		hb.warned[n.Node] = true
+		logger.Warnf("Another writer, %s, is using gs://%s/%s (started %s, last seen %s). "+
+			"Concurrent writers can corrupt each other's data. Stop one of them.",
+			n.Node, gd.Config.Bucket, gd.Config.Prefix, n.Started.Format(time.RFC3339), n.LastSeen.Format(time.RFC3339))
+	}
+	if !gd.Config.ReadOnlyOnConflict {
+		return
+	}
+	if n.Started.Before(hb.started) || (n.Started.Equal(hb.started) && n.Node < hb.node) {
+		if !gd.readOnly.Swap(true) {
+			logger.Warnf("Switching to read-only mode, since %s started writing first.", n.Node)
+		}
+	}
+}
+
+// Nodes returns the heartbeats of the nodes using the datastore, including
+// nodes that stopped without removing theirs.
+func (gd *GCSDatastore) Nodes(ctx context.Context) ([]NodeHeartbeat, error) {
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, &storage.Query{Prefix: gd.heartbeatDir()})
+	nodes := []NodeHeartbeat{}
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nodes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		n := NodeHeartbeat{
+			Node:     attrs.Metadata["node"],
+			Mode:     attrs.Metadata["mode"],
+			LastSeen: lockHeartbeat(attrs),
+			TTL:      DefaultHeartbeatTTL,
+		}
+		n.Started, _ = time.Parse(time.RFC3339Nano, attrs.Metadata["started"])
+		if ttl, err := time.ParseDuration(attrs.Metadata["ttl"]); err == nil {
+			n.TTL = ttl
+		}
+		nodes = append(nodes, n)
+	}
+}
+
+// ReadOnly reports whether writes fail with ErrReadOnly.
+func (gd *GCSDatastore) ReadOnly() bool {
+	return gd.readOnly.Load()
+}
+
+// stopHeartbeat removes this node's heartbeat.
+func (gd *GCSDatastore) stopHeartbeat(ctx context.Context) {
+	if gd.heartbeat == nil {
+		return
+	}
+	err := gd.client.Bucket(gd.Config.Bucket).Object(gd.heartbeatDir() + gd.heartbeat.node).Delete(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		logger.Warnf("Failed to remove heartbeat: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// sizeBounds are the inclusive upper bounds of the size histogram buckets:
+// 1kB, 4kB, ... 4MB, and a catch-all.
+var sizeBounds = [...]int64{
+	1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, math.MaxInt64,
+}
+
+// SizeBucket counts values of at most UpperBound bytes that didn't fit a
+// smaller bucket.
+type SizeBucket struct {
+	UpperBound int64
+	Count      int64
+}
+
+// sizeHistogram counts values by size.
+type sizeHistogram struct {
+	counts [len(sizeBounds)]atomic.Int64
+	bytes  atomic.Int64
+}
+
+func (h *sizeHistogram) observe(size int) {
+	for i, b := range sizeBounds {
+		if int64(size) <= b {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.bytes.Add(int64(size))
+}
+
+func (h *sizeHistogram) snapshot() []SizeBucket {
+	buckets := make([]SizeBucket, len(sizeBounds))
+	for i, b := range sizeBounds {
+		buckets[i] = SizeBucket{UpperBound: b, Count: h.counts[i].Load()}
+	}
+	return buckets
+}
@@ -0,0 +1,91 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// RequiredPermissions are the IAM permissions the datastore needs on its
+// bucket. Updates cover SetTTL, holds and the writer lock heartbeat.
+var RequiredPermissions = []string{
+	"storage.objects.get",
+	"storage.objects.list",
+	"storage.objects.create",
+	"storage.objects.update",
+	"storage.objects.delete",
+}
+
+// MissingPermissionsError lists the required IAM permissions that the
+// credentials in use lack on the bucket.
+type MissingPermissionsError struct {
+	Bucket      string
+	Permissions []string
+}
+
+func (e *MissingPermissionsError) Error() string {
+	return fmt.Sprintf("gcsds: missing permissions on bucket %s: %s",
+		e.Bucket, strings.Join(e.Permissions, ", "))
+}
+
+// missingPermissions returns the required permissions not granted on the
+// bucket.
+func (gd *GCSDatastore) missingPermissions(ctx context.Context) ([]string, error) {
+	bkt := gd.client.Bucket(gd.Config.Bucket)
+	granted, err := bkt.IAM().TestPermissions(ctx, RequiredPermissions)
+	if err != nil {
+		return nil, err
+	}
+	have := map[string]bool{}
+	for _, p := range granted {
+		have[p] = true
+	}
+	missing := []string{}
+	for _, p := range RequiredPermissions {
+		if !have[p] {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+// checkPermissions fails if any required permission is missing. If the
+// permissions can't be tested at all, e.g. against an emulator, it only logs.
+func (gd *GCSDatastore) checkPermissions(ctx context.Context) error {
+	missing, err := gd.missingPermissions(ctx)
+	if err != nil {
+		logger.Warnf("Unable to test IAM permissions on bucket %s. Continuing. err: %v", gd.Config.Bucket, err)
+		return nil
+	}
+	if len(missing) > 0 {
+		err := &MissingPermissionsError{Bucket: gd.Config.Bucket, Permissions: missing}
+		logger.Error(err)
+		return err
+	}
+	return nil
+}
+
+// checkUniformAccess warns about buckets using fine-grained ACLs. The
+// datastore relies on IAM alone, and per-object ACLs make access hard to
+// reason about.
+func (gd *GCSDatastore) checkUniformAccess() {
+	if gd.bucketAttrs != nil && !gd.bucketAttrs.UniformBucketLevelAccess.Enabled {
+		logger.Warnf("Bucket %s does not use uniform bucket-level access. Consider enabling it: "+
+			"gcloud storage buckets update gs://%s --uniform-bucket-level-access",
+			gd.Config.Bucket, gd.Config.Bucket)
+	}
+}
@@ -0,0 +1,171 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// importBatchPerWorker is the number of values ImportDatastore reads per
+// worker before writing them.
+const importBatchPerWorker = 4
+
+// ImportOptions configure ImportDatastore.
+type ImportOptions struct {
+	// Prefix is the key prefix the keys of the source are stored under,
+	// e.g. "/blocks" for a flatfs datastore when the datastore is mounted
+	// at / in kubo. When it is mounted at /blocks, blocks are at the root.
+	Prefix string
+	// Verify checks, once the values are imported, that every key of the
+	// source is stored in GCS with the size of its value.
+	Verify bool
+}
+
+// ImportResult reports what ImportDatastore did.
+type ImportResult struct {
+	// Imported is the number of values written, and Skipped the number
+	// of those already stored.
+	Imported int
+	Skipped  int
+	// Verified is the number of keys checked in GCS.
+	Verified int
+}
+
+// ImportDatastore stores the values of src, e.g. a datastore of a kubo
+// repo on disk, under opts.Prefix, so that nodes can move to GCS without
+// adding their content again. Keys already stored are skipped without
+// reading their value, so an interrupted import resumes where it stopped,
+// and values are written in parallel through PutMany. With opts.Verify, it
+// then stats every key in GCS and returns a BatchError with those missing
+// or of the wrong size. The metadata must be loaded.
+func (gd *GCSDatastore) ImportDatastore(ctx context.Context, src ds.Datastore, opts ImportOptions) (ImportResult, error) {
+	start := time.Now()
+	prefix := strings.TrimSuffix(ds.NewKey(opts.Prefix).String(), "/")
+	var res ImportResult
+	batch := importBatchPerWorker * gd.workers()
+	keys := make([]ds.Key, 0, batch)
+	values := make([][]byte, 0, batch)
+	flush := func() error {
+		if err := gd.PutMany(ctx, keys, values); err != nil {
+			return err
+		}
+		res.Imported += len(keys)
+		keys, values = keys[:0], values[:0]
+		return nil
+	}
+	err := forEachKey(ctx, src, func(k string) error {
+		key := ds.RawKey(prefix + k)
+		if gd.mdCache.Has(key.String()) {
+			res.Skipped++
+			return nil
+		}
+		value, err := src.Get(ctx, ds.RawKey(k))
+		if err == ds.ErrNotFound {
+			// Deleted since it was listed.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("gcsds: reading %s from the source: %w", k, err)
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+		if len(keys) == batch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return res, err
+	}
+	logger.Infof("Imported %d values, skipped %d already stored, in %.2f s.",
+		res.Imported, res.Skipped, time.Since(start).Seconds())
+	if !opts.Verify {
+		return res, nil
+	}
+	return res, gd.verifyImport(ctx, src, prefix, &res)
+}
+
+// verifyImport stats the object of every key of src, stored under prefix,
+// with up to Workers requests in parallel.
+func (gd *GCSDatastore) verifyImport(ctx context.Context, src ds.Datastore, prefix string, res *ImportResult) error {
+	var mu sync.Mutex
+	errs := map[ds.Key]error{}
+	fail := func(k ds.Key, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs[k] = err
+	}
+	sem := make(chan struct{}, gd.workers())
+	var wg sync.WaitGroup
+	err := forEachKey(ctx, src, func(k string) error {
+		size, err := src.GetSize(ctx, ds.RawKey(k))
+		if err == ds.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("gcsds: reading %s from the source: %w", k, err)
+		}
+		res.Verified++
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key ds.Key) {
+			defer func() { <-sem; wg.Done() }()
+			m, err := gd.statObject(ctx, key.String())
+			if err != nil {
+				fail(key, err)
+			} else if m.Size != int64(size) {
+				fail(key, fmt.Errorf("gcsds: stored %d bytes, expected %d", m.Size, size))
+			}
+		}(ds.RawKey(prefix + k))
+		return nil
+	})
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &BatchError{Errors: errs}
+	}
+	logger.Infof("Verified %d imported values.", res.Verified)
+	return nil
+}
+
+// forEachKey calls f with the keys of src until it fails.
+func forEachKey(ctx context.Context, src ds.Datastore, f func(key string) error) error {
+	results, err := src.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+	for r := range results.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		if err := f(r.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// ChecksumError is returned when the CRC32C of an object's data doesn't
+// match the one GCS recorded, on a read or write. It matches ErrCorrupt.
+type ChecksumError struct {
+	// Object is the name of the object in the bucket.
+	Object string
+	Err    error
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("gcsds: corrupt object %s: %v", e.Object, e.Err)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return e.Err
+}
+
+// setChecksum makes w send the CRC32C of value, so that GCS rejects the
+// write if the data was corrupted on the way.
+func setChecksum(w *storage.Writer, value []byte) {
+	w.CRC32C = crc32.Checksum(value, castagnoli)
+	w.SendCRC32C = true
+}
+
+// checksumError returns err as a ChecksumError for object if it's a failed
+// CRC32C check, by the client on a read or by GCS on a write.
+func checksumError(object string, err error) error {
+	var cerr *ChecksumError
+	if err == nil || errors.As(err, &cerr) {
+		return err
+	}
+	if isBadCRC(err) || isChecksumMismatch(err) {
+		return &ChecksumError{Object: object, Err: err}
+	}
+	return err
+}
+
+// isChecksumMismatch reports whether err is GCS rejecting a write whose
+// data doesn't match its CRC32C.
+func isChecksumMismatch(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusBadRequest && strings.Contains(gerr.Message, "CRC32C")
+}
+
+// verifyChecksum makes r check the data it reads in full against want,
+// the CRC32C GCS recorded for the object. The client checks full reads
+// itself only if the response carries the CRC32C.
+func (r *objectReader) verifyChecksum(want uint32) {
+	r.verify = true
+	r.want = want
+}
+
+// readStored reads the data of the object as stored.
+func (r *objectReader) readStored(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.verify {
+		r.crc = crc32.Update(r.crc, castagnoli, p[:n])
+		if err == io.EOF && r.crc != r.want {
+			err = fmt.Errorf("CRC32C is %08x, GCS recorded %08x", r.crc, r.want)
+		}
+	}
+	return n, checksumError(r.name, err)
+}
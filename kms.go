@@ -0,0 +1,73 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// newWriter returns a writer to obj, encrypted with Config.KMSKeyName if
+// set.
+func (gd *GCSDatastore) newWriter(ctx context.Context, obj *storage.ObjectHandle) *storage.Writer {
+	w := obj.NewWriter(ctx)
+	w.KMSKeyName = gd.Config.KMSKeyName
+	return w
+}
+
+// newCopier returns a copier of src to dst, encrypted with
+// Config.KMSKeyName if set.
+func (gd *GCSDatastore) newCopier(dst, src *storage.ObjectHandle) *storage.Copier {
+	c := dst.CopierFrom(src)
+	c.DestinationKMSKeyName = gd.Config.KMSKeyName
+	return c
+}
+
+// kmsKeyLocation returns the location of a Cloud KMS key named
+// "projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY".
+func kmsKeyLocation(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 8 || parts[0] != "projects" || parts[2] != "locations" ||
+		parts[4] != "keyRings" || parts[6] != "cryptoKeys" {
+		return "", fmt.Errorf("gcsds: KMS key name %q is not projects/PROJECT/locations/LOCATION/keyRings/RING/cryptoKeys/KEY", name)
+	}
+	for _, p := range parts {
+		if p == "" {
+			return "", fmt.Errorf("gcsds: KMS key name %q has an empty component", name)
+		}
+	}
+	return parts[3], nil
+}
+
+// checkKMSKey fails if Config.KMSKeyName is malformed or in another
+// location than the bucket, which GCS would only report on the first
+// write.
+func (gd *GCSDatastore) checkKMSKey() error {
+	if gd.Config.KMSKeyName == "" {
+		return nil
+	}
+	location, err := kmsKeyLocation(gd.Config.KMSKeyName)
+	if err != nil {
+		return err
+	}
+	if gd.bucketAttrs != nil && !strings.EqualFold(location, gd.bucketAttrs.Location) {
+		return fmt.Errorf("gcsds: KMS key %s is in %s, but bucket %s is in %s",
+			gd.Config.KMSKeyName, location, gd.Config.Bucket, strings.ToLower(gd.bucketAttrs.Location))
+	}
+	return nil
+}
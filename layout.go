@@ -0,0 +1,271 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// LayoutVersion is the version of the object layout this package writes.
+const LayoutVersion = 1
+
+// Layout describes how keys and values are stored in objects. It is
+// recorded in a manifest object next to the prefix, and checked on start,
+// so that a datastore never reads or writes objects of another layout.
+type Layout struct {
+	Version int `json:"version"`
+	// Keys is how object names are derived from keys. "escaped" appends
+	// the key, escaped, to the Prefix, and "prefix" appended it as it was.
+	Keys string `json:"keys"`
+	// Sharding is the flatfs spec of Config.Sharding, such as
+	// "/repo/flatfs/shard/v1/next-to-last/2", or "none". Packing is
+	// "packs" with Config.PackBlocks, "none" otherwise. Compression is the codec of Config.Compression,
+	// "none" if values aren't compressed.
+	Sharding    string `json:"sharding"`
+	Packing     string `json:"packing"`
+	Compression string `json:"compression"`
+	// Encryption is the scheme of Config.EncryptionKey, "none" if values
+	// aren't encrypted.
+	Encryption string `json:"encryption"`
+}
+
+// ErrLayoutMismatch matches every LayoutError.
+var ErrLayoutMismatch = errors.New("gcsds: bucket layout mismatch")
+
+// LayoutError is returned when the layout recorded in the bucket differs
+// from the layout of the configuration, and can't be migrated.
+type LayoutError struct {
+	Found    Layout
+	Expected Layout
+}
+
+func (e *LayoutError) Error() string {
+	return fmt.Sprintf("gcsds: bucket layout %+v does not match the configured layout %+v", e.Found, e.Expected)
+}
+
+func (e *LayoutError) Is(target error) bool {
+	return target == ErrLayoutMismatch
+}
+
+// layoutMigration converts the objects of a datastore from one layout to
+// another.
+type layoutMigration struct {
+	from, to Layout
+	migrate  func(ctx context.Context, gd *GCSDatastore) error
+}
+
+// baseLayout is the layout without any of the options changing it.
+var baseLayout = Layout{
+	Version:     LayoutVersion,
+	Keys:        KeysEscaped,
+	Sharding:    ShardingNone,
+	Packing:     PackingNone,
+	Compression: CompressionNone,
+	Encryption:  EncryptionNone,
+}
+
+// layoutMigrations are the supported migrations, tried until the
+// configured layout is reached.
+var layoutMigrations = optionMigrations()
+
+// optionMigrations returns the migrations that change one of the key
+// escaping, codec, encryption and packing of values, from any combination
+// of the others: to escaped keys, to another codec, to encrypted, to
+// packed. Values are read according to their own encoding and location, so
+// those already stored stay as they are. Only escaping renames objects.
+func optionMigrations() []layoutMigration {
+	keep := func(context.Context, *GCSDatastore) error { return nil }
+	ms := []layoutMigration{}
+	for _, keys := range []string{KeysPrefix, KeysEscaped} {
+		for _, codec := range []string{CompressionNone, CompressionGzip, CompressionZstd} {
+			for _, encryption := range []string{EncryptionNone, EncryptionAES256GCM} {
+				for _, packing := range []string{PackingNone, PackingPacks} {
+					from := baseLayout
+					from.Keys, from.Compression, from.Encryption, from.Packing = keys, codec, encryption, packing
+					if keys == KeysPrefix {
+						to := from
+						to.Keys = KeysEscaped
+						ms = append(ms, layoutMigration{from: from, to: to, migrate: escapeNames})
+					}
+					var tos []Layout
+					for _, to := range []string{CompressionGzip, CompressionZstd} {
+						if to != codec {
+							l := from
+							l.Compression = to
+							tos = append(tos, l)
+						}
+					}
+					if encryption == EncryptionNone {
+						l := from
+						l.Encryption = EncryptionAES256GCM
+						tos = append(tos, l)
+					}
+					if packing == PackingNone {
+						l := from
+						l.Packing = PackingPacks
+						tos = append(tos, l)
+					}
+					for _, to := range tos {
+						ms = append(ms, layoutMigration{from: from, to: to, migrate: keep})
+					}
+				}
+			}
+		}
+	}
+	return ms
+}
+
+// layout returns the layout of the configuration.
+func (gd *GCSDatastore) layout() Layout {
+	l := baseLayout
+	l.Compression = gd.compression()
+	l.Encryption = gd.encryption()
+	l.Packing = gd.packing()
+	l.Sharding = gd.sharding()
+	return l
+}
+
+// layoutPath returns the name of the manifest object, next to the prefix
+// like the lock object.
+func (gd *GCSDatastore) layoutPath() string {
+	return strings.TrimSuffix(path.Join(gd.Config.Prefix), "/") + ".layout"
+}
+
+// readLayout returns the layout in the manifest and its generation, or
+// storage.ErrObjectNotExist.
+func (gd *GCSDatastore) readLayout(ctx context.Context) (Layout, int64, error) {
+	r, err := gd.client.Bucket(gd.Config.Bucket).Object(gd.layoutPath()).NewReader(ctx)
+	if err != nil {
+		return Layout{}, 0, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Layout{}, 0, err
+	}
+	var l Layout
+	if err := json.Unmarshal(data, &l); err != nil {
+		return Layout{}, 0, fmt.Errorf("gcsds: corrupt layout manifest gs://%s/%s: %w", gd.Config.Bucket, gd.layoutPath(), err)
+	}
+	if l.Encryption == "" {
+		// Written before encryption.
+		l.Encryption = EncryptionNone
+	}
+	return l, r.Attrs.Generation, nil
+}
+
+// writeLayout writes the manifest if its generation is still gen, or if it
+// doesn't exist for gen 0.
+func (gd *GCSDatastore) writeLayout(ctx context.Context, l Layout, gen int64) error {
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.layoutPath())
+	if gen == 0 {
+		obj = obj.If(storage.Conditions{DoesNotExist: true})
+	} else {
+		obj = obj.If(storage.Conditions{GenerationMatch: gen})
+	}
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	w := obj.NewWriter(ctx)
+	w.ContentType = "application/json"
+	w.Write(data)
+	return w.Close()
+}
+
+// checkLayout verifies that the bucket uses the configured layout. A
+// bucket without a manifest, written before manifests or empty, gets one
+// for the configured layout. With MigrateLayout, a bucket in another layout
+// is migrated if possible.
+func (gd *GCSDatastore) checkLayout(ctx context.Context) error {
+	expected := gd.layout()
+	found, gen, err := gd.readLayout(ctx)
+	if err == storage.ErrObjectNotExist {
+		err = gd.writeLayout(ctx, expected, 0)
+		if !isPreconditionFailed(err) {
+			return err
+		}
+		// Another node wrote it first. Read it back once: a manifest that
+		// exists but can't be read isn't retried forever.
+		found, gen, err = gd.readLayout(ctx)
+		if err == storage.ErrObjectNotExist {
+			return fmt.Errorf("gcsds: layout manifest gs://%s/%s written concurrently but not readable", gd.Config.Bucket, gd.layoutPath())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for found != expected {
+		m, ok := findMigration(found, expected)
+		if !ok || !gd.Config.MigrateLayout {
+			logger.Warnf("Bucket layout %+v does not match the configured layout %+v. Migration available: %v",
+				found, expected, ok)
+			return &LayoutError{Found: found, Expected: expected}
+		}
+		logger.Infof("Migrating bucket layout from %+v to %+v.", m.from, m.to)
+		if err := m.migrate(ctx, gd); err != nil {
+			return fmt.Errorf("gcsds: layout migration failed: %w", err)
+		}
+		if err := gd.writeLayout(ctx, m.to, gen); err != nil {
+			return err
+		}
+		if found, gen, err = gd.readLayout(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findMigration returns the first migration on the shortest path from
+// found to expected. The migrations between unsharded layouts apply to
+// sharded ones too, which keep their sharding.
+func findMigration(found, expected Layout) (layoutMigration, bool) {
+	if sharding := found.Sharding; sharding != ShardingNone && sharding == expected.Sharding {
+		found.Sharding, expected.Sharding = ShardingNone, ShardingNone
+		m, ok := findMigration(found, expected)
+		m.from.Sharding, m.to.Sharding = sharding, sharding
+		return m, ok
+	}
+	// first holds the first migration on the way to each layout reached.
+	first := map[Layout]layoutMigration{}
+	queue := []Layout{found}
+	for len(queue) > 0 {
+		l := queue[0]
+		queue = queue[1:]
+		for _, m := range layoutMigrations {
+			if _, seen := first[m.to]; m.from != l || m.to == found || seen {
+				continue
+			}
+			step, ok := first[l]
+			if !ok {
+				step = m
+			}
+			if m.to == expected {
+				return step, true
+			}
+			first[m.to] = step
+			queue = append(queue, m.to)
+		}
+	}
+	return layoutMigration{}, false
+}
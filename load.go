@@ -0,0 +1,419 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Delay before retrying a failed background metadata load.
+const loadRetryDelay = 30 * time.Second
+
+// LoadMetadataInBackground loads the metadata like LoadMetadata, but
+// returns immediately. Until the load completes, Has and GetSize fall back
+// to GCS for keys not loaded yet, and Query waits for it. Progress is
+// reported in Stats. Failed loads are retried from where they stopped.
+func (gd *GCSDatastore) LoadMetadataInBackground() {
+	gd.metadataLoading = make(chan struct{})
+	gd.background(func(ctx context.Context) {
+		defer close(gd.metadataLoading)
+		for gd.loadMetadata(ctx) != nil {
+			select {
+			case <-time.After(loadRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// metadataPending reports whether the metadata cache is incomplete, while
+// a background load runs or with LazyMetadata until one completes.
+func (gd *GCSDatastore) metadataPending() bool {
+	return !gd.metadataLoaded.Load() && (gd.metadataLoading != nil || gd.Config.LazyMetadata)
+}
+
+// waitMetadata waits for a background load to end.
+func (gd *GCSDatastore) waitMetadata(ctx context.Context) error {
+	if !gd.metadataPending() || gd.metadataLoading == nil {
+		return nil
+	}
+	logger.Debugf("Query waits for metadata to load.")
+	select {
+	case <-gd.metadataLoading:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RefreshMetadata lists the bucket again to reconcile the loaded metadata
+// with it: objects written by other nodes are added, and objects they
+// deleted are removed once the listing completes. Writes and deletes made
+// meanwhile by this node are kept. The keys of the metadata cache are
+// copied while listing. A refresh that fails is resumed by the next call,
+// like a load. It fails if the metadata isn't loaded.
+func (gd *GCSDatastore) RefreshMetadata(ctx context.Context) error {
+	gd.loadMu.Lock()
+	defer gd.loadMu.Unlock()
+	if gd.loadResume.shards == nil {
+		if !gd.metadataLoaded.Load() {
+			return errors.New("gcsds: refresh of metadata that isn't loaded")
+		}
+		gd.unlistedMu.Lock()
+		gd.unlisted = make(map[string]struct{}, gd.mdCache.Size())
+		next := gd.mdCache.Iterator("", 0)
+		for m := next(); m != nil; m = next() {
+			gd.unlisted[m.Key] = struct{}{}
+		}
+		gd.unlistedMu.Unlock()
+	}
+	return gd.loadMetadataLocked(ctx)
+}
+
+// runRefresh refreshes the metadata every MetadataRefreshInterval until
+// ctx is done.
+func (gd *GCSDatastore) runRefresh(ctx context.Context) {
+	ticker := time.NewTicker(gd.Config.MetadataRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !gd.metadataLoaded.Load() {
+			continue
+		}
+		if err := gd.RefreshMetadata(ctx); err != nil && ctx.Err() == nil {
+			logger.Warnf("Failed to refresh metadata: %v", err)
+		}
+	}
+}
+
+// loadListed stores m, listed from the bucket, in the metadata cache. For
+// a key in unlisted, it replaces the cached entry, unlike LoadEntry, but
+// keeps when it was last read.
+func (gd *GCSDatastore) loadListed(m Metadata) {
+	gd.unlistedMu.Lock()
+	defer gd.unlistedMu.Unlock()
+	if _, ok := gd.unlisted[m.Key]; ok {
+		delete(gd.unlisted, m.Key)
+		if old, err := gd.mdCache.Get(m.Key); err == nil {
+			gd.observeClass(old, m.StorageClass)
+			if old.Accessed > m.Accessed {
+				m.Accessed = old.Accessed
+			}
+		}
+		gd.mdCache.PutEntry(m)
+		return
+	}
+	gd.mdCache.LoadEntry(m)
+}
+
+// forgetUnlisted stops the running load from replacing or dropping the
+// cached entry for key, which was just written or deleted. Call it before
+// updating the metadata cache.
+func (gd *GCSDatastore) forgetUnlisted(key string) {
+	gd.unlistedMu.Lock()
+	defer gd.unlistedMu.Unlock()
+	delete(gd.unlisted, key)
+}
+
+// dropUnlisted removes the entries that a complete load didn't list, which
+// are for objects deleted since they were cached.
+func (gd *GCSDatastore) dropUnlisted() {
+	gd.unlistedMu.Lock()
+	defer gd.unlistedMu.Unlock()
+	if len(gd.unlisted) > 0 {
+		logger.Infof("Dropped %d objects deleted since they were cached.", len(gd.unlisted))
+	}
+	for key := range gd.unlisted {
+		if gd.packs.has(key) {
+			// Packed values have no object to list.
+			continue
+		}
+		gd.mdCache.Delete(key)
+	}
+	gd.unlisted = nil
+}
+
+// statObject gets the metadata for key from GCS and caches it.
+func (gd *GCSDatastore) statObject(ctx context.Context, key string) (*Metadata, error) {
+	if m, ok := gd.packs.stat(key); ok {
+		gd.mdCache.LoadEntry(m)
+		return &m, nil
+	}
+	attrs, err := gd.retryer(gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key)), key).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, requestError("stat", gd.GCSPath(key), err)
+	}
+	m := objectMetadata(key, attrs)
+	gd.mdCache.LoadEntry(m)
+	return &m, nil
+}
+
+// objectMetadata returns the metadata of key, stored in the object with
+// attrs.
+func objectMetadata(key string, attrs *storage.ObjectAttrs) Metadata {
+	return Metadata{
+		Key:          key,
+		Size:         objectSize(attrs),
+		StorageClass: attrs.StorageClass,
+		Accessed:     attrs.Updated.Unix(),
+		Expiration:   objectExpiration(attrs),
+	}
+}
+
+// A metadata load lists the bucket in shards, in parallel, split by the
+// characters after a common prefix of the object names. The key space is
+// split again until there are loadShardTarget shards, up to loadShardDepth
+// times.
+const (
+	loadShardTarget = 16
+	loadShardDepth  = 3
+	// loadStemLength bounds how many characters shared by all names
+	// under a prefix are skipped before splitting it, as in "CIQ" of
+	// sha2-256 block keys.
+	loadStemLength = 4
+	// loadPageSize is the number of objects per page of listing.
+	loadPageSize = 1000
+)
+
+// loadShard is the range of object names from start to end, or the end of
+// the listing if end is "", that a metadata load lists.
+type loadShard struct {
+	start, end string
+	// next is the last object listed, where listing resumes. done is set
+	// once the shard was listed.
+	next string
+	done bool
+}
+
+// loadShards splits the listing of a metadata load into shards covering
+// all object names under the prefix.
+func (gd *GCSDatastore) loadShards(ctx context.Context) ([]*loadShard, error) {
+	if gd.shard != nil {
+		return gd.shardLoadShards(ctx)
+	}
+	prefixes := []string{gd.listPrefix()}
+	for depth := 0; depth < loadShardDepth && len(prefixes) < loadShardTarget; depth++ {
+		split := []string{}
+		for _, p := range prefixes {
+			children, err := gd.splitPrefix(ctx, p)
+			if err != nil {
+				return nil, err
+			}
+			if len(children) == 0 {
+				children = []string{p}
+			}
+			split = append(split, children...)
+		}
+		if len(split) == len(prefixes) {
+			break
+		}
+		prefixes = split
+	}
+	// Each shard extends to the next, so names outside of the prefixes,
+	// like the prefixes themselves, are listed too.
+	prefixes[0] = gd.listPrefix()
+	shards := make([]*loadShard, len(prefixes))
+	for i, p := range prefixes {
+		shards[i] = &loadShard{start: p}
+		if i+1 < len(prefixes) {
+			shards[i].end = prefixes[i+1]
+		}
+	}
+	return shards, nil
+}
+
+// splitPrefix returns the prefixes of one more character that the object
+// names under p, in order, after skipping the characters all of them share.
+// Prefixes with fewer names than a page of listing aren't split.
+func (gd *GCSDatastore) splitPrefix(ctx context.Context, p string) ([]string, error) {
+	query := &storage.Query{Prefix: p}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, query)
+	it.PageInfo().MaxSize = loadPageSize
+	for n := 0; n <= loadPageSize; n++ {
+		_, err := it.Next()
+		if err == iterator.Done {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := 0; ; i++ {
+		children, err := gd.childPrefixes(ctx, p)
+		if err != nil || len(children) != 1 || i == loadStemLength {
+			return children, err
+		}
+		p = children[0]
+	}
+}
+
+// childPrefixes returns the prefixes of one more printable ASCII character
+// than p that object names start with, in order. Each is checked by a list
+// request of one object, in parallel.
+func (gd *GCSDatastore) childPrefixes(ctx context.Context, p string) ([]string, error) {
+	const first, last = '!', '~'
+	found := make([]bool, last-first+1)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, gd.workers())
+	for c := first; c <= last; c++ {
+		wg.Add(1)
+		go func(c rune) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			query := &storage.Query{Prefix: p + string(c)}
+			if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+				once.Do(func() { firstErr = err })
+				return
+			}
+			it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, query)
+			it.PageInfo().MaxSize = 1
+			_, err := it.Next()
+			if err == iterator.Done {
+				return
+			}
+			if err != nil {
+				once.Do(func() { firstErr = err })
+				return
+			}
+			found[c-first] = true
+		}(c)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	children := []string{}
+	for i, ok := range found {
+		if ok {
+			children = append(children, p+string(rune(first+i)))
+		}
+	}
+	return children, nil
+}
+
+// listMetadata returns the entries under prefix in key order, listed from
+// GCS rather than the metadata cache, and the listing error once done.
+// Sharded names aren't in key order, so their entries are sorted once all
+// are listed.
+func (gd *GCSDatastore) listMetadata(ctx context.Context, prefix string) (func() *Metadata, func() error) {
+	query := &storage.Query{Prefix: gd.namePrefix(prefix)}
+	// Only the attributes of the metadata are listed.
+	err := query.SetAttrSelection(listedAttrs)
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, query)
+	next := func() *Metadata {
+		for err == nil {
+			var attrs *storage.ObjectAttrs
+			attrs, err = it.Next()
+			if err == iterator.Done {
+				err = nil
+				return nil
+			}
+			if err != nil {
+				err = requestError("list", query.Prefix, err)
+				logger.Warnf("Failed to list objects for query: %v", err)
+				return nil
+			}
+			if key := gd.keyOf(attrs.Name); strings.HasPrefix(key, prefix) {
+				m := objectMetadata(key, attrs)
+				return &m
+			}
+		}
+		return nil
+	}
+	if gd.shard != nil {
+		next = sortedMetadata(next)
+	}
+	return next, func() error { return err }
+}
+
+// listedAttrs are the attributes objectMetadata reads.
+var listedAttrs = []string{"Name", "Size", "StorageClass", "Updated", "CustomTime", "ContentEncoding", "Metadata"}
+
+// namePrefix returns a prefix of the names of the objects for the keys
+// under prefix. Names are sharded, and escaped, by segment, so the last
+// segment of prefix is left out unless it's a prefix of the escaped segments
+// it starts.
+func (gd *GCSDatastore) namePrefix(prefix string) string {
+	dir, base := path.Split(strings.TrimPrefix(prefix, "/"))
+	p := strings.TrimPrefix(escapeKey("/"+dir), "/")
+	if gd.shard == nil && base != "." && base != ".." && utf8.ValidString(base) && len(escapeSegment(base)) < maxNameSegment-2 {
+		p += escapeSegment(base)
+	}
+	return gd.listPrefix() + p
+}
+
+// sortedMetadata returns the entries of next in key order.
+func sortedMetadata(next func() *Metadata) func() *Metadata {
+	var entries []*Metadata
+	for m := next(); m != nil; m = next() {
+		entries = append(entries, m)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return func() *Metadata {
+		if len(entries) == 0 {
+			return nil
+		}
+		m := entries[0]
+		entries = entries[1:]
+		return m
+	}
+}
+
+// mergeMetadata returns the entries of a and b, which are in key order,
+// in key order. Entries of a take precedence over those of b with the same
+// key.
+func mergeMetadata(a, b func() *Metadata) func() *Metadata {
+	ma, mb := a(), b()
+	return func() *Metadata {
+		var m *Metadata
+		switch {
+		case ma == nil && mb == nil:
+			return nil
+		case mb == nil || ma != nil && ma.Key <= mb.Key:
+			if mb != nil && ma.Key == mb.Key {
+				mb = b()
+			}
+			m, ma = ma, a()
+		default:
+			m, mb = mb, b()
+		}
+		return m
+	}
+}
@@ -0,0 +1,126 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// predefinedDualRegions maps the predefined dual-region locations to the
+// regions they replicate between.
+var predefinedDualRegions = map[string][]string{
+	"ASIA1": {"ASIA-NORTHEAST1", "ASIA-NORTHEAST2"},
+	"EUR4":  {"EUROPE-NORTH1", "EUROPE-WEST4"},
+	"NAM4":  {"US-CENTRAL1", "US-EAST1"},
+}
+
+// Locality describes where the node runs relative to the bucket.
+type Locality struct {
+	// NodeRegion is the GCE region of this node, or "" when not on GCE.
+	NodeRegion string
+	// BucketLocation and BucketLocationType are as reported by GCS.
+	BucketLocation     string
+	BucketLocationType string
+	// CoLocated is true if the bucket stores data in NodeRegion.
+	CoLocated bool
+}
+
+// nodeRegion returns the GCE region this process runs in, or "" if not on
+// GCE.
+func nodeRegion() string {
+	if !metadata.OnGCE() {
+		return ""
+	}
+	zone, err := metadata.Zone()
+	if err != nil {
+		logger.Warnf("Failed to get GCE zone: %v", err)
+		return ""
+	}
+	// Zones are regions with a suffix, e.g. us-central1-a.
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return strings.ToUpper(zone[:i])
+	}
+	return ""
+}
+
+// bucketRegions returns the regions that hold the bucket's data. Multi-region
+// buckets return nil, as they have no specific region.
+func bucketRegions(attrs *storage.BucketAttrs) []string {
+	switch strings.ToLower(attrs.LocationType) {
+	case "region":
+		return []string{strings.ToUpper(attrs.Location)}
+	case "dual-region":
+		if attrs.CustomPlacementConfig != nil {
+			regions := []string{}
+			for _, r := range attrs.CustomPlacementConfig.DataLocations {
+				regions = append(regions, strings.ToUpper(r))
+			}
+			return regions
+		}
+		return predefinedDualRegions[strings.ToUpper(attrs.Location)]
+	}
+	return nil
+}
+
+// checkLocality compares the node's region with the bucket's location and
+// warns on a mismatch, since cross-region reads cost both latency and
+// egress. For buckets co-located with the node, reads switch to the
+// configured regional endpoint.
+func (gd *GCSDatastore) checkLocality(ctx context.Context) error {
+	if gd.bucketAttrs == nil {
+		return nil
+	}
+	loc := Locality{
+		NodeRegion:         nodeRegion(),
+		BucketLocation:     gd.bucketAttrs.Location,
+		BucketLocationType: gd.bucketAttrs.LocationType,
+	}
+	for _, r := range bucketRegions(gd.bucketAttrs) {
+		if r == loc.NodeRegion {
+			loc.CoLocated = true
+		}
+	}
+	gd.locality = loc
+	if loc.NodeRegion == "" {
+		return nil
+	}
+	if !loc.CoLocated {
+		logger.Warnf("node region %s is not a data location of bucket %s (%s %s). "+
+			"Reads will cross regions, adding latency and egress cost.",
+			loc.NodeRegion, gd.Config.Bucket, loc.BucketLocationType, loc.BucketLocation)
+		return nil
+	}
+	if gd.Config.RegionalEndpoint == "" {
+		return nil
+	}
+	endpoint := gd.Config.RegionalEndpoint
+	if strings.Contains(endpoint, "%s") {
+		endpoint = fmt.Sprintf(endpoint, strings.ToLower(loc.NodeRegion))
+	}
+	client, err := newClient(ctx, gd.Config, gd.throttle, option.WithEndpoint(endpoint))
+	if err != nil {
+		logger.Warnf("Failed to create GCS client for endpoint %s: %v", endpoint, err)
+		return err
+	}
+	logger.Infof("Reading from co-located endpoint %s.", endpoint)
+	gd.readClient = client
+	return nil
+}
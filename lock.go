@@ -0,0 +1,238 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// DefaultLockTTL is how long a writer lock survives without a heartbeat
+// when Config.WriterLockTTL is unset.
+const DefaultLockTTL = time.Minute
+
+var (
+	// ErrLocked matches every LockedError.
+	ErrLocked = errors.New("gcsds: prefix is locked by another writer")
+	// ErrLockLost is returned by writes after the datastore's writer lock
+	// could not be renewed.
+	ErrLockLost = errors.New("gcsds: writer lock lost")
+)
+
+// LockedError is returned when another writer holds the lock.
+type LockedError struct {
+	Owner string
+	// Heartbeat is when the owner last renewed the lock.
+	Heartbeat time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("gcsds: prefix is locked by %s, last heartbeat %s",
+		e.Owner, e.Heartbeat.Format(time.RFC3339))
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// Lock is an advisory lock on a datastore prefix, held by renewing a lock
+// object in the bucket. A lock not renewed within its TTL is stale and
+// can be taken over, so a crashed writer doesn't block its replacement.
+type Lock struct {
+	obj   *storage.ObjectHandle
+	owner string
+	ttl   time.Duration
+	gen   int64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+	err    error
+}
+
+// lockPath returns the name of the lock object, next to the prefix rather
+// than inside it so that it isn't listed as a key.
+func (gd *GCSDatastore) lockPath() string {
+	return strings.TrimSuffix(path.Join(gd.Config.Prefix), "/") + ".lock"
+}
+
+// lockOwner identifies this process in the lock object.
+func lockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// AcquireLock takes the writer lock on the datastore prefix for owner, or
+// returns a LockedError if another owner holds it. The lock is renewed in
+// the background every ttl/3 until released.
+func (gd *GCSDatastore) AcquireLock(ctx context.Context, owner string, ttl time.Duration) (*Lock, error) {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.lockPath())
+	attrs, err := writeLock(ctx, obj.If(storage.Conditions{DoesNotExist: true}), owner, ttl)
+	if isPreconditionFailed(err) {
+		attrs, err = takeOverLock(ctx, obj, owner, ttl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lctx, cancel := context.WithCancel(context.Background())
+	l := &Lock{obj: obj, owner: owner, ttl: ttl, gen: attrs.Generation, cancel: cancel, done: make(chan struct{})}
+	go l.renew(lctx)
+	logger.Infof("Acquired writer lock gs://%s/%s as %s.", gd.Config.Bucket, gd.lockPath(), owner)
+	return l, nil
+}
+
+// takeOverLock replaces a stale lock held by another owner.
+func takeOverLock(ctx context.Context, obj *storage.ObjectHandle, owner string, ttl time.Duration) (*storage.ObjectAttrs, error) {
+	held, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		// Released in the meantime.
+		return writeLock(ctx, obj.If(storage.Conditions{DoesNotExist: true}), owner, ttl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	heldOwner := held.Metadata["owner"]
+	heldTTL, err := time.ParseDuration(held.Metadata["ttl"])
+	if err != nil {
+		heldTTL = DefaultLockTTL
+	}
+	heartbeat := lockHeartbeat(held)
+	if time.Since(heartbeat) < heldTTL {
+		return nil, &LockedError{Owner: heldOwner, Heartbeat: heartbeat}
+	}
+	logger.Warnf("Taking over writer lock from %s, last heartbeat %s.", heldOwner, heartbeat.Format(time.RFC3339))
+	attrs, err := writeLock(ctx, obj.If(storage.Conditions{GenerationMatch: held.Generation}), owner, ttl)
+	if isPreconditionFailed(err) {
+		// Another writer took it over first.
+		return nil, &LockedError{Owner: "another writer", Heartbeat: time.Now()}
+	}
+	return attrs, err
+}
+
+// lockHeartbeat returns when the lock was last renewed: the later of the
+// object's update time and the heartbeat recorded by the owner.
+func lockHeartbeat(attrs *storage.ObjectAttrs) time.Time {
+	heartbeat := attrs.Updated
+	if t, err := time.Parse(time.RFC3339Nano, attrs.Metadata["heartbeat"]); err == nil && t.After(heartbeat) {
+		heartbeat = t
+	}
+	return heartbeat
+}
+
+func writeLock(ctx context.Context, obj *storage.ObjectHandle, owner string, ttl time.Duration) (*storage.ObjectAttrs, error) {
+	w := obj.NewWriter(ctx)
+	w.ContentType = "text/plain"
+	w.Metadata = map[string]string{"owner": owner, "ttl": ttl.String(),
+		"heartbeat": time.Now().UTC().Format(time.RFC3339Nano)}
+	w.Write([]byte(owner))
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Attrs(), nil
+}
+
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// renew updates the lock object's heartbeat until the lock is released or
+// can't be renewed. Transient errors are retried, but only until the last
+// heartbeat is so old that the lock could go stale before the next one:
+// another writer may then take it over.
+func (l *Lock) renew(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	// lastOK is when the heartbeat of the last successful renewal was
+	// taken, no later than the one recorded in the object.
+	lastOK := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		heartbeat := time.Now()
+		rctx, cancel := context.WithTimeout(ctx, l.ttl/3)
+		_, err := l.obj.If(storage.Conditions{GenerationMatch: l.gen}).Update(rctx, storage.ObjectAttrsToUpdate{
+			Metadata: map[string]string{"owner": l.owner, "ttl": l.ttl.String(),
+				"heartbeat": heartbeat.UTC().Format(time.RFC3339Nano)},
+		})
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == storage.ErrObjectNotExist || isPreconditionFailed(err) {
+			l.fail(fmt.Errorf("%w: taken over or removed", ErrLockLost))
+			return
+		}
+		if err == nil {
+			lastOK = heartbeat
+			continue
+		}
+		// The next renewal, a tick away, could complete only after the
+		// lock went stale.
+		if time.Since(lastOK) >= l.ttl-l.ttl/3 {
+			l.fail(fmt.Errorf("%w: not renewed since %s: %v", ErrLockLost, lastOK.Format(time.RFC3339), err))
+			return
+		}
+		logger.Warnf("Failed to renew writer lock: %v", err)
+	}
+}
+
+func (l *Lock) fail(err error) {
+	logger.Error(err)
+	l.mu.Lock()
+	l.err = err
+	l.mu.Unlock()
+}
+
+// Done is closed when the lock is released or lost.
+func (l *Lock) Done() <-chan struct{} {
+	return l.done
+}
+
+// Err returns ErrLockLost once the lock was lost, and nil otherwise.
+func (l *Lock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Release stops renewing the lock and deletes the lock object, unless it
+// was taken over.
+func (l *Lock) Release(ctx context.Context) error {
+	l.cancel()
+	<-l.done
+	err := l.obj.If(storage.Conditions{GenerationMatch: l.gen}).Delete(ctx)
+	if err == storage.ErrObjectNotExist || isPreconditionFailed(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import logging "github.com/ipfs/go-log/v2"
+
+// logger logs under the "gcsds" subsystem. Its level is set with
+// GOLOG_LOG_LEVEL, e.g. GOLOG_LOG_LEVEL="gcsds=debug".
+var logger = logging.Logger("gcsds")
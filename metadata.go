@@ -15,7 +15,11 @@ package gcsds
 // limitations under the License.
 
 import (
+	"sort"
 	"strings"
+	"sync"
+	"time"
+	"unsafe"
 
 	ds "github.com/ipfs/go-datastore"
 )
@@ -25,56 +29,263 @@ type Metadata struct {
 	// Store object size as int64.
 	// In practice, all IPFS objects are max 256kB.
 	Size int64
+	// StorageClass is the GCS storage class, or "" for the bucket default.
+	StorageClass string
+	// Accessed is the unix time of the last read or write.
+	Accessed int64
+	// Expiration is when the value expires, or zero if it doesn't.
+	Expiration time.Time
 }
 
+// Usage is the number and total size of entries.
+type Usage struct {
+	Objects int64
+	Bytes   int64
+}
+
+// MetadataIndex holds the metadata of the stored objects: in RAM by
+// MetadataCache, or on local disk by DiskMetadataCache for buckets with
+// more objects than fit in RAM.
+type MetadataIndex interface {
+	Has(key string) bool
+	Get(key string) (*Metadata, error)
+	Put(key string, size int64)
+	PutEntry(m Metadata)
+	StartLoading()
+	LoadEntry(m Metadata)
+	DoneLoading()
+	TrackPrefix(prefix string)
+	PrefixUsage(prefix string) Usage
+	Touch(key string)
+	SetStorageClass(key string, class string)
+	StorageClasses() map[string]int
+	Delete(key string)
+	Bytes() int64
+	Size() int
+	// Iterator returns the entries under prefix in key order, up to limit
+	// unless it's 0.
+	Iterator(prefix string, limit int) func() *Metadata
+}
+
+var _ MetadataIndex = (*MetadataCache)(nil)
+
 type MetadataCache struct {
+	mu    sync.RWMutex
 	cache map[string]*Metadata
+	// bytes is the total size of all entries, and keyBytes the total
+	// length of their keys.
+	bytes    int64
+	keyBytes int64
+	// prefixes holds the usage of tracked key prefixes.
+	prefixes map[string]*Usage
+	// deleted holds the keys deleted while loading, which a listing
+	// started earlier may still return. It is nil when not loading.
+	deleted map[string]bool
 }
 
 func NewMetadataCache() *MetadataCache {
 	return &MetadataCache{
-		cache: make(map[string]*Metadata),
+		cache:    make(map[string]*Metadata),
+		prefixes: make(map[string]*Usage),
 	}
 }
 
 func (md *MetadataCache) Has(key string) bool {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
 	_, ok := md.cache[key]
 	return ok
 }
 
+// Get returns a copy of the metadata for key.
 func (md *MetadataCache) Get(key string) (*Metadata, error) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
 	if v, ok := md.cache[key]; ok {
-		return v, nil
+		m := *v
+		return &m, nil
 	}
 	return nil, ds.ErrNotFound
 }
 
 func (md *MetadataCache) Put(key string, size int64) {
-	md.cache[key] = &Metadata{Key: key, Size: size}
+	md.PutEntry(Metadata{Key: key, Size: size, Accessed: time.Now().Unix()})
+}
+
+// PutEntry stores m under m.Key.
+func (md *MetadataCache) PutEntry(m Metadata) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if old, ok := md.cache[m.Key]; ok {
+		md.account(old, -1)
+	}
+	md.cache[m.Key] = &m
+	md.account(&m, 1)
+}
+
+// StartLoading prepares for LoadEntry calls from a bucket listing that
+// runs concurrently with Put and Delete.
+func (md *MetadataCache) StartLoading() {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.deleted = make(map[string]bool)
+}
+
+// LoadEntry stores m from a listing, unless the key was written or deleted
+// since StartLoading, which makes the listed entry stale.
+func (md *MetadataCache) LoadEntry(m Metadata) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if _, ok := md.cache[m.Key]; ok || md.deleted[m.Key] {
+		return
+	}
+	md.cache[m.Key] = &m
+	md.account(&m, 1)
+}
+
+// DoneLoading ends loading.
+func (md *MetadataCache) DoneLoading() {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.deleted = nil
+}
+
+// account adds (sign 1) or removes (sign -1) m from the usage totals.
+func (md *MetadataCache) account(m *Metadata, sign int64) {
+	md.bytes += sign * m.Size
+	md.keyBytes += sign * int64(len(m.Key))
+	for prefix, u := range md.prefixes {
+		if strings.HasPrefix(m.Key, prefix) {
+			u.Objects += sign
+			u.Bytes += sign * m.Size
+		}
+	}
+}
+
+// TrackPrefix starts accounting the usage of entries under prefix.
+func (md *MetadataCache) TrackPrefix(prefix string) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if _, ok := md.prefixes[prefix]; ok {
+		return
+	}
+	u := &Usage{}
+	for k, v := range md.cache {
+		if strings.HasPrefix(k, prefix) {
+			u.Objects++
+			u.Bytes += v.Size
+		}
+	}
+	md.prefixes[prefix] = u
+}
+
+// PrefixUsage returns the usage of a prefix passed to TrackPrefix.
+func (md *MetadataCache) PrefixUsage(prefix string) Usage {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	if u, ok := md.prefixes[prefix]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+// Touch records an access to key.
+func (md *MetadataCache) Touch(key string) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if v, ok := md.cache[key]; ok {
+		v.Accessed = time.Now().Unix()
+	}
+}
+
+// SetStorageClass records the storage class of key.
+func (md *MetadataCache) SetStorageClass(key string, class string) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if v, ok := md.cache[key]; ok {
+		v.StorageClass = class
+	}
+}
+
+// StorageClasses counts entries per storage class.
+func (md *MetadataCache) StorageClasses() map[string]int {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	classes := map[string]int{}
+	for _, v := range md.cache {
+		classes[v.StorageClass]++
+	}
+	return classes
 }
 
 func (md *MetadataCache) Delete(key string) {
-	delete(md.cache, key)
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if md.deleted != nil {
+		md.deleted[key] = true
+	}
+	if old, ok := md.cache[key]; ok {
+		md.account(old, -1)
+		delete(md.cache, key)
+	}
+}
+
+// Bytes returns the total size of all entries.
+func (md *MetadataCache) Bytes() int64 {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	return md.bytes
 }
 
 func (md *MetadataCache) Size() int {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
 	return len(md.cache)
 }
 
-// Offset not supported, for now.
+// Keys returns the keys of the unexpired entries under prefix, in no
+// particular order. Unlike Iterator, it doesn't copy or sort the entries.
+func (md *MetadataCache) Keys(prefix string) []string {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	keys := []string{}
+	for k, v := range md.cache {
+		if strings.HasPrefix(k, prefix) && !expired(v.Expiration) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// metadataEntryOverhead estimates the memory used by an entry of a
+// MetadataCache besides its key: the Metadata, a pointer to it, and the
+// key header and hash map slot.
+const metadataEntryOverhead = int64(unsafe.Sizeof(Metadata{})) + 8 + 16 + 16
+
+// MemoryUsage estimates the memory used by the entries.
+func (md *MetadataCache) MemoryUsage() int64 {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	return md.keyBytes + int64(len(md.cache))*metadataEntryOverhead
+}
+
+// Iterator returns the entries under prefix in key order, up to limit
+// unless it's 0. The entries are copied up front, so the iterator doesn't
+// see later changes.
 func (md *MetadataCache) Iterator(prefix string, limit int) func() *Metadata {
 	values := []*Metadata{}
-	count := 0
-	// TODO(leffler): Iterate consistently over map, so that offset and limit work correctly.
+	md.mu.RLock()
 	for k, v := range md.cache {
 		if strings.HasPrefix(k, prefix) {
-			values = append(values, v)
-			count++
-		}
-		if limit > 0 && count == limit {
-			break
+			m := *v
+			values = append(values, &m)
 		}
 	}
+	md.mu.RUnlock()
+	sort.Slice(values, func(i, j int) bool { return values[i].Key < values[j].Key })
+	if limit > 0 && len(values) > limit {
+		values = values[:limit]
+	}
 
 	i := 0
 	l := len(values)
@@ -0,0 +1,75 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+// cacheGauges publish the cache statistics as IPFS metrics.
+type cacheGauges struct {
+	items, bytes, hits, misses, evictions, rejections metrics.Gauge
+	metadataEntries, metadataMemory                   metrics.Gauge
+}
+
+func newCacheGauges() *cacheGauges {
+	gauge := func(name, help string) metrics.Gauge {
+		return metrics.New("gcsds."+name, help).Gauge()
+	}
+	return &cacheGauges{
+		items:           gauge("datacache.items", "Number of values in the data cache"),
+		bytes:           gauge("datacache.bytes", "Total size of the values in the data cache"),
+		hits:            gauge("datacache.hits_total", "Data cache hits"),
+		misses:          gauge("datacache.misses_total", "Data cache misses"),
+		evictions:       gauge("datacache.evictions_total", "Values evicted from the data cache"),
+		rejections:      gauge("datacache.rejections_total", "Values not admitted to the data cache"),
+		metadataEntries: gauge("metadata.entries", "Number of entries in the metadata cache"),
+		metadataMemory:  gauge("metadata.memory_bytes", "Estimated memory used by the metadata cache"),
+	}
+}
+
+// set publishes the current statistics. Unlike Stats, it doesn't iterate
+// over the metadata cache.
+func (g *cacheGauges) set(gd *GCSDatastore) {
+	dc := gd.dataCache.Stats()
+	g.items.Set(float64(dc.Items))
+	g.bytes.Set(float64(dc.Bytes))
+	g.hits.Set(float64(dc.Hits))
+	g.misses.Set(float64(dc.Misses))
+	g.evictions.Set(float64(dc.Evictions))
+	g.rejections.Set(float64(dc.Rejections))
+	g.metadataEntries.Set(float64(gd.mdCache.Size()))
+	g.metadataMemory.Set(float64(gd.metadataMemory()))
+}
+
+// runMetrics publishes the cache statistics every MetricsInterval until
+// ctx is done.
+func (gd *GCSDatastore) runMetrics(ctx context.Context) {
+	g := newCacheGauges()
+	g.set(gd)
+	ticker := time.NewTicker(gd.Config.MetricsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.set(gd)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Pending mirror operations per worker before Put and Delete block.
+const mirrorQueuePerWorker = 100
+
+// mirrorOp is a pending copy, or delete, of key in the mirror bucket.
+type mirrorOp struct {
+	key    string
+	delete bool
+}
+
+// startMirror checks that the mirror bucket is readable and, with
+// MirrorCopy, starts the workers that keep it up to date.
+func (gd *GCSDatastore) startMirror(ctx context.Context) error {
+	_, err := gd.readClient.Bucket(gd.Config.MirrorBucket).Attrs(ctx)
+	if err != nil {
+		logger.Warnf("Failed to get attributes for mirror bucket %s: %v", gd.Config.MirrorBucket, err)
+		return err
+	}
+	if !gd.Config.MirrorCopy {
+		return nil
+	}
+	gd.mirrorQueue = make(chan mirrorOp, mirrorQueuePerWorker*gd.workers())
+	for i := 0; i < gd.workers(); i++ {
+		gd.background(gd.runMirror)
+	}
+	return nil
+}
+
+// enqueueMirror queues op for the mirror workers. It blocks while the
+// queue is full, so a slow mirror applies back pressure to writers instead
+// of growing without bound. The key isn't read from the mirror until op
+// is applied.
+func (gd *GCSDatastore) enqueueMirror(ctx context.Context, op mirrorOp) {
+	gd.mirrorMu.Lock()
+	if gd.mirrorPending == nil {
+		gd.mirrorPending = map[string]int{}
+	}
+	gd.mirrorPending[op.key]++
+	gd.mirrorMu.Unlock()
+	select {
+	case gd.mirrorQueue <- op:
+	case <-ctx.Done():
+	case <-gd.ctx.Done():
+	}
+}
+
+func (gd *GCSDatastore) runMirror(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			if n := len(gd.mirrorQueue); n > 0 {
+				logger.Warnf("Closing with %d mirror operations pending.", n)
+			}
+			return
+		case op := <-gd.mirrorQueue:
+			if err := gd.applyMirror(ctx, op); err != nil {
+				// The mirror object stays stale, and unread.
+				gd.stats.mirrorErrors.Add(1)
+				logger.Warnw("Failed to update mirror bucket", "bucket", gd.Config.MirrorBucket, "key", op.key, "err", err)
+				continue
+			}
+			gd.mirrorMu.Lock()
+			if gd.mirrorPending[op.key]--; gd.mirrorPending[op.key] <= 0 {
+				delete(gd.mirrorPending, op.key)
+			}
+			gd.mirrorMu.Unlock()
+		}
+	}
+}
+
+// applyMirror applies op to the mirror bucket. Copies run server-side.
+func (gd *GCSDatastore) applyMirror(ctx context.Context, op mirrorOp) error {
+	path := gd.GCSPath(op.key)
+	dst := gd.client.Bucket(gd.Config.MirrorBucket).Object(path)
+	if op.delete {
+		err := dst.Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+		return nil
+	}
+	src := gd.client.Bucket(gd.Config.Bucket).Object(path)
+	_, err := dst.CopierFrom(src).Run(ctx)
+	if err == storage.ErrObjectNotExist {
+		// Deleted from the primary since. The queued delete follows.
+		return nil
+	}
+	return err
+}
+
+// mirrorStale reports whether the mirror object of key may be stale
+// because of a pending or failed copy or delete.
+func (gd *GCSDatastore) mirrorStale(key string) bool {
+	gd.mirrorMu.Lock()
+	defer gd.mirrorMu.Unlock()
+	return gd.mirrorPending[key] > 0
+}
+
+// openMirror opens the value of key in the mirror bucket like openObject,
+// if the mirror object has size, that of the value in the primary bucket.
+// Other mirror objects are stale, e.g. of deleted or overwritten values,
+// and are an error.
+func (gd *GCSDatastore) openMirror(ctx context.Context, key string, size, offset, length int64) (*objectReader, error) {
+	obj := gd.retryer(gd.readClient.Bucket(gd.Config.MirrorBucket).Object(gd.GCSPath(key)), key)
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		return nil, requestError("stat", obj.ObjectName(), err)
+	}
+	if got := objectSize(attrs); got != size {
+		return nil, fmt.Errorf("gcsds: mirror object %s has %d bytes, not %d", obj.ObjectName(), got, size)
+	}
+	r, err := gd.openObject(ctx, obj.Generation(attrs.Generation), key, offset, length, false)
+	if err == nil && offset == 0 && length < 0 {
+		r.verifyChecksum(attrs.CRC32C)
+	}
+	return r, err
+}
@@ -0,0 +1,153 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+const (
+	// Notifications pulled at once.
+	notificationBatch = 100
+	// Delay before pulling again after a failed pull.
+	notificationRetryDelay = 10 * time.Second
+)
+
+// startNotifications subscribes to the bucket notifications of
+// Config.NotificationSubscription, and applies them in the background. The
+// Pub/Sub emulator is used if PUBSUB_EMULATOR_HOST is set.
+func (gd *GCSDatastore) startNotifications(ctx context.Context) error {
+	var opts []option.ClientOption
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		opts = append(opts, option.WithEndpoint("http://"+host+"/"), option.WithoutAuthentication())
+	} else {
+		credOpts, err := credentialOptions(ctx, gd.Config, pubsub.PubsubScope)
+		if err != nil {
+			return err
+		}
+		opts = credOpts
+	}
+	svc, err := pubsub.NewService(ctx, opts...)
+	if err != nil {
+		logger.Warnf("Failed to create Pub/Sub client: %v", err)
+		return err
+	}
+	subs := pubsub.NewProjectsSubscriptionsService(svc)
+	gd.background(func(ctx context.Context) {
+		gd.pullNotifications(ctx, subs)
+	})
+	return nil
+}
+
+// pullNotifications applies the notifications of the subscription until
+// ctx is done. Notifications that can't be applied aren't acknowledged, so
+// Pub/Sub delivers them again.
+func (gd *GCSDatastore) pullNotifications(ctx context.Context, subs *pubsub.ProjectsSubscriptionsService) {
+	sub := gd.Config.NotificationSubscription
+	for ctx.Err() == nil {
+		resp, err := subs.Pull(sub, &pubsub.PullRequest{MaxMessages: notificationBatch}).Context(ctx).Do()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			gd.stats.notificationErrors.Add(1)
+			logger.Warnf("Failed to pull notifications from %s: %v", sub, err)
+			select {
+			case <-time.After(notificationRetryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		var acks []string
+		for _, m := range resp.ReceivedMessages {
+			if m.Message == nil {
+				continue
+			}
+			if err := gd.applyNotification(ctx, m.Message.Attributes); err != nil {
+				gd.stats.notificationErrors.Add(1)
+				logger.Warnf("Failed to apply notification for %s: %v", m.Message.Attributes["objectId"], err)
+				continue
+			}
+			acks = append(acks, m.AckId)
+		}
+		if len(acks) == 0 {
+			continue
+		}
+		_, err = subs.Acknowledge(sub, &pubsub.AcknowledgeRequest{AckIds: acks}).Context(ctx).Do()
+		if err != nil && ctx.Err() == nil {
+			gd.stats.notificationErrors.Add(1)
+			logger.Warnf("Failed to acknowledge notifications from %s: %v", sub, err)
+		}
+	}
+}
+
+// applyNotification updates the caches for the object of a bucket
+// notification with the given attributes. Notifications for other buckets
+// and objects outside the prefix are ignored.
+//
+// The object is looked up again rather than taken from the notification,
+// since notifications arrive late and out of order: the write it reports
+// may have been overwritten or deleted since, by this node or another.
+func (gd *GCSDatastore) applyNotification(ctx context.Context, attrs map[string]string) error {
+	name := attrs["objectId"]
+	if attrs["bucketId"] != gd.Config.Bucket || !strings.HasPrefix(name, gd.listPrefix()) {
+		return nil
+	}
+	switch attrs["eventType"] {
+	case "OBJECT_FINALIZE", "OBJECT_METADATA_UPDATE", "OBJECT_DELETE", "OBJECT_ARCHIVE":
+	default:
+		return nil
+	}
+	// The finalize of the new generation reports an overwrite.
+	if attrs["overwrittenByGeneration"] != "" {
+		return nil
+	}
+	gd.stats.notifications.Add(1)
+	key := gd.keyOf(name)
+	oattrs, err := gd.client.Bucket(gd.Config.Bucket).Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		gd.forgetUnlisted(key)
+		gd.mdCache.Delete(key)
+		gd.dataCache.Remove(key)
+		gd.removeDisk(key)
+		return nil
+	}
+	if err != nil {
+		return requestError("stat", name, err)
+	}
+	m := objectMetadata(key, oattrs)
+	gd.forgetUnlisted(key)
+	if old, err := gd.mdCache.Get(key); err == nil {
+		gd.observeClass(old, m.StorageClass)
+		if old.Accessed > m.Accessed {
+			m.Accessed = old.Accessed
+		}
+	}
+	gd.mdCache.PutEntry(m)
+	gd.forgetMissing(key)
+	// Blocks can't change, other values may have been overwritten.
+	if !isBlockKey(key) {
+		gd.dataCache.Remove(key)
+		gd.removeDisk(key)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Custom metadata that Config.ObjectMetadata can record on the objects of
+// values, under these names.
+const (
+	// ObjectMetadataKey is the datastore key of the value.
+	ObjectMetadataKey = "key"
+	// ObjectMetadataNode is Config.NodeID, or else an ID of the host and
+	// process.
+	ObjectMetadataNode = "node"
+	// ObjectMetadataWritten is when the value was written, in RFC 3339.
+	ObjectMetadataWritten = "written"
+	// ObjectMetadataCodec is the compression codec of the stored value,
+	// "none" for values stored uncompressed.
+	ObjectMetadataCodec = "codec"
+)
+
+// initObjectMetadata checks Config.ObjectMetadata.
+func (gd *GCSDatastore) initObjectMetadata() error {
+	for _, name := range gd.Config.ObjectMetadata {
+		switch name {
+		case ObjectMetadataKey, ObjectMetadataWritten, ObjectMetadataCodec:
+		case ObjectMetadataNode:
+			gd.node = gd.Config.NodeID
+			if gd.node == "" {
+				gd.node = nodeID()
+			}
+		default:
+			return fmt.Errorf("gcsds: unknown object metadata %q", name)
+		}
+	}
+	return nil
+}
+
+// annotate adds the metadata of Config.ObjectMetadata to w, which writes
+// the value of key stored with encoding.
+func (gd *GCSDatastore) annotate(w *storage.Writer, key, encoding string) {
+	if len(gd.Config.ObjectMetadata) == 0 {
+		return
+	}
+	if w.Metadata == nil {
+		w.Metadata = make(map[string]string, len(gd.Config.ObjectMetadata))
+	}
+	for _, name := range gd.Config.ObjectMetadata {
+		switch name {
+		case ObjectMetadataKey:
+			w.Metadata[name] = key
+		case ObjectMetadataNode:
+			w.Metadata[name] = gd.node
+		case ObjectMetadataWritten:
+			w.Metadata[name] = time.Now().UTC().Format(time.RFC3339Nano)
+		case ObjectMetadataCodec:
+			codec, _, _ := strings.Cut(encoding, ",")
+			if codec != CompressionGzip && codec != CompressionZstd {
+				codec = CompressionNone
+			}
+			w.Metadata[name] = codec
+		}
+	}
+}
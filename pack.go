@@ -0,0 +1,783 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/iterator"
+)
+
+// Packing is how small blocks are stored, recorded in the Layout.
+const (
+	PackingNone  = "none"
+	PackingPacks = "packs"
+)
+
+// Defaults of the pack options, see Config.PackBlocks.
+const (
+	DefaultPackSize         = 8 << 20
+	DefaultPackMaxValueSize = 16 << 10
+	DefaultPackFlushDelay   = 50 * time.Millisecond
+)
+
+const (
+	// packMagic ends every pack object, after the length of its index.
+	packMagic       = "gcsdspk1"
+	packTrailerSize = 8 + len(packMagic)
+
+	// A pack is compacted once it holds more dead bytes than live ones.
+	packCompactRatio = 0.5
+)
+
+// packLoc locates a value stored in a pack.
+type packLoc struct {
+	pack string
+	// offset and length are of the stored data, size of the value. The
+	// data is encoded with encoding, and crc is its CRC32C.
+	offset, length, size int64
+	encoding             string
+	crc                  uint32
+}
+
+// packEntry is a value, or the deletion of a key, in a pack.
+type packEntry struct {
+	key     string
+	loc     packLoc
+	deleted bool
+	// moved is set for the entries copied by a compaction, which only
+	// apply if the key didn't change meanwhile: a value if the key is
+	// still at from, a deletion if the key is still deleted.
+	moved bool
+	from  packLoc
+}
+
+// packInfo describes a stored pack.
+type packInfo struct {
+	name    string
+	entries []packEntry
+	// size is the size of the data, live the part of it the index
+	// points to.
+	size, live int64
+	class      string
+	updated    time.Time
+}
+
+// pendingPack is a pack being filled, then stored.
+type pendingPack struct {
+	name    string
+	data    bytes.Buffer
+	entries []packEntry
+	// done is closed once the pack is stored, or failed with err.
+	done chan struct{}
+	err  error
+}
+
+// packStore appends small blocks to large pack objects, and indexes the
+// packs in memory. Only one datastore may write the packs of a prefix:
+// the index is loaded on start and isn't refreshed.
+type packStore struct {
+	gd *GCSDatastore
+
+	mu    sync.Mutex
+	index map[string]packLoc
+	packs map[string]*packInfo
+	open  *pendingPack
+	// stamp is the time of the latest pack, to name the next one after
+	// it even if the clock went back.
+	stamp int64
+
+	// compactMu serializes compactions.
+	compactMu sync.Mutex
+}
+
+// packDir returns the prefix of the names of the pack objects, next to the
+// prefix like the lock object, so that listings of keys skip them.
+func (gd *GCSDatastore) packDir() string {
+	return strings.TrimSuffix(path.Join(gd.Config.Prefix), "/") + ".packs/"
+}
+
+// packing returns the packing of the configuration.
+func (gd *GCSDatastore) packing() string {
+	if gd.Config.PackBlocks {
+		return PackingPacks
+	}
+	return PackingNone
+}
+
+func (gd *GCSDatastore) packSize() int {
+	if gd.Config.PackSize > 0 {
+		return gd.Config.PackSize
+	}
+	return DefaultPackSize
+}
+
+func (gd *GCSDatastore) packMaxValueSize() int {
+	if gd.Config.PackMaxValueSize > 0 {
+		return gd.Config.PackMaxValueSize
+	}
+	return DefaultPackMaxValueSize
+}
+
+func (gd *GCSDatastore) packFlushDelay() time.Duration {
+	if gd.Config.PackFlushDelay > 0 {
+		return gd.Config.PackFlushDelay
+	}
+	return DefaultPackFlushDelay
+}
+
+// packable reports whether the value for key is stored in a pack. Values
+// that expire have objects of their own, with the expiration.
+func (gd *GCSDatastore) packable(key string, value []byte, expiration time.Time) bool {
+	return gd.packs != nil && expiration.IsZero() && len(value) <= gd.packMaxValueSize() && isBlockKey(key) && !gd.ephemeral(key)
+}
+
+// initPacks loads the index of the packs, with PackBlocks.
+func (gd *GCSDatastore) initPacks(ctx context.Context) error {
+	if !gd.Config.PackBlocks {
+		return nil
+	}
+	ps := &packStore{
+		gd:    gd,
+		index: make(map[string]packLoc),
+		packs: make(map[string]*packInfo),
+	}
+	if err := ps.load(ctx); err != nil {
+		return err
+	}
+	gd.packs = ps
+	if gd.Config.PackCompactInterval > 0 {
+		gd.background(gd.runCompaction)
+	}
+	return nil
+}
+
+// load reads the indexes of the stored packs, in parallel, and applies
+// them in order.
+func (ps *packStore) load(ctx context.Context) error {
+	gd := ps.gd
+	start := time.Now()
+	var infos []*packInfo
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, &storage.Query{Prefix: gd.packDir()})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return requestError("list", gd.packDir(), err)
+		}
+		infos = append(infos, &packInfo{
+			name:    attrs.Name,
+			size:    attrs.Size,
+			class:   attrs.StorageClass,
+			updated: attrs.Updated,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].name < infos[j].name })
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	sem := make(chan struct{}, gd.workers())
+	for _, info := range infos {
+		wg.Add(1)
+		go func(info *packInfo) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := ps.readIndex(ctx, info); err != nil {
+				once.Do(func() { firstErr = err })
+			}
+		}(info)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		logger.Warnf("Failed to load the pack indexes: %v", firstErr)
+		return firstErr
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, info := range infos {
+		ps.apply(info)
+		ps.stamp = packStamp(info.name)
+	}
+	for key, loc := range ps.index {
+		gd.mdCache.LoadEntry(ps.metadata(key, loc))
+	}
+	logger.Infof("Loaded %d packed values from %d packs in %.2f s.",
+		len(ps.index), len(infos), time.Since(start).Seconds())
+	return nil
+}
+
+// readIndex reads the index of the pack of info, whose size is that of the
+// object until then.
+func (ps *packStore) readIndex(ctx context.Context, info *packInfo) error {
+	obj := ps.gd.client.Bucket(ps.gd.Config.Bucket).Object(info.name)
+	trailer, err := readRange(ctx, obj, info.size-int64(packTrailerSize), int64(packTrailerSize))
+	if err != nil {
+		return err
+	}
+	if string(trailer[8:]) != packMagic {
+		return &ChecksumError{Object: info.name, Err: errors.New("gcsds: not a pack")}
+	}
+	n := int64(binary.BigEndian.Uint64(trailer))
+	info.size -= int64(packTrailerSize) + n
+	if info.size < 0 {
+		return &ChecksumError{Object: info.name, Err: errors.New("gcsds: pack index out of range")}
+	}
+	index, err := readRange(ctx, obj, info.size, n)
+	if err != nil {
+		return err
+	}
+	if info.entries, err = parsePackIndex(info.name, index); err != nil {
+		return &ChecksumError{Object: info.name, Err: err}
+	}
+	return nil
+}
+
+// readRange reads length bytes from offset of obj.
+func readRange(ctx context.Context, obj *storage.ObjectHandle, offset, length int64) ([]byte, error) {
+	if offset < 0 {
+		return nil, &ChecksumError{Object: obj.ObjectName(), Err: errors.New("gcsds: truncated pack")}
+	}
+	r, err := obj.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, requestError("read", obj.ObjectName(), err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, requestError("read", obj.ObjectName(), err)
+	}
+	return data, nil
+}
+
+// appendPackEntry appends e to an index.
+func appendPackEntry(b []byte, e packEntry) []byte {
+	b = binary.AppendUvarint(b, uint64(len(e.key)))
+	b = append(b, e.key...)
+	if e.deleted {
+		return append(b, 1)
+	}
+	b = append(b, 0)
+	b = binary.AppendUvarint(b, uint64(e.loc.offset))
+	b = binary.AppendUvarint(b, uint64(e.loc.length))
+	b = binary.AppendUvarint(b, uint64(e.loc.size))
+	b = binary.AppendUvarint(b, uint64(len(e.loc.encoding)))
+	b = append(b, e.loc.encoding...)
+	return binary.BigEndian.AppendUint32(b, e.loc.crc)
+}
+
+// parsePackIndex parses the index of the pack name.
+func parsePackIndex(name string, b []byte) ([]packEntry, error) {
+	r := bytes.NewReader(b)
+	str := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil || n > uint64(r.Len()) {
+			return "", io.ErrUnexpectedEOF
+		}
+		s := make([]byte, n)
+		r.Read(s)
+		return string(s), nil
+	}
+	var entries []packEntry
+	for r.Len() > 0 {
+		var e packEntry
+		var err error
+		if e.key, err = str(); err != nil {
+			return nil, err
+		}
+		flags, err := r.ReadByte()
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if flags == 1 {
+			e.deleted = true
+			entries = append(entries, e)
+			continue
+		}
+		e.loc.pack = name
+		for _, v := range []*int64{&e.loc.offset, &e.loc.length, &e.loc.size} {
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			*v = int64(n)
+		}
+		if e.loc.encoding, err = str(); err != nil {
+			return nil, err
+		}
+		var crc [4]byte
+		if _, err := io.ReadFull(r, crc[:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		e.loc.crc = binary.BigEndian.Uint32(crc[:])
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// apply adds the stored pack of info to the index. Call with mu held.
+func (ps *packStore) apply(info *packInfo) {
+	ps.packs[info.name] = info
+	for _, e := range info.entries {
+		old, had := ps.index[e.key]
+		if e.moved && (e.deleted && had || !e.deleted && (!had || old != e.from)) {
+			continue
+		}
+		if had {
+			if p := ps.packs[old.pack]; p != nil {
+				p.live -= old.length
+			}
+		}
+		if e.deleted {
+			delete(ps.index, e.key)
+			continue
+		}
+		ps.index[e.key] = e.loc
+		info.live += e.loc.length
+	}
+}
+
+// lookup returns where the value for key is packed.
+func (ps *packStore) lookup(key string) (packLoc, bool) {
+	if ps == nil {
+		return packLoc{}, false
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	loc, ok := ps.index[key]
+	return loc, ok
+}
+
+// has reports whether the value for key is packed.
+func (ps *packStore) has(key string) bool {
+	_, ok := ps.lookup(key)
+	return ok
+}
+
+// metadata returns the metadata of key, packed at loc. Call with mu held.
+func (ps *packStore) metadata(key string, loc packLoc) Metadata {
+	m := Metadata{Key: key, Size: loc.size}
+	if info := ps.packs[loc.pack]; info != nil {
+		m.StorageClass = info.class
+		m.Accessed = info.updated.Unix()
+	}
+	return m
+}
+
+// stat returns the metadata of key if it's packed.
+func (ps *packStore) stat(key string) (Metadata, bool) {
+	if ps == nil {
+		return Metadata{}, false
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	loc, ok := ps.index[key]
+	if !ok {
+		return Metadata{}, false
+	}
+	return ps.metadata(key, loc), true
+}
+
+// list returns the metadata of the packed keys under prefix.
+func (ps *packStore) list(prefix string) []*Metadata {
+	if ps == nil {
+		return nil
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	entries := []*Metadata{}
+	for key, loc := range ps.index {
+		if strings.HasPrefix(key, prefix) {
+			m := ps.metadata(key, loc)
+			entries = append(entries, &m)
+		}
+	}
+	return entries
+}
+
+// counts returns the number of packs and of packed values.
+func (ps *packStore) counts() (packs, values int) {
+	if ps == nil {
+		return 0, 0
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.packs), len(ps.index)
+}
+
+// put packs value under key, returning once the pack is stored.
+func (ps *packStore) put(ctx context.Context, key string, value []byte) error {
+	data, encoding := ps.gd.encodeStored(key, value)
+	e := packEntry{key: key, loc: packLoc{
+		length:   int64(len(data)),
+		size:     int64(len(value)),
+		encoding: encoding,
+		crc:      crc32.Checksum(data, castagnoli),
+	}}
+	return ps.append(ctx, e, data)
+}
+
+// delete packs the deletions of keys whose values are packed, and waits
+// until they're stored.
+func (ps *packStore) delete(ctx context.Context, keys ...string) error {
+	var pending []*pendingPack
+	for _, key := range keys {
+		if ps.has(key) {
+			p := ps.add(packEntry{key: key, deleted: true}, nil)
+			if len(pending) == 0 || pending[len(pending)-1] != p {
+				pending = append(pending, p)
+			}
+		}
+	}
+	for _, p := range pending {
+		if err := p.wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append adds e, with data, to the open pack and waits until it's stored.
+func (ps *packStore) append(ctx context.Context, e packEntry, data []byte) error {
+	return ps.add(e, data).wait(ctx)
+}
+
+// add adds e, with data, to the open pack and returns it. Concurrent
+// writes share packs: a pack is stored once full, or after PackFlushDelay.
+func (ps *packStore) add(e packEntry, data []byte) *pendingPack {
+	ps.mu.Lock()
+	p := ps.open
+	if p == nil {
+		p = ps.newPack()
+		ps.open = p
+		time.AfterFunc(ps.gd.packFlushDelay(), func() { ps.flushOpen(p) })
+	}
+	if !e.deleted {
+		e.loc.pack = p.name
+		e.loc.offset = int64(p.data.Len())
+		p.data.Write(data)
+	}
+	p.entries = append(p.entries, e)
+	full := p.data.Len() >= ps.gd.packSize()
+	if full {
+		ps.open = nil
+	}
+	ps.mu.Unlock()
+	if full {
+		go ps.store(ps.gd.ctx, p)
+	}
+	return p
+}
+
+// wait waits until p is stored.
+func (p *pendingPack) wait(ctx context.Context) error {
+	select {
+	case <-p.done:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newPack returns an empty pack, named after the latest one. Call with mu
+// held.
+func (ps *packStore) newPack() *pendingPack {
+	stamp := time.Now().UnixNano()
+	if stamp <= ps.stamp {
+		stamp = ps.stamp + 1
+	}
+	ps.stamp = stamp
+	var id [4]byte
+	rand.Read(id[:])
+	name := fmt.Sprintf("%s%016x-%s.pack", ps.gd.packDir(), stamp, hex.EncodeToString(id[:]))
+	return &pendingPack{name: name, done: make(chan struct{})}
+}
+
+// compactedName returns the name of the pack of the values compacted from
+// packs up to last. It sorts right after last, so that the packs after
+// last still override them.
+func compactedName(last string) string {
+	base, n := strings.TrimSuffix(last, ".pack"), 0
+	if i := strings.IndexByte(base, '~'); i >= 0 {
+		n, _ = strconv.Atoi(base[i+1:])
+		base = base[:i]
+	}
+	return fmt.Sprintf("%s~%06d.pack", base, n+1)
+}
+
+// packStamp returns the time in the name of a pack.
+func packStamp(name string) int64 {
+	base := path.Base(name)
+	if i := strings.IndexByte(base, '-'); i >= 0 {
+		base = base[:i]
+	}
+	stamp, _ := strconv.ParseInt(base, 16, 64)
+	return stamp
+}
+
+// flushOpen stores p if it's still open.
+func (ps *packStore) flushOpen(p *pendingPack) {
+	ps.mu.Lock()
+	if ps.open != p {
+		ps.mu.Unlock()
+		return
+	}
+	ps.open = nil
+	ps.mu.Unlock()
+	ps.store(ps.gd.ctx, p)
+}
+
+// flush stores the open pack, and waits for it.
+func (ps *packStore) flush() {
+	if ps == nil {
+		return
+	}
+	ps.mu.Lock()
+	p := ps.open
+	ps.mu.Unlock()
+	if p != nil {
+		ps.flushOpen(p)
+		<-p.done
+	}
+}
+
+// store writes p, followed by its index, and adds it to the index.
+func (ps *packStore) store(ctx context.Context, p *pendingPack) {
+	defer close(p.done)
+	gd := ps.gd
+	var index []byte
+	for _, e := range p.entries {
+		index = appendPackEntry(index, e)
+	}
+	size := int64(p.data.Len())
+	p.data.Write(index)
+	p.data.Write(binary.BigEndian.AppendUint64(nil, uint64(len(index))))
+	p.data.WriteString(packMagic)
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(p.name).If(storage.Conditions{DoesNotExist: true})
+	w := gd.newWriter(ctx, obj)
+	w.ContentType = "application/octet-stream"
+	setChecksum(w, p.data.Bytes())
+	w.Write(p.data.Bytes())
+	if err := w.Close(); err != nil {
+		p.err = checksumError(p.name, requestError("write", p.name, err))
+		logger.Warnf("Failed to store pack %s: %v", p.name, p.err)
+		return
+	}
+	attrs := w.Attrs()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.apply(&packInfo{
+		name:    p.name,
+		entries: p.entries,
+		size:    size,
+		class:   attrs.StorageClass,
+		updated: attrs.Updated,
+	})
+}
+
+// openPacked opens length bytes from offset of the value for key, packed
+// at loc, or the rest if length is negative.
+func (gd *GCSDatastore) openPacked(ctx context.Context, key string, loc packLoc, offset, length int64) (*objectReader, error) {
+	if offset > loc.size {
+		return nil, fmt.Errorf("gcsds: offset %d beyond the %d bytes of %s", offset, loc.size, key)
+	}
+	if length < 0 || offset+length > loc.size {
+		length = loc.size - offset
+	}
+	encoded := loc.encoding != ""
+	start, n := loc.offset+offset, length
+	if encoded {
+		start, n = loc.offset, loc.length
+	}
+	obj := gd.retryer(gd.readClient.Bucket(gd.Config.Bucket).Object(loc.pack), key)
+	r, err := obj.NewRangeReader(ctx, start, n)
+	if err == storage.ErrObjectNotExist {
+		// Compacted meanwhile.
+		if moved, ok := gd.packs.lookup(key); ok && moved != loc {
+			return gd.openPacked(ctx, key, moved, offset, length)
+		}
+		return nil, ds.ErrNotFound
+	}
+	if err != nil {
+		err = requestError("read", loc.pack, err)
+		logger.Errorf("Problem reading pack from GCS: %v", err)
+		return nil, err
+	}
+	reader := &objectReader{Reader: r, name: loc.pack}
+	if encoded || length == loc.size {
+		reader.verifyChecksum(loc.crc)
+	}
+	if !encoded {
+		return reader, nil
+	}
+	if err := gd.decodeObject(reader, key, loc.encoding, offset, length); err != nil {
+		reader.Close()
+		err = checksumError(loc.pack, err)
+		logger.Errorf("Problem reading pack from GCS: %v", err)
+		return nil, err
+	}
+	return reader, nil
+}
+
+// readPacked returns the value of key, packed at loc.
+func (gd *GCSDatastore) readPacked(ctx context.Context, key string, loc packLoc) ([]byte, error) {
+	r, err := gd.openPacked(ctx, key, loc, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readAll(r)
+}
+
+// runCompaction compacts the packs every PackCompactInterval until ctx is
+// done.
+func (gd *GCSDatastore) runCompaction(ctx context.Context) {
+	ticker := time.NewTicker(gd.Config.PackCompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := gd.CompactPacks(ctx); err != nil && ctx.Err() == nil {
+				logger.Warnf("Compacting packs failed: %v", err)
+			}
+		}
+	}
+}
+
+// CompactPacks rewrites the packs that hold more deleted or overwritten
+// values than live ones, into new packs of their live values, and deletes
+// them. It returns the number of packs deleted.
+func (gd *GCSDatastore) CompactPacks(ctx context.Context) (int, error) {
+	ps := gd.packs
+	if ps == nil {
+		return 0, nil
+	}
+	ps.compactMu.Lock()
+	defer ps.compactMu.Unlock()
+	ps.mu.Lock()
+	var sparse, deletions []*packInfo
+	// Deletions are kept while other packs may hold values they delete.
+	others := make(map[string]bool)
+	for _, info := range ps.packs {
+		switch {
+		case info.size == 0:
+			deletions = append(deletions, info)
+			continue
+		case float64(info.size-info.live) >= packCompactRatio*float64(info.size):
+			sparse = append(sparse, info)
+			continue
+		}
+		for _, e := range info.entries {
+			if !e.deleted {
+				others[e.key] = true
+			}
+		}
+	}
+	// Packs of deletions only are dropped once they delete nothing.
+	for _, info := range deletions {
+		needed := false
+		for _, e := range info.entries {
+			needed = needed || others[e.key]
+		}
+		if !needed {
+			sparse = append(sparse, info)
+		}
+	}
+	ps.mu.Unlock()
+	sort.Slice(sparse, func(i, j int) bool { return sparse[i].name < sparse[j].name })
+	compacted := 0
+	var freed int64
+	// Packs are compacted in order, into packs of up to PackSize.
+	for len(sparse) > 0 {
+		var group []*packInfo
+		var p *pendingPack
+		for len(sparse) > 0 && (p == nil || p.data.Len() < gd.packSize()) {
+			info := sparse[0]
+			var data []byte
+			if info.size > 0 {
+				var err error
+				data, err = readRange(ctx, gd.client.Bucket(gd.Config.Bucket).Object(info.name), 0, info.size)
+				if err != nil {
+					return compacted, err
+				}
+			}
+			ps.mu.Lock()
+			if p == nil {
+				p = &pendingPack{done: make(chan struct{})}
+			}
+			for _, e := range info.entries {
+				loc, live := ps.index[e.key]
+				switch {
+				case !e.deleted && live && loc == e.loc:
+					moved := packEntry{key: e.key, loc: e.loc, moved: true, from: e.loc}
+					moved.loc.offset = int64(p.data.Len())
+					p.data.Write(data[e.loc.offset : e.loc.offset+e.loc.length])
+					p.entries = append(p.entries, moved)
+				case e.deleted && !live && others[e.key]:
+					p.entries = append(p.entries, packEntry{key: e.key, deleted: true, moved: true})
+				}
+			}
+			ps.mu.Unlock()
+			freed += info.size
+			group = append(group, info)
+			sparse = sparse[1:]
+		}
+		if len(p.entries) > 0 {
+			p.name = compactedName(group[len(group)-1].name)
+			for i := range p.entries {
+				p.entries[i].loc.pack = p.name
+			}
+			freed -= int64(p.data.Len())
+			ps.store(ctx, p)
+			if p.err != nil {
+				return compacted, p.err
+			}
+		}
+		for _, info := range group {
+			err := gd.client.Bucket(gd.Config.Bucket).Object(info.name).Delete(ctx)
+			if err != nil && err != storage.ErrObjectNotExist {
+				return compacted, requestError("delete", info.name, err)
+			}
+			ps.mu.Lock()
+			delete(ps.packs, info.name)
+			ps.mu.Unlock()
+			compacted++
+		}
+	}
+	if compacted > 0 {
+		logger.Infof("Compacted %d packs, freeing %d bytes.", compacted, freed)
+	}
+	return compacted, nil
+}
@@ -0,0 +1,185 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	"google.golang.org/api/iterator"
+)
+
+// ErrInvalidPageToken is returned by QueryPage for tokens it didn't return
+// for the same query.
+var ErrInvalidPageToken = errors.New("gcsds: invalid page token")
+
+// pageToken is where a paginated query resumes: at a page of the bucket
+// listing, then after a key of the packed values.
+type pageToken struct {
+	Prefix string `json:"p"`
+	// List is the GCS page token of the listing, and Packed the last
+	// packed key returned once the listing is done.
+	List   string  `json:"l,omitempty"`
+	Packed *string `json:"k,omitempty"`
+}
+
+func (t pageToken) encode() string {
+	b, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageToken(s string) (pageToken, error) {
+	var t pageToken
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &t)
+	}
+	if err != nil {
+		return t, fmt.Errorf("%w: %v", ErrInvalidPageToken, err)
+	}
+	return t, nil
+}
+
+// QueryPage returns a page of up to pageSize results of q, starting at
+// token, "" for the first page, and the token of the next page, "" after
+// the last one. Tokens are GCS listing page tokens, so that a large query
+// can be resumed later, even by another process. Results are in listing
+// order, with the packed values last. Values not uploaded yet aren't
+// returned. Pages may be shorter than pageSize, or empty, as expired
+// values are skipped. Filters, orders, offsets and limits aren't
+// supported.
+func (gd *GCSDatastore) QueryPage(ctx context.Context, q dsq.Query, token string, pageSize int) ([]dsq.Entry, string, error) {
+	if len(q.Filters) > 0 || len(q.Orders) > 0 || q.Offset > 0 || q.Limit > 0 {
+		return nil, "", fmt.Errorf("gcsds: filters, orders, offsets and limits aren't supported by QueryPage")
+	}
+	if pageSize <= 0 {
+		return nil, "", fmt.Errorf("gcsds: invalid page size %d", pageSize)
+	}
+	q.Prefix = queryPrefix(q.Prefix)
+	t := pageToken{Prefix: q.Prefix}
+	if token != "" {
+		var err error
+		if t, err = decodePageToken(token); err != nil {
+			return nil, "", err
+		}
+		if t.Prefix != q.Prefix {
+			return nil, "", fmt.Errorf("%w: for prefix %q", ErrInvalidPageToken, t.Prefix)
+		}
+	}
+	var entries []*Metadata
+	var err error
+	if t.Packed == nil {
+		entries, t, err = gd.listPage(ctx, t, pageSize)
+	} else {
+		entries, t = gd.packedPage(t, pageSize)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if t.List != "" || t.Packed != nil {
+		next = t.encode()
+	}
+	results := make([]dsq.Entry, 0, len(entries))
+	var values valueFunc
+	metadata := func() *Metadata {
+		if len(entries) == 0 {
+			return nil
+		}
+		m := entries[0]
+		entries = entries[1:]
+		return m
+	}
+	if !q.KeysOnly {
+		var stop func()
+		values, stop = gd.readAheadValues(ctx, metadata, gd.workers())
+		defer stop()
+	}
+	for {
+		var m *Metadata
+		var value []byte
+		if q.KeysOnly {
+			m = metadata()
+		} else if m, value, err = values(); err == ds.ErrNotFound {
+			// Deleted since it was listed.
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		if m == nil {
+			return results, next, nil
+		}
+		e := dsq.Entry{Key: m.Key, Size: int(m.Size), Value: value}
+		if q.ReturnExpirations {
+			e.Expiration = m.Expiration
+		}
+		results = append(results, e)
+	}
+}
+
+// listPage lists a page of the objects for the keys under t.Prefix from
+// t.List, and returns the token after it.
+func (gd *GCSDatastore) listPage(ctx context.Context, t pageToken, pageSize int) ([]*Metadata, pageToken, error) {
+	query := &storage.Query{Prefix: gd.namePrefix(t.Prefix)}
+	if err := query.SetAttrSelection(listedAttrs); err != nil {
+		return nil, t, err
+	}
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, query)
+	var objects []*storage.ObjectAttrs
+	next, err := iterator.NewPager(it, pageSize, t.List).NextPage(&objects)
+	if err != nil {
+		return nil, t, requestError("list", query.Prefix, err)
+	}
+	entries := []*Metadata{}
+	for _, attrs := range objects {
+		key := gd.keyOf(attrs.Name)
+		if m := objectMetadata(key, attrs); strings.HasPrefix(key, t.Prefix) && !expired(m.Expiration) {
+			entries = append(entries, &m)
+		}
+	}
+	t.List = next
+	if next == "" && len(gd.packs.list(t.Prefix)) > 0 {
+		t.Packed = new(string)
+	}
+	return entries, t, nil
+}
+
+// packedPage returns a page of the packed values under t.Prefix after
+// *t.Packed, and the token after it.
+func (gd *GCSDatastore) packedPage(t pageToken, pageSize int) ([]*Metadata, pageToken) {
+	entries := []*Metadata{}
+	for _, m := range gd.packs.list(t.Prefix) {
+		if m.Key > *t.Packed && !expired(m.Expiration) {
+			entries = append(entries, m)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	if len(entries) <= pageSize {
+		t.Packed = nil
+		return entries, t
+	}
+	entries = entries[:pageSize]
+	last := entries[pageSize-1].Key
+	t.Packed = &last
+	return entries, t
+}
@@ -15,22 +15,58 @@ package plugin
 // limitations under the License.
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
-	"log"
+	"math"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"cloud.google.com/go/storage"
 	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	logging "github.com/ipfs/go-log/v2"
 	"github.com/ipfs/kubo/plugin"
 	"github.com/ipfs/kubo/repo"
 	"github.com/ipfs/kubo/repo/fsrepo"
 )
 
+var logger = logging.Logger("gcsds")
+
 const (
 	defaultWorkers = 100
 	defaultPrefix  = "ipfs/"
 
-	// Use at most 1GB ram for the in memory LRU data cache.
-	// IPFS blocks are max 256kB, therefore bounded at 40'000 * 256kB.
-	defaultCacheSize = 40000
+	// Use at most 1GB ram for the in memory LRU data cache, whatever the
+	// size of the blocks, and keep at most 40'000 of them.
+	defaultCacheSize     = 40000
+	defaultCacheMaxBytes = 1 << 30
+
+	// Values above 1MB are larger than any IPFS block and are not cached.
+	defaultCacheMaxValueSize = 1 << 20
+
+	defaultArchiveReadTimeout = 5 * time.Minute
+
+	defaultQueryReadAhead = 16
+
+	defaultSharedCacheTTL = 24 * time.Hour
+
+	// The WAL of buffered writes is kept in the repo unless waldir is set.
+	defaultWALDir = "gcsds-wal"
+
+	// The on-disk metadata index is kept in the repo.
+	defaultMetadataIndexFile = "gcsds-metadata.db"
+
+	// The disk cache is kept in the repo unless diskcachedir is set.
+	defaultDiskCacheDir = "gcsds-cache"
+
+	// Metadata snapshots are saved hourly, so that a crash loses little.
+	defaultMetadataSnapshotInterval = time.Hour
 )
 
 var Plugins = []plugin.Plugin{
@@ -52,68 +88,926 @@ func (plugin GCSPlugin) Init(env *plugin.Environment) error {
 }
 
 func (plugin GCSPlugin) DatastoreTypeName() string {
-	log.Printf("Return datastore name.\n")
 	return "gcsds"
 }
 
 func (plugin GCSPlugin) DatastoreConfigParser() fsrepo.ConfigFromMap {
 	// Parse config here.
-	log.Printf("Parse configuration.\n")
 	return func(m map[string]interface{}) (fsrepo.DatastoreConfig, error) {
-		bucket, ok := m["bucket"].(string)
-		if !ok {
+		o := newOptions(m)
+		// The type selects this parser.
+		o.get("type")
+		bucket, err := stringOption(o, "bucket", "")
+		if err != nil {
+			return nil, err
+		}
+		if bucket == "" {
 			return nil, fmt.Errorf("gcsds: no bucket specified")
 		}
+		if err := checkBucketName("bucket", bucket); err != nil {
+			return nil, err
+		}
 
 		// Optional.
-		var prefix = defaultPrefix
-		if v, ok := m["prefix"]; ok {
-			prefix = v.(string)
-		}
-
-		var workers = defaultWorkers
-		if v, ok := m["workers"]; ok {
-			if w, ok := v.(float64); ok {
-				workers = int(w)
-			} else if w, ok := v.(int); ok {
-				workers = w
-			} else {
-				return nil, fmt.Errorf("gcsds: workers not a number: %T %v", v, v)
-			}
-			if workers <= 0 {
-				return nil, fmt.Errorf("gcsds: workers <= 0: %d", workers)
+		prefix, err := stringOption(o, "prefix", defaultPrefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPrefix("prefix", prefix); err != nil {
+			return nil, err
+		}
+
+		endpoint, err := stringOption(o, "endpoint", "")
+		if err != nil {
+			return nil, err
+		}
+		credentialsFile, err := stringOption(o, "credentialsfile", "")
+		if err != nil {
+			return nil, err
+		}
+		impersonateServiceAccount, err := stringOption(o, "impersonateserviceaccount", "")
+		if err != nil {
+			return nil, err
+		}
+		scopes, err := stringsOption(o, "scopes")
+		if err != nil {
+			return nil, err
+		}
+
+		retryInitialBackoff, err := durationOption(o, "retryinitialbackoff", 0)
+		if err != nil {
+			return nil, err
+		}
+		retryMaxBackoff, err := durationOption(o, "retrymaxbackoff", 0)
+		if err != nil {
+			return nil, err
+		}
+		retryMultiplier, err := floatOption(o, "retrymultiplier", 0)
+		if err != nil {
+			return nil, err
+		}
+		retryMaxAttempts, err := intOption(o, "retrymaxattempts", 0)
+		if err != nil {
+			return nil, err
+		}
+		retryBlockWrites, err := boolOption(o, "retryblockwrites", false)
+		if err != nil {
+			return nil, err
+		}
+		retryAlways, err := boolOption(o, "retryalways", false)
+		if err != nil {
+			return nil, err
+		}
+		maxRequestsPerSecond, err := floatOption(o, "maxrequestspersecond", 0)
+		if err != nil {
+			return nil, err
+		}
+		maxConcurrentRequests, err := intOption(o, "maxconcurrentrequests", 0)
+		if err != nil {
+			return nil, err
+		}
+
+		workers, err := intOption(o, "workers", defaultWorkers)
+		if err != nil {
+			return nil, err
+		}
+		if workers <= 0 {
+			return nil, fmt.Errorf("gcsds: workers <= 0: %d", workers)
+		}
+
+		cacheSize, err := intOption(o, "cachesize", defaultCacheSize)
+		if err != nil {
+			return nil, err
+		}
+		if cacheSize <= 0 {
+			return nil, fmt.Errorf("gcsds: cachesize <= 0: %d", cacheSize)
+		}
+
+		cacheMaxValueSize, err := intOption(o, "cachemaxvaluesize", defaultCacheMaxValueSize)
+		if err != nil {
+			return nil, err
+		}
+		if cacheMaxValueSize < 0 {
+			return nil, fmt.Errorf("gcsds: cachemaxvaluesize < 0: %d", cacheMaxValueSize)
+		}
+
+		cacheMaxBytes, err := intOption(o, "cachemaxbytes", defaultCacheMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		if cacheMaxBytes < 0 {
+			return nil, fmt.Errorf("gcsds: cachemaxbytes < 0: %d", cacheMaxBytes)
+		}
+
+		cacheAdmission, err := boolOption(o, "cacheadmission", false)
+		if err != nil {
+			return nil, err
+		}
+
+		verifyPut, err := boolOption(o, "verifyput", false)
+		if err != nil {
+			return nil, err
+		}
+
+		skipExistingBlocks, err := boolOption(o, "skipexistingblocks", false)
+		if err != nil {
+			return nil, err
+		}
+
+		archiveAfterDays, err := intOption(o, "archiveafterdays", 0)
+		if err != nil {
+			return nil, err
+		}
+		if archiveAfterDays < 0 {
+			return nil, fmt.Errorf("gcsds: archiveafterdays < 0: %d", archiveAfterDays)
+		}
+
+		coldlineAfterDays, err := intOption(o, "coldlineafterdays", 0)
+		if err != nil {
+			return nil, err
+		}
+		if coldlineAfterDays < 0 {
+			return nil, fmt.Errorf("gcsds: coldlineafterdays < 0: %d", coldlineAfterDays)
+		}
+
+		archiveReadTimeout, err := durationOption(o, "archivereadtimeout", defaultArchiveReadTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		restoreOnRead, err := boolOption(o, "restoreonread", false)
+		if err != nil {
+			return nil, err
+		}
+
+		autoclass, err := boolOption(o, "autoclass", false)
+		if err != nil {
+			return nil, err
+		}
+		enableAutoclass, err := boolOption(o, "enableautoclass", false)
+		if err != nil {
+			return nil, err
+		}
+
+		regionalEndpoint, err := stringOption(o, "regionalendpoint", "")
+		if err != nil {
+			return nil, err
+		}
+
+		mirrorBucket, err := stringOption(o, "mirrorbucket", "")
+		if err != nil {
+			return nil, err
+		}
+		if mirrorBucket != "" {
+			if err := checkBucketName("mirrorbucket", mirrorBucket); err != nil {
+				return nil, err
 			}
 		}
 
-		var cacheSize = defaultCacheSize
-		if v, ok := m["cachesize"]; ok {
-			if c, ok := v.(float64); ok {
-				cacheSize = int(c)
-			} else if c, ok := v.(int); ok {
-				cacheSize = c
-			} else {
-				return nil, fmt.Errorf("gcsds: cachesize not a number: %T %v", v, v)
+		mirrorCopy, err := boolOption(o, "mirrorcopy", false)
+		if err != nil {
+			return nil, err
+		}
+		if mirrorCopy && mirrorBucket == "" {
+			return nil, fmt.Errorf("gcsds: mirrorcopy requires mirrorbucket")
+		}
+
+		queryReadAhead, err := intOption(o, "queryreadahead", defaultQueryReadAhead)
+		if err != nil {
+			return nil, err
+		}
+		if queryReadAhead < 0 {
+			return nil, fmt.Errorf("gcsds: queryreadahead < 0: %d", queryReadAhead)
+		}
+
+		maxBytes, err := intOption(o, "maxbytes", 0)
+		if err != nil {
+			return nil, err
+		}
+		if maxBytes < 0 {
+			return nil, fmt.Errorf("gcsds: maxbytes < 0: %d", maxBytes)
+		}
+
+		maxObjects, err := intOption(o, "maxobjects", 0)
+		if err != nil {
+			return nil, err
+		}
+		if maxObjects < 0 {
+			return nil, fmt.Errorf("gcsds: maxobjects < 0: %d", maxObjects)
+		}
+
+		quotas, err := quotasOption(o, "quotas")
+		if err != nil {
+			return nil, err
+		}
+
+		trashPrefix, err := stringOption(o, "trashprefix", "")
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPrefix("trashprefix", trashPrefix); err != nil {
+			return nil, err
+		}
+
+		sharedCacheAddr, err := stringOption(o, "sharedcache", "")
+		if err != nil {
+			return nil, err
+		}
+		sharedCacheTTL, err := durationOption(o, "sharedcachettl", defaultSharedCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		var sharedCache gcsds.SharedCache
+		if sharedCacheAddr != "" {
+			sharedCache = gcsds.NewRedisCache(sharedCacheAddr, sharedCacheTTL)
+		}
+
+		writerLock, err := boolOption(o, "writerlock", false)
+		if err != nil {
+			return nil, err
+		}
+		writerLockTTL, err := durationOption(o, "writerlockttl", gcsds.DefaultLockTTL)
+		if err != nil {
+			return nil, err
+		}
+
+		backgroundLoad, err := boolOption(o, "backgroundload", false)
+		if err != nil {
+			return nil, err
+		}
+		lazyMetadata, err := boolOption(o, "lazymetadata", false)
+		if err != nil {
+			return nil, err
+		}
+		metadataSnapshot, err := boolOption(o, "metadatasnapshot", false)
+		if err != nil {
+			return nil, err
+		}
+		metadataSnapshotInterval, err := durationOption(o, "metadatasnapshotinterval", defaultMetadataSnapshotInterval)
+		if err != nil {
+			return nil, err
+		}
+		metadataRefreshInterval, err := durationOption(o, "metadatarefreshinterval", 0)
+		if err != nil {
+			return nil, err
+		}
+		notificationSubscription, err := stringOption(o, "notificationsubscription", "")
+		if err != nil {
+			return nil, err
+		}
+		kmsKeyName, err := stringOption(o, "kmskeyname", "")
+		if err != nil {
+			return nil, err
+		}
+
+		durability, err := durabilityOption(o, "durability")
+		if err != nil {
+			return nil, err
+		}
+
+		walDir, err := stringOption(o, "waldir", "")
+		if err != nil {
+			return nil, err
+		}
+
+		metadataIndex, err := stringOption(o, "metadataindex", "memory")
+		if err != nil {
+			return nil, err
+		}
+		if metadataIndex != "memory" && metadataIndex != "disk" {
+			return nil, fmt.Errorf("gcsds: metadataindex not memory or disk: %s", metadataIndex)
+		}
+
+		diskCache, err := boolOption(o, "diskcache", false)
+		if err != nil {
+			return nil, err
+		}
+		diskCacheDir, err := stringOption(o, "diskcachedir", "")
+		if err != nil {
+			return nil, err
+		}
+		diskCacheMaxBytes, err := intOption(o, "diskcachemaxbytes", gcsds.DefaultDiskCacheMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		if diskCacheMaxBytes <= 0 {
+			return nil, fmt.Errorf("gcsds: diskcachemaxbytes <= 0: %d", diskCacheMaxBytes)
+		}
+
+		migrateLayout, err := boolOption(o, "migratelayout", false)
+		if err != nil {
+			return nil, err
+		}
+		compression, err := stringOption(o, "compression", "")
+		if err != nil {
+			return nil, err
+		}
+		compressionMinSize, err := intOption(o, "compressionminsize", 0)
+		if err != nil {
+			return nil, err
+		}
+		compressionLevel, err := intOption(o, "compressionlevel", 0)
+		if err != nil {
+			return nil, err
+		}
+		encryptionKey, err := stringOption(o, "encryptionkey", "")
+		if err != nil {
+			return nil, err
+		}
+		var encryptionKeyBytes []byte
+		if encryptionKey != "" {
+			if encryptionKeyBytes, err = base64.StdEncoding.DecodeString(encryptionKey); err != nil {
+				return nil, fmt.Errorf("gcsds: encryptionkey is not base64: %w", err)
 			}
-			if cacheSize <= 0 {
-				return nil, fmt.Errorf("gcsds: cachesize <= 0: %d", cacheSize)
+		}
+		encryptionKMSKeyName, err := stringOption(o, "encryptionkmskeyname", "")
+		if err != nil {
+			return nil, err
+		}
+		sharding, err := stringOption(o, "sharding", "")
+		if err != nil {
+			return nil, err
+		}
+		contentType, err := stringOption(o, "contenttype", "")
+		if err != nil {
+			return nil, err
+		}
+		objectMetadata, err := stringsOption(o, "objectmetadata")
+		if err != nil {
+			return nil, err
+		}
+		nodeID, err := stringOption(o, "nodeid", "")
+		if err != nil {
+			return nil, err
+		}
+		fallbackBucket, err := stringOption(o, "fallbackbucket", "")
+		if err != nil {
+			return nil, err
+		}
+		if fallbackBucket != "" {
+			if err := checkBucketName("fallbackbucket", fallbackBucket); err != nil {
+				return nil, err
 			}
 		}
+		fallbackPrefix, err := stringOption(o, "fallbackprefix", "")
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPrefix("fallbackprefix", fallbackPrefix); err != nil {
+			return nil, err
+		}
+		turboReplication, err := boolOption(o, "turboreplication", false)
+		if err != nil {
+			return nil, err
+		}
+		requireTurboReplication, err := boolOption(o, "requireturboreplication", false)
+		if err != nil {
+			return nil, err
+		}
+		metricsInterval, err := durationOption(o, "metricsinterval", 0)
+		if err != nil {
+			return nil, err
+		}
+		healthAddr, err := stringOption(o, "healthaddr", "")
+		if err != nil {
+			return nil, err
+		}
+		healthMaxErrorRate, err := floatOption(o, "healthmaxerrorrate", 0)
+		if err != nil {
+			return nil, err
+		}
+		queryConsistency, err := stringOption(o, "queryconsistency", "")
+		if err != nil {
+			return nil, err
+		}
+		packBlocks, err := boolOption(o, "packblocks", false)
+		if err != nil {
+			return nil, err
+		}
+		packSize, err := intOption(o, "packsize", 0)
+		if err != nil {
+			return nil, err
+		}
+		packMaxValueSize, err := intOption(o, "packmaxvaluesize", 0)
+		if err != nil {
+			return nil, err
+		}
+		if packSize < 0 || packMaxValueSize < 0 {
+			return nil, fmt.Errorf("gcsds: packsize or packmaxvaluesize < 0: %d, %d", packSize, packMaxValueSize)
+		}
+		packFlushDelay, err := durationOption(o, "packflushdelay", 0)
+		if err != nil {
+			return nil, err
+		}
+		packCompactInterval, err := durationOption(o, "packcompactinterval", 0)
+		if err != nil {
+			return nil, err
+		}
 
-		log.Printf("Parsed GCS config: bucket: %s, prefix: %s, workers: %d, cachesize: %d",
+		bloomFilterKeys, err := intOption(o, "bloomfilterkeys", 0)
+		if err != nil {
+			return nil, err
+		}
+		if bloomFilterKeys < 0 {
+			return nil, fmt.Errorf("gcsds: bloomfilterkeys < 0: %d", bloomFilterKeys)
+		}
+		bloomFilterFPRate, err := floatOption(o, "bloomfilterfprate", gcsds.DefaultBloomFilterFPRate)
+		if err != nil {
+			return nil, err
+		}
+		if bloomFilterFPRate <= 0 || bloomFilterFPRate >= 1 {
+			return nil, fmt.Errorf("gcsds: bloomfilterfprate not between 0 and 1: %v", bloomFilterFPRate)
+		}
+
+		heartbeat, err := boolOption(o, "heartbeat", false)
+		if err != nil {
+			return nil, err
+		}
+		heartbeatTTL, err := durationOption(o, "heartbeatttl", gcsds.DefaultHeartbeatTTL)
+		if err != nil {
+			return nil, err
+		}
+		readOnlyOnConflict, err := boolOption(o, "readonlyonconflict", false)
+		if err != nil {
+			return nil, err
+		}
+		ttlLifecycle, err := boolOption(o, "ttllifecycle", false)
+		if err != nil {
+			return nil, err
+		}
+		scrubRepair, err := boolOption(o, "scrubrepair", false)
+		if err != nil {
+			return nil, err
+		}
+		strictHas, err := boolOption(o, "stricthas", false)
+		if err != nil {
+			return nil, err
+		}
+		negativeCacheTTL, err := durationOption(o, "negativecachettl", 0)
+		if err != nil {
+			return nil, err
+		}
+		gcLifecycleDays, err := intOption(o, "gclifecycledays", 0)
+		if err != nil {
+			return nil, err
+		}
+		if gcLifecycleDays < 0 {
+			return nil, fmt.Errorf("gcsds: gclifecycledays < 0: %d", gcLifecycleDays)
+		}
+		ephemeralPrefixes, err := stringsOption(o, "ephemeralprefixes")
+		if err != nil {
+			return nil, err
+		}
+		touchInterval, err := durationOption(o, "touchinterval", 0)
+		if err != nil {
+			return nil, err
+		}
+		touchMaxPerSecond, err := floatOption(o, "touchmaxpersecond", 0)
+		if err != nil {
+			return nil, err
+		}
+		holdPinned, err := boolOption(o, "holdpinned", false)
+		if err != nil {
+			return nil, err
+		}
+		createBucket, err := boolOption(o, "createbucket", false)
+		if err != nil {
+			return nil, err
+		}
+		project, err := stringOption(o, "project", "")
+		if err != nil {
+			return nil, err
+		}
+		location, err := stringOption(o, "location", "")
+		if err != nil {
+			return nil, err
+		}
+		storageClass, err := stringOption(o, "storageclass", "")
+		if err != nil {
+			return nil, err
+		}
+		if err := o.checkUnknown(); err != nil {
+			return nil, fmt.Errorf("gcsds: %w", err)
+		}
+
+		logger.Debugf("Parsed GCS config: bucket: %s, prefix: %s, workers: %d, cachesize: %d",
 			bucket, prefix, workers, cacheSize)
 		return &GcsConfig{
 			cfg: gcsds.Config{
-				Bucket:         bucket,
-				Prefix:         prefix,
-				Workers:        workers,
-				DataCacheItems: cacheSize,
+				Bucket:                    bucket,
+				Prefix:                    prefix,
+				Endpoint:                  endpoint,
+				CredentialsFile:           credentialsFile,
+				ImpersonateServiceAccount: impersonateServiceAccount,
+				Scopes:                    scopes,
+				RetryInitialBackoff:       retryInitialBackoff,
+				RetryMaxBackoff:           retryMaxBackoff,
+				RetryMultiplier:           retryMultiplier,
+				RetryMaxAttempts:          retryMaxAttempts,
+				RetryBlockWrites:          retryBlockWrites,
+				RetryAlways:               retryAlways,
+				MaxRequestsPerSecond:      maxRequestsPerSecond,
+				MaxConcurrentRequests:     maxConcurrentRequests,
+				Workers:                   workers,
+				DataCacheItems:            cacheSize,
+				DataCacheMaxBytes:         int64(cacheMaxBytes),
+				DataCacheMaxValueSize:     cacheMaxValueSize,
+				DataCacheAdmission:        cacheAdmission,
+				VerifyPut:                 verifyPut,
+				SkipExistingBlocks:        skipExistingBlocks,
+				ArchiveAfter:              time.Duration(archiveAfterDays) * 24 * time.Hour,
+				ColdlineAfter:             time.Duration(coldlineAfterDays) * 24 * time.Hour,
+				ArchiveReadTimeout:        archiveReadTimeout,
+				RestoreOnRead:             restoreOnRead,
+				Autoclass:                 autoclass,
+				EnableAutoclass:           enableAutoclass,
+				RegionalEndpoint:          regionalEndpoint,
+				MirrorBucket:              mirrorBucket,
+				MirrorCopy:                mirrorCopy,
+				QueryReadAhead:            queryReadAhead,
+				MaxBytes:                  int64(maxBytes),
+				MaxObjects:                int64(maxObjects),
+				Quotas:                    quotas,
+				TrashPrefix:               trashPrefix,
+				SharedCache:               sharedCache,
+				WriterLock:                writerLock,
+				WriterLockTTL:             writerLockTTL,
+				Durability:                durability,
+				WALDir:                    walDir,
+				MigrateLayout:             migrateLayout,
+				Compression:               compression,
+				CompressionMinSize:        compressionMinSize,
+				CompressionLevel:          compressionLevel,
+				EncryptionKey:             encryptionKeyBytes,
+				EncryptionKMSKeyName:      encryptionKMSKeyName,
+				PackBlocks:                packBlocks,
+				PackSize:                  packSize,
+				PackMaxValueSize:          packMaxValueSize,
+				PackFlushDelay:            packFlushDelay,
+				PackCompactInterval:       packCompactInterval,
+				Sharding:                  sharding,
+				ContentType:               contentType,
+				ObjectMetadata:            objectMetadata,
+				NodeID:                    nodeID,
+				FallbackBucket:            fallbackBucket,
+				FallbackPrefix:            fallbackPrefix,
+				TurboReplication:          turboReplication,
+				RequireTurboReplication:   requireTurboReplication,
+				MetricsInterval:           metricsInterval,
+				HealthAddr:                healthAddr,
+				HealthMaxErrorRate:        healthMaxErrorRate,
+				QueryConsistency:          queryConsistency,
+				Heartbeat:                 heartbeat,
+				HeartbeatTTL:              heartbeatTTL,
+				ReadOnlyOnConflict:        readOnlyOnConflict,
+				TTLLifecycle:              ttlLifecycle,
+				ScrubRepair:               scrubRepair,
+				StrictHas:                 strictHas,
+				NegativeCacheTTL:          negativeCacheTTL,
+				DiskCacheDir:              diskCacheDir,
+				DiskCacheMaxBytes:         int64(diskCacheMaxBytes),
+				LazyMetadata:              lazyMetadata,
+				BloomFilterKeys:           bloomFilterKeys,
+				BloomFilterFPRate:         bloomFilterFPRate,
+				MetadataSnapshot:          metadataSnapshot,
+				MetadataSnapshotInterval:  metadataSnapshotInterval,
+				MetadataRefreshInterval:   metadataRefreshInterval,
+				NotificationSubscription:  notificationSubscription,
+				KMSKeyName:                kmsKeyName,
+				GCLifecycleDays:           gcLifecycleDays,
+				EphemeralPrefixes:         ephemeralPrefixes,
+				TouchInterval:             touchInterval,
+				TouchMaxPerSecond:         touchMaxPerSecond,
+				HoldPinned:                holdPinned,
+				CreateBucket:              createBucket,
+				Project:                   project,
+				Location:                  location,
+				StorageClass:              storageClass,
 			},
+			backgroundLoad: backgroundLoad,
+			diskIndex:      metadataIndex == "disk",
+			diskCache:      diskCache,
 		}, nil
 	}
 }
 
+// options are the options of a datastore spec. They record which ones
+// were read, so that the others can be reported as unknown.
+type options struct {
+	m    map[string]interface{}
+	read map[string]bool
+}
+
+func newOptions(m map[string]interface{}) *options {
+	return &options{m: m, read: map[string]bool{}}
+}
+
+// get returns the option stored under key, if present.
+func (o *options) get(key string) (interface{}, bool) {
+	o.read[key] = true
+	v, ok := o.m[key]
+	return v, ok
+}
+
+// checkUnknown returns an error listing the options that were never read,
+// such as misspelled ones, with the known options closest to them.
+func (o *options) checkUnknown() error {
+	var unknown []string
+	for key := range o.m {
+		if o.read[key] {
+			continue
+		}
+		desc := strconv.Quote(key)
+		if known := o.closest(key); known != "" {
+			desc += fmt.Sprintf(" (did you mean %q?)", known)
+		}
+		unknown = append(unknown, desc)
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown options %s", strings.Join(unknown, ", "))
+}
+
+// closest returns the option read whose name is closest to key, ignoring
+// case, if at most 2 edits away.
+func (o *options) closest(key string) string {
+	best, bestDist := "", 3
+	for known := range o.read {
+		if d := editDistance(strings.ToLower(key), known); d < bestDist || d == bestDist && known < best {
+			best, bestDist = known, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			d := prev[j-1]
+			if a[i-1] != b[j-1] {
+				d++
+			}
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			cur[j] = d
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// checkBucketName checks that the bucket name of option key follows the
+// naming rules of GCS, see
+// https://cloud.google.com/storage/docs/buckets#naming.
+func checkBucketName(key, name string) error {
+	invalid := func(why string) error {
+		return fmt.Errorf("gcsds: %s %q invalid: %s", key, name, why)
+	}
+	if len(name) < 3 || len(name) > 222 {
+		return invalid("not 3 to 222 characters long")
+	}
+	for _, c := range name {
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return invalid("only lowercase letters, digits, -, _ and . are allowed")
+		}
+	}
+	alnum := func(c byte) bool { return 'a' <= c && c <= 'z' || '0' <= c && c <= '9' }
+	if !alnum(name[0]) || !alnum(name[len(name)-1]) {
+		return invalid("doesn't start and end with a letter or digit")
+	}
+	for _, part := range strings.Split(name, ".") {
+		if len(part) == 0 || len(part) > 63 {
+			return invalid("dot-separated parts not 1 to 63 characters long")
+		}
+	}
+	if net.ParseIP(name) != nil {
+		return invalid("an IP address")
+	}
+	if strings.HasPrefix(name, "goog") || strings.Contains(name, "google") {
+		return invalid("starts with goog or contains google")
+	}
+	return nil
+}
+
+// checkPrefix checks that the object name prefix of option key is valid
+// UTF-8 without control characters or . and .. segments, which GCS
+// rejects or the datastore can't list.
+func checkPrefix(key, prefix string) error {
+	if !utf8.ValidString(prefix) {
+		return fmt.Errorf("gcsds: %s %q not valid UTF-8", key, prefix)
+	}
+	if len(prefix) > 512 {
+		return fmt.Errorf("gcsds: %s longer than 512 bytes: %q", key, prefix)
+	}
+	for _, c := range prefix {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("gcsds: %s %q contains control characters", key, prefix)
+		}
+	}
+	for _, seg := range strings.Split(prefix, "/") {
+		if seg == "." || seg == ".." {
+			return fmt.Errorf("gcsds: %s %q contains a %s segment", key, prefix, seg)
+		}
+	}
+	return nil
+}
+
+// intOption returns the number stored under key in m, or def if absent.
+// JSON numbers decode as float64, but ints are accepted too.
+func intOption(o *options, key string, def int) (int, error) {
+	v, ok := o.get(key)
+	if !ok {
+		return def, nil
+	}
+	if n, ok := v.(float64); ok {
+		// Fractions and numbers beyond int would be silently changed.
+		if n != math.Trunc(n) || n < math.MinInt || n >= -math.MinInt {
+			return 0, fmt.Errorf("gcsds: %s not an integer: %T %v", key, v, v)
+		}
+		return int(n), nil
+	} else if n, ok := v.(int); ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("gcsds: %s not a number: %T %v", key, v, v)
+}
+
+// floatOption returns the number stored under key in m, or def if absent.
+func floatOption(o *options, key string, def float64) (float64, error) {
+	v, ok := o.get(key)
+	if !ok {
+		return def, nil
+	}
+	if n, ok := v.(float64); ok {
+		return n, nil
+	} else if n, ok := v.(int); ok {
+		return float64(n), nil
+	}
+	return 0, fmt.Errorf("gcsds: %s not a number: %T %v", key, v, v)
+}
+
+// stringOption returns the string stored under key in m, or def if absent.
+func stringOption(o *options, key string, def string) (string, error) {
+	v, ok := o.get(key)
+	if !ok {
+		return def, nil
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return "", fmt.Errorf("gcsds: %s not a string: %T %v", key, v, v)
+}
+
+// stringsOption returns the list of strings stored under key in m, or nil
+// if absent.
+func stringsOption(o *options, key string) ([]string, error) {
+	v, ok := o.get(key)
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("gcsds: %s not a list: %T %v", key, v, v)
+	}
+	strs := make([]string, len(list))
+	for i, e := range list {
+		s, ok := e.(string)
+		if !ok {
+			return nil, fmt.Errorf("gcsds: %s[%d] not a string: %T %v", key, i, e, e)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+// boolOption returns the boolean stored under key in m, or def if absent.
+func boolOption(o *options, key string, def bool) (bool, error) {
+	v, ok := o.get(key)
+	if !ok {
+		return def, nil
+	}
+	if b, ok := v.(bool); ok {
+		return b, nil
+	}
+	return false, fmt.Errorf("gcsds: %s not a boolean: %T %v", key, v, v)
+}
+
+// durationOption returns the duration stored under key in m, or def if
+// absent. Durations are strings such as "30s" or "5m".
+func durationOption(o *options, key string, def time.Duration) (time.Duration, error) {
+	v, ok := o.get(key)
+	if !ok {
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("gcsds: %s not a duration string: %T %v", key, v, v)
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("gcsds: %s: %v", key, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("gcsds: %s < 0: %v", key, d)
+	}
+	return d, nil
+}
+
+// quotasOption parses a list of per-prefix quotas, e.g.
+// [{"prefix": "/tenant1", "maxbytes": 1000000, "maxobjects": 100}].
+func quotasOption(o *options, key string) ([]gcsds.Quota, error) {
+	v, ok := o.get(key)
+	if !ok {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("gcsds: %s not a list: %T %v", key, v, v)
+	}
+	quotas := []gcsds.Quota{}
+	for _, e := range list {
+		qm, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("gcsds: %s entry not an object: %T %v", key, e, e)
+		}
+		qo := newOptions(qm)
+		prefix, err := stringOption(qo, "prefix", "")
+		if err != nil {
+			return nil, err
+		}
+		if prefix == "" {
+			return nil, fmt.Errorf("gcsds: %s entry without prefix: %v", key, qm)
+		}
+		maxBytes, err := intOption(qo, "maxbytes", 0)
+		if err != nil {
+			return nil, err
+		}
+		maxObjects, err := intOption(qo, "maxobjects", 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := qo.checkUnknown(); err != nil {
+			return nil, fmt.Errorf("gcsds: %s entry: %w", key, err)
+		}
+		if maxBytes < 0 || maxObjects < 0 {
+			return nil, fmt.Errorf("gcsds: %s entry with negative limit: %v", key, qm)
+		}
+		quotas = append(quotas, gcsds.Quota{
+			Prefix:     prefix,
+			MaxBytes:   int64(maxBytes),
+			MaxObjects: int64(maxObjects),
+		})
+	}
+	return quotas, nil
+}
+
+// durabilityOption parses a map of key prefixes to durability modes, e.g.
+// {"/blocks": "buffered", "/providers": "async"}.
+func durabilityOption(o *options, key string) (map[string]gcsds.Durability, error) {
+	v, ok := o.get(key)
+	if !ok {
+		return nil, nil
+	}
+	dm, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("gcsds: %s not an object: %T %v", key, v, v)
+	}
+	modes := map[string]gcsds.Durability{}
+	for prefix, e := range dm {
+		s, ok := e.(string)
+		if !ok {
+			return nil, fmt.Errorf("gcsds: %s of %q not a string: %T %v", key, prefix, e, e)
+		}
+		switch mode := gcsds.Durability(s); mode {
+		case gcsds.DurabilityStrict, gcsds.DurabilityBuffered, gcsds.DurabilityAsync:
+			modes[prefix] = mode
+		default:
+			return nil, fmt.Errorf("gcsds: %s of %q: unknown mode %q", key, prefix, s)
+		}
+	}
+	return modes, nil
+}
+
 type GcsConfig struct {
 	cfg gcsds.Config
+	// backgroundLoad loads the metadata while serving requests.
+	backgroundLoad bool
+	// diskIndex keeps the metadata in the repo rather than in RAM.
+	diskIndex bool
+	// diskCache caches values in the repo unless DiskCacheDir is set.
+	diskCache bool
 }
 
 func (gcsConfig *GcsConfig) DiskSpec() fsrepo.DiskSpec {
@@ -124,11 +1018,43 @@ func (gcsConfig *GcsConfig) DiskSpec() fsrepo.DiskSpec {
 }
 
 func (gcsConfig *GcsConfig) Create(path string) (repo.Datastore, error) {
-	log.Printf("Create() path: %s\n", path)
-	gd, err := gcsds.NewGCSDatastore(gcsConfig.cfg)
+	logger.Debugf("Create() path: %s", path)
+	cfg := gcsConfig.cfg
+	if cfg.WALDir == "" {
+		for _, mode := range cfg.Durability {
+			if mode == gcsds.DurabilityBuffered {
+				cfg.WALDir = filepath.Join(path, defaultWALDir)
+			}
+		}
+	}
+	if gcsConfig.diskIndex {
+		cfg.MetadataIndexPath = filepath.Join(path, defaultMetadataIndexFile)
+	}
+	if gcsConfig.diskCache && cfg.DiskCacheDir == "" {
+		cfg.DiskCacheDir = filepath.Join(path, defaultDiskCacheDir)
+	}
+	gd, err := gcsds.NewGCSDatastore(cfg)
 	if err != nil {
+		logger.Errorf("Preflight checks:\n%s", gcsds.Doctor(context.Background(), cfg))
 		return nil, err
 	}
+	if cfg.MetadataSnapshot {
+		err := gd.LoadMetadataSnapshot(context.Background())
+		if err == nil {
+			gd.LoadMetadataInBackground()
+			return gd, nil
+		}
+		if err != storage.ErrObjectNotExist {
+			logger.Warnf("Listing the bucket instead of the metadata snapshot: %v", err)
+		}
+	}
+	if gcsConfig.backgroundLoad {
+		gd.LoadMetadataInBackground()
+		return gd, nil
+	}
+	if cfg.LazyMetadata {
+		return gd, nil
+	}
 	err = gd.LoadMetadata()
 	if err != nil {
 		return nil, err
@@ -0,0 +1,281 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// Query consistencies, see Config.QueryConsistency.
+const (
+	// QueryConsistencyCached answers queries from the metadata cache.
+	QueryConsistencyCached = "cached"
+	// QueryConsistencyListed answers queries by listing the bucket.
+	QueryConsistencyListed = "listed"
+)
+
+// checkQueryConsistency validates Config.QueryConsistency.
+func (gd *GCSDatastore) checkQueryConsistency() error {
+	switch gd.Config.QueryConsistency {
+	case "", QueryConsistencyCached, QueryConsistencyListed:
+		return nil
+	}
+	return fmt.Errorf("gcsds: unknown query consistency %q", gd.Config.QueryConsistency)
+}
+
+// localMetadata returns, in key order, the entries under prefix that a
+// listing of the bucket doesn't return: values not uploaded yet, and
+// packed values.
+func (gd *GCSDatastore) localMetadata(prefix string) func() *Metadata {
+	entries := gd.pendingMetadata(prefix)
+	pending := make(map[string]bool, len(entries))
+	for _, m := range entries {
+		pending[m.Key] = true
+	}
+	for _, m := range gd.packs.list(prefix) {
+		if !pending[m.Key] {
+			entries = append(entries, m)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return func() *Metadata {
+		if len(entries) == 0 {
+			return nil
+		}
+		m := entries[0]
+		entries = entries[1:]
+		return m
+	}
+}
+
+// queryPrefix returns the prefix of the keys matched by a query for prefix:
+// the cleaned key and a slash, so that /foo matches /foo/bar but not
+// /foobar, as with other datastores.
+func queryPrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	if prefix = ds.NewKey(prefix).String(); prefix != "/" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// keyFilter returns a function applying filters to metadata entries, and
+// whether the filters only look at keys. Filters of keys are applied
+// before values are fetched.
+func keyFilter(filters []dsq.Filter) (func(*Metadata) bool, bool) {
+	for _, f := range filters {
+		switch f.(type) {
+		case dsq.FilterKeyCompare, *dsq.FilterKeyCompare, dsq.FilterKeyPrefix, *dsq.FilterKeyPrefix:
+		default:
+			return nil, false
+		}
+	}
+	return func(m *Metadata) bool {
+		e := dsq.Entry{Key: m.Key, Size: int(m.Size)}
+		for _, f := range filters {
+			if !f.Filter(e) {
+				return false
+			}
+		}
+		return true
+	}, true
+}
+
+// filtered returns the entries from next that keep accepts.
+func filtered(next func() *Metadata, keep func(*Metadata) bool) func() *Metadata {
+	return func() *Metadata {
+		for m := next(); m != nil; m = next() {
+			if keep(m) {
+				return m
+			}
+		}
+		return nil
+	}
+}
+
+// keyOrder reports whether o orders by key, and whether descending. Keys
+// are unique, so orders after a key order don't matter.
+func keyOrder(o dsq.Order) (descending bool, ok bool) {
+	switch o.(type) {
+	case dsq.OrderByKey, *dsq.OrderByKey:
+		return false, true
+	case dsq.OrderByKeyDescending, *dsq.OrderByKeyDescending:
+		return true, true
+	}
+	return false, false
+}
+
+// reversed returns the entries from next in reverse order.
+func reversed(next func() *Metadata) func() *Metadata {
+	entries := []*Metadata{}
+	for m := next(); m != nil; m = next() {
+		entries = append(entries, m)
+	}
+	i := len(entries)
+	return func() *Metadata {
+		if i == 0 {
+			return nil
+		}
+		i--
+		return entries[i]
+	}
+}
+
+// naiveQuery runs q with filters or orders other than by key, which may
+// compare values, by filtering and sorting all results. Keys-only queries
+// are filtered and sorted without values.
+func (gd *GCSDatastore) naiveQuery(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	all := q
+	all.Filters, all.Orders, all.Offset, all.Limit = nil, nil, 0, 0
+	res, err := gd.Query(ctx, all)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range q.Filters {
+		res = dsq.NaiveFilter(res, f)
+	}
+	if len(q.Orders) > 0 {
+		res = dsq.NaiveOrder(res, q.Orders...)
+	}
+	if q.Offset > 0 {
+		res = dsq.NaiveOffset(res, q.Offset)
+	}
+	if q.Limit > 0 {
+		res = dsq.NaiveLimit(res, q.Limit)
+	}
+	return dsq.ResultsReplaceQuery(res, q), nil
+}
+
+// valueFunc returns the next metadata entry and its value, or a nil entry
+// when done.
+type valueFunc func() (*Metadata, []byte, error)
+
+// serialValues fetches the value of each entry from next when asked for it.
+func (gd *GCSDatastore) serialValues(ctx context.Context, next func() *Metadata) valueFunc {
+	return func() (*Metadata, []byte, error) {
+		m := next()
+		if m == nil {
+			return nil, nil, nil
+		}
+		value, err := gd.get(ctx, ds.RawKey(m.Key))
+		return m, value, err
+	}
+}
+
+// prefetch is a value being fetched ahead of the consumer.
+type prefetch struct {
+	m     *Metadata
+	value []byte
+	err   error
+	done  chan struct{}
+}
+
+// readAheadValues fetches the values of the entries from next with up to n
+// requests in flight, and returns them in order. Consumers that handle
+// results one at a time are then not bounded by per-object GCS latency.
+// The returned stop function abandons outstanding fetches.
+func (gd *GCSDatastore) readAheadValues(ctx context.Context, next func() *Metadata, n int) (valueFunc, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	// The channel is the reorder buffer: fetches complete in any order but
+	// are consumed in the order they were started.
+	pending := make(chan *prefetch, n)
+	go func() {
+		defer close(pending)
+		for m := next(); m != nil; m = next() {
+			p := &prefetch{m: m, done: make(chan struct{})}
+			select {
+			case pending <- p:
+			case <-ctx.Done():
+				return
+			}
+			go func() {
+				defer close(p.done)
+				p.value, p.err = gd.get(ctx, ds.RawKey(p.m.Key))
+			}()
+		}
+	}()
+	values := func() (*Metadata, []byte, error) {
+		p, ok := <-pending
+		if !ok {
+			return nil, nil, nil
+		}
+		<-p.done
+		return p.m, p.value, p.err
+	}
+	return values, cancel
+}
+
+// AllKeys streams the keys under prefix on the returned channel, in no
+// particular order, without the results of a keys-only Query, for
+// enumerating millions of keys, e.g. to reprovide blocks. The keys come
+// from the metadata cache, once loaded, or from a listing of the bucket
+// when Query lists it. The channel is closed once all keys are sent, or
+// when ctx is done. The returned function then returns the error that
+// ended it early, if any.
+func (gd *GCSDatastore) AllKeys(ctx context.Context, prefix string) (<-chan ds.Key, func() error) {
+	out := make(chan ds.Key, dsq.KeysOnlyBufSize)
+	var err error
+	send := func(key string) bool {
+		select {
+		case out <- ds.RawKey(key):
+			return true
+		case <-ctx.Done():
+			err = ctx.Err()
+			return false
+		}
+	}
+	go func() {
+		defer close(out)
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if gd.Config.QueryConsistency == QueryConsistencyListed || gd.Config.LazyMetadata && gd.metadataPending() {
+			listing, listErr := gd.listMetadata(ctx, prefix)
+			next := mergeMetadata(gd.localMetadata(prefix), listing)
+			for m := next(); m != nil; m = next() {
+				if !expired(m.Expiration) && !send(m.Key) {
+					return
+				}
+			}
+			err = listErr()
+			return
+		}
+		if err = gd.waitMetadata(ctx); err != nil {
+			return
+		}
+		if md, ok := gd.mdCache.(interface{ Keys(prefix string) []string }); ok {
+			for _, key := range md.Keys(prefix) {
+				if !send(key) {
+					return
+				}
+			}
+			return
+		}
+		next := gd.mdCache.Iterator(prefix, 0)
+		for m := next(); m != nil; m = next() {
+			if !expired(m.Expiration) && !send(m.Key) {
+				return
+			}
+		}
+	}()
+	return out, func() error { return err }
+}
@@ -0,0 +1,121 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+var _ ds.PersistentDatastore = (*GCSDatastore)(nil)
+
+// ErrQuotaExceeded matches every QuotaError.
+var ErrQuotaExceeded = errors.New("gcsds: quota exceeded")
+
+// Quota limits the values stored under a key prefix, e.g. one tenant's
+// namespace in a shared datastore. A zero limit is unlimited.
+type Quota struct {
+	Prefix     string
+	MaxBytes   int64
+	MaxObjects int64
+}
+
+// QuotaUsage reports a quota and its current usage.
+type QuotaUsage struct {
+	Quota
+	Usage
+}
+
+// QuotaError is returned by Put when storing a value would exceed a quota.
+type QuotaError struct {
+	// Prefix is the key prefix of the quota, "" for the datastore-wide one.
+	Prefix string
+	// Unit is "bytes" or "objects".
+	Unit  string
+	Limit int64
+	Used  int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("gcsds: quota exceeded for prefix %q: %d of %d %s used",
+		e.Prefix, e.Used, e.Limit, e.Unit)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// DiskUsage returns the total size of all values, as tracked by the
+// metadata cache.
+func (gd *GCSDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return uint64(gd.mdCache.Bytes()), nil
+}
+
+// quotas returns the configured quotas, including the datastore-wide one.
+func (gd *GCSDatastore) quotas() []Quota {
+	quotas := gd.Config.Quotas
+	if gd.Config.MaxBytes > 0 || gd.Config.MaxObjects > 0 {
+		quotas = append([]Quota{{MaxBytes: gd.Config.MaxBytes, MaxObjects: gd.Config.MaxObjects}}, quotas...)
+	}
+	return quotas
+}
+
+// trackQuotas starts usage accounting for every quota.
+func (gd *GCSDatastore) trackQuotas() {
+	for _, q := range gd.quotas() {
+		gd.mdCache.TrackPrefix(q.Prefix)
+	}
+}
+
+// quotaUsage returns every quota with its usage.
+func (gd *GCSDatastore) quotaUsage() []QuotaUsage {
+	usage := []QuotaUsage{}
+	for _, q := range gd.quotas() {
+		usage = append(usage, QuotaUsage{Quota: q, Usage: gd.mdCache.PrefixUsage(q.Prefix)})
+	}
+	return usage
+}
+
+// checkQuota returns a QuotaError if storing size bytes under key would
+// exceed a quota covering key. Concurrent Puts may overshoot a limit by the
+// values in flight.
+func (gd *GCSDatastore) checkQuota(key string, size int64) error {
+	quotas := gd.quotas()
+	if len(quotas) == 0 {
+		return nil
+	}
+	bytes, objects := size, int64(1)
+	if md, err := gd.mdCache.Get(key); err == nil {
+		bytes -= md.Size
+		objects = 0
+	}
+	for _, q := range quotas {
+		if !strings.HasPrefix(key, q.Prefix) {
+			continue
+		}
+		u := gd.mdCache.PrefixUsage(q.Prefix)
+		if q.MaxBytes > 0 && bytes > 0 && u.Bytes+bytes > q.MaxBytes {
+			return &QuotaError{Prefix: q.Prefix, Unit: "bytes", Limit: q.MaxBytes, Used: u.Bytes}
+		}
+		if q.MaxObjects > 0 && objects > 0 && u.Objects+objects > q.MaxObjects {
+			return &QuotaError{Prefix: q.Prefix, Unit: "objects", Limit: q.MaxObjects, Used: u.Objects}
+		}
+	}
+	return nil
+}
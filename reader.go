@@ -0,0 +1,76 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// GetReader returns a reader of the value of k, which the caller must
+// close. Unlike Get it streams values not in the caches from GCS, rather
+// than buffering them, and doesn't cache them. Use it to serve large
+// values, e.g. from a gateway.
+func (gd *GCSDatastore) GetReader(ctx context.Context, k ds.Key) (io.ReadCloser, error) {
+	key := k.String()
+	if gd.expired(key) {
+		return nil, ds.ErrNotFound
+	}
+	if value, ok := gd.localValue(ctx, key); ok {
+		return io.NopCloser(bytes.NewReader(value)), nil
+	}
+	r, err := gd.openValue(ctx, key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetRange returns length bytes of the value of k from offset, or the rest
+// of the value if length is negative. Values not in the caches are read
+// from GCS with a ranged request, so only the range is downloaded.
+func (gd *GCSDatastore) GetRange(ctx context.Context, k ds.Key, offset, length int64) ([]byte, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("gcsds: negative offset %d", offset)
+	}
+	key := k.String()
+	if gd.expired(key) {
+		return nil, ds.ErrNotFound
+	}
+	if value, ok := gd.localValue(ctx, key); ok {
+		if offset > int64(len(value)) {
+			return nil, fmt.Errorf("gcsds: offset %d beyond the %d bytes of %s", offset, len(value), gd.GCSPath(key))
+		}
+		value = value[offset:]
+		if length >= 0 && length < int64(len(value)) {
+			value = value[:length]
+		}
+		return value, nil
+	}
+	r, err := gd.openValue(ctx, key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := readAll(r)
+	if err != nil {
+		return nil, requestError("read", gd.GCSPath(key), err)
+	}
+	return data, nil
+}
@@ -0,0 +1,81 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// Replication describes how the bucket replicates data across regions.
+type Replication struct {
+	// DualRegion is set for dual-region buckets, whose data is in Regions.
+	DualRegion bool
+	Regions    []string
+	// RPO is the recovery point objective of the bucket: "DEFAULT", or
+	// "ASYNC_TURBO" with turbo replication, which replicates new objects
+	// within 15 minutes. It is "" for buckets that aren't dual-region.
+	RPO string
+}
+
+// Turbo reports whether turbo replication is on.
+func (r Replication) Turbo() bool {
+	return r.RPO == storage.RPOAsyncTurbo.String()
+}
+
+// replication returns the replication of the bucket with attrs.
+func replication(attrs *storage.BucketAttrs) Replication {
+	if attrs == nil || strings.ToLower(attrs.LocationType) != "dual-region" {
+		return Replication{}
+	}
+	r := Replication{DualRegion: true, Regions: bucketRegions(attrs), RPO: storage.RPODefault.String()}
+	if attrs.RPO != storage.RPOUnknown {
+		r.RPO = attrs.RPO.String()
+	}
+	return r
+}
+
+// checkReplication enables turbo replication on a dual-region bucket with
+// TurboReplication, and fails with RequireTurboReplication unless it's on.
+func (gd *GCSDatastore) checkReplication(ctx context.Context) error {
+	if gd.bucketAttrs == nil {
+		return nil
+	}
+	r := replication(gd.bucketAttrs)
+	if !r.DualRegion {
+		if gd.Config.TurboReplication || gd.Config.RequireTurboReplication {
+			logger.Warnf("Bucket %s is not dual-region (%s %s), so it has no turbo replication.",
+				gd.Config.Bucket, gd.bucketAttrs.LocationType, gd.bucketAttrs.Location)
+		}
+	} else if gd.Config.TurboReplication && !r.Turbo() {
+		bucket := gd.client.Bucket(gd.Config.Bucket).If(storage.BucketConditions{MetagenerationMatch: gd.bucketAttrs.MetaGeneration})
+		attrs, err := bucket.Update(ctx, storage.BucketAttrsToUpdate{RPO: storage.RPOAsyncTurbo})
+		if err != nil {
+			logger.Warnf("Failed to enable turbo replication on bucket %s: %v", gd.Config.Bucket, err)
+		} else {
+			gd.bucketAttrs = attrs
+			r = replication(attrs)
+			logger.Infof("Enabled turbo replication on bucket %s.", gd.Config.Bucket)
+		}
+	}
+	if gd.Config.RequireTurboReplication && !r.Turbo() {
+		return fmt.Errorf("gcsds: bucket %s does not have turbo replication (%s %s, RPO %q)",
+			gd.Config.Bucket, gd.bucketAttrs.LocationType, gd.bucketAttrs.Location, r.RPO)
+	}
+	return nil
+}
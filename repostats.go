@@ -0,0 +1,85 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"strings"
+)
+
+// RepoStats summarizes the values under a key prefix, see
+// GCSDatastore.RepoStats.
+type RepoStats struct {
+	// Keys and Bytes are the number and total size of the values.
+	Keys  int64
+	Bytes int64
+	// Blocks and BlockBytes are those of the values stored under the
+	// multihash of a block.
+	Blocks     int64
+	BlockBytes int64
+	// Sizes is a histogram of the sizes of the values.
+	Sizes []SizeBucket
+	// StorageClasses is the usage of each storage class, "" for the bucket
+	// default. Packed values have the storage class of their pack.
+	StorageClasses map[string]Usage
+	// Namespaces is the usage of each namespace directly under the prefix,
+	// e.g. "/blocks" for "/". Keys directly under the prefix count towards
+	// the prefix.
+	Namespaces map[string]Usage
+}
+
+// RepoStats lists the values under prefix, "/" for all, and summarizes
+// them. Unlike Stats it lists the bucket, selecting only the attributes
+// it reports, so it's accurate without loaded metadata and includes values
+// written by other nodes.
+func (gd *GCSDatastore) RepoStats(ctx context.Context, prefix string) (RepoStats, error) {
+	if prefix = queryPrefix(prefix); prefix == "" {
+		prefix = "/"
+	}
+	listing, listErr := gd.listMetadata(ctx, prefix)
+	next := mergeMetadata(gd.localMetadata(prefix), listing)
+	stats := RepoStats{StorageClasses: map[string]Usage{}, Namespaces: map[string]Usage{}}
+	var sizes sizeHistogram
+	add := func(usage map[string]Usage, key string, size int64) {
+		u := usage[key]
+		u.Objects++
+		u.Bytes += size
+		usage[key] = u
+	}
+	root := strings.TrimSuffix(prefix, "/")
+	if root == "" {
+		root = "/"
+	}
+	for m := next(); m != nil; m = next() {
+		if expired(m.Expiration) {
+			continue
+		}
+		stats.Keys++
+		stats.Bytes += m.Size
+		if isBlockKey(m.Key) {
+			stats.Blocks++
+			stats.BlockBytes += m.Size
+		}
+		sizes.observe(int(m.Size))
+		add(stats.StorageClasses, m.StorageClass, m.Size)
+		ns := root
+		if rest := strings.TrimPrefix(m.Key, prefix); strings.Contains(rest, "/") {
+			ns = prefix + rest[:strings.Index(rest, "/")]
+		}
+		add(stats.Namespaces, ns, m.Size)
+	}
+	stats.Sizes = sizes.snapshot()
+	return stats, listErr()
+}
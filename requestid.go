@@ -0,0 +1,77 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Response headers identifying a GCS request, most specific first.
+var requestIDHeaders = []string{"X-Guploader-Uploadid", "X-Goog-Request-Id"}
+
+// RequestError is a failed GCS request with the ID that Google Cloud
+// support needs to trace it.
+type RequestError struct {
+	// Op is the operation, e.g. "read" or "delete".
+	Op        string
+	Object    string
+	RequestID string
+	Err       error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("gcsds: %s %s: %v (GCS request ID %s)", e.Op, e.Object, e.Err, e.RequestID)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// RequestID returns the ID of the failed GCS request err comes from, or ""
+// if it doesn't come from a GCS response.
+func RequestID(err error) string {
+	var rerr *RequestError
+	if errors.As(err, &rerr) {
+		return rerr.RequestID
+	}
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return ""
+	}
+	for _, h := range requestIDHeaders {
+		if id := gerr.Header.Get(h); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// requestError wraps err from op on object in a RequestError, if it has a
+// request ID. Other errors, including sentinels like
+// storage.ErrObjectNotExist, are returned as is.
+func requestError(op, object string, err error) error {
+	var rerr *RequestError
+	if errors.As(err, &rerr) {
+		return err
+	}
+	id := RequestID(err)
+	if id == "" {
+		return err
+	}
+	return &RequestError{Op: op, Object: object, RequestID: id, Err: err}
+}
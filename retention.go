@@ -0,0 +1,176 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrObjectRetained matches every RetainedError.
+var ErrObjectRetained = errors.New("gcsds: object is retained")
+
+// RetainedError is returned by Delete for objects that a bucket retention
+// policy or an object hold protects from deletion.
+type RetainedError struct {
+	Key string
+	// RetainUntil is when the retention period ends, if any.
+	RetainUntil    time.Time
+	EventBasedHold bool
+	TemporaryHold  bool
+}
+
+func (e *RetainedError) Error() string {
+	reasons := []string{}
+	if !e.RetainUntil.IsZero() {
+		reasons = append(reasons, "retention policy until "+e.RetainUntil.Format(time.RFC3339))
+	}
+	if e.EventBasedHold {
+		reasons = append(reasons, "event-based hold")
+	}
+	if e.TemporaryHold {
+		reasons = append(reasons, "temporary hold")
+	}
+	return fmt.Sprintf("gcsds: cannot delete retained object %s: %s", e.Key, strings.Join(reasons, ", "))
+}
+
+func (e *RetainedError) Is(target error) bool {
+	return target == ErrObjectRetained
+}
+
+// checkRetention logs the bucket's retention settings, and checks that
+// the trash prefix, if any, is outside the datastore prefix.
+func (gd *GCSDatastore) checkRetention() error {
+	trash, prefix := ds.NewKey(gd.Config.TrashPrefix), ds.NewKey(gd.Config.Prefix)
+	if gd.Config.TrashPrefix != "" && (trash.Equal(prefix) || trash.IsDescendantOf(prefix)) {
+		return fmt.Errorf("gcsds: trash prefix %q must not be within prefix %q",
+			gd.Config.TrashPrefix, gd.Config.Prefix)
+	}
+	if gd.bucketAttrs == nil {
+		return nil
+	}
+	if rp := gd.bucketAttrs.RetentionPolicy; rp != nil {
+		logger.Warnf("Bucket %s has a retention policy of %v (locked: %v). Objects can't be deleted until it expires.",
+			gd.Config.Bucket, rp.RetentionPeriod, rp.IsLocked)
+	}
+	if gd.bucketAttrs.VersioningEnabled {
+		logger.Infof("Bucket %s keeps deleted objects as noncurrent versions, which Undelete restores.",
+			gd.Config.Bucket)
+	}
+	if gd.bucketAttrs.DefaultEventBasedHold {
+		logger.Warnf("Bucket %s places event-based holds on new objects. Held objects can't be deleted.",
+			gd.Config.Bucket)
+	}
+	return nil
+}
+
+// isRetentionError reports whether err is GCS refusing to delete an object
+// under retention or hold.
+func isRetentionError(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || gerr.Code != http.StatusForbidden {
+		return false
+	}
+	msg := strings.ToLower(gerr.Message)
+	return strings.Contains(msg, "retention") || strings.Contains(msg, "hold")
+}
+
+// retainedError turns a failed delete of key into a RetainedError, if it
+// failed because of retention.
+func (gd *GCSDatastore) retainedError(ctx context.Context, key string, err error) error {
+	if !isRetentionError(err) {
+		return err
+	}
+	rerr := &RetainedError{Key: key}
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key))
+	if attrs, aerr := obj.Attrs(ctx); aerr == nil {
+		rerr.RetainUntil = attrs.RetentionExpirationTime
+		rerr.EventBasedHold = attrs.EventBasedHold
+		rerr.TemporaryHold = attrs.TemporaryHold
+	}
+	return rerr
+}
+
+// trashPath returns the object name key is moved to on Delete.
+func (gd *GCSDatastore) trashPath(key string) string {
+	return path.Join(gd.Config.TrashPrefix, escapeKey(key))
+}
+
+// moveToTrash copies the object for key to the trash prefix, from where it
+// can be recovered or expired by a lifecycle rule.
+func (gd *GCSDatastore) moveToTrash(ctx context.Context, key string) error {
+	return gd.copyObject(ctx, key, gd.trashPath(key))
+}
+
+// copyObject copies the object for key to the object named dst. A missing
+// object isn't copied.
+func (gd *GCSDatastore) copyObject(ctx context.Context, key, dst string) error {
+	bkt := gd.client.Bucket(gd.Config.Bucket)
+	src := bkt.Object(gd.GCSPath(key))
+	attrs, err := src.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	copier := gd.newCopier(bkt.Object(dst), src.Generation(attrs.Generation))
+	copier.ObjectAttrs = rewriteAttrs(attrs)
+	if _, err := copier.Run(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	return nil
+}
+
+// SetHold places or releases a temporary hold on the object for k. Held
+// objects can't be deleted or overwritten, even by this datastore, which
+// protects e.g. pinned blocks from bugs and operator error.
+func (gd *GCSDatastore) SetHold(ctx context.Context, k ds.Key, hold bool) error {
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(k.String()))
+	_, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{TemporaryHold: hold})
+	if err == storage.ErrObjectNotExist {
+		return ds.ErrNotFound
+	}
+	return err
+}
+
+// SetEventBasedHold places or releases event-based holds on the objects of
+// keys, e.g. those of pinned blocks in an archival deployment. Held
+// objects can't be deleted or overwritten. On a bucket with a retention
+// policy, releasing the hold starts the object's retention period, so
+// pinned blocks stay immutable for that long once unpinned. Packed values
+// are skipped. Missing keys are reported in a BatchError.
+func (gd *GCSDatastore) SetEventBasedHold(ctx context.Context, keys []ds.Key, hold bool) error {
+	return gd.forEachObject(ctx, keys, func(ctx context.Context, key string, obj *storage.ObjectHandle) error {
+		return gd.setEventBasedHold(ctx, obj, hold)
+	})
+}
+
+func (gd *GCSDatastore) setEventBasedHold(ctx context.Context, obj *storage.ObjectHandle, hold bool) error {
+	_, err := obj.Update(ctx, storage.ObjectAttrsToUpdate{EventBasedHold: hold})
+	if err != nil && err != storage.ErrObjectNotExist {
+		return requestError("update", obj.ObjectName(), err)
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"sync/atomic"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+)
+
+// setRetry applies the retry settings of cfg to all requests of client.
+func setRetry(client *storage.Client, cfg Config) {
+	var opts []storage.RetryOption
+	if cfg.RetryInitialBackoff > 0 || cfg.RetryMaxBackoff > 0 || cfg.RetryMultiplier > 0 {
+		opts = append(opts, storage.WithBackoff(gax.Backoff{
+			Initial:    cfg.RetryInitialBackoff,
+			Max:        cfg.RetryMaxBackoff,
+			Multiplier: cfg.RetryMultiplier,
+		}))
+	}
+	if cfg.RetryAlways {
+		opts = append(opts, storage.WithPolicy(storage.RetryAlways))
+	}
+	if len(opts) > 0 {
+		client.SetRetry(opts...)
+	}
+}
+
+// retryer returns obj, the object of key, with the retry settings that
+// apply per request: the writes of blocks are retried with
+// RetryBlockWrites, and requests are attempted up to RetryMaxAttempts
+// times. Use a new handle for each request, since attempts are counted per
+// handle.
+func (gd *GCSDatastore) retryer(obj *storage.ObjectHandle, key string) *storage.ObjectHandle {
+	var opts []storage.RetryOption
+	if gd.Config.RetryBlockWrites && isBlockKey(key) {
+		opts = append(opts, storage.WithPolicy(storage.RetryAlways))
+	}
+	if max := int32(gd.Config.RetryMaxAttempts); max > 0 {
+		var attempts atomic.Int32
+		opts = append(opts, storage.WithErrorFunc(func(err error) bool {
+			return storage.ShouldRetry(err) && attempts.Add(1) < max
+		}))
+	}
+	if len(opts) == 0 {
+		return obj
+	}
+	return obj.Retryer(opts...)
+}
@@ -0,0 +1,197 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/iterator"
+)
+
+var _ ds.ScrubbedDatastore = (*GCSDatastore)(nil)
+
+// ErrCorrupt is returned for objects whose data fails a check. It matches
+// every CorruptError.
+var ErrCorrupt = errors.New("gcsds: corrupt object")
+
+// CorruptError lists the keys whose objects Scrub found corrupt and didn't
+// delete.
+type CorruptError struct {
+	Keys []string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("gcsds: %d corrupt objects, first %s", len(e.Keys), e.Keys[0])
+}
+
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Scrub reads every object under the prefix and checks its data against the
+// CRC32C recorded by GCS and, for blocks, the multihash in its key. It also
+// reconciles the metadata cache with the listing: objects missing from the
+// cache are added, and cached keys without an object are removed. Corrupt
+// objects are deleted if Config.ScrubRepair is set, through the trash if
+// there is one, and returned in a CorruptError otherwise.
+func (gd *GCSDatastore) Scrub(ctx context.Context) error {
+	gd.mdCache.StartLoading()
+	defer gd.mdCache.DoneLoading()
+	listed := map[string]bool{}
+	var mu sync.Mutex
+	var firstErr error
+	corrupt := []string{}
+	added := 0
+	sem := make(chan struct{}, gd.workers())
+	var wg sync.WaitGroup
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, &storage.Query{Prefix: gd.listPrefix()})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			mu.Lock()
+			firstErr = requestError("list", gd.listPrefix(), err)
+			mu.Unlock()
+			break
+		}
+		key := gd.keyOf(attrs.Name)
+		listed[key] = true
+		if !gd.mdCache.Has(key) {
+			added++
+			gd.mdCache.LoadEntry(objectMetadata(key, attrs))
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			err := gd.scrubObject(ctx, key, attrs)
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, ErrCorrupt) {
+				logger.Warnw("Scrub found corrupt object", "key", key, "err", err)
+				corrupt = append(corrupt, key)
+			} else if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	removed, err := gd.removeOrphans(ctx, listed)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Scrubbed %d objects: %d corrupt, %d added to and %d removed from the metadata cache.",
+		len(listed), len(corrupt), added, removed)
+	if len(corrupt) == 0 {
+		return nil
+	}
+	sort.Strings(corrupt)
+	if !gd.Config.ScrubRepair {
+		return &CorruptError{Keys: corrupt}
+	}
+	for _, key := range corrupt {
+		if err := gd.Delete(ctx, ds.RawKey(key)); err != nil {
+			return err
+		}
+	}
+	logger.Infof("Deleted %d corrupt objects.", len(corrupt))
+	return nil
+}
+
+// scrubObject reads the generation of key in attrs and checks its data. A
+// failed check is ErrCorrupt.
+func (gd *GCSDatastore) scrubObject(ctx context.Context, key string, attrs *storage.ObjectAttrs) error {
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(attrs.Name).Generation(attrs.Generation)
+	r, err := obj.ReadCompressed(true).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		// Overwritten or deleted since it was listed.
+		return nil
+	}
+	if err != nil {
+		return requestError("read", attrs.Name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if isBadCRC(err) {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if err != nil {
+		return requestError("read", attrs.Name, err)
+	}
+	if sum := crc32.Checksum(data, castagnoli); sum != attrs.CRC32C {
+		return fmt.Errorf("%w: CRC32C is %08x, GCS recorded %08x", ErrCorrupt, sum, attrs.CRC32C)
+	}
+	if data, err = gd.decodeValue(attrs.ContentEncoding, key, data); err != nil {
+		if errors.Is(err, ErrCorrupt) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	if VerifyMultihash(ds.RawKey(key), data) != nil {
+		return fmt.Errorf("%w: value does not match key multihash", ErrCorrupt)
+	}
+	return nil
+}
+
+// isBadCRC reports whether err is the client's own CRC32C check of a full
+// read failing.
+func isBadCRC(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "bad CRC")
+}
+
+// removeOrphans removes cached keys that weren't listed and don't exist,
+// and returns how many. Keys written since the listing exist, so they stay.
+func (gd *GCSDatastore) removeOrphans(ctx context.Context, listed map[string]bool) (int, error) {
+	candidates := []ds.Key{}
+	next := gd.mdCache.Iterator("", 0)
+	for m := next(); m != nil; m = next() {
+		if _, ok := gd.pendingValue(m.Key); !ok && !listed[m.Key] {
+			candidates = append(candidates, ds.RawKey(m.Key))
+		}
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+	has, err := gd.HasMany(ctx, candidates)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for i, ok := range has {
+		if !ok {
+			gd.mdCache.Delete(candidates[i].String())
+			gd.dataCache.Remove(candidates[i].String())
+			gd.removeDisk(candidates[i].String())
+			removed++
+		}
+	}
+	return removed, nil
+}
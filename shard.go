@@ -0,0 +1,134 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// shardPrefix starts the sharding specs of flatfs, which Config.Sharding
+// accepts with or without it.
+const shardPrefix = "/repo/flatfs/shard/v1/"
+
+// ShardingNone is the Sharding of object names without shard directories.
+const ShardingNone = "none"
+
+// shardFunc returns the shard directory of the last element of a key.
+type shardFunc func(base string) string
+
+// parseSharding returns the shard function of a flatfs sharding spec,
+// such as "next-to-last/2", and the spec in full.
+func parseSharding(spec string) (shardFunc, string, error) {
+	fun, param, ok := strings.Cut(strings.TrimPrefix(spec, shardPrefix), "/")
+	n, err := strconv.Atoi(param)
+	if !ok || err != nil || n <= 0 {
+		return nil, "", fmt.Errorf("gcsds: invalid sharding %q", spec)
+	}
+	padding := strings.Repeat("_", n+1)
+	var f shardFunc
+	switch fun {
+	case "prefix":
+		f = func(base string) string { return (base + padding)[:n] }
+	case "suffix":
+		f = func(base string) string {
+			s := padding + base
+			return s[len(s)-n:]
+		}
+	case "next-to-last":
+		f = func(base string) string {
+			s := padding + base
+			offset := len(s) - n - 1
+			return s[offset : offset+n]
+		}
+	default:
+		return nil, "", fmt.Errorf("gcsds: unknown sharding function %q", fun)
+	}
+	return f, fmt.Sprintf("%s%s/%d", shardPrefix, fun, n), nil
+}
+
+// initSharding parses Config.Sharding.
+func (gd *GCSDatastore) initSharding() error {
+	if gd.Config.Sharding == "" || gd.Config.Sharding == ShardingNone {
+		return nil
+	}
+	f, _, err := parseSharding(gd.Config.Sharding)
+	gd.shard = f
+	return err
+}
+
+// sharding returns the sharding of the configuration, in full.
+func (gd *GCSDatastore) sharding() string {
+	if gd.Config.Sharding == "" || gd.Config.Sharding == ShardingNone {
+		return ShardingNone
+	}
+	_, spec, err := parseSharding(gd.Config.Sharding)
+	if err != nil {
+		return gd.Config.Sharding
+	}
+	return spec
+}
+
+// shardPath returns key with a shard directory before its last element.
+func (gd *GCSDatastore) shardPath(key string) string {
+	dir, base := path.Split(path.Clean("/" + key))
+	return path.Join(dir, gd.shard(base), base)
+}
+
+// unshard returns the name of an object without its shard directory.
+func unshard(name string) string {
+	dir, base := path.Split(name)
+	return path.Join(path.Dir(strings.TrimSuffix(dir, "/")), base)
+}
+
+// shardLoadShards returns shards of a metadata load that split the shard
+// directories under the prefix into up to loadShardTarget ranges.
+func (gd *GCSDatastore) shardLoadShards(ctx context.Context) ([]*loadShard, error) {
+	query := &storage.Query{Prefix: gd.listPrefix(), Delimiter: "/"}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+	var dirs []string
+	it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Prefix != "" {
+			dirs = append(dirs, attrs.Prefix)
+		}
+	}
+	sort.Strings(dirs)
+	// Each shard extends to the next, so names outside of the
+	// directories are listed too.
+	shards := []*loadShard{{start: gd.listPrefix()}}
+	per := (len(dirs) + loadShardTarget - 1) / loadShardTarget
+	for i := per; i < len(dirs); i += per {
+		shards[len(shards)-1].end = dirs[i]
+		shards = append(shards, &loadShard{start: dirs[i]})
+	}
+	return shards, nil
+}
@@ -0,0 +1,249 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SharedCache is a value cache shared by the nodes of a fleet serving the
+// same bucket, between each node's in-memory data cache and GCS. A value
+// one node fetched from GCS is then a cache hit for all of them.
+//
+// Errors are logged and otherwise ignored: the shared cache is an
+// optimization and GCS stays the source of truth.
+type SharedCache interface {
+	// Get returns the value for key, and whether it was found.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores value for key.
+	Set(ctx context.Context, key string, value []byte) error
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// sharedCacheKey returns the shared cache key for key, which is unique
+// across buckets and prefixes.
+func (gd *GCSDatastore) sharedCacheKey(key string) string {
+	return "gcsds:" + gd.Config.Bucket + "/" + gd.GCSPath(key)
+}
+
+// sharedCacheable reports whether value fits the data cache size threshold,
+// which also applies to the shared cache.
+func (gd *GCSDatastore) sharedCacheable(value []byte) bool {
+	return gd.Config.DataCacheMaxValueSize <= 0 || len(value) <= gd.Config.DataCacheMaxValueSize
+}
+
+// getShared looks key up in the shared cache.
+func (gd *GCSDatastore) getShared(ctx context.Context, key string) ([]byte, bool) {
+	if gd.Config.SharedCache == nil {
+		return nil, false
+	}
+	value, ok, err := gd.Config.SharedCache.Get(ctx, gd.sharedCacheKey(key))
+	if err != nil {
+		gd.stats.sharedCacheErrors.Add(1)
+		logger.Warnw("Failed to get value from shared cache", "key", key, "err", err)
+		return nil, false
+	}
+	if ok {
+		gd.stats.sharedCacheHits.Add(1)
+	} else {
+		gd.stats.sharedCacheMisses.Add(1)
+	}
+	return value, ok
+}
+
+// setShared stores value for key in the shared cache. Values over the size
+// threshold invalidate the key instead, so an overwritten value is never
+// served stale.
+func (gd *GCSDatastore) setShared(ctx context.Context, key string, value []byte) {
+	if gd.Config.SharedCache == nil {
+		return
+	}
+	var err error
+	if gd.sharedCacheable(value) {
+		err = gd.Config.SharedCache.Set(ctx, gd.sharedCacheKey(key), value)
+	} else {
+		err = gd.Config.SharedCache.Delete(ctx, gd.sharedCacheKey(key))
+	}
+	if err != nil {
+		gd.stats.sharedCacheErrors.Add(1)
+		logger.Warnw("Failed to update shared cache", "key", key, "err", err)
+	}
+}
+
+// deleteShared removes key from the shared cache.
+func (gd *GCSDatastore) deleteShared(ctx context.Context, key string) {
+	if gd.Config.SharedCache == nil {
+		return
+	}
+	if err := gd.Config.SharedCache.Delete(ctx, gd.sharedCacheKey(key)); err != nil {
+		gd.stats.sharedCacheErrors.Add(1)
+		logger.Warnw("Failed to delete from shared cache", "key", key, "err", err)
+	}
+}
+
+const (
+	// redisTimeout bounds requests without a context deadline.
+	redisTimeout = time.Second
+	// redisIdleConns is the number of idle connections RedisCache keeps.
+	redisIdleConns = 16
+)
+
+// RedisCache is a SharedCache speaking the Redis protocol, e.g. to
+// Memorystore for Redis. It needs only GET, SET and DEL.
+type RedisCache struct {
+	addr string
+	ttl  time.Duration
+	idle chan *redisConn
+}
+
+// NewRedisCache returns a cache backed by the Redis server at addr
+// ("host:port"). Values expire after ttl, or are evicted by the server's
+// policy if ttl is 0. Connections are made on demand.
+func NewRedisCache(addr string, ttl time.Duration) *RedisCache {
+	return &RedisCache{addr: addr, ttl: ttl, idle: make(chan *redisConn, redisIdleConns)}
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// errRedisNil is the reply to GET for a missing key.
+var errRedisNil = errors.New("redis: nil")
+
+func (rc *RedisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := rc.do(ctx, "GET", []byte(key))
+	if err == errRedisNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (rc *RedisCache) Set(ctx context.Context, key string, value []byte) error {
+	args := [][]byte{[]byte(key), value}
+	if rc.ttl > 0 {
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(rc.ttl.Milliseconds(), 10)))
+	}
+	_, err := rc.do(ctx, "SET", args...)
+	return err
+}
+
+func (rc *RedisCache) Delete(ctx context.Context, key string) error {
+	_, err := rc.do(ctx, "DEL", []byte(key))
+	return err
+}
+
+// Close closes the idle connections.
+func (rc *RedisCache) Close() error {
+	for {
+		select {
+		case c := <-rc.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends a command and returns the reply. Connections that fail are
+// discarded, others are reused.
+func (rc *RedisCache) do(ctx context.Context, cmd string, args ...[]byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	var c *redisConn
+	select {
+	case c = <-rc.idle:
+	default:
+		d := net.Dialer{Deadline: deadline}
+		conn, err := d.DialContext(ctx, "tcp", rc.addr)
+		if err != nil {
+			return nil, err
+		}
+		c = &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	}
+	c.conn.SetDeadline(deadline)
+	reply, err := c.command(cmd, args)
+	if err != nil && err != errRedisNil {
+		c.conn.Close()
+		return nil, err
+	}
+	select {
+	case rc.idle <- c:
+	default:
+		c.conn.Close()
+	}
+	return reply, err
+}
+
+// command writes a command as a RESP array of bulk strings and reads the
+// reply.
+func (c *redisConn) command(cmd string, args [][]byte) ([]byte, error) {
+	fmt.Fprintf(c.w, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n", len(a))
+		c.w.Write(a)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.reply()
+}
+
+// reply reads a simple string, error, integer or bulk string reply.
+func (c *redisConn) reply() ([]byte, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, errors.New("redis: " + line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed reply %q", line)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		value := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, value); err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
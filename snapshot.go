@@ -0,0 +1,211 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// snapshotMagic starts every metadata snapshot, followed by the entries,
+// each a uvarint-prefixed key and a uvarint-prefixed encodeMetadata value.
+const snapshotMagic = "gcsds-metadata-snapshot 1\n"
+
+// accessSinceMetadataKey records the accessSince of the datastore that
+// saved a metadata snapshot, in its custom metadata.
+const accessSinceMetadataKey = "access-since"
+
+// snapshotPath returns the name of the metadata snapshot object, next to
+// the prefix like the lock object.
+func (gd *GCSDatastore) snapshotPath() string {
+	return strings.TrimSuffix(path.Join(gd.Config.Prefix), "/") + ".metadata"
+}
+
+// SaveMetadataSnapshot writes the metadata cache to a compressed object
+// next to the prefix, for LoadMetadataSnapshot to read on the next start.
+// It fails unless the metadata is loaded, since a snapshot of a partial
+// cache would hide objects until the next full listing.
+func (gd *GCSDatastore) SaveMetadataSnapshot(ctx context.Context) error {
+	if !gd.metadataLoaded.Load() {
+		return errors.New("gcsds: metadata snapshot of an incomplete metadata cache")
+	}
+	if err := gd.checkWritable(); err != nil {
+		return err
+	}
+	start := time.Now()
+	// Cancelling ctx abandons the upload on errors.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := gd.newWriter(ctx, gd.client.Bucket(gd.Config.Bucket).Object(gd.snapshotPath()))
+	w.ContentType = "application/gzip"
+	w.Metadata = map[string]string{accessSinceMetadataKey: strconv.FormatInt(gd.accessSince.Load(), 10)}
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	bw.WriteString(snapshotMagic)
+	var n int
+	var buf [binary.MaxVarintLen64]byte
+	next := gd.mdCache.Iterator("", 0)
+	for m := next(); m != nil; m = next() {
+		value := encodeMetadata(m)
+		bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(m.Key)))])
+		bw.WriteString(m.Key)
+		bw.Write(buf[:binary.PutUvarint(buf[:], uint64(len(value)))])
+		if _, err := bw.Write(value); err != nil {
+			return requestError("write", gd.snapshotPath(), err)
+		}
+		n++
+	}
+	err := bw.Flush()
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		return requestError("write", gd.snapshotPath(), err)
+	}
+	if err := w.Close(); err != nil {
+		return requestError("write", gd.snapshotPath(), err)
+	}
+	logger.Infof("Saved metadata snapshot of %d objects (%d bytes) in %.2f s",
+		n, w.Attrs().Size, time.Since(start).Seconds())
+	return nil
+}
+
+// LoadMetadataSnapshot fills the metadata cache from the snapshot last
+// saved by SaveMetadataSnapshot, which is much faster than listing the
+// bucket. Objects written or deleted by other nodes since the snapshot
+// was taken aren't reflected, so the cache isn't considered loaded: the
+// next metadata load reconciles it with the bucket, replacing the entries
+// it lists and dropping the others, unless written meanwhile. Follow it
+// with LoadMetadataInBackground to serve while the bucket is listed. It
+// returns
+// storage.ErrObjectNotExist if there is no snapshot.
+func (gd *GCSDatastore) LoadMetadataSnapshot(ctx context.Context) error {
+	start := time.Now()
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.snapshotPath())
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return err
+	}
+	if err != nil {
+		return requestError("stat", gd.snapshotPath(), err)
+	}
+	r, err := obj.Generation(attrs.Generation).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return err
+	}
+	if err != nil {
+		return requestError("read", gd.snapshotPath(), err)
+	}
+	defer r.Close()
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return gd.corruptSnapshot(err)
+	}
+	br := bufio.NewReader(zr)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != snapshotMagic {
+		return gd.corruptSnapshot(fmt.Errorf("bad header %q", magic))
+	}
+	var entries []*Metadata
+	for {
+		key, err := readSnapshotField(br)
+		if err == io.EOF {
+			break
+		}
+		var value []byte
+		if err == nil {
+			value, err = readSnapshotField(br)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return gd.corruptSnapshot(err)
+		}
+		m := decodeMetadata(key, value)
+		if m == nil {
+			return gd.corruptSnapshot(fmt.Errorf("bad entry for %q", key))
+		}
+		entries = append(entries, m)
+	}
+	gd.unlistedMu.Lock()
+	defer gd.unlistedMu.Unlock()
+	if gd.unlisted == nil {
+		gd.unlisted = make(map[string]struct{}, len(entries))
+	}
+	for _, m := range entries {
+		// Keys already cached, e.g. from the write-ahead log, are newer.
+		if gd.mdCache.Has(m.Key) {
+			continue
+		}
+		gd.mdCache.PutEntry(*m)
+		gd.unlisted[m.Key] = struct{}{}
+	}
+	// Snapshots without it have unknown access times.
+	if since, err := strconv.ParseInt(attrs.Metadata[accessSinceMetadataKey], 10, 64); err == nil && since < gd.accessSince.Load() {
+		gd.accessSince.Store(since)
+	}
+	logger.Infof("Loaded metadata snapshot of %d objects taken %s in %.2f s",
+		len(entries), r.Attrs.LastModified.Format(time.RFC3339), time.Since(start).Seconds())
+	return nil
+}
+
+// corruptSnapshot returns the error for a snapshot that can't be read.
+func (gd *GCSDatastore) corruptSnapshot(err error) error {
+	return fmt.Errorf("gcsds: corrupt metadata snapshot gs://%s/%s: %w", gd.Config.Bucket, gd.snapshotPath(), err)
+}
+
+// readSnapshotField reads a uvarint-prefixed field of a snapshot.
+func readSnapshotField(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// runSnapshots saves a metadata snapshot every interval until ctx is done.
+func (gd *GCSDatastore) runSnapshots(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !gd.metadataLoaded.Load() {
+			continue
+		}
+		if err := gd.SaveMetadataSnapshot(ctx); err != nil && ctx.Err() == nil {
+			logger.Warnf("Failed to save metadata snapshot: %v", err)
+		}
+	}
+}
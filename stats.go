@@ -0,0 +1,202 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of datastore counters.
+type Stats struct {
+	// ArchivedObjects is the number of objects moved to ARCHIVE.
+	ArchivedObjects int64
+	// ArchivedReads is the number of reads served from ARCHIVE objects.
+	ArchivedReads int64
+	// ColdlineObjects is the number of objects moved to COLDLINE.
+	ColdlineObjects int64
+	// Restores is the number of COLDLINE and ARCHIVE objects moved back to
+	// STANDARD on read.
+	Restores int64
+	// MirrorFallbacks is the number of reads the mirror bucket couldn't
+	// serve and that went to the primary bucket.
+	MirrorFallbacks int64
+	// MirrorErrors is the number of failed mirror copies and deletes.
+	MirrorErrors int64
+	// SharedCacheHits, SharedCacheMisses and SharedCacheErrors count
+	// lookups in the shared cache, and its failed requests.
+	SharedCacheHits   int64
+	SharedCacheMisses int64
+	SharedCacheErrors int64
+	// DiskCacheHits, DiskCacheMisses and DiskCacheErrors count lookups in
+	// the disk cache, and its failed writes.
+	DiskCacheHits   int64
+	DiskCacheMisses int64
+	DiskCacheErrors int64
+	// DataCache reports the usage and hit rate of the in-memory data cache,
+	// to size DataCacheItems and DataCacheMaxBytes.
+	DataCache DataCacheStats
+	// MetadataEntries is the number of entries in the metadata cache, and
+	// MetadataMemory an estimate of the memory they use. It is 0 with
+	// MetadataIndexPath, which keeps them on disk.
+	MetadataEntries int
+	MetadataMemory  int64
+
+	// WrittenSizes and ReadSizes are histograms of the sizes of values
+	// written by Put and returned by Get.
+	WrittenSizes []SizeBucket
+	ReadSizes    []SizeBucket
+	// WrittenBytes and ReadBytes are the totals of the same values.
+	WrittenBytes int64
+	ReadBytes    int64
+
+	// Autoclass reports whether GCS manages storage classes for the bucket.
+	Autoclass bool
+	// AutoclassToggleTime is when Autoclass was last turned on or off.
+	AutoclassToggleTime time.Time
+	// StorageClasses counts cached objects per storage class, as last
+	// observed. "" is the bucket default class.
+	StorageClasses map[string]int
+	// StorageClassTransitions counts the objects found in another storage
+	// class than cached, moved by Autoclass or lifecycle rules, when the
+	// metadata is refreshed or notified.
+	StorageClassTransitions int64
+	// ThrottledRequests is the number of GCS requests delayed by
+	// MaxRequestsPerSecond or MaxConcurrentRequests.
+	ThrottledRequests int64
+	// FallbackReads is the number of reads served from FallbackBucket.
+	FallbackReads int64
+	// Packs is the number of pack objects, and PackedValues the number of
+	// values stored in them, see PackBlocks.
+	Packs        int
+	PackedValues int
+
+	// Quotas reports usage against each configured quota. The
+	// datastore-wide quota has an empty prefix.
+	Quotas []QuotaUsage
+
+	// MetadataLoaded reports whether the metadata of all objects was
+	// loaded. MetadataListed is the number of objects listed so far.
+	MetadataLoaded bool
+	MetadataListed int64
+
+	// PendingWrites and PendingBytes count the values Put acknowledged
+	// that aren't stored in GCS yet. UploadErrors counts failed attempts
+	// to store them.
+	PendingWrites int64
+	PendingBytes  int64
+	UploadErrors  int64
+	// SkippedWrites counts the writes of blocks already stored that
+	// SkipExistingBlocks skipped.
+	SkippedWrites int64
+	// Notifications counts the bucket notifications applied to the caches,
+	// and NotificationErrors the failures to pull or apply them.
+	Notifications      int64
+	NotificationErrors int64
+	// Touches counts the refreshes of the CustomTime of unpinned values
+	// read, see TouchInterval, and DroppedTouches the reads that didn't
+	// refresh it because of TouchMaxPerSecond.
+	Touches        int64
+	DroppedTouches int64
+
+	// Locality describes the node's region relative to the bucket.
+	Locality Locality
+	// Replication describes the replication of the bucket across regions.
+	Replication Replication
+}
+
+// counters are the live values behind Stats.
+type counters struct {
+	archivedObjects    atomic.Int64
+	coldlineObjects    atomic.Int64
+	fallbackReads      atomic.Int64
+	archivedReads      atomic.Int64
+	restores           atomic.Int64
+	mirrorFallbacks    atomic.Int64
+	mirrorErrors       atomic.Int64
+	sharedCacheHits    atomic.Int64
+	sharedCacheMisses  atomic.Int64
+	sharedCacheErrors  atomic.Int64
+	diskCacheHits      atomic.Int64
+	diskCacheMisses    atomic.Int64
+	diskCacheErrors    atomic.Int64
+	metadataListed     atomic.Int64
+	uploadErrors       atomic.Int64
+	skippedWrites      atomic.Int64
+	notifications      atomic.Int64
+	notificationErrors atomic.Int64
+	classTransitions   atomic.Int64
+	touches            atomic.Int64
+	droppedTouches     atomic.Int64
+	written            sizeHistogram
+	read               sizeHistogram
+}
+
+// Stats returns a snapshot of the datastore counters.
+func (gd *GCSDatastore) Stats() Stats {
+	st := Stats{
+		ArchivedObjects:   gd.stats.archivedObjects.Load(),
+		ColdlineObjects:   gd.stats.coldlineObjects.Load(),
+		ArchivedReads:     gd.stats.archivedReads.Load(),
+		Restores:          gd.stats.restores.Load(),
+		MirrorFallbacks:   gd.stats.mirrorFallbacks.Load(),
+		MirrorErrors:      gd.stats.mirrorErrors.Load(),
+		SharedCacheHits:   gd.stats.sharedCacheHits.Load(),
+		SharedCacheMisses: gd.stats.sharedCacheMisses.Load(),
+		SharedCacheErrors: gd.stats.sharedCacheErrors.Load(),
+		DiskCacheHits:     gd.stats.diskCacheHits.Load(),
+		DiskCacheMisses:   gd.stats.diskCacheMisses.Load(),
+		DiskCacheErrors:   gd.stats.diskCacheErrors.Load(),
+		DataCache:         gd.dataCache.Stats(),
+		MetadataEntries:   gd.mdCache.Size(),
+		WrittenSizes:      gd.stats.written.snapshot(),
+		ReadSizes:         gd.stats.read.snapshot(),
+		WrittenBytes:      gd.stats.written.bytes.Load(),
+		ReadBytes:         gd.stats.read.bytes.Load(),
+		StorageClasses:    gd.mdCache.StorageClasses(),
+		Quotas:            gd.quotaUsage(),
+		MetadataLoaded:    gd.metadataLoaded.Load(),
+		MetadataListed:    gd.stats.metadataListed.Load(),
+		Locality:          gd.locality,
+		Replication:       replication(gd.bucketAttrs),
+	}
+	pending := gd.pendingUsage()
+	st.PendingWrites, st.PendingBytes = pending.Objects, pending.Bytes
+	st.UploadErrors = gd.stats.uploadErrors.Load()
+	st.SkippedWrites = gd.stats.skippedWrites.Load()
+	st.Notifications = gd.stats.notifications.Load()
+	st.NotificationErrors = gd.stats.notificationErrors.Load()
+	st.Touches = gd.stats.touches.Load()
+	st.DroppedTouches = gd.stats.droppedTouches.Load()
+	st.StorageClassTransitions = gd.stats.classTransitions.Load()
+	st.ThrottledRequests = gd.throttle.throttled()
+	st.FallbackReads = gd.stats.fallbackReads.Load()
+	st.Packs, st.PackedValues = gd.packs.counts()
+	st.MetadataMemory = gd.metadataMemory()
+	if autoclassEnabled(gd.bucketAttrs) {
+		st.Autoclass = true
+		st.AutoclassToggleTime = gd.bucketAttrs.Autoclass.ToggleTime
+	}
+	return st
+}
+
+// metadataMemory estimates the memory used by the metadata cache, if it's
+// in memory.
+func (gd *GCSDatastore) metadataMemory() int64 {
+	if m, ok := gd.mdCache.(interface{ MemoryUsage() int64 }); ok {
+		return m.MemoryUsage()
+	}
+	return 0
+}
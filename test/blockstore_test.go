@@ -0,0 +1,199 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	blocks "github.com/ipfs/go-block-format"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+func TestBlockstore(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	defer gd.Close()
+	bs := gcsds.NewBlockstore(gd)
+
+	blks := []blocks.Block{}
+	for i := 0; i < 5; i++ {
+		blks = append(blks, blocks.NewBlock([]byte(randomSeq(100+i))))
+	}
+	if err := bs.Put(ctx, blks[0]); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := bs.PutMany(ctx, blks); err != nil {
+		t.Fatalf("PutMany: %v", err)
+	}
+	for _, b := range blks {
+		if has, _ := bs.Has(ctx, b.Cid()); !has {
+			t.Errorf("Has(%v) = false", b.Cid())
+		}
+		if size, err := bs.GetSize(ctx, b.Cid()); err != nil || size != len(b.RawData()) {
+			t.Errorf("GetSize(%v) = %d, %v", b.Cid(), size, err)
+		}
+		got, err := bs.Get(ctx, b.Cid())
+		if err != nil || !bytes.Equal(got.RawData(), b.RawData()) {
+			t.Errorf("Get(%v) = %v", b.Cid(), err)
+		}
+		// Blocks are stored where kubo's blockstore puts them.
+		if has, _ := gd.Has(ctx, blockstore.BlockPrefix.Child(dshelp.MultihashToDsKey(b.Cid().Hash()))); !has {
+			t.Errorf("Block %v not in kubo layout", b.Cid())
+		}
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatalf("AllKeysChan: %v", err)
+	}
+	n := 0
+	for c := range keys {
+		for _, b := range blks {
+			if bytes.Equal(c.Hash(), b.Cid().Hash()) {
+				n++
+			}
+		}
+	}
+	if n != len(blks) {
+		t.Errorf("AllKeysChan returned %d of %d blocks", n, len(blks))
+	}
+
+	// Corrupt a block behind the blockstore's back.
+	corrupt := blks[1]
+	key := blockstore.BlockPrefix.Child(dshelp.MultihashToDsKey(corrupt.Cid().Hash()))
+	if err := gd.Put(ctx, key, []byte("corrupt")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := bs.Get(ctx, corrupt.Cid()); err != nil {
+		t.Errorf("Get without HashOnRead: %v", err)
+	}
+	bs.HashOnRead(true)
+	if _, err := bs.Get(ctx, corrupt.Cid()); !errors.Is(err, blockstore.ErrHashMismatch) {
+		t.Errorf("Expected ErrHashMismatch, got %v", err)
+	}
+
+	if err := bs.DeleteBlock(ctx, blks[0].Cid()); err != nil {
+		t.Fatalf("DeleteBlock: %v", err)
+	}
+	if has, _ := bs.Has(ctx, blks[0].Cid()); has {
+		t.Errorf("Has after DeleteBlock = true")
+	}
+	if _, err := bs.Get(ctx, blks[0].Cid()); !ipld.IsNotFound(err) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+}
+
+func TestBlockstoreRootPrefix(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	defer gd.Close()
+	bs := gcsds.NewBlockstoreWithOptions(gd, gcsds.BlockstoreOptions{Prefix: "/"})
+
+	blks := []blocks.Block{}
+	for i := 0; i < 3; i++ {
+		blks = append(blks, blocks.NewBlock([]byte(randomSeq(100+i))))
+	}
+	if err := bs.PutMany(ctx, blks); err != nil {
+		t.Fatalf("PutMany: %v", err)
+	}
+	for _, b := range blks {
+		if has, _ := bs.Has(ctx, b.Cid()); !has {
+			t.Errorf("Has(%v) = false", b.Cid())
+		}
+		got, err := bs.Get(ctx, b.Cid())
+		if err != nil || !bytes.Equal(got.RawData(), b.RawData()) {
+			t.Errorf("Get(%v) = %v", b.Cid(), err)
+		}
+		// Blocks are named after their multihash at the root.
+		if has, _ := gd.Has(ctx, dshelp.MultihashToDsKey(b.Cid().Hash())); !has {
+			t.Errorf("Block %v not at the root", b.Cid())
+		}
+		if has, _ := gcsds.NewBlockstore(gd).Has(ctx, b.Cid()); has {
+			t.Errorf("Block %v in kubo layout", b.Cid())
+		}
+	}
+
+	keys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		t.Fatalf("AllKeysChan: %v", err)
+	}
+	n := 0
+	for c := range keys {
+		for _, b := range blks {
+			if bytes.Equal(c.Hash(), b.Cid().Hash()) {
+				n++
+			}
+		}
+	}
+	if n != len(blks) {
+		t.Errorf("AllKeysChan returned %d of %d blocks", n, len(blks))
+	}
+}
+
+func TestBlockstoreKeyChanFunc(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "reprovide" + randomKey().String(),
+		Workers:        10,
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blks := []blocks.Block{}
+	for i := 0; i < 5; i++ {
+		blks = append(blks, blocks.NewBlock([]byte(randomSeq(100+i))))
+	}
+	if err := gcsds.NewBlockstore(gd).PutMany(ctx, blks); err != nil {
+		t.Fatalf("PutMany: %v", err)
+	}
+	gd.Close()
+
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	cids, err := gcsds.NewBlockstore(gd).KeyChanFunc()(ctx)
+	if err != nil {
+		t.Fatalf("KeyChanFunc: %v", err)
+	}
+	n := 0
+	for c := range cids {
+		for _, b := range blks {
+			if bytes.Equal(c.Hash(), b.Cid().Hash()) {
+				n++
+			}
+		}
+	}
+	if n != len(blks) {
+		t.Errorf("KeyChanFunc returned %d of %d blocks", n, len(blks))
+	}
+	// No values were read to enumerate the blocks.
+	if stats := gd.Stats(); stats.ReadBytes != 0 || stats.DataCache.Misses != 0 {
+		t.Errorf("Enumerating read %d bytes, %d data cache misses", stats.ReadBytes, stats.DataCache.Misses)
+	}
+}
@@ -0,0 +1,391 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	"github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/mount"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// readCARSection reads a length-prefixed CARv1 section.
+func readCARSection(t *testing.T, r *bufio.Reader) []byte {
+	size, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Failed to read section length: %v", err)
+	}
+	section := make([]byte, size)
+	if _, err := io.ReadFull(r, section); err != nil {
+		t.Fatalf("Failed to read section: %v", err)
+	}
+	return section
+}
+
+func TestExportCAR(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	prefix := "/blocks" + randomKey().String()
+	values := map[string][]byte{}
+	for i := 0; i < 10; i++ {
+		value := []byte(randomSeq(100 + i))
+		key := ds.NewKey(prefix).Child(blockKey(t, value))
+		testPut(t, ctx, gd, key, value)
+		values[string(key.BaseNamespace())] = value
+	}
+	hash, err := mh.Sum([]byte("root"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("Failed to hash root: %v", err)
+	}
+	root := cid.NewCidV1(cid.Raw, hash)
+	if _, err := gd.ExportCAR(ctx, prefix, nil, "car/test.car"); !errors.Is(err, gcsds.ErrNoRoots) {
+		t.Fatalf("Expected ErrNoRoots, got %v", err)
+	}
+	dest := "car/" + randomSeq(10) + ".car"
+	// Blocks are exported as raw, so a dag-pb root would match none.
+	if _, err := gd.ExportCAR(ctx, prefix, []cid.Cid{cid.NewCidV1(cid.DagProtobuf, hash)}, dest); err == nil {
+		t.Fatalf("ExportCAR accepted a dag-pb root")
+	}
+	if _, err := gd.WriteCAR(ctx, io.Discard, gcsds.CARExport{Prefix: prefix, Roots: []cid.Cid{cid.NewCidV0(hash)}}); err == nil {
+		t.Fatalf("WriteCAR of all blocks accepted a dag-pb root")
+	}
+	n, err := gd.ExportCAR(ctx, prefix, []cid.Cid{root}, dest)
+	if err != nil {
+		t.Fatalf("ExportCAR: %v", err)
+	}
+	if n != len(values) {
+		t.Fatalf("Exported %d blocks, expected %d", n, len(values))
+	}
+
+	obj := gd.BucketHandle().Object(dest)
+	defer obj.Delete(ctx)
+	reader, err := obj.NewReader(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read CAR: %v", err)
+	}
+	defer reader.Close()
+	r := bufio.NewReader(reader)
+	header := readCARSection(t, r)
+	if !bytes.Contains(header, root.Bytes()) || !bytes.HasSuffix(header, []byte("version\x01")) {
+		t.Fatalf("Unexpected header %x", header)
+	}
+	blocks := 0
+	for section := readCARSection(t, r); section != nil; section = readCARSection(t, r) {
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			t.Fatalf("Invalid CID: %v", err)
+		}
+		if !bytes.Equal(section[n:], values[dshelp.MultihashToDsKey(c.Hash()).BaseNamespace()]) {
+			t.Errorf("Block %v doesn't match its value", c)
+		}
+		blocks++
+	}
+	if blocks != len(values) {
+		t.Errorf("Read %d blocks, expected %d", blocks, len(values))
+	}
+}
+
+func TestImportCAR(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	prefix := "/blocks" + randomKey().String()
+	values := map[ds.Key][]byte{}
+	for i := 0; i < 25; i++ {
+		value := []byte(randomSeq(100 + i))
+		key := blockKey(t, value)
+		testPut(t, ctx, gd, ds.NewKey(prefix).Child(key), value)
+		values[ds.NewKey("/blocks").Child(key)] = value
+	}
+	hash, err := mh.Sum([]byte("root"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("Failed to hash root: %v", err)
+	}
+	v1 := "car/" + randomSeq(10) + ".car"
+	if _, err := gd.ExportCAR(ctx, prefix, []cid.Cid{cid.NewCidV1(cid.Raw, hash)}, v1); err != nil {
+		t.Fatalf("ExportCAR: %v", err)
+	}
+	defer gd.BucketHandle().Object(v1).Delete(ctx)
+
+	// Wrap the CARv1 in a CARv2 with padding before the payload.
+	reader, err := gd.BucketHandle().Object(v1).NewReader(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read CAR: %v", err)
+	}
+	payload, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("Failed to read CAR: %v", err)
+	}
+	v2 := "car/" + randomSeq(10) + ".car"
+	header := []byte{0x0a, 0xa1, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02}
+	header = append(header, make([]byte, 16)...)
+	header = binary.LittleEndian.AppendUint64(header, 64)
+	header = binary.LittleEndian.AppendUint64(header, uint64(len(payload)))
+	header = binary.LittleEndian.AppendUint64(header, 0)
+	w := gd.BucketHandle().Object(v2).NewWriter(ctx)
+	w.Write(header)
+	w.Write(make([]byte, 64-len(header)))
+	w.Write(payload)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to write CARv2: %v", err)
+	}
+	defer gd.BucketHandle().Object(v2).Delete(ctx)
+
+	for _, src := range []string{v1, v2} {
+		config := gcsds.Config{
+			Bucket:         getTestBucket(t),
+			Prefix:         "import" + randomKey().String(),
+			Workers:        4,
+			DataCacheItems: 1000,
+		}
+		imported, err := gcsds.NewGCSDatastore(config)
+		if err != nil {
+			t.Fatalf("NewGCSDatastore: %v", err)
+		}
+		defer imported.Close()
+		opts := gcsds.CARImport{Prefix: "/blocks"}
+		n, err := imported.ImportCAR(ctx, src, opts)
+		if err != nil {
+			t.Fatalf("ImportCAR(%s): %v", src, err)
+		}
+		if n != len(values) {
+			t.Fatalf("Imported %d blocks from %s, expected %d", n, src, len(values))
+		}
+		for key, value := range values {
+			testPositive(t, ctx, imported, key, value)
+		}
+		// Blocks already stored are skipped.
+		if n, err := imported.ImportCAR(ctx, src, opts); err != nil || n != 0 {
+			t.Fatalf("Second ImportCAR(%s) = %d, %v, expected 0", src, n, err)
+		}
+	}
+}
+
+func TestWriteCAR(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	prefix := "/blocks" + randomKey().String()
+	var cids []cid.Cid
+	values := map[cid.Cid][]byte{}
+	for i := 0; i < 10; i++ {
+		value := []byte(randomSeq(100 + i))
+		hash, err := mh.Sum(value, mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatalf("Failed to hash value: %v", err)
+		}
+		testPut(t, ctx, gd, ds.NewKey(prefix).Child(dshelp.MultihashToDsKey(hash)), value)
+		c := cid.NewCidV1(cid.DagProtobuf, hash)
+		values[c] = value
+		if i%2 == 0 {
+			cids = append(cids, c)
+		}
+	}
+	readBlocks := func(r *bufio.Reader) []cid.Cid {
+		header := readCARSection(t, r)
+		if !bytes.Contains(header, cids[0].Bytes()) || !bytes.HasSuffix(header, []byte("version\x01")) {
+			t.Fatalf("Unexpected header %x", header)
+		}
+		var read []cid.Cid
+		for section := readCARSection(t, r); section != nil; section = readCARSection(t, r) {
+			n, c, err := cid.CidFromBytes(section)
+			if err != nil {
+				t.Fatalf("Invalid CID: %v", err)
+			}
+			if !bytes.Equal(section[n:], values[c]) {
+				t.Errorf("Block %v doesn't match its value", c)
+			}
+			read = append(read, c)
+		}
+		return read
+	}
+
+	var buf bytes.Buffer
+	opts := gcsds.CARExport{Prefix: prefix, CIDs: cids}
+	n, err := gd.WriteCAR(ctx, &buf, opts)
+	if err != nil || n != len(cids) {
+		t.Fatalf("WriteCAR = %d, %v, expected %d", n, err, len(cids))
+	}
+	if read := readBlocks(bufio.NewReader(&buf)); !reflect.DeepEqual(read, cids) {
+		t.Fatalf("Read blocks %v, expected %v", read, cids)
+	}
+
+	opts.Version = 2
+	if _, err := gd.WriteCAR(ctx, &buf, opts); err == nil {
+		t.Fatalf("Expected CARv2 export to a buffer to fail")
+	}
+	f, err := os.CreateTemp(t.TempDir(), "*.car")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := gd.WriteCAR(ctx, f, opts); err != nil {
+		t.Fatalf("WriteCAR v2: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 51)
+	if _, err := io.ReadFull(f, header); err != nil {
+		t.Fatalf("Failed to read CARv2 header: %v", err)
+	}
+	offset := binary.LittleEndian.Uint64(header[27:])
+	size := binary.LittleEndian.Uint64(header[35:])
+	if header[10] != 2 || offset != 51 || binary.LittleEndian.Uint64(header[43:]) != 0 {
+		t.Fatalf("Unexpected CARv2 header %x", header)
+	}
+	r := bufio.NewReader(io.LimitReader(f, int64(size)))
+	if read := readBlocks(r); !reflect.DeepEqual(read, cids) {
+		t.Fatalf("Read blocks %v from CARv2, expected %v", read, cids)
+	}
+
+	missing, err := mh.Sum([]byte("missing"), mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("Failed to hash: %v", err)
+	}
+	opts = gcsds.CARExport{Prefix: prefix, CIDs: append(cids, cid.NewCidV1(cid.Raw, missing))}
+	if _, err := gd.WriteCAR(ctx, io.Discard, opts); !errors.Is(err, ds.ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound for a missing block, got %v", err)
+	}
+}
+
+func TestReadCAR(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	prefix := "/blocks" + randomKey().String()
+	var cids []cid.Cid
+	values := map[ds.Key][]byte{}
+	for i := 0; i < 25; i++ {
+		value := []byte(randomSeq(100 + i))
+		key := blockKey(t, value)
+		testPut(t, ctx, gd, ds.NewKey(prefix).Child(key), value)
+		values[key] = value
+		hash, err := dshelp.DsKeyToMultihash(key)
+		if err != nil {
+			t.Fatalf("Invalid key %s: %v", key, err)
+		}
+		cids = append(cids, cid.NewCidV1(cid.Raw, hash))
+	}
+	dir := t.TempDir()
+	for _, version := range []int{1, 2} {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("v%d.car", version)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		opts := gcsds.CARExport{Prefix: prefix, CIDs: cids, Version: version}
+		if _, err := gd.WriteCAR(ctx, f, opts); err != nil {
+			t.Fatalf("WriteCAR v%d: %v", version, err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+
+		config := gcsds.Config{
+			Bucket:         getTestBucket(t),
+			Prefix:         "import" + randomKey().String(),
+			Workers:        4,
+			DataCacheItems: 1000,
+		}
+		imported, err := gcsds.NewGCSDatastore(config)
+		if err != nil {
+			t.Fatalf("NewGCSDatastore: %v", err)
+		}
+		defer imported.Close()
+		n, err := imported.ReadCAR(ctx, f, gcsds.CARImport{})
+		if err != nil {
+			t.Fatalf("ReadCAR v%d: %v", version, err)
+		}
+		if n != len(values) {
+			t.Fatalf("Imported %d blocks from CARv%d, expected %d", n, version, len(values))
+		}
+		// Blocks are stored at the root, where kubo reads them with the
+		// datastore mounted at /blocks.
+		for key, value := range values {
+			testPositive(t, ctx, imported, key, value)
+		}
+		mounted := mount.New([]mount.Mount{{Prefix: ds.NewKey("/blocks"), Datastore: imported}})
+		bs := blockstore.NewBlockstore(mounted)
+		for _, c := range cids {
+			b, err := bs.Get(ctx, c)
+			if err != nil || !bytes.Equal(b.RawData(), values[dshelp.MultihashToDsKey(c.Hash())]) {
+				t.Fatalf("Blockstore Get(%s) through the mount failed: %v", c, err)
+			}
+		}
+	}
+	if _, err := gd.ReadCAR(ctx, bytes.NewReader([]byte("not a CAR")), gcsds.CARImport{}); err == nil {
+		t.Fatalf("Expected ReadCAR to reject invalid input")
+	}
+}
+
+func TestReadCARTamperedBlock(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	prefix := "/blocks" + randomKey().String()
+	var cids []cid.Cid
+	for i := 0; i < 3; i++ {
+		value := []byte(randomSeq(100 + i))
+		key := blockKey(t, value)
+		testPut(t, ctx, gd, ds.NewKey(prefix).Child(key), value)
+		hash, err := dshelp.DsKeyToMultihash(key)
+		if err != nil {
+			t.Fatalf("Invalid key %s: %v", key, err)
+		}
+		cids = append(cids, cid.NewCidV1(cid.Raw, hash))
+	}
+	var buf bytes.Buffer
+	if _, err := gd.WriteCAR(ctx, &buf, gcsds.CARExport{Prefix: prefix, CIDs: cids}); err != nil {
+		t.Fatalf("WriteCAR: %v", err)
+	}
+	// Change the last byte of the last block.
+	car := buf.Bytes()
+	car[len(car)-1] ^= 0xff
+
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "import" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	imported, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer imported.Close()
+	_, err = imported.ReadCAR(ctx, bytes.NewReader(car), gcsds.CARImport{})
+	if err == nil || !strings.Contains(err.Error(), "section 3") {
+		t.Fatalf("ReadCAR of a tampered block returned %v", err)
+	}
+	if has, _ := imported.Has(ctx, dshelp.MultihashToDsKey(cids[2].Hash())); has {
+		t.Fatalf("Tampered block stored")
+	}
+}
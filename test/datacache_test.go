@@ -0,0 +1,155 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"testing"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+)
+
+func TestDataCacheGetAdd(t *testing.T) {
+	dc, err := gcsds.NewDataCache(10, 0, 0, false)
+	if err != nil {
+		t.Fatalf("Failed to create data cache: %v", err)
+	}
+	key := randomKey().String()
+	value := []byte(randomSeq(100))
+	if _, ok := dc.Get(key); ok {
+		t.Fatalf("Key existed too early.")
+	}
+	if !dc.Add(key, value) {
+		t.Fatalf("Value not admitted.")
+	}
+	v, ok := dc.Get(key)
+	if !ok || string(v) != string(value) {
+		t.Fatalf("Cached value mismatch.")
+	}
+	dc.Remove(key)
+	if _, ok := dc.Get(key); ok {
+		t.Fatalf("Removed key still cached.")
+	}
+}
+
+func TestDataCacheMaxValueSize(t *testing.T) {
+	dc, err := gcsds.NewDataCache(10, 0, 100, false)
+	if err != nil {
+		t.Fatalf("Failed to create data cache: %v", err)
+	}
+	key := randomKey().String()
+	if !dc.Add(key, []byte(randomSeq(100))) {
+		t.Fatalf("Value at the size limit not admitted.")
+	}
+	if dc.Add(key, []byte(randomSeq(101))) {
+		t.Fatalf("Oversized value admitted.")
+	}
+	if _, ok := dc.Get(key); ok {
+		t.Fatalf("Stale value for oversized key still cached.")
+	}
+}
+
+func TestDataCacheMaxBytes(t *testing.T) {
+	dc, err := gcsds.NewDataCache(10, 1000, 0, false)
+	if err != nil {
+		t.Fatalf("Failed to create data cache: %v", err)
+	}
+	keys := []string{}
+	for i := 0; i < 4; i++ {
+		key := randomKey().String()
+		keys = append(keys, key)
+		if !dc.Add(key, []byte(randomSeq(300))) {
+			t.Fatalf("Value not admitted.")
+		}
+	}
+	if dc.Len() != 3 || dc.Bytes() != 900 {
+		t.Fatalf("Cache holds %d values of %d bytes. Expected 3 of 900.", dc.Len(), dc.Bytes())
+	}
+	if _, ok := dc.Get(keys[0]); ok {
+		t.Fatalf("Least recently used value not evicted.")
+	}
+	// Replacing a value accounts for the old one.
+	dc.Add(keys[3], []byte(randomSeq(100)))
+	if dc.Bytes() != 700 {
+		t.Fatalf("Cache holds %d bytes after replacing a value. Expected 700.", dc.Bytes())
+	}
+	dc.Remove(keys[3])
+	if dc.Bytes() != 600 {
+		t.Fatalf("Cache holds %d bytes after removing a value. Expected 600.", dc.Bytes())
+	}
+	if dc.Add(randomKey().String(), []byte(randomSeq(1001))) {
+		t.Fatalf("Value larger than the cache admitted.")
+	}
+}
+
+func TestDataCacheAdmission(t *testing.T) {
+	items := 10
+	dc, err := gcsds.NewDataCache(items, 0, 0, true)
+	if err != nil {
+		t.Fatalf("Failed to create data cache: %v", err)
+	}
+	// Fill the cache with hot keys.
+	hot := []string{}
+	for i := 0; i < items; i++ {
+		key := randomKey().String()
+		hot = append(hot, key)
+		dc.Add(key, []byte(randomSeq(10)))
+	}
+	for i := 0; i < 10; i++ {
+		for _, key := range hot {
+			dc.Get(key)
+		}
+	}
+	// A scan of keys read once must not flush the hot keys.
+	for i := 0; i < 100; i++ {
+		key := randomKey().String()
+		dc.Get(key)
+		dc.Add(key, []byte(randomSeq(10)))
+	}
+	// The sketch is probabilistic, so tolerate a single unlucky collision.
+	evicted := 0
+	for _, key := range hot {
+		if _, ok := dc.Get(key); !ok {
+			evicted++
+		}
+	}
+	if evicted > 1 {
+		t.Fatalf("%d hot keys evicted by scan.", evicted)
+	}
+}
+
+func TestDataCacheStats(t *testing.T) {
+	dc, err := gcsds.NewDataCache(2, 0, 100, false)
+	if err != nil {
+		t.Fatalf("Failed to create data cache: %v", err)
+	}
+	keys := []string{randomKey().String(), randomKey().String(), randomKey().String()}
+	for _, key := range keys {
+		dc.Add(key, []byte(randomSeq(10)))
+	}
+	dc.Add(randomKey().String(), []byte(randomSeq(101)))
+	dc.Get(keys[0])
+	dc.Get(keys[1])
+	dc.Get(keys[2])
+	want := gcsds.DataCacheStats{
+		Items: 2, MaxItems: 2, Bytes: 20,
+		Hits: 2, Misses: 1, Evictions: 1, Rejections: 1,
+	}
+	if st := dc.Stats(); st != want {
+		t.Fatalf("Stats: %+v, expected %+v", st, want)
+	}
+	if rate := dc.Stats().HitRate(); rate < 0.66 || rate > 0.67 {
+		t.Errorf("Hit rate: %v, expected 2/3", rate)
+	}
+}
@@ -0,0 +1,207 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+)
+
+func TestDiskCacheGetAdd(t *testing.T) {
+	dir := t.TempDir()
+	dc, err := gcsds.OpenDiskCache(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to open disk cache: %v", err)
+	}
+	key := randomKey().String()
+	value := []byte(randomSeq(100))
+	if _, ok := dc.Get(key); ok {
+		t.Fatalf("Key existed too early.")
+	}
+	if err := dc.Add(key, value); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if v, ok := dc.Get(key); !ok || !bytes.Equal(v, value) {
+		t.Fatalf("Cached value mismatch.")
+	}
+	// Values survive reopening.
+	dc, err = gcsds.OpenDiskCache(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk cache: %v", err)
+	}
+	if v, ok := dc.Get(key); !ok || !bytes.Equal(v, value) {
+		t.Fatalf("Cached value lost on reopening.")
+	}
+	dc.Remove(key)
+	if _, ok := dc.Get(key); ok {
+		t.Fatalf("Removed key still cached.")
+	}
+}
+
+func TestDiskCacheMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	// Each value takes 304 bytes with its checksum.
+	dc, err := gcsds.OpenDiskCache(dir, 1000)
+	if err != nil {
+		t.Fatalf("Failed to open disk cache: %v", err)
+	}
+	keys := []string{}
+	for i := 0; i < 4; i++ {
+		key := randomKey().String()
+		keys = append(keys, key)
+		if err := dc.Add(key, []byte(randomSeq(300))); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if dc.Len() != 3 || dc.Bytes() != 912 {
+		t.Fatalf("Cache holds %d values of %d bytes. Expected 3 of 912.", dc.Len(), dc.Bytes())
+	}
+	if _, ok := dc.Get(keys[0]); ok {
+		t.Fatalf("Least recently used value not evicted.")
+	}
+	// Reading keys[1] makes keys[2] the least recently used, also after
+	// reopening.
+	dc.Get(keys[1])
+	dc, err = gcsds.OpenDiskCache(dir, 1000)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk cache: %v", err)
+	}
+	if dc.Len() != 3 || dc.Bytes() != 912 {
+		t.Fatalf("Reopened cache holds %d values of %d bytes. Expected 3 of 912.", dc.Len(), dc.Bytes())
+	}
+	if err := dc.Add(randomKey().String(), []byte(randomSeq(300))); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, ok := dc.Get(keys[1]); !ok {
+		t.Fatalf("Recently read value evicted.")
+	}
+	if _, ok := dc.Get(keys[2]); ok {
+		t.Fatalf("Least recently used value not evicted after reopening.")
+	}
+
+	// Uses within one tick of a coarse clock keep their order: with all
+	// file times equal, and ahead of the clock, reads still order them.
+	future := time.Now().Add(time.Hour)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		return os.Chtimes(p, future, future)
+	})
+	if err != nil {
+		t.Fatalf("Failed to set file times: %v", err)
+	}
+	dc, err = gcsds.OpenDiskCache(dir, 1000)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk cache: %v", err)
+	}
+	if _, ok := dc.Get(keys[3]); !ok {
+		t.Fatalf("Value of %s missing.", keys[3])
+	}
+	if _, ok := dc.Get(keys[1]); !ok {
+		t.Fatalf("Value of %s missing.", keys[1])
+	}
+	dc, err = gcsds.OpenDiskCache(dir, 1000)
+	if err != nil {
+		t.Fatalf("Failed to reopen disk cache: %v", err)
+	}
+	if err := dc.Add(randomKey().String(), []byte(randomSeq(300))); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, ok := dc.Get(keys[3]); !ok {
+		t.Fatalf("Value read within the clock tick evicted.")
+	}
+	if _, ok := dc.Get(keys[1]); !ok {
+		t.Fatalf("Value read last evicted.")
+	}
+}
+
+func TestDiskCacheCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	dc, err := gcsds.OpenDiskCache(dir, 0)
+	if err != nil {
+		t.Fatalf("Failed to open disk cache: %v", err)
+	}
+	key := randomKey().String()
+	if err := dc.Add(key, []byte(randomSeq(100))); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		return os.WriteFile(p, []byte("corrupt"), 0o600)
+	})
+	if err != nil {
+		t.Fatalf("Failed to corrupt the cache: %v", err)
+	}
+	if _, ok := dc.Get(key); ok {
+		t.Fatalf("Corrupt value returned.")
+	}
+	if dc.Len() != 0 {
+		t.Fatalf("Corrupt value still cached.")
+	}
+}
+
+func TestDiskCacheDatastore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	open := func() *gcsds.GCSDatastore {
+		gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+			Bucket:         getTestBucket(t),
+			Prefix:         "ipfs",
+			DataCacheItems: 1000,
+			DiskCacheDir:   dir,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create data store: %v", err)
+		}
+		return gd
+	}
+	key := randomKey()
+	value := []byte(randomSeq(100))
+	testPut(t, ctx, GetGCSDatastore(t), key, value)
+	gd := open()
+	if v, err := gd.Get(ctx, key); err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("Get(%s) = %v", key, err)
+	}
+	// Closing waits for the value to be written to the disk cache.
+	gd.Close()
+
+	// After a restart, the value is read from disk.
+	gd = open()
+	if v, err := gd.Get(ctx, key); err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("Get(%s) after restart = %v", key, err)
+	}
+	if hits := gd.Stats().DiskCacheHits; hits != 1 {
+		t.Fatalf("%d disk cache hits. Expected 1.", hits)
+	}
+	// Overwriting the value invalidates it.
+	value = []byte(randomSeq(100))
+	testPut(t, ctx, gd, key, value)
+	gd.Close()
+	gd = open()
+	defer gd.Close()
+	if v, err := gd.Get(ctx, key); err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("Get(%s) after overwriting returned a stale value, %v", key, err)
+	}
+}
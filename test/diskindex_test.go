@@ -0,0 +1,191 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func openDiskMetadataCache(t *testing.T) *gcsds.DiskMetadataCache {
+	md, err := gcsds.OpenDiskMetadataCache(filepath.Join(t.TempDir(), "metadata.db"))
+	if err != nil {
+		t.Fatalf("OpenDiskMetadataCache: %v", err)
+	}
+	t.Cleanup(func() { md.Close() })
+	return md
+}
+
+func TestDiskMetadataCache(t *testing.T) {
+	md := openDiskMetadataCache(t)
+	md.TrackPrefix("/a/")
+	expires := time.Now().Add(time.Hour).Round(0)
+	md.PutEntry(gcsds.Metadata{Key: "/a/1", Size: 10, StorageClass: "NEARLINE", Accessed: 5, Expiration: expires})
+	md.Put("/a/2", 20)
+	md.Put("/b/1", 30)
+	md.Put("/b/1", 40)
+
+	m, err := md.Get("/a/1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if m.Size != 10 || m.StorageClass != "NEARLINE" || m.Accessed != 5 || !m.Expiration.Equal(expires) {
+		t.Fatalf("Wrong entry: %+v", m)
+	}
+	if md.Size() != 3 || md.Bytes() != 70 {
+		t.Fatalf("Got %d entries, %d bytes. Expected 3, 70", md.Size(), md.Bytes())
+	}
+	if u := md.PrefixUsage("/a/"); u.Objects != 2 || u.Bytes != 30 {
+		t.Fatalf("Wrong usage for prefix /a/: %+v", u)
+	}
+	md.Touch("/a/1")
+	md.SetStorageClass("/a/1", "ARCHIVE")
+	if m, _ := md.Get("/a/1"); m.Accessed <= 5 || m.StorageClass != "ARCHIVE" {
+		t.Fatalf("Touch or SetStorageClass not recorded: %+v", m)
+	}
+	if classes := md.StorageClasses(); classes["ARCHIVE"] != 1 || classes[""] != 2 {
+		t.Fatalf("Wrong storage classes: %v", classes)
+	}
+	md.Delete("/a/2")
+	md.Delete("/a/2")
+	if md.Has("/a/2") || md.Size() != 2 || md.PrefixUsage("/a/").Objects != 1 {
+		t.Fatalf("Delete not applied")
+	}
+
+	md.StartLoading()
+	md.Put("/written", 10)
+	md.Delete("/deleted")
+	for _, key := range []string{"/written", "/deleted", "/listed"} {
+		md.LoadEntry(gcsds.Metadata{Key: key, Size: 1})
+	}
+	md.DoneLoading()
+	if m, err := md.Get("/written"); err != nil || m.Size != 10 {
+		t.Errorf("Listing overwrote a newer entry: %v %v", m, err)
+	}
+	if md.Has("/deleted") {
+		t.Errorf("Listing restored a deleted entry")
+	}
+	if !md.Has("/listed") {
+		t.Errorf("Listed entry missing")
+	}
+}
+
+func TestDiskMetadataCacheIterator(t *testing.T) {
+	md := openDiskMetadataCache(t)
+	// Several iterator chunks and load batches.
+	md.StartLoading()
+	for i := 0; i < 2500; i++ {
+		md.LoadEntry(gcsds.Metadata{Key: fmt.Sprintf("/a/%05d", i), Size: 1})
+	}
+	md.DoneLoading()
+	md.Put("/b", 1)
+
+	next := md.Iterator("/a/", 0)
+	i := 0
+	for m := next(); m != nil; m = next() {
+		if expected := fmt.Sprintf("/a/%05d", i); m.Key != expected {
+			t.Fatalf("Got %s, expected %s", m.Key, expected)
+		}
+		i++
+	}
+	if i != 2500 {
+		t.Fatalf("Iterated %d entries, expected 2500", i)
+	}
+	if entries := getEntries(md.Iterator("", 1001)); len(entries) != 1001 {
+		t.Fatalf("Got %d entries with limit 1001", len(entries))
+	}
+	if entries := getEntries(md.Iterator("/c", 0)); len(entries) != 0 {
+		t.Fatalf("Got %d entries for an empty prefix", len(entries))
+	}
+}
+
+func TestDiskMetadataIndexDatastore(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:            getTestBucket(t),
+		Prefix:            "diskindex" + randomKey().String(),
+		DataCacheItems:    1000,
+		MetadataIndexPath: filepath.Join(t.TempDir(), "metadata.db"),
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	key := randomKey()
+	value := []byte(randomSeq(100))
+	testPut(t, ctx, gd, key, value)
+	testPositive(t, ctx, gd, key, value)
+	gd.Close()
+
+	// The index is rebuilt from the bucket.
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	testPositive(t, ctx, gd, key, value)
+	res, err := gd.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	entries, err := res.Rest()
+	if err != nil || len(entries) != 1 || entries[0].Key != key.String() {
+		t.Fatalf("Query returned %v, %v", entries, err)
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:            getTestBucket(t),
+		Prefix:            "bloom" + randomKey().String(),
+		DataCacheItems:    1000,
+		MetadataIndexPath: filepath.Join(t.TempDir(), "metadata.db"),
+		BloomFilterKeys:   1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	key := randomKey()
+	value := []byte(randomSeq(100))
+	testPut(t, ctx, gd, key, value)
+	testPositive(t, ctx, gd, key, value)
+	gd.Close()
+
+	// The filter is rebuilt with the index.
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	testPositive(t, ctx, gd, key, value)
+	testNegative(t, ctx, gd, randomKey())
+	// Deleted keys are missing, though the filter still has them.
+	testDelete(t, ctx, gd, key)
+	testNegative(t, ctx, gd, key)
+}
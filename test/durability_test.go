@@ -0,0 +1,314 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	ds "github.com/ipfs/go-datastore"
+)
+
+func getDurabilityDatastore(t *testing.T, prefix string, walDir string) *gcsds.GCSDatastore {
+	gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         prefix,
+		Workers:        10,
+		DataCacheItems: 1000,
+		Durability: map[string]gcsds.Durability{
+			"/async":         gcsds.DurabilityAsync,
+			"/buffered":      gcsds.DurabilityBuffered,
+			"/buffered/sync": gcsds.DurabilityStrict,
+		},
+		WALDir: walDir,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create datastore: %v", err)
+	}
+	return gd
+}
+
+// stored reports whether the object of k exists in GCS.
+func stored(t *testing.T, ctx context.Context, gd *gcsds.GCSDatastore, k ds.Key) bool {
+	_, err := gd.BucketHandle().Object(gd.ObjectPath(k)).Attrs(ctx)
+	return err == nil
+}
+
+func TestDurability(t *testing.T) {
+	ctx := context.Background()
+	gd := getDurabilityDatastore(t, "durability-"+randomSeq(10), t.TempDir())
+	defer gd.Close()
+
+	keys := []ds.Key{
+		ds.NewKey("/async").Child(randomKey()),
+		ds.NewKey("/buffered").Child(randomKey()),
+		ds.NewKey("/buffered/sync").Child(randomKey()),
+		randomKey(),
+	}
+	for _, k := range keys {
+		value := []byte(randomSeq(100))
+		testPut(t, ctx, gd, k, value)
+		testPositive(t, ctx, gd, k, value)
+	}
+	// Strict writes are stored when Put returns.
+	for _, k := range keys[2:] {
+		if !stored(t, ctx, gd, k) {
+			t.Fatalf("Strict write of %v not stored", k)
+		}
+	}
+	if err := gd.Sync(ctx, ds.NewKey("/")); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	for _, k := range keys {
+		if !stored(t, ctx, gd, k) {
+			t.Fatalf("Write of %v not stored after Sync", k)
+		}
+	}
+	if stats := gd.Stats(); stats.PendingWrites != 0 || stats.PendingBytes != 0 {
+		t.Fatalf("Pending writes after Sync: %d, %d bytes", stats.PendingWrites, stats.PendingBytes)
+	}
+
+	// The last of several writes of a key wins.
+	k := keys[0]
+	var value []byte
+	for i := 0; i < 10; i++ {
+		value = []byte(randomSeq(100 + i))
+		testPut(t, ctx, gd, k, value)
+	}
+	testDelete(t, ctx, gd, keys[1])
+	if err := gd.Sync(ctx, ds.NewKey("/")); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if got := readObject(t, ctx, gd, k); !bytes.Equal(got, value) {
+		t.Fatalf("Stored %q, expected the last write %q", got, value)
+	}
+	if stored(t, ctx, gd, keys[1]) {
+		t.Fatalf("Deleted key %v stored", keys[1])
+	}
+}
+
+func TestDurabilityPrefixes(t *testing.T) {
+	ctx := context.Background()
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator.")
+	}
+	// The proxy fails uploads while failing is set, so that only writes
+	// not acknowledged before upload fail.
+	var failing atomic.Bool
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && strings.HasPrefix(r.URL.Path, "/upload/") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:              getTestBucket(t),
+		Prefix:              "durability-" + randomSeq(10),
+		DataCacheItems:      1000,
+		Endpoint:            server.URL + "/storage/v1/",
+		RetryInitialBackoff: time.Millisecond,
+		RetryMaxBackoff:     10 * time.Millisecond,
+		RetryMaxAttempts:    2,
+		Durability: map[string]gcsds.Durability{
+			"/async": gcsds.DurabilityAsync,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create datastore: %v", err)
+	}
+	defer gd.Close()
+
+	failing.Store(true)
+	defer failing.Store(false)
+	async := ds.NewKey("/async").Child(randomKey())
+	if err := gd.Put(ctx, async, []byte("value")); err != nil {
+		t.Fatalf("Async Put: %v", err)
+	}
+	// Prefixes match whole key namespaces, not leading characters.
+	for _, k := range []ds.Key{ds.NewKey("/asynchronous").Child(randomKey()), randomKey()} {
+		if err := gd.Put(ctx, k, []byte("value")); err == nil {
+			t.Fatalf("Put of %v succeeded without uploading", k)
+		}
+	}
+	failing.Store(false)
+	if err := gd.Sync(ctx, ds.NewKey("/async")); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+}
+
+// readObject returns the value stored in GCS for k, or nil if none is.
+func readObject(t *testing.T, ctx context.Context, gd *gcsds.GCSDatastore, k ds.Key) []byte {
+	r, err := gd.BucketHandle().Object(gd.ObjectPath(k)).NewReader(ctx)
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	value := new(bytes.Buffer)
+	if _, err := value.ReadFrom(r); err != nil {
+		t.Fatalf("Failed to read %v: %v", k, err)
+	}
+	return value.Bytes()
+}
+
+func TestSyncOrdering(t *testing.T) {
+	ctx := context.Background()
+	gd := getDurabilityDatastore(t, "durability-"+randomSeq(10), t.TempDir())
+	defer gd.Close()
+
+	for _, prefix := range []string{"/async", "/buffered"} {
+		// Puts and Deletes of a key are applied in order.
+		k := ds.NewKey(prefix).Child(randomKey())
+		testPut(t, ctx, gd, k, []byte("v1"))
+		testPut(t, ctx, gd, k, []byte("v2"))
+		if err := gd.Delete(ctx, k); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		testPut(t, ctx, gd, k, []byte("v3"))
+		if err := gd.Sync(ctx, k); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		if got := readObject(t, ctx, gd, k); string(got) != "v3" {
+			t.Fatalf("Stored %q, expected v3", got)
+		}
+		testPut(t, ctx, gd, k, []byte("v4"))
+		if err := gd.Delete(ctx, k); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := gd.Sync(ctx, k); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		if got := readObject(t, ctx, gd, k); got != nil {
+			t.Fatalf("Stored %q after Delete", got)
+		}
+
+		// Sync of a prefix stores all writes under it acknowledged before.
+		parent := ds.NewKey(prefix).Child(randomKey())
+		values := map[ds.Key][]byte{}
+		for i := 0; i < 20; i++ {
+			k := parent.Child(randomKey())
+			values[k] = []byte(randomSeq(100))
+			testPut(t, ctx, gd, k, values[k])
+		}
+		if err := gd.Sync(ctx, parent); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+		for k, value := range values {
+			if got := readObject(t, ctx, gd, k); !bytes.Equal(got, value) {
+				t.Fatalf("Stored %q for %v after Sync, expected %q", got, k, value)
+			}
+		}
+	}
+}
+
+func TestSyncSteadyWriters(t *testing.T) {
+	ctx := context.Background()
+	gd := getDurabilityDatastore(t, "durability-"+randomSeq(10), t.TempDir())
+	defer gd.Close()
+
+	k := ds.NewKey("/async").Child(randomKey())
+	testPut(t, ctx, gd, k, []byte("synced"))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			gd.Put(ctx, ds.NewKey("/async").Child(randomKey()), []byte(randomSeq(10)))
+			gd.Put(ctx, k, []byte(randomSeq(10)))
+		}
+	}()
+	defer wg.Wait()
+	defer close(stop)
+
+	sctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := gd.Sync(sctx, ds.NewKey("/async")); err != nil {
+		t.Fatalf("Sync with steady writers: %v", err)
+	}
+	if got := readObject(t, ctx, gd, k); got == nil || string(got) == "" {
+		t.Fatalf("Nothing stored for %v after Sync", k)
+	}
+}
+
+func TestDurabilityBufferedRecovery(t *testing.T) {
+	ctx := context.Background()
+	prefix := "durability-" + randomSeq(10)
+	walDir := t.TempDir()
+	gd := getDurabilityDatastore(t, prefix, walDir)
+	k := ds.NewKey("/buffered").Child(randomKey())
+	value := []byte(randomSeq(100))
+	testPut(t, ctx, gd, k, value)
+
+	// Keep the WAL as a crash right after Put would have left it.
+	crashDir := t.TempDir()
+	names, _ := filepath.Glob(filepath.Join(walDir, "*.wal"))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Failed to read WAL: %v", err)
+		}
+		os.WriteFile(filepath.Join(crashDir, filepath.Base(name)), data, 0o600)
+	}
+	if err := gd.Delete(ctx, k); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	gd.Close()
+	if stored(t, ctx, gd, k) {
+		t.Fatalf("Deleted key %v stored", k)
+	}
+
+	gd = getDurabilityDatastore(t, prefix, crashDir)
+	defer gd.Close()
+	testPositive(t, ctx, gd, k, value)
+	if err := gd.Sync(ctx, k); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	if !stored(t, ctx, gd, k) {
+		t.Fatalf("Recovered write of %v not stored", k)
+	}
+}
+
+func TestDurabilityRequiresWALDir(t *testing.T) {
+	_, err := gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:     getTestBucket(t),
+		Prefix:     "ipfs",
+		Durability: map[string]gcsds.Durability{"/blocks": gcsds.DurabilityBuffered},
+	})
+	if err == nil {
+		t.Fatalf("Buffered durability without WALDir accepted")
+	}
+}
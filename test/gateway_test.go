@@ -0,0 +1,95 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func testSigningKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+func TestRedirectHandler(t *testing.T) {
+	ds := GetGCSDatastore(t)
+	value := []byte(randomSeq(100))
+	key := blockKey(t, value)
+	ctx := context.Background()
+	testPut(t, ctx, ds, key, value)
+	defer testDelete(t, ctx, ds, key)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := ds.RedirectHandler(next, gcsds.RedirectOptions{
+		GoogleAccessID: "test@example.com",
+		PrivateKey:     testSigningKey(t),
+	})
+	hash, _ := mh.Sum(value, mh.SHA2_256, -1)
+	c := cid.NewCidV1(cid.Raw, hash)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/ipfs/"+c.String()+"?format=raw", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Got status %d, expected %d.", rec.Code, http.StatusFound)
+	}
+	location := rec.Header().Get("Location")
+	if !strings.Contains(location, ds.GCSPath(key.String())) {
+		t.Fatalf("Redirect to wrong object: %v", location)
+	}
+
+	// Non-raw requests go to the gateway.
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/ipfs/"+c.String(), nil))
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("Got status %d, expected %d.", rec.Code, http.StatusTeapot)
+	}
+
+	// Expired blocks go to the gateway, which reports them missing.
+	value = []byte(randomSeq(100))
+	key = blockKey(t, value)
+	if err := ds.PutWithTTL(ctx, key, value, time.Millisecond); err != nil {
+		t.Fatalf("PutWithTTL: %v", err)
+	}
+	defer ds.Delete(ctx, key)
+	time.Sleep(10 * time.Millisecond)
+	hash, _ = mh.Sum(value, mh.SHA2_256, -1)
+	c = cid.NewCidV1(cid.Raw, hash)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/ipfs/"+c.String()+"?format=raw", nil))
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("Got status %d for an expired block, expected %d.", rec.Code, http.StatusTeapot)
+	}
+}
@@ -17,13 +17,32 @@ package test
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"cloud.google.com/go/storage"
 	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
 	ds "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
 	dstest "github.com/ipfs/go-datastore/test"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	leveldb "github.com/ipfs/go-ds-leveldb"
+	"google.golang.org/api/googleapi"
 )
 
 // GCS test bucket is specified as an environmment variable. Example:
@@ -71,6 +90,50 @@ func TestCheckBucket(t *testing.T) {
 	}
 }
 
+func TestCreateBucket(t *testing.T) {
+	ctx := context.Background()
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("Needs the emulator to create a bucket.")
+	}
+	config := gcsds.Config{
+		Bucket:         "created-" + strings.ToLower(randomSeq(8)),
+		Prefix:         "ipfs",
+		DataCacheItems: 1000,
+		Project:        "test",
+		Location:       "US-CENTRAL1",
+	}
+	if _, err := gcsds.NewGCSDatastore(config); err == nil {
+		t.Fatalf("NewGCSDatastore succeeded without the bucket")
+	}
+	config.CreateBucket = true
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	attrs, err := gd.BucketHandle().Attrs(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get bucket attributes: %v", err)
+	}
+	if attrs.Location != config.Location {
+		t.Fatalf("Bucket created in %q, expected %q", attrs.Location, config.Location)
+	}
+	key, value := randomKey(), []byte(randomSeq(100))
+	testPut(t, ctx, gd, key, value)
+	testPositive(t, ctx, gd, key, value)
+
+	// An existing bucket is used as is.
+	other, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer other.Close()
+	if err := other.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	testPositive(t, ctx, other, key, value)
+}
+
 func TestLoadMetadata(t *testing.T) {
 	ds := GetGCSDatastore(t)
 	err := ds.LoadMetadata()
@@ -219,4 +282,3915 @@ func TestSuiteGCS(t *testing.T) {
 	t.Run("return sizes", func(t *testing.T) {
 		dstest.SubtestReturnSizes(t, gcsds)
 	})
+	t.Run("order", func(t *testing.T) {
+		dstest.SubtestOrder(t, gcsds)
+	})
+	t.Run("sync", func(t *testing.T) {
+		dstest.SubtestBasicSync(t, gcsds)
+	})
+	t.Run("batch", func(t *testing.T) {
+		dstest.RunBatchTest(t, gcsds)
+	})
+	t.Run("batch delete", func(t *testing.T) {
+		dstest.RunBatchDeleteTest(t, gcsds)
+	})
+	t.Run("batch put and delete", func(t *testing.T) {
+		dstest.RunBatchPutAndDeleteTest(t, gcsds)
+	})
+}
+
+func TestBatchErrors(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs",
+		Workers:        10,
+		DataCacheItems: 1000,
+		VerifyPut:      true,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+
+	good := []byte(randomSeq(100))
+	bad := []byte(randomSeq(100))
+	deleted := []byte(randomSeq(100))
+	goodKey, badKey, deletedKey := blockKey(t, good), blockKey(t, bad), blockKey(t, deleted)
+	testPut(t, ctx, gd, deletedKey, deleted)
+	b, err := gd.Batch(ctx)
+	if err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	b.Put(ctx, goodKey, bad)
+	b.Put(ctx, goodKey, good)
+	b.Put(ctx, badKey, good)
+	b.Delete(ctx, deletedKey)
+	if has, _ := gd.Has(ctx, goodKey); has {
+		t.Fatalf("Batch applied before Commit")
+	}
+	err = b.Commit(ctx)
+	var berr *gcsds.BatchError
+	if !errors.As(err, &berr) || len(berr.Errors) != 1 || berr.Errors[badKey] == nil {
+		t.Fatalf("Commit returned %v, expected a BatchError for %v", err, badKey)
+	}
+	if !errors.Is(err, gcsds.ErrHashMismatch) {
+		t.Fatalf("Commit error %v doesn't match ErrHashMismatch", err)
+	}
+	testPositive(t, ctx, gd, goodKey, good)
+	if has, _ := gd.Has(ctx, deletedKey); has {
+		t.Fatalf("Batch Delete not applied")
+	}
+
+	// Only the failed operations are retried.
+	b.Put(ctx, badKey, bad)
+	if err := b.Commit(ctx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	testPositive(t, ctx, gd, badKey, bad)
+}
+
+func TestArchiveColdObjects(t *testing.T) {
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs",
+		Workers:        10,
+		DataCacheItems: 1000,
+		ArchiveAfter:   time.Nanosecond,
+		RestoreOnRead:  true,
+	}
+	ds, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer ds.Close()
+	key := randomKey()
+	value := []byte(randomSeq(100))
+	ctx := context.Background()
+	testPut(t, ctx, ds, key, value)
+	archived, err := ds.ArchiveColdObjects(ctx)
+	if err != nil {
+		t.Fatalf("Failed to archive. err: %v", err)
+	}
+	if archived != 1 {
+		t.Fatalf("Archived %d objects, expected 1.", archived)
+	}
+	if n := ds.Stats().ArchivedObjects; n != 1 {
+		t.Fatalf("Stats report %d archived objects, expected 1.", n)
+	}
+	// Archived objects remain readable.
+	testPositive(t, ctx, ds, key, value)
+	testDelete(t, ctx, ds, key)
+}
+
+func TestArchiveAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:           getTestBucket(t),
+		Prefix:           "restart-" + randomSeq(8),
+		DataCacheItems:   1000,
+		ArchiveAfter:     time.Second,
+		MetadataSnapshot: true,
+	}
+	open := func() *gcsds.GCSDatastore {
+		gd, err := gcsds.NewGCSDatastore(config)
+		if err != nil {
+			t.Fatalf("NewGCSDatastore: %v", err)
+		}
+		return gd
+	}
+	archive := func(gd *gcsds.GCSDatastore, want int) {
+		if n, err := gd.ArchiveColdObjects(ctx); err != nil || n != want {
+			t.Fatalf("ArchiveColdObjects returned %d, %v, expected %d", n, err, want)
+		}
+	}
+	gd := open()
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	key, value := randomKey(), []byte(randomSeq(100))
+	testPut(t, ctx, gd, key, value)
+	other := randomKey()
+	testPut(t, ctx, gd, other, value)
+	time.Sleep(1100 * time.Millisecond)
+	if err := gd.SaveMetadataSnapshot(ctx); err != nil {
+		t.Fatalf("SaveMetadataSnapshot: %v", err)
+	}
+	testDelete(t, ctx, gd, other)
+
+	// After a restart, objects last written long ago may have been read
+	// since, so they aren't archived until the node has watched them for
+	// ArchiveAfter.
+	restarted := open()
+	defer restarted.Close()
+	if err := restarted.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	archive(restarted, 0)
+
+	// The metadata snapshot carries the access times over.
+	fromSnapshot := open()
+	defer fromSnapshot.Close()
+	if err := fromSnapshot.LoadMetadataSnapshot(ctx); err != nil {
+		t.Fatalf("LoadMetadataSnapshot: %v", err)
+	}
+	if err := fromSnapshot.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	archive(fromSnapshot, 1)
+
+	time.Sleep(time.Second)
+	archive(restarted, 1)
+}
+
+func TestColdlineTiering(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "tiering-" + randomSeq(8),
+		DataCacheItems: 1,
+		ColdlineAfter:  time.Nanosecond,
+		ArchiveAfter:   time.Hour,
+		RestoreOnRead:  true,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	key := randomKey()
+	value := []byte(randomSeq(100))
+	testPut(t, ctx, gd, key, value)
+	if n, err := gd.ArchiveColdObjects(ctx); err != nil || n != 1 {
+		t.Fatalf("ArchiveColdObjects = %d, %v, expected 1", n, err)
+	}
+	st := gd.Stats()
+	if st.ColdlineObjects != 1 || st.ArchivedObjects != 0 || st.StorageClasses[gcsds.StorageClassColdline] != 1 {
+		t.Fatalf("Stats report %d objects moved to COLDLINE and %d to ARCHIVE, classes %v, expected 1 in COLDLINE",
+			st.ColdlineObjects, st.ArchivedObjects, st.StorageClasses)
+	}
+	// Objects already cold enough stay put.
+	if n, err := gd.ArchiveColdObjects(ctx); err != nil || n != 0 {
+		t.Fatalf("Second ArchiveColdObjects = %d, %v, expected 0", n, err)
+	}
+
+	// Reading from GCS, once evicted from the data cache, promotes the
+	// object back to STANDARD.
+	testPut(t, ctx, gd, randomKey(), []byte(randomSeq(100)))
+	testPositive(t, ctx, gd, key, value)
+	deadline := time.Now().Add(5 * time.Second)
+	for gd.Stats().Restores == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := gd.Stats(); st.Restores != 1 || st.StorageClasses[gcsds.StorageClassColdline] != 0 {
+		t.Fatalf("Stats report %d restores, classes %v, expected 1 restore", st.Restores, st.StorageClasses)
+	}
+}
+
+func TestStorageClassTransitions(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "transitions" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	writer, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer writer.Close()
+	key := randomKey()
+	testPut(t, ctx, writer, key, []byte("value"))
+
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	// A lifecycle rule, or Autoclass, moves the object. The emulator
+	// doesn't change classes on rewrites, so it's written again.
+	w := gd.BucketHandle().Object(gd.ObjectPath(key)).NewWriter(ctx)
+	w.StorageClass = "NEARLINE"
+	w.Write([]byte("value"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := gd.RefreshMetadata(ctx); err != nil {
+		t.Fatalf("RefreshMetadata: %v", err)
+	}
+	st := gd.Stats()
+	if st.StorageClassTransitions != 1 || st.StorageClasses["NEARLINE"] != 1 {
+		t.Errorf("Stats: %d transitions, classes %v", st.StorageClassTransitions, st.StorageClasses)
+	}
+}
+
+func TestQueryReadAhead(t *testing.T) {
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs",
+		Workers:        10,
+		DataCacheItems: 1000,
+		QueryReadAhead: 4,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	ctx := context.Background()
+	values := map[string][]byte{}
+	for i := 0; i < 10; i++ {
+		key := randomKey()
+		value := []byte(randomSeq(100))
+		testPut(t, ctx, gd, key, value)
+		values[key.String()] = value
+	}
+	results, err := gd.Query(ctx, dsq.Query{Prefix: "/"})
+	if err != nil {
+		t.Fatalf("Query err: %v", err)
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		t.Fatalf("Query.Rest err: %v", err)
+	}
+	if len(entries) != len(values) {
+		t.Fatalf("Got %d entries, expected %d.", len(entries), len(values))
+	}
+	for _, e := range entries {
+		if !bytes.Equal(e.Value, values[e.Key]) {
+			t.Fatalf("Wrong value for key %v.", e.Key)
+		}
+		testDelete(t, ctx, gd, ds.NewKey(e.Key))
+	}
+}
+
+func TestSizeHistogram(t *testing.T) {
+	ds := GetGCSDatastore(t)
+	key := randomKey()
+	value := []byte(randomSeq(2000))
+	ctx := context.Background()
+	testPut(t, ctx, ds, key, value)
+	testPositive(t, ctx, ds, key, value)
+	testDelete(t, ctx, ds, key)
+	st := ds.Stats()
+	// 2000 bytes falls in the 4kB bucket.
+	if st.WrittenSizes[1].Count != 1 || st.ReadSizes[1].Count != 1 {
+		t.Fatalf("Wrong histogram counts. written: %v read: %v", st.WrittenSizes, st.ReadSizes)
+	}
+	if st.WrittenBytes != 2000 || st.ReadBytes != 2000 {
+		t.Fatalf("Wrong byte counts. written: %d read: %d", st.WrittenBytes, st.ReadBytes)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs",
+		Workers:        10,
+		DataCacheItems: 1000,
+		MaxBytes:       150,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	ctx := context.Background()
+	key1, key2 := randomKey(), randomKey()
+	testPut(t, ctx, gd, key1, []byte(randomSeq(100)))
+	defer testDelete(t, ctx, gd, key1)
+	err = gd.Put(ctx, key2, []byte(randomSeq(100)))
+	if !errors.Is(err, gcsds.ErrQuotaExceeded) {
+		t.Fatalf("Expected quota error. Got: %v", err)
+	}
+	// Overwriting with a value of the same size fits.
+	testPut(t, ctx, gd, key1, []byte(randomSeq(100)))
+	usage, _ := gd.DiskUsage(ctx)
+	if usage != 100 {
+		t.Fatalf("DiskUsage %d, expected 100.", usage)
+	}
+}
+
+func TestPrefixQuota(t *testing.T) {
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs",
+		Workers:        10,
+		DataCacheItems: 1000,
+		Quotas:         []gcsds.Quota{{Prefix: "/tenant1", MaxObjects: 1}},
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	ctx := context.Background()
+	key1 := ds.NewKey("/tenant1").Child(randomKey())
+	key2 := ds.NewKey("/tenant1").Child(randomKey())
+	other := ds.NewKey("/tenant2").Child(randomKey())
+	testPut(t, ctx, gd, key1, []byte(randomSeq(100)))
+	defer testDelete(t, ctx, gd, key1)
+	testPut(t, ctx, gd, other, []byte(randomSeq(100)))
+	defer testDelete(t, ctx, gd, other)
+	err = gd.Put(ctx, key2, []byte(randomSeq(100)))
+	var qerr *gcsds.QuotaError
+	if !errors.As(err, &qerr) || qerr.Prefix != "/tenant1" || qerr.Unit != "objects" {
+		t.Fatalf("Expected object quota error for /tenant1. Got: %v", err)
+	}
+	quotas := gd.Stats().Quotas
+	if len(quotas) != 1 || quotas[0].Objects != 1 {
+		t.Fatalf("Wrong quota usage in Stats: %+v", quotas)
+	}
+}
+
+func TestTrashPrefix(t *testing.T) {
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs/",
+		Workers:        10,
+		DataCacheItems: 1000,
+		TrashPrefix:    "trash/",
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	ctx := context.Background()
+	key := randomKey()
+	value := []byte(randomSeq(100))
+	testPut(t, ctx, gd, key, value)
+	testDelete(t, ctx, gd, key)
+	testNegative(t, ctx, gd, key)
+
+	// The deleted value is recoverable from the trash.
+	trash := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "trash/",
+		Workers:        10,
+		DataCacheItems: 1000,
+	}
+	td, err := gcsds.NewGCSDatastore(trash)
+	if err != nil {
+		t.Fatalf("Failed to create trash data store: %v", err)
+	}
+	v, err := td.Get(ctx, key)
+	if err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("Value not in trash. err: %v", err)
+	}
+	testDelete(t, ctx, td, key)
+}
+
+func TestTrashPrefixWithinPrefix(t *testing.T) {
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs",
+		DataCacheItems: 1000,
+	}
+	for _, trash := range []string{"ipfs", "ipfs/", "ipfs/trash/"} {
+		config.TrashPrefix = trash
+		if _, err := gcsds.NewGCSDatastore(config); err == nil {
+			t.Fatalf("Expected error for trash prefix %q within prefix.", trash)
+		}
+	}
+	// A sibling sharing the leading characters isn't within the prefix.
+	config.TrashPrefix = "ipfs-trash/"
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore with trash prefix %q: %v", config.TrashPrefix, err)
+	}
+	gd.Close()
+}
+
+func TestLaggingMirror(t *testing.T) {
+	ctx := context.Background()
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("Needs the emulator to create a mirror bucket.")
+	}
+	mirror := "mirror-" + strings.ToLower(randomSeq(8))
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	if err := client.Bucket(mirror).Create(ctx, "test", nil); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	// The mirror is maintained externally, and lags behind.
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "mirror-" + randomSeq(8),
+		MirrorBucket:   mirror,
+		DataCacheItems: 1,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	copyToMirror := func(key ds.Key) {
+		path := gd.ObjectPath(key)
+		if _, err := client.Bucket(mirror).Object(path).CopierFrom(gd.BucketHandle().Object(path)).Run(ctx); err != nil {
+			t.Fatalf("Failed to copy %s to the mirror: %v", key, err)
+		}
+	}
+	// evict reads another value, so that key isn't read from the data cache.
+	evict := func() {
+		key := randomKey()
+		testPut(t, ctx, gd, key, []byte("other"))
+		testPositive(t, ctx, gd, key, []byte("other"))
+	}
+	key := randomKey()
+	testPut(t, ctx, gd, key, []byte("old value"))
+	copyToMirror(key)
+	evict()
+	testPositive(t, ctx, gd, key, []byte("old value"))
+	if n := gd.Stats().MirrorFallbacks; n != 0 {
+		t.Fatalf("%d mirror fallbacks reading an up to date mirror", n)
+	}
+
+	testPut(t, ctx, gd, key, []byte("new, longer value"))
+	evict()
+	testPositive(t, ctx, gd, key, []byte("new, longer value"))
+	if size, err := gd.GetSize(ctx, key); err != nil || size != len("new, longer value") {
+		t.Fatalf("GetSize after overwrite returned %d, %v", size, err)
+	}
+
+	testDelete(t, ctx, gd, key)
+	evict()
+	testNegative(t, ctx, gd, key)
+	if _, err := gd.GetSize(ctx, key); err != ds.ErrNotFound {
+		t.Fatalf("GetSize after delete returned %v", err)
+	}
+}
+
+func TestMirrorCopy(t *testing.T) {
+	ctx := context.Background()
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator to create a mirror bucket.")
+	}
+	mirror := "mirror-" + strings.ToLower(randomSeq(8))
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	if err := client.Bucket(mirror).Create(ctx, "test", nil); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	// The proxy counts reads of the mirror, and holds or fails the copies
+	// and deletes that update it.
+	var mirrorReads atomic.Int32
+	var holding, failing atomic.Bool
+	release := make(chan struct{})
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = host
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, mirror) {
+			if r.Method == http.MethodGet {
+				mirrorReads.Add(1)
+			} else if failing.Load() {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			} else if holding.Load() {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+					return
+				}
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	config := gcsds.Config{
+		Bucket:              getTestBucket(t),
+		Prefix:              "mirror-" + randomSeq(8),
+		MirrorBucket:        mirror,
+		MirrorCopy:          true,
+		DataCacheItems:      1,
+		Endpoint:            server.URL + "/storage/v1/",
+		RetryInitialBackoff: time.Millisecond,
+		RetryMaxBackoff:     10 * time.Millisecond,
+		RetryMaxAttempts:    2,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	var releaseOnce sync.Once
+	unhold := func() {
+		releaseOnce.Do(func() { close(release) })
+	}
+	defer unhold()
+	// waitMirror waits for the mirror object of key to hold value, or to
+	// be deleted if value is nil.
+	waitMirror := func(key ds.Key, value []byte) {
+		obj := client.Bucket(mirror).Object(gd.ObjectPath(key))
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			r, err := obj.NewReader(ctx)
+			if err == storage.ErrObjectNotExist && value == nil {
+				return
+			}
+			if err == nil {
+				got, err := io.ReadAll(r)
+				r.Close()
+				if err == nil && value != nil && bytes.Equal(got, value) {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Mirror of %s not updated to %q", key, value)
+			}
+		}
+	}
+	// evict reads another value, so that key isn't read from the data cache.
+	evict := func() {
+		key := randomKey()
+		testPut(t, ctx, gd, key, []byte("other"))
+		testPositive(t, ctx, gd, key, []byte("other"))
+	}
+
+	// A Put is copied to the mirror, which then serves reads.
+	key := randomKey()
+	testPut(t, ctx, gd, key, []byte("value 1"))
+	waitMirror(key, []byte("value 1"))
+	evict()
+	reads := mirrorReads.Load()
+	testPositive(t, ctx, gd, key, []byte("value 1"))
+	if mirrorReads.Load() == reads || gd.Stats().MirrorFallbacks != 0 {
+		t.Fatalf("Up to date value not read from the mirror")
+	}
+
+	// A same size overwrite isn't read from the mirror while its copy is
+	// pending.
+	holding.Store(true)
+	testPut(t, ctx, gd, key, []byte("value 2"))
+	evict()
+	reads = mirrorReads.Load()
+	testPositive(t, ctx, gd, key, []byte("value 2"))
+	if mirrorReads.Load() != reads {
+		t.Fatalf("Value read from the mirror while its copy is pending")
+	}
+	holding.Store(false)
+	unhold()
+	waitMirror(key, []byte("value 2"))
+
+	// Nor once its copy failed.
+	failing.Store(true)
+	mirrorErrors := gd.Stats().MirrorErrors
+	testPut(t, ctx, gd, key, []byte("value 3"))
+	for deadline := time.Now().Add(10 * time.Second); gd.Stats().MirrorErrors == mirrorErrors; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Mirror copy didn't fail")
+		}
+	}
+	evict()
+	reads = mirrorReads.Load()
+	testPositive(t, ctx, gd, key, []byte("value 3"))
+	if mirrorReads.Load() != reads {
+		t.Fatalf("Value read from the mirror after its copy failed")
+	}
+	failing.Store(false)
+
+	// A Delete removes the mirror object.
+	testDelete(t, ctx, gd, key)
+	waitMirror(key, nil)
+	testNegative(t, ctx, gd, key)
+}
+
+func TestUndelete(t *testing.T) {
+	ctx := context.Background()
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("Needs the emulator to create a versioned bucket.")
+	}
+	if _, err := GetGCSDatastore(t).ListDeleted(ctx, "/", time.Time{}); !errors.Is(err, gcsds.ErrNotRecoverable) {
+		t.Fatalf("ListDeleted on a bucket without versioning returned %v", err)
+	}
+	bucket := "versioned-" + strings.ToLower(randomSeq(8))
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	if err := client.Bucket(bucket).Create(ctx, "test", &storage.BucketAttrs{VersioningEnabled: true}); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	config := gcsds.Config{Bucket: bucket, Prefix: "ipfs", DataCacheItems: 1000}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	if r, err := gd.Recovery(ctx); err != nil || !r.Versioning {
+		t.Fatalf("Recovery returned %+v, %v, expected versioning", r, err)
+	}
+	values := map[ds.Key][]byte{}
+	for i := 0; i < 3; i++ {
+		value := []byte(randomSeq(100))
+		key := ds.NewKey("/blocks").Child(blockKey(t, value))
+		testPut(t, ctx, gd, key, value)
+		values[key] = value
+	}
+	kept := randomKey()
+	testPut(t, ctx, gd, kept, []byte("old"))
+	testPut(t, ctx, gd, kept, []byte("new"))
+	for key := range values {
+		testDelete(t, ctx, gd, key)
+	}
+
+	// Overwritten values with a live value aren't listed.
+	deleted, err := gd.ListDeleted(ctx, "/", time.Time{})
+	if err != nil {
+		t.Fatalf("ListDeleted: %v", err)
+	}
+	if len(deleted) != len(values) {
+		t.Fatalf("ListDeleted returned %+v, expected %d values", deleted, len(values))
+	}
+	for _, v := range deleted {
+		if values[ds.NewKey(v.Key)] == nil || v.Size != 100 {
+			t.Fatalf("Unexpected deleted value %+v", v)
+		}
+	}
+	if since, err := gd.ListDeleted(ctx, "/", time.Now().Add(time.Hour)); err != nil || len(since) != 0 {
+		t.Fatalf("ListDeleted since the future returned %v, %v", since, err)
+	}
+	n, err := gd.Undelete(ctx, deleted)
+	if err != nil || n != len(values) {
+		t.Fatalf("Undelete = %d, %v, expected %d", n, err, len(values))
+	}
+	for key, value := range values {
+		testPositive(t, ctx, gd, key, value)
+	}
+	testPositive(t, ctx, gd, kept, []byte("new"))
+	// Restored keys have a value again.
+	if deleted, err := gd.ListDeleted(ctx, "/", time.Time{}); err != nil || len(deleted) != 0 {
+		t.Fatalf("ListDeleted after Undelete returned %+v, %v", deleted, err)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	config := gcsds.Config{Bucket: getTestBucket(t), Prefix: "ipfs"}
+	report := gcsds.Doctor(context.Background(), config)
+	if !report.OK() {
+		t.Fatalf("Doctor failed:\n%s", report)
+	}
+	config.Bucket = "no-such-bucket-" + strings.ToLower(randomSeq(8))
+	report = gcsds.Doctor(context.Background(), config)
+	if report.OK() {
+		t.Fatalf("Doctor passed for a missing bucket:\n%s", report)
+	}
+}
+
+func TestMissingPermissions(t *testing.T) {
+	ctx := context.Background()
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator.")
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+	bucket := "iam-" + strings.ToLower(randomSeq(8))
+	if err := client.Bucket(bucket).Create(ctx, "test", nil); err != nil {
+		t.Fatalf("Failed to create bucket: %v", err)
+	}
+	// The proxy grants every permission tested but storage.objects.update.
+	// The emulator doesn't keep uniform bucket-level access, so the proxy
+	// reports it when set.
+	var uniform atomic.Bool
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if !uniform.Load() || resp.Request.URL.Path != "/storage/v1/b/"+bucket {
+			return nil
+		}
+		attrs := map[string]interface{}{}
+		if err := json.NewDecoder(resp.Body).Decode(&attrs); err != nil {
+			return err
+		}
+		resp.Body.Close()
+		attrs["iamConfiguration"] = map[string]interface{}{
+			"uniformBucketLevelAccess": map[string]interface{}{"enabled": true},
+		}
+		body, err := json.Marshal(attrs)
+		if err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/iam/testPermissions") {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		granted := []string{}
+		for _, p := range r.URL.Query()["permissions"] {
+			if p != "storage.objects.update" {
+				granted = append(granted, p)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":        "storage#testIamPermissionsResponse",
+			"permissions": granted,
+		})
+	}))
+	defer server.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+
+	config := gcsds.Config{
+		Bucket:         bucket,
+		Prefix:         "iam",
+		DataCacheItems: 1000,
+		Endpoint:       server.URL + "/storage/v1/",
+	}
+	_, err = gcsds.NewGCSDatastore(config)
+	var perr *gcsds.MissingPermissionsError
+	if !errors.As(err, &perr) || !reflect.DeepEqual(perr.Permissions, []string{"storage.objects.update"}) {
+		t.Fatalf("NewGCSDatastore returned %v, expected storage.objects.update missing", err)
+	}
+
+	checks := func(report *gcsds.Report) map[string]gcsds.Check {
+		found := map[string]gcsds.Check{}
+		for _, c := range report.Checks {
+			found[c.Name] = c
+		}
+		return found
+	}
+	report := gcsds.Doctor(ctx, config)
+	found := checks(report)
+	if c := found["permissions"]; c.Status != gcsds.CheckFailed || !strings.Contains(c.Detail, "storage.objects.update") {
+		t.Errorf("Doctor didn't report the missing permission:\n%s", report)
+	}
+	if c := found["uniform access"]; c.Status != gcsds.CheckWarning {
+		t.Errorf("Doctor didn't warn about fine-grained ACLs:\n%s", report)
+	}
+	uniform.Store(true)
+	report = gcsds.Doctor(ctx, config)
+	if c := checks(report)["uniform access"]; c.Status != gcsds.CheckOK {
+		t.Errorf("Doctor warned about uniform bucket-level access:\n%s", report)
+	}
+}
+
+func TestKMSKeyName(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "kms" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	plain, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer plain.Close()
+	attrs, err := plain.BucketHandle().Attrs(ctx)
+	if err != nil {
+		t.Fatalf("Attrs: %v", err)
+	}
+	location := strings.ToLower(attrs.Location)
+	for _, name := range []string{
+		"projects/p/locations/" + location + "/keyRings/r/cryptoKeys",
+		"projects/p/locations/elsewhere/keyRings/r/cryptoKeys/k",
+	} {
+		config.KMSKeyName = name
+		if _, err := gcsds.NewGCSDatastore(config); err == nil {
+			t.Errorf("NewGCSDatastore accepted KMS key %s", name)
+		}
+		if report := gcsds.Doctor(ctx, config); report.OK() {
+			t.Errorf("Doctor passed for KMS key %s:\n%s", name, report)
+		}
+	}
+
+	// The emulator doesn't encrypt objects, nor report their key.
+	config.KMSKeyName = "projects/p/locations/" + location + "/keyRings/r/cryptoKeys/k"
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	key := randomKey()
+	testPut(t, ctx, gd, key, []byte("value"))
+	testPositive(t, ctx, gd, key, []byte("value"))
+}
+
+func TestEndpoint(t *testing.T) {
+	ctx := context.Background()
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator.")
+	}
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "endpoint" + randomKey().String(),
+		DataCacheItems: 1000,
+		Endpoint:       "http://" + host + "/storage/v1/",
+	}
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	if report := gcsds.Doctor(ctx, config); !report.OK() {
+		t.Errorf("Doctor failed:\n%s", report)
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	key := randomKey()
+	testPut(t, ctx, gd, key, []byte("value"))
+	testPositive(t, ctx, gd, key, []byte("value"))
+	// HasMany goes to the batch endpoint.
+	if has, err := gd.HasMany(ctx, []ds.Key{key, randomKey()}); err != nil || !has[0] || has[1] {
+		t.Errorf("HasMany = %v, %v", has, err)
+	}
+	testDelete(t, ctx, gd, key)
+
+	config.Endpoint = "localhost:4443"
+	if _, err := gcsds.NewGCSDatastore(config); err == nil {
+		t.Errorf("NewGCSDatastore accepted endpoint %s", config.Endpoint)
+	}
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator.")
+	}
+	// The proxy fails all requests for keys containing "FAIL".
+	var failed atomic.Int32
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "FAIL") {
+			failed.Add(1)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	config := gcsds.Config{
+		Bucket:              getTestBucket(t),
+		Prefix:              "retry" + randomKey().String(),
+		DataCacheItems:      1000,
+		Endpoint:            server.URL + "/storage/v1/",
+		RetryInitialBackoff: time.Millisecond,
+		RetryMaxBackoff:     10 * time.Millisecond,
+		RetryMaxAttempts:    3,
+	}
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	testPut(t, ctx, gd, randomKey(), []byte("value"))
+	if _, err := gd.GetSize(ctx, ds.NewKey("FAIL"+randomSeq(8))); err == nil {
+		t.Fatalf("GetSize succeeded")
+	}
+	if n := failed.Load(); n != 3 {
+		t.Errorf("%d attempts, expected 3", n)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator.")
+	}
+	// The proxy slows requests down and records how many were in flight.
+	var inFlight, maxInFlight atomic.Int32
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := maxInFlight.Load(); n > m && !maxInFlight.CompareAndSwap(m, n); m = maxInFlight.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	config := gcsds.Config{
+		Bucket:                getTestBucket(t),
+		Prefix:                "throttle" + randomKey().String(),
+		DataCacheItems:        1000,
+		Endpoint:              server.URL + "/storage/v1/",
+		MaxRequestsPerSecond:  50,
+		MaxConcurrentRequests: 2,
+	}
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	const n = 10
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := gd.GetSize(ctx, randomKey()); err != ds.ErrNotFound {
+				t.Errorf("GetSize: %v, expected ErrNotFound", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed, min := time.Since(start), (n-1)*time.Second/50; elapsed < min {
+		t.Errorf("%d requests took %v, expected at least %v", n, elapsed, min)
+	}
+	if m := maxInFlight.Load(); m > 2 {
+		t.Errorf("%d requests in flight, expected at most 2", m)
+	}
+	if st := gd.Stats(); st.ThrottledRequests == 0 {
+		t.Errorf("no throttled requests")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	ctx := context.Background()
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator.")
+	}
+	// The proxy flips a bit of the data of objects named "CORRUPT".
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		// The emulator takes other hosts for bucket names.
+		r.Host = host
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if !strings.Contains(resp.Request.URL.Path, "CORRUPT") || strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			return nil
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(data) > 0 {
+			data[0] ^= 1
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		return nil
+	}
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "checksum" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	writer, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer writer.Close()
+	good, corrupt := ds.NewKey(randomSeq(8)), ds.NewKey("CORRUPT"+randomSeq(8))
+	testPut(t, ctx, writer, good, []byte("good value"))
+	testPut(t, ctx, writer, corrupt, []byte("corrupt value"))
+
+	config.Endpoint = server.URL + "/storage/v1/"
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if value, err := gd.Get(ctx, good); err != nil || string(value) != "good value" {
+		t.Errorf("Get: %q, %v", value, err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := gd.Get(ctx, corrupt)
+		var cerr *gcsds.ChecksumError
+		if !errors.Is(err, gcsds.ErrCorrupt) || !errors.As(err, &cerr) {
+			t.Fatalf("Get: %v, expected a ChecksumError", err)
+		}
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	ctx := context.Background()
+	// Nothing listens there: the credentials fail first.
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	garbage := t.TempDir() + "/garbage.json"
+	if err := os.WriteFile(garbage, []byte("not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{t.TempDir() + "/missing.json", garbage} {
+		config := gcsds.Config{
+			Bucket:          getTestBucket(t),
+			DataCacheItems:  1000,
+			Endpoint:        "https://localhost:1/storage/v1/",
+			CredentialsFile: file,
+		}
+		if _, err := gcsds.NewGCSDatastore(config); err == nil {
+			t.Errorf("NewGCSDatastore accepted credentials file %s", file)
+		}
+		report := gcsds.Doctor(ctx, config)
+		failed := false
+		for _, c := range report.Checks {
+			failed = failed || (c.Name == "credentials" && c.Status == gcsds.CheckFailed)
+		}
+		if !failed {
+			t.Errorf("Doctor passed the credentials file %s:\n%s", file, report)
+		}
+	}
+}
+
+func TestObjectPath(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs/",
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	key := randomKey()
+	testPut(t, ctx, gd, key, []byte("value"))
+	if _, err := gd.BucketHandle().Object(gd.ObjectPath(key)).Attrs(ctx); err != nil {
+		t.Fatalf("Attrs(%s): %v", gd.ObjectPath(key), err)
+	}
+
+	// Keys listed from the bucket match the keys written.
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd2.Close()
+	if err := gd2.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	if has, err := gd2.Has(ctx, key); err != nil || !has {
+		t.Fatalf("Has(%s) = %v, %v after LoadMetadata", key, has, err)
+	}
+}
+
+func TestWriterLock(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "lock" + randomKey().String(),
+		DataCacheItems: 1000,
+		WriterLock:     true,
+		WriterLockTTL:  300 * time.Millisecond,
+	}
+	gd1, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	// Heartbeats keep the lock from going stale.
+	time.Sleep(time.Second)
+	if _, err := gcsds.NewGCSDatastore(config); !errors.Is(err, gcsds.ErrLocked) {
+		t.Fatalf("Expected ErrLocked, got %v", err)
+	}
+	testPut(t, ctx, gd1, randomKey(), []byte("value"))
+	if err := gd1.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore after Close: %v", err)
+	}
+	if err := gd2.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// The lock of a crashed writer is taken over once stale.
+	lockObject := gd2.BucketHandle().Object(strings.TrimSuffix(config.Prefix, "/") + ".lock")
+	w := lockObject.NewWriter(ctx)
+	w.Metadata = map[string]string{"owner": "crashed", "ttl": "500ms",
+		"heartbeat": time.Now().UTC().Format(time.RFC3339Nano)}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to write lock: %v", err)
+	}
+	if _, err := gcsds.NewGCSDatastore(config); !errors.Is(err, gcsds.ErrLocked) {
+		t.Fatalf("Expected ErrLocked, got %v", err)
+	}
+	time.Sleep(time.Second)
+	gd3, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to take over stale lock: %v", err)
+	}
+	gd3.Close()
+}
+
+func TestWriterLockReleasedOnFailedOpen(t *testing.T) {
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "lockinit" + randomKey().String(),
+		DataCacheItems: 1000,
+		WriterLock:     true,
+		WriterLockTTL:  time.Minute,
+		// Fails after the lock is acquired.
+		Compression: "bogus",
+	}
+	if _, err := gcsds.NewGCSDatastore(config); err == nil {
+		t.Fatalf("NewGCSDatastore accepted compression %q", config.Compression)
+	}
+	config.Compression = ""
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore after a failed open: %v", err)
+	}
+	gd.Close()
+}
+
+func TestWriterLockRenewalFailures(t *testing.T) {
+	ctx := context.Background()
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator.")
+	}
+	// The proxy fails updates of the lock object while failing is set.
+	var failing atomic.Bool
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = host
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && r.Method == http.MethodPatch && strings.HasSuffix(r.URL.Path, ".lock") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "lockfail" + randomKey().String(),
+		Endpoint:       server.URL + "/storage/v1/",
+		DataCacheItems: 1000,
+		WriterLock:     true,
+		WriterLockTTL:  300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	time.Sleep(500 * time.Millisecond)
+	testPut(t, ctx, gd, randomKey(), []byte("value"))
+
+	// Writes stop before another writer could take over the stale lock.
+	failing.Store(true)
+	time.Sleep(500 * time.Millisecond)
+	if err := gd.Put(ctx, randomKey(), []byte("value")); !errors.Is(err, gcsds.ErrLockLost) {
+		t.Fatalf("Put after failed renewals returned %v, expected ErrLockLost", err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	ctx := context.Background()
+	gd1 := GetGCSDatastore(t)
+	gd2 := GetGCSDatastore(t)
+	key := randomKey()
+	increment := func(old []byte, exists bool) ([]byte, error) {
+		n := 0
+		if exists {
+			var err error
+			if n, err = strconv.Atoi(string(old)); err != nil {
+				return nil, err
+			}
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		gd := gd1
+		if i%2 == 1 {
+			gd = gd2
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := gd.Update(ctx, key, increment); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Update: %v", err)
+	}
+	reader, err := gd1.BucketHandle().Object(gd1.ObjectPath(key)).NewReader(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read counter: %v", err)
+	}
+	defer reader.Close()
+	value, err := io.ReadAll(reader)
+	if err != nil || string(value) != "40" {
+		t.Fatalf("Counter is %q (%v), expected 40", value, err)
+	}
+}
+
+func TestLoadMetadataInBackground(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "load" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	gd1, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd1.Close()
+	keys := []ds.Key{randomKey(), randomKey(), randomKey()}
+	for _, key := range keys {
+		testPut(t, ctx, gd1, key, []byte("value"))
+	}
+
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd2.Close()
+	gd2.LoadMetadataInBackground()
+	if has, err := gd2.Has(ctx, keys[0]); err != nil || !has {
+		t.Errorf("Has(%s) = %v, %v", keys[0], has, err)
+	}
+	if size, err := gd2.GetSize(ctx, keys[1]); err != nil || size != 5 {
+		t.Errorf("GetSize(%s) = %d, %v", keys[1], size, err)
+	}
+	if has, err := gd2.Has(ctx, randomKey()); err != nil || has {
+		t.Errorf("Has(missing) = %v, %v", has, err)
+	}
+	res, err := gd2.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	entries, err := res.Rest()
+	if err != nil || len(entries) != len(keys) {
+		t.Fatalf("Query returned %d entries, %v", len(entries), err)
+	}
+	if st := gd2.Stats(); !st.MetadataLoaded || st.MetadataListed != int64(len(keys)) {
+		t.Errorf("Stats: loaded %v listed %d", st.MetadataLoaded, st.MetadataListed)
+	}
+}
+
+func TestQueryExpirations(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "expiration" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	write := func(k ds.Key, metadata map[string]string, customTime time.Time) {
+		w := gd.BucketHandle().Object(gd.ObjectPath(k)).NewWriter(ctx)
+		w.Metadata = metadata
+		w.CustomTime = customTime
+		w.Write([]byte("value"))
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to write %v: %v", k, err)
+		}
+	}
+	write(ds.NewKey("/metadata"), map[string]string{"expiration": expires.Format(time.RFC3339Nano)}, time.Time{})
+	write(ds.NewKey("/customtime"), nil, expires)
+	write(ds.NewKey("/none"), nil, time.Time{})
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+
+	for _, returnExpirations := range []bool{false, true} {
+		res, err := gd.Query(ctx, dsq.Query{KeysOnly: true, ReturnExpirations: returnExpirations})
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatalf("Rest: %v", err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("Got %d entries, expected 3", len(entries))
+		}
+		for _, e := range entries {
+			expected := time.Time{}
+			if returnExpirations && e.Key != "/none" {
+				expected = expires
+			}
+			if !e.Expiration.Equal(expected) {
+				t.Fatalf("Expiration of %s is %v, expected %v", e.Key, e.Expiration, expected)
+			}
+		}
+	}
+}
+
+func TestBatchHasAndDelete(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	defer gd.Close()
+	// More keys than fit in one batch request.
+	keys := []ds.Key{}
+	for i := 0; i < 150; i++ {
+		keys = append(keys, randomKey())
+	}
+	vals := make([][]byte, len(keys))
+	for i := range vals {
+		vals[i] = []byte(randomSeq(10))
+	}
+	if err := gd.PutMany(ctx, keys[:120], vals[:120]); err != nil {
+		t.Fatalf("PutMany: %v", err)
+	}
+	has, err := gd.HasMany(ctx, keys)
+	if err != nil {
+		t.Fatalf("HasMany: %v", err)
+	}
+	for i, h := range has {
+		if h != (i < 120) {
+			t.Fatalf("HasMany(%v) = %v", keys[i], h)
+		}
+	}
+
+	// Deleting missing keys is not an error.
+	if err := gd.DeleteMany(ctx, keys[10:]); err != nil {
+		t.Fatalf("DeleteMany: %v", err)
+	}
+	has, err = gd.HasMany(ctx, keys)
+	if err != nil {
+		t.Fatalf("HasMany: %v", err)
+	}
+	for i, h := range has {
+		if h != (i < 10) {
+			t.Fatalf("HasMany(%v) = %v after DeleteMany", keys[i], h)
+		}
+		if cached, _ := gd.Has(ctx, keys[i]); cached != h {
+			t.Fatalf("Has(%v) = %v after DeleteMany", keys[i], cached)
+		}
+	}
+}
+
+func TestLoadMetadataResume(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "resume" + randomKey().String(),
+		Workers:        10,
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	keys := make([]ds.Key, 50)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = randomKey()
+		values[i] = []byte("value")
+	}
+	if err := gd.PutMany(ctx, keys, values); err != nil {
+		t.Fatalf("PutMany: %v", err)
+	}
+
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd2.Close()
+	lctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := gd2.LoadMetadataContext(lctx); err == nil {
+		t.Fatalf("LoadMetadataContext succeeded with a cancelled context")
+	}
+	for i := 0; i < 2; i++ {
+		// A completed load doesn't resume, but lists everything again.
+		if err := gd2.LoadMetadataContext(ctx); err != nil {
+			t.Fatalf("LoadMetadataContext: %v", err)
+		}
+		if listed := gd2.Stats().MetadataListed; listed != int64(len(keys)) {
+			t.Fatalf("Listed %d objects, expected %d", listed, len(keys))
+		}
+	}
+	res, err := gd2.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatalf("Rest: %v", err)
+	}
+	if len(entries) != len(keys) {
+		t.Fatalf("Loaded %d keys, expected %d", len(entries), len(keys))
+	}
+}
+
+func TestLoadMetadataShards(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "shards" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	// More keys than a page of listing, which is split, sharing a stem
+	// as block keys do, and keys under a second level and with characters
+	// the listing isn't split on.
+	keys := []ds.Key{ds.NewKey("/\u00e9t\u00e9"), ds.NewKey("/ CIQ")}
+	for i := 0; i < 1100; i++ {
+		keys = append(keys, ds.NewKey("/CIQ"+strings.ToUpper(randomSeq(10))))
+	}
+	for i := 0; i < 5; i++ {
+		keys = append(keys, ds.NewKey("/pins/"+randomSeq(10)))
+	}
+	values := make([][]byte, len(keys))
+	for i := range values {
+		values[i] = []byte("value")
+	}
+	if err := gd.PutMany(ctx, keys, values); err != nil {
+		t.Fatalf("PutMany: %v", err)
+	}
+
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd2.Close()
+	if err := gd2.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	for _, key := range keys {
+		if has, err := gd2.Has(ctx, key); err != nil || !has {
+			t.Fatalf("Has(%s) = %v, %v after LoadMetadata", key, has, err)
+		}
+	}
+	if listed := gd2.Stats().MetadataListed; listed != int64(len(keys)) {
+		t.Fatalf("Listed %d objects, expected %d", listed, len(keys))
+	}
+}
+
+func TestUnreadableLayoutManifest(t *testing.T) {
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator.")
+	}
+	// The proxy hides the manifest, and fails its creation as if another
+	// node had created it first.
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = host
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/upload/"):
+			http.Error(w, "conditionNotMet", http.StatusPreconditionFailed)
+		case strings.Contains(r.URL.Path, ".layout"):
+			http.Error(w, "not found", http.StatusNotFound)
+		default:
+			proxy.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := gcsds.NewGCSDatastoreContext(ctx, gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "layout" + randomKey().String(),
+		Endpoint:       server.URL + "/storage/v1/",
+		DataCacheItems: 1000,
+	})
+	if err == nil || ctx.Err() != nil {
+		t.Fatalf("NewGCSDatastore with an unreadable manifest returned %v, %v", err, ctx.Err())
+	}
+}
+
+func TestLayoutManifest(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "layout" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	manifest := gd.BucketHandle().Object(config.Prefix + ".layout")
+	r, err := manifest.NewReader(ctx)
+	if err != nil {
+		t.Fatalf("No layout manifest: %v", err)
+	}
+	var layout gcsds.Layout
+	err = json.NewDecoder(r).Decode(&layout)
+	r.Close()
+	if err != nil || layout.Version != gcsds.LayoutVersion {
+		t.Fatalf("Wrong manifest %+v: %v", layout, err)
+	}
+
+	// The manifest of an existing datastore is accepted.
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	gd2.Close()
+
+	// Other layouts are refused.
+	for _, l := range []gcsds.Layout{
+		{Version: gcsds.LayoutVersion + 1, Keys: layout.Keys, Sharding: layout.Sharding, Packing: layout.Packing, Compression: layout.Compression, Encryption: layout.Encryption},
+		{Version: layout.Version, Keys: layout.Keys, Sharding: layout.Sharding, Packing: layout.Packing, Compression: "zstd", Encryption: layout.Encryption},
+	} {
+		w := manifest.NewWriter(ctx)
+		json.NewEncoder(w).Encode(l)
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to write manifest: %v", err)
+		}
+		_, err := gcsds.NewGCSDatastore(config)
+		var lerr *gcsds.LayoutError
+		if !errors.Is(err, gcsds.ErrLayoutMismatch) || !errors.As(err, &lerr) || lerr.Found != l {
+			t.Fatalf("Layout %+v accepted: %v", l, err)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "compression" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	// An existing bucket needs a migration to compress.
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	plain := randomKey()
+	testPut(t, ctx, gd, plain, bytes.Repeat([]byte("plain "), 200))
+	gd.Close()
+	config.Compression = gcsds.CompressionGzip
+	if _, err := gcsds.NewGCSDatastore(config); !errors.Is(err, gcsds.ErrLayoutMismatch) {
+		t.Fatalf("NewGCSDatastore: %v, expected a layout mismatch", err)
+	}
+	config.MigrateLayout = true
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	small, large := randomKey(), randomKey()
+	largeValue := bytes.Repeat([]byte("compressible "), 1000)
+	testPut(t, ctx, gd, small, []byte("small"))
+	testPut(t, ctx, gd, large, largeValue)
+	gd.Close()
+
+	attrs, err := gd.BucketHandle().Object(gd.GCSPath(large.String())).Attrs(ctx)
+	if err != nil {
+		t.Fatalf("Attrs: %v", err)
+	}
+	if attrs.ContentEncoding != "gzip" || attrs.Size >= int64(len(largeValue)) {
+		t.Errorf("Stored %d bytes with encoding %q", attrs.Size, attrs.ContentEncoding)
+	}
+	attrs, err = gd.BucketHandle().Object(gd.GCSPath(small.String())).Attrs(ctx)
+	if err != nil || attrs.ContentEncoding != "" {
+		t.Errorf("Small value stored with encoding %q: %v", attrs.ContentEncoding, err)
+	}
+
+	// A new datastore reads all values from GCS.
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if size, err := gd.GetSize(ctx, large); err != nil || size != len(largeValue) {
+		t.Errorf("GetSize: %d, %v, expected %d", size, err, len(largeValue))
+	}
+	r, err := gd.GetReader(ctx, large)
+	if err != nil {
+		t.Fatalf("GetReader: %v", err)
+	}
+	value, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(value, largeValue) {
+		t.Errorf("GetReader read %d bytes: %v", len(value), err)
+	}
+	if value, err := gd.GetRange(ctx, large, 100, 30); err != nil || !bytes.Equal(value, largeValue[100:130]) {
+		t.Errorf("GetRange: %q, %v", value, err)
+	}
+	// Listed sizes are of the values too.
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	testPositive(t, ctx, gd, small, []byte("small"))
+	testPositive(t, ctx, gd, plain, bytes.Repeat([]byte("plain "), 200))
+	testPositive(t, ctx, gd, large, largeValue)
+}
+
+func TestCompressionCodecs(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "codecs" + randomKey().String(),
+		DataCacheItems: 1000,
+		MigrateLayout:  true,
+	}
+	values := map[ds.Key][]byte{}
+	for _, c := range []struct {
+		codec string
+		level int
+	}{{gcsds.CompressionZstd, 19}, {gcsds.CompressionGzip, 9}} {
+		codec := c.codec
+		config.Compression, config.CompressionLevel = codec, c.level
+		gd, err := gcsds.NewGCSDatastore(config)
+		if err != nil {
+			t.Fatalf("NewGCSDatastore with %s: %v", codec, err)
+		}
+		key, value := randomKey(), bytes.Repeat([]byte(codec+" compressed "), 500)
+		testPut(t, ctx, gd, key, value)
+		values[key] = value
+		gd.Close()
+		attrs, err := gd.BucketHandle().Object(gd.GCSPath(key.String())).Attrs(ctx)
+		if err != nil || attrs.ContentEncoding != codec || attrs.Size >= int64(len(value)) {
+			t.Errorf("Stored %d bytes with encoding %q, expected %s: %v", attrs.Size, attrs.ContentEncoding, codec, err)
+		}
+	}
+	// Values of both codecs are read.
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	for key, value := range values {
+		if got, err := gd.Get(ctx, key); err != nil || !bytes.Equal(got, value) {
+			t.Errorf("Get read %d bytes: %v", len(got), err)
+		}
+		if got, err := gd.GetRange(ctx, key, 10, 20); err != nil || !bytes.Equal(got, value[10:30]) {
+			t.Errorf("GetRange: %q, %v", got, err)
+		}
+	}
+
+	config.CompressionLevel = 23
+	if _, err := gcsds.NewGCSDatastore(config); err == nil {
+		t.Errorf("Compression level 23 accepted for gzip")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "encryption" + randomKey().String(),
+		DataCacheItems: 1000,
+		Compression:    gcsds.CompressionZstd,
+		EncryptionKey:  bytes.Repeat([]byte{7}, 32),
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	small, large := randomKey(), randomKey()
+	largeValue := bytes.Repeat([]byte("secret "), 1000)
+	testPut(t, ctx, gd, small, []byte("secret"))
+	testPut(t, ctx, gd, large, largeValue)
+	gd.Close()
+
+	for key, encoding := range map[ds.Key]string{small: "aes-256-gcm", large: "zstd, aes-256-gcm"} {
+		obj := gd.BucketHandle().Object(gd.GCSPath(key.String()))
+		attrs, err := obj.Attrs(ctx)
+		if err != nil || attrs.ContentEncoding != encoding {
+			t.Errorf("Stored with encoding %q, expected %q: %v", attrs.ContentEncoding, encoding, err)
+		}
+		r, err := obj.ReadCompressed(true).NewReader(ctx)
+		if err != nil {
+			t.Fatalf("NewReader: %v", err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if bytes.Contains(data, []byte("secret")) {
+			t.Errorf("Stored data isn't encrypted: %q", data)
+		}
+	}
+
+	// A new datastore decrypts the values.
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	testPositive(t, ctx, gd, small, []byte("secret"))
+	testPositive(t, ctx, gd, large, largeValue)
+	gd.Close()
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	if value, err := gd.GetRange(ctx, large, 7, 6); err != nil || string(value) != "secret" {
+		t.Errorf("GetRange: %q, %v", value, err)
+	}
+	gd.Close()
+
+	// Values don't decrypt with another key, and the layout needs one.
+	config.EncryptionKey = bytes.Repeat([]byte{8}, 32)
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if _, err := gd.Get(ctx, small); !errors.Is(err, gcsds.ErrCorrupt) {
+		t.Errorf("Get with another key: %v, expected ErrCorrupt", err)
+	}
+	config.EncryptionKey = nil
+	if _, err := gcsds.NewGCSDatastore(config); !errors.Is(err, gcsds.ErrLayoutMismatch) {
+		t.Errorf("NewGCSDatastore without a key: %v, expected a layout mismatch", err)
+	}
+	config.EncryptionKey = []byte("short")
+	if _, err := gcsds.NewGCSDatastore(config); err == nil {
+		t.Errorf("Short key accepted")
+	}
+}
+
+func TestPackedTxnAndTTL(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:           getTestBucket(t),
+		Prefix:           "packtxn" + randomKey().String(),
+		DataCacheItems:   1,
+		PackBlocks:       true,
+		PackSize:         4096,
+		PackMaxValueSize: 1024,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	value := []byte(randomSeq(100))
+	values := map[ds.Key][]byte{}
+	for i := 0; i < 3; i++ {
+		v := append([]byte(strconv.Itoa(i)), value...)
+		values[blockKey(t, v)] = v
+	}
+	var overwritten, deleted, expiring ds.Key
+	for key, v := range values {
+		testPut(t, ctx, gd, key, v)
+		switch v[0] {
+		case '0':
+			overwritten = key
+		case '1':
+			deleted = key
+		default:
+			expiring = key
+		}
+	}
+	value = values[overwritten]
+	if n := gd.Stats().PackedValues; n != 3 {
+		t.Fatalf("%d packed values, expected 3", n)
+	}
+
+	txn, err := gd.NewTransaction(ctx, false)
+	if err != nil {
+		t.Fatalf("NewTransaction: %v", err)
+	}
+	if got, err := txn.Get(ctx, overwritten); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("Transaction read of a packed value: %q, %v", got, err)
+	}
+	newValue := []byte(randomSeq(100))
+	if err := txn.Put(ctx, overwritten, newValue); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := txn.Delete(ctx, deleted); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	testPositive(t, ctx, gd, overwritten, newValue)
+	testNegative(t, ctx, gd, deleted)
+
+	if err := gd.SetTTL(ctx, expiring, time.Hour); err != nil {
+		t.Fatalf("SetTTL of a packed value: %v", err)
+	}
+	if exp, err := gd.GetExpiration(ctx, expiring); err != nil || exp.IsZero() {
+		t.Fatalf("GetExpiration: %v, %v", exp, err)
+	}
+	testPositive(t, ctx, gd, expiring, values[expiring])
+	if n := gd.Stats().PackedValues; n != 0 {
+		t.Errorf("%d packed values left", n)
+	}
+	gd.Close()
+
+	// The pack index agrees.
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	testPositive(t, ctx, gd, overwritten, newValue)
+	testNegative(t, ctx, gd, deleted)
+	testPositive(t, ctx, gd, expiring, values[expiring])
+	if exp, err := gd.GetExpiration(ctx, expiring); err != nil || exp.IsZero() {
+		t.Fatalf("GetExpiration after reload: %v, %v", exp, err)
+	}
+}
+
+func TestPackBlocks(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:           getTestBucket(t),
+		Prefix:           "packs" + randomKey().String(),
+		DataCacheItems:   1000,
+		PackBlocks:       true,
+		PackSize:         4096,
+		PackMaxValueSize: 1024,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	// Concurrent puts share packs.
+	keys := make([]ds.Key, 50)
+	values := make(map[ds.Key][]byte)
+	var wg sync.WaitGroup
+	for i := range keys {
+		value := []byte(strings.Repeat(strconv.Itoa(i), 100))
+		keys[i] = blockKey(t, value)
+		values[keys[i]] = value
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			testPut(t, ctx, gd, keys[i], values[keys[i]])
+		}(i)
+	}
+	large := bytes.Repeat([]byte("large "), 1000)
+	largeKey := blockKey(t, large)
+	testPut(t, ctx, gd, largeKey, large)
+	wg.Wait()
+	st := gd.Stats()
+	if st.Packs == 0 || st.Packs >= len(keys) || st.PackedValues != len(keys) {
+		t.Errorf("Stored %d values in %d packs", st.PackedValues, st.Packs)
+	}
+	if _, err := gd.BucketHandle().Object(gd.GCSPath(keys[0].String())).Attrs(ctx); err != storage.ErrObjectNotExist {
+		t.Errorf("Packed value stored in an object: %v", err)
+	}
+	if _, err := gd.BucketHandle().Object(gd.GCSPath(largeKey.String())).Attrs(ctx); err != nil {
+		t.Errorf("Large value not stored in an object: %v", err)
+	}
+	if value, err := gd.GetRange(ctx, keys[7], 10, 20); err != nil || !bytes.Equal(value, values[keys[7]][10:30]) {
+		t.Errorf("GetRange: %q, %v", value, err)
+	}
+	gd.Close()
+
+	// A new datastore loads the index of the packs.
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	for _, key := range keys {
+		testPositive(t, ctx, gd, key, values[key])
+	}
+	testPositive(t, ctx, gd, largeKey, large)
+	if err := gd.DeleteMany(ctx, keys[10:]); err != nil {
+		t.Fatalf("DeleteMany: %v", err)
+	}
+	packs := gd.Stats().Packs
+	if n, err := gd.CompactPacks(ctx); err != nil || n == 0 {
+		t.Errorf("CompactPacks: %d, %v", n, err)
+	}
+	if st := gd.Stats(); st.Packs != 1 || st.PackedValues != 10 {
+		t.Errorf("Compacted %d packs into %d with %d values", packs, st.Packs, st.PackedValues)
+	}
+	gd.Close()
+
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	for _, key := range keys[:10] {
+		testPositive(t, ctx, gd, key, values[key])
+	}
+	for _, key := range keys[10:] {
+		testNegative(t, ctx, gd, key)
+	}
+}
+
+func TestSharding(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "sharding" + randomKey().String(),
+		DataCacheItems: 1000,
+		Sharding:       "next-to-last/2",
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	keys := []ds.Key{ds.NewKey("/CIQABCDEFXYZ"), ds.NewKey("/CIQABCDEFXYQ"), ds.NewKey("/b/1"), ds.NewKey("/b/22")}
+	for _, key := range keys {
+		testPut(t, ctx, gd, key, []byte(key.String()))
+	}
+	for key, name := range map[ds.Key]string{
+		keys[0]: config.Prefix + "/XY/CIQABCDEFXYZ",
+		keys[2]: config.Prefix + "/b/__/1",
+		keys[3]: config.Prefix + "/b/_2/22",
+	} {
+		if path := gd.ObjectPath(key); path != name {
+			t.Errorf("ObjectPath(%v) = %s, expected %s", key, path, name)
+		}
+		if _, err := gd.BucketHandle().Object(name).Attrs(ctx); err != nil {
+			t.Errorf("Object %s: %v", name, err)
+		}
+	}
+	gd.Close()
+
+	// The sharding is recorded in the layout.
+	config.Sharding = "prefix/2"
+	if _, err := gcsds.NewGCSDatastore(config); !errors.Is(err, gcsds.ErrLayoutMismatch) {
+		t.Fatalf("NewGCSDatastore: %v, expected a layout mismatch", err)
+	}
+	config.Sharding = "/repo/flatfs/shard/v1/next-to-last/2"
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	for _, key := range keys {
+		testPositive(t, ctx, gd, key, []byte(key.String()))
+	}
+
+	// Queries listing GCS return keys in order.
+	config.LazyMetadata = true
+	lazy, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer lazy.Close()
+	res, err := lazy.Query(ctx, dsq.Query{KeysOnly: true, Orders: []dsq.Order{dsq.OrderByKey{}}})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatalf("Rest: %v", err)
+	}
+	got := []string{}
+	for _, e := range entries {
+		got = append(got, e.Key)
+	}
+	if expected := []string{"/CIQABCDEFXYQ", "/CIQABCDEFXYZ", "/b/1", "/b/22"}; fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Query returned %v, expected %v", got, expected)
+	}
+}
+
+func TestKeyEscaping(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "escaping" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	keys := []ds.Key{
+		ds.RawKey("/control\x01\n"),
+		ds.RawKey("/percent%41"),
+		ds.RawKey("/dots/./.."),
+		ds.RawKey("/wildcards#[x]?*"),
+		ds.RawKey("/invalid\xff"),
+		ds.RawKey("/long/" + strings.Repeat("é", 300)),
+	}
+	for _, key := range keys {
+		testPut(t, ctx, gd, key, []byte(key.String()))
+		name := gd.ObjectPath(key)
+		for _, seg := range strings.Split(name, "/") {
+			if seg == "." || seg == ".." || len(seg) > 255 || strings.ContainsAny(seg, "\x01\n\xff#[]?*") {
+				t.Errorf("Object name %q of %q has segment %q", name, key, seg)
+			}
+		}
+	}
+	gd.Close()
+
+	// The keys listed from GCS are the keys stored.
+	config.LazyMetadata = true
+	gd, err = gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	res, err := gd.Query(ctx, dsq.Query{})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatalf("Rest: %v", err)
+	}
+	if len(entries) != len(keys) {
+		t.Errorf("Query returned %d entries, expected %d", len(entries), len(keys))
+	}
+	for _, e := range entries {
+		if e.Key != string(e.Value) {
+			t.Errorf("Query returned key %q for the value of %q", e.Key, e.Value)
+		}
+	}
+	res, err = gd.Query(ctx, dsq.Query{Prefix: "/long", KeysOnly: true})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if entries, err := res.Rest(); err != nil || len(entries) != 1 || entries[0].Key != keys[5].String() {
+		t.Errorf("Query(/long): %v, %v", entries, err)
+	}
+}
+
+func TestKeyEscapingMigration(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "unescaped" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	// A bucket written before keys were escaped.
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer client.Close()
+	for name, data := range map[string]string{
+		config.Prefix + ".layout":       `{"version":1,"keys":"prefix","sharding":"none","packing":"none","compression":"none"}`,
+		config.Prefix + "/percent%41":   "/percent%41",
+		config.Prefix + "/percent%2541": "/percent%2541",
+		config.Prefix + "/plain":        "/plain",
+	} {
+		w := client.Bucket(config.Bucket).Object(name).NewWriter(ctx)
+		w.Write([]byte(data))
+		if err := w.Close(); err != nil {
+			t.Fatalf("Write %s: %v", name, err)
+		}
+	}
+	if _, err := gcsds.NewGCSDatastore(config); !errors.Is(err, gcsds.ErrLayoutMismatch) {
+		t.Fatalf("NewGCSDatastore: %v, expected a layout mismatch", err)
+	}
+	config.MigrateLayout = true
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	for _, key := range []string{"/percent%41", "/percent%2541", "/plain"} {
+		testPositive(t, ctx, gd, ds.RawKey(key), []byte(key))
+	}
+}
+
+func TestContentType(t *testing.T) {
+	ctx := context.Background()
+	for _, c := range []struct{ config, expected string }{
+		{"", gcsds.DefaultContentType},
+		{"application/vnd.ipld.raw", "application/vnd.ipld.raw"},
+	} {
+		gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+			Bucket:         getTestBucket(t),
+			Prefix:         "contenttype" + randomKey().String(),
+			DataCacheItems: 1000,
+			ContentType:    c.config,
+		})
+		if err != nil {
+			t.Fatalf("NewGCSDatastore: %v", err)
+		}
+		key := randomKey()
+		testPut(t, ctx, gd, key, []byte("value"))
+		attrs, err := gd.BucketHandle().Object(gd.ObjectPath(key)).Attrs(ctx)
+		if err != nil {
+			t.Fatalf("Attrs: %v", err)
+		}
+		if attrs.ContentType != c.expected || len(attrs.Metadata) != 0 {
+			t.Errorf("Stored Content-Type %q and metadata %v, expected %q", attrs.ContentType, attrs.Metadata, c.expected)
+		}
+		gd.Close()
+	}
+}
+
+func TestObjectMetadata(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "objectmetadata" + randomKey().String(),
+		DataCacheItems: 1000,
+		ObjectMetadata: []string{"bogus"},
+	}
+	if _, err := gcsds.NewGCSDatastore(config); err == nil {
+		t.Fatalf("NewGCSDatastore accepted unknown object metadata")
+	}
+	config.ObjectMetadata = []string{gcsds.ObjectMetadataKey, gcsds.ObjectMetadataNode, gcsds.ObjectMetadataWritten, gcsds.ObjectMetadataCodec}
+	config.NodeID = "12D3KooWPeer"
+	config.Compression = gcsds.CompressionGzip
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	key := randomKey()
+	before := time.Now()
+	testPut(t, ctx, gd, key, bytes.Repeat([]byte("compressible "), 100))
+	attrs, err := gd.BucketHandle().Object(gd.ObjectPath(key)).Attrs(ctx)
+	if err != nil {
+		t.Fatalf("Attrs: %v", err)
+	}
+	md := attrs.Metadata
+	if md["key"] != key.String() || md["node"] != config.NodeID || md["codec"] != gcsds.CompressionGzip {
+		t.Errorf("Stored metadata %v", md)
+	}
+	if written, err := time.Parse(time.RFC3339Nano, md["written"]); err != nil || written.Before(before.Add(-time.Second)) {
+		t.Errorf("Stored write time %q: %v", md["written"], err)
+	}
+}
+
+func TestFallbackBucket(t *testing.T) {
+	ctx := context.Background()
+	shared := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "shared" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(shared)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	snapshot := randomKey()
+	testPut(t, ctx, gd, snapshot, []byte("shared"))
+	gd.Close()
+
+	gd, err = gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "private" + randomKey().String(),
+		DataCacheItems: 1000,
+		FallbackBucket: shared.Bucket,
+		FallbackPrefix: shared.Prefix,
+	})
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	private := randomKey()
+	testPut(t, ctx, gd, private, []byte("private"))
+	testPositive(t, ctx, gd, snapshot, []byte("shared"))
+	testPositive(t, ctx, gd, private, []byte("private"))
+	testNegative(t, ctx, gd, randomKey())
+	has, err := gd.HasMany(ctx, []ds.Key{private, randomKey(), snapshot})
+	if err != nil || fmt.Sprint(has) != "[true false true]" {
+		t.Errorf("HasMany: %v, %v", has, err)
+	}
+	if st := gd.Stats(); st.FallbackReads != 1 {
+		t.Errorf("Read %d values from the fallback bucket, expected 1", st.FallbackReads)
+	}
+	// The fallback bucket isn't written to.
+	if err := gd.Delete(ctx, snapshot); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := gd.BucketHandle().Object(shared.Prefix + snapshot.String()).Attrs(ctx); err != nil {
+		t.Errorf("Fallback object: %v", err)
+	}
+}
+
+func TestTurboReplication(t *testing.T) {
+	// The emulated bucket is regional, so it can't have turbo replication.
+	config := gcsds.Config{
+		Bucket:           getTestBucket(t),
+		Prefix:           randomKey().String(),
+		DataCacheItems:   1000,
+		TurboReplication: true,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	if r := gd.Stats().Replication; r.DualRegion || r.Turbo() {
+		t.Errorf("Replication of a regional bucket: %+v", r)
+	}
+	gd.Close()
+
+	config.RequireTurboReplication = true
+	if gd, err := gcsds.NewGCSDatastore(config); err == nil {
+		gd.Close()
+		t.Errorf("Started without turbo replication")
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	ctx := context.Background()
+	gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:          getTestBucket(t),
+		Prefix:          randomKey().String(),
+		DataCacheItems:  1000,
+		MetricsInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	key := randomKey()
+	testPut(t, ctx, gd, key, []byte("value"))
+	testPositive(t, ctx, gd, key, []byte("value"))
+	st := gd.Stats()
+	if st.DataCache.Items != 1 || st.DataCache.Bytes != 5 || st.DataCache.MaxItems != 1000 || st.DataCache.Hits != 1 {
+		t.Errorf("Data cache stats: %+v", st.DataCache)
+	}
+	if st.MetadataEntries != 1 || st.MetadataMemory <= int64(len(key.String())) {
+		t.Errorf("Metadata cache of %d entries using %d bytes", st.MetadataEntries, st.MetadataMemory)
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	ctx := context.Background()
+	gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         randomKey().String(),
+		DataCacheItems: 1000,
+		HealthAddr:     "localhost:0",
+	})
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	if err := gd.Healthy(ctx); err != nil {
+		t.Errorf("Healthy: %v", err)
+	}
+	srv := httptest.NewServer(gd.HealthHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Health status %d, expected 200", resp.StatusCode)
+	}
+	gd.Close()
+	if err := gd.Healthy(ctx); !errors.Is(err, gcsds.ErrUnhealthy) {
+		t.Errorf("Healthy after Close: %v", err)
+	}
+	resp, err = http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Health status after Close %d, expected 503", resp.StatusCode)
+	}
+}
+
+func TestHealthyErrorRate(t *testing.T) {
+	ctx := context.Background()
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		t.Skip("Needs the emulator.")
+	}
+	// The proxy denies object requests once failing is set.
+	var failing atomic.Bool
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: host})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() && strings.Contains(r.URL.Path, "/o/") {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		r.Host = host
+		proxy.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	t.Setenv("STORAGE_EMULATOR_HOST", "")
+	gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         randomKey().String(),
+		DataCacheItems: 1000,
+		Endpoint:       server.URL + "/storage/v1/",
+	})
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	for i := 0; i < 20; i++ {
+		if _, err := gd.GetSize(ctx, randomKey()); err != ds.ErrNotFound {
+			t.Fatalf("GetSize: %v, expected ErrNotFound", err)
+		}
+	}
+	if err := gd.Healthy(ctx); err != nil {
+		t.Errorf("Healthy after missing keys: %v", err)
+	}
+	failing.Store(true)
+	for i := 0; i < 30; i++ {
+		if _, err := gd.GetSize(ctx, randomKey()); err == nil || err == ds.ErrNotFound {
+			t.Fatalf("GetSize: %v, expected a failure", err)
+		}
+	}
+	if err := gd.Healthy(ctx); !errors.Is(err, gcsds.ErrUnhealthy) {
+		t.Errorf("Healthy after 30 of 50 requests failed: %v", err)
+	}
+}
+
+func TestQueryConsistencyListed(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	other, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer other.Close()
+	config.QueryConsistency = gcsds.QueryConsistencyListed
+	config.Durability = map[string]gcsds.Durability{"/pending": gcsds.DurabilityAsync}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	deleted, added := ds.NewKey("/deleted"), ds.NewKey("/added")
+	testPut(t, ctx, gd, deleted, []byte("deleted"))
+	testPut(t, ctx, other, added, []byte("added"))
+	if err := other.Delete(ctx, deleted); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	testPut(t, ctx, gd, ds.NewKey("/pending"), []byte("pending"))
+	res, err := gd.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, fmt.Sprintf("%s:%d", e.Key, e.Size))
+	}
+	if got := strings.Join(keys, " "); got != "/added:5 /pending:7" {
+		t.Errorf("Query returned %s, expected /added:5 /pending:7", got)
+	}
+	config.QueryConsistency = "eventual"
+	if gd, err := gcsds.NewGCSDatastore(config); err == nil {
+		gd.Close()
+		t.Errorf("Started with an unknown query consistency")
+	}
+}
+
+func TestChildren(t *testing.T) {
+	ctx := context.Background()
+	long := strings.Repeat("n", 300)
+	for _, sharding := range []string{"", "next-to-last/2"} {
+		gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+			Bucket:         getTestBucket(t),
+			Prefix:         randomKey().String(),
+			DataCacheItems: 1000,
+			Sharding:       sharding,
+		})
+		if err != nil {
+			t.Fatalf("NewGCSDatastore: %v", err)
+		}
+		defer gd.Close()
+		for _, key := range []string{"/a", "/ns1/x", "/ns1/y/z", "/" + long + "/x", "/ns2/x", "/ns2", "/%2E"} {
+			testPut(t, ctx, gd, ds.RawKey(key), []byte("value"))
+		}
+		keys, namespaces, err := gd.Children(ctx, ds.NewKey("/"))
+		if err != nil {
+			t.Fatalf("Children: %v", err)
+		}
+		if got, want := fmt.Sprint(keys, namespaces), fmt.Sprintf("[/%%2E /a /ns2] [/%s /ns1 /ns2]", long); got != want {
+			t.Errorf("Children of / with sharding %q: %s, expected %s", sharding, got, want)
+		}
+		keys, namespaces, err = gd.Children(ctx, ds.NewKey("/ns1"))
+		if err != nil {
+			t.Fatalf("Children: %v", err)
+		}
+		if got := fmt.Sprint(keys, namespaces); got != "[/ns1/x] [/ns1/y]" {
+			t.Errorf("Children of /ns1 with sharding %q: %s", sharding, got)
+		}
+	}
+}
+
+func TestQueryPage(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:           getTestBucket(t),
+		Prefix:           "pages" + randomKey().String(),
+		DataCacheItems:   1000,
+		PackBlocks:       true,
+		PackMaxValueSize: 16,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	// Small blocks are packed, large ones stored as objects.
+	values := map[string]string{}
+	for i := 0; i < 17; i++ {
+		value := strconv.Itoa(i)
+		if i%3 != 0 {
+			value = strings.Repeat(value, 20)
+		}
+		key := blockKey(t, []byte(value))
+		testPut(t, ctx, gd, key, []byte(value))
+		values[key.String()] = value
+	}
+
+	// The query resumes after a restart.
+	q := dsq.Query{}
+	page, token, err := gd.QueryPage(ctx, q, "", 5)
+	if err != nil || len(page) != 5 || token == "" {
+		t.Fatalf("First page: %d results, token %q, %v", len(page), token, err)
+	}
+	gd.Close()
+	if gd, err = gcsds.NewGCSDatastore(config); err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	found := map[string]string{}
+	for {
+		for _, e := range page {
+			if _, ok := found[e.Key]; ok {
+				t.Errorf("%s returned twice", e.Key)
+			}
+			found[e.Key] = string(e.Value)
+		}
+		if token == "" {
+			break
+		}
+		if page, token, err = gd.QueryPage(ctx, q, token, 5); err != nil {
+			t.Fatalf("QueryPage: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(found, values) {
+		t.Errorf("Pages returned %v, expected %v", found, values)
+	}
+
+	if _, _, err := gd.QueryPage(ctx, dsq.Query{Prefix: "/other"}, token, 5); err != nil {
+		t.Errorf("QueryPage from the start: %v", err)
+	}
+	_, token, _ = gd.QueryPage(ctx, dsq.Query{KeysOnly: true}, "", 5)
+	if _, _, err := gd.QueryPage(ctx, dsq.Query{Prefix: "/other"}, token, 5); !errors.Is(err, gcsds.ErrInvalidPageToken) {
+		t.Errorf("QueryPage with the token of another query: %v", err)
+	}
+}
+
+func TestPutManyErrors(t *testing.T) {
+	ctx := context.Background()
+	gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         randomKey().String(),
+		DataCacheItems: 1000,
+		VerifyPut:      true,
+	})
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	keys := make([]ds.Key, 20)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		values[i] = []byte(strconv.Itoa(i))
+		keys[i] = blockKey(t, values[i])
+	}
+	// Blocks that don't match their keys fail.
+	values[3], values[7] = values[7], values[3]
+	err = gd.PutMany(ctx, keys, values)
+	var berr *gcsds.BatchError
+	if !errors.As(err, &berr) || len(berr.Errors) != 2 || berr.Errors[keys[3]] == nil || berr.Errors[keys[7]] == nil {
+		t.Fatalf("PutMany: %v, expected errors for 2 keys", err)
+	}
+	for i := range keys {
+		if i != 3 && i != 7 {
+			testPositive(t, ctx, gd, keys[i], values[i])
+		}
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := gd.PutMany(cctx, keys, values); !errors.Is(err, context.Canceled) {
+		t.Errorf("PutMany with a cancelled context: %v", err)
+	}
+}
+
+func TestAllKeys(t *testing.T) {
+	ctx := context.Background()
+	for _, consistency := range []string{gcsds.QueryConsistencyCached, gcsds.QueryConsistencyListed} {
+		gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+			Bucket:           getTestBucket(t),
+			Prefix:           randomKey().String(),
+			DataCacheItems:   1000,
+			QueryConsistency: consistency,
+		})
+		if err != nil {
+			t.Fatalf("NewGCSDatastore: %v", err)
+		}
+		defer gd.Close()
+		if err := gd.LoadMetadata(); err != nil {
+			t.Fatalf("LoadMetadata: %v", err)
+		}
+		want := []string{}
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("/blocks/%02d", i)
+			testPut(t, ctx, gd, ds.NewKey(key), []byte("value"))
+			want = append(want, key)
+		}
+		testPut(t, ctx, gd, ds.NewKey("/other"), []byte("value"))
+		if err := gd.PutWithTTL(ctx, ds.NewKey("/blocks/expired"), []byte("value"), time.Millisecond); err != nil {
+			t.Fatalf("PutWithTTL: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		keys, keysErr := gd.AllKeys(ctx, "/blocks/")
+		got := []string{}
+		for key := range keys {
+			got = append(got, key.String())
+		}
+		sort.Strings(got)
+		if err := keysErr(); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("AllKeys with %s consistency: %v, %v", consistency, got, err)
+		}
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		keys, keysErr = gd.AllKeys(cctx, "/blocks/")
+		if _, ok := <-keys; ok || keysErr() != context.Canceled {
+			t.Errorf("AllKeys with a cancelled context: %v", keysErr())
+		}
+	}
+}
+
+func TestClusterSemantics(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "cluster" + randomKey().String(),
+		Workers:        10,
+		DataCacheItems: 1000,
+		Durability:     map[string]gcsds.Durability{"/crdt": gcsds.DurabilityAsync},
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gd.Close()
+
+	// Elements of CRDT keys, written in a batch as go-ds-crdt does.
+	b, err := gd.Batch(ctx)
+	if err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+	values := map[string]string{
+		"/crdt/s/k/foo/a":    "1",
+		"/crdt/s/k/foo/b":    "2",
+		"/crdt/s/k/foobar/a": "3",
+	}
+	for k, v := range values {
+		if err := b.Put(ctx, ds.NewKey(k), []byte(v)); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := gd.Sync(ctx, ds.NewKey("/crdt")); err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+
+	query := func(q dsq.Query) []string {
+		t.Helper()
+		res, err := gd.Query(ctx, q)
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatalf("Rest: %v", err)
+		}
+		keys := []string{}
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+	foo := []string{"/crdt/s/k/foo/a", "/crdt/s/k/foo/b"}
+	for _, prefix := range []string{"/crdt/s/k/foo", "/crdt/s/k/foo/", "crdt/s/k/./foo"} {
+		if got := query(dsq.Query{Prefix: prefix, KeysOnly: true}); !reflect.DeepEqual(got, foo) {
+			t.Errorf("Query(%q) = %v, expected %v", prefix, got, foo)
+		}
+	}
+	got := query(dsq.Query{
+		Prefix:  "/crdt",
+		Filters: []dsq.Filter{dsq.FilterKeyCompare{Op: dsq.GreaterThan, Key: "/crdt/s/k/foo/a"}},
+		Orders:  []dsq.Order{dsq.OrderByKeyDescending{}},
+	})
+	if expected := []string{"/crdt/s/k/foobar/a", "/crdt/s/k/foo/b"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Query(key filter) = %v, expected %v", got, expected)
+	}
+	got = query(dsq.Query{
+		Prefix:  "/crdt",
+		Filters: []dsq.Filter{dsq.FilterValueCompare{Op: dsq.LessThan, Value: []byte("3")}},
+		Limit:   1,
+	})
+	if expected := []string{"/crdt/s/k/foo/a"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Query(value filter) = %v, expected %v", got, expected)
+	}
+
+	// Synced writes are in GCS for another peer to read.
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gd2.Close()
+	for k, v := range values {
+		if got, err := gd2.Get(ctx, ds.NewKey(k)); err != nil || string(got) != v {
+			t.Errorf("Get(%s) = %q, %v", k, got, err)
+		}
+	}
+}
+
+func TestRepoStats(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "repostats" + randomKey().String(),
+		Workers:        10,
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gd.Close()
+	blocks := ds.NewKey("/blocks")
+	for i := 0; i < 3; i++ {
+		value := []byte(randomSeq(100))
+		testPut(t, ctx, gd, blocks.Child(blockKey(t, value)), value)
+	}
+	testPut(t, ctx, gd, ds.NewKey("/pins/a"), []byte(randomSeq(5000)))
+	testPut(t, ctx, gd, ds.NewKey("/version"), []byte("1"))
+	if err := gd.PutWithTTL(ctx, ds.NewKey("/pins/expired"), []byte("x"), time.Millisecond); err != nil {
+		t.Fatalf("PutWithTTL: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	stats, err := gd.RepoStats(ctx, "/")
+	if err != nil {
+		t.Fatalf("RepoStats: %v", err)
+	}
+	if stats.Keys != 5 || stats.Bytes != 5301 || stats.Blocks != 3 || stats.BlockBytes != 300 {
+		t.Errorf("RepoStats = %+v, expected 5 keys of 5301 bytes, 3 blocks of 300 bytes", stats)
+	}
+	if stats.Sizes[0].Count != 4 || stats.Sizes[2].Count != 1 {
+		t.Errorf("Sizes = %v", stats.Sizes)
+	}
+	expected := map[string]gcsds.Usage{
+		"/blocks": {Objects: 3, Bytes: 300},
+		"/pins":   {Objects: 1, Bytes: 5000},
+		"/":       {Objects: 1, Bytes: 1},
+	}
+	if !reflect.DeepEqual(stats.Namespaces, expected) {
+		t.Errorf("Namespaces = %v, expected %v", stats.Namespaces, expected)
+	}
+	var classes gcsds.Usage
+	for _, u := range stats.StorageClasses {
+		classes.Objects += u.Objects
+		classes.Bytes += u.Bytes
+	}
+	if classes != (gcsds.Usage{Objects: 5, Bytes: 5301}) {
+		t.Errorf("StorageClasses = %v", stats.StorageClasses)
+	}
+
+	stats, err = gd.RepoStats(ctx, "/pins")
+	if err != nil {
+		t.Fatalf("RepoStats(/pins): %v", err)
+	}
+	if expected := map[string]gcsds.Usage{"/pins": {Objects: 1, Bytes: 5000}}; !reflect.DeepEqual(stats.Namespaces, expected) {
+		t.Errorf("Namespaces under /pins = %v, expected %v", stats.Namespaces, expected)
+	}
+}
+
+func TestCopyRepo(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "copy" + randomKey().String(),
+		Workers:        10,
+		DataCacheItems: 1000,
+		PackBlocks:     true,
+		WriterLock:     true,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gd.Close()
+	values := map[ds.Key][]byte{ds.NewKey("/pins/a"): []byte("pin")}
+	for i := 0; i < 3; i++ {
+		value := []byte(randomSeq(100))
+		values[ds.NewKey("/blocks").Child(blockKey(t, value))] = value
+	}
+	for k, v := range values {
+		testPut(t, ctx, gd, k, v)
+	}
+
+	if _, err := gd.CopyRepo(ctx, gcsds.CopyOptions{Bucket: config.Bucket}); err == nil {
+		t.Error("CopyRepo copied the repo onto itself")
+	}
+	dest := config
+	dest.Prefix = "copied" + randomKey().String()
+	var tokens []string
+	n, err := gd.CopyRepo(ctx, gcsds.CopyOptions{
+		Bucket:   config.Bucket,
+		Prefix:   dest.Prefix,
+		Progress: func(copied int, token string) { tokens = append(tokens, token) },
+	})
+	if err != nil {
+		t.Fatalf("CopyRepo: %v", err)
+	}
+	// The pin, the packs of the blocks, and the layout.
+	if n < 3 || len(tokens) != 1 || tokens[0] != "" {
+		t.Errorf("CopyRepo copied %d objects, progress %q", n, tokens)
+	}
+
+	// The copy opens without the source's lock.
+	copied, err := gcsds.NewGCSDatastore(dest)
+	if err != nil {
+		t.Fatalf("Opening the copy: %v", err)
+	}
+	defer copied.Close()
+	if err := copied.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	for k, v := range values {
+		testPositive(t, ctx, copied, k, v)
+	}
+}
+
+func TestImportDatastore(t *testing.T) {
+	ctx := context.Background()
+	src, err := flatfs.CreateOrOpen(t.TempDir(), flatfs.NextToLast(2), false)
+	if err != nil {
+		t.Fatalf("flatfs: %v", err)
+	}
+	defer src.Close()
+	values := map[ds.Key][]byte{}
+	for i := 0; i < 20; i++ {
+		value := []byte(randomSeq(100 + i))
+		k := blockKey(t, value)
+		if err := src.Put(ctx, k, value); err != nil {
+			t.Fatalf("flatfs Put: %v", err)
+		}
+		values[ds.NewKey("/blocks").Child(k)] = value
+	}
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "import" + randomKey().String(),
+		Workers:        3,
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	opts := gcsds.ImportOptions{Prefix: "/blocks", Verify: true}
+	res, err := gd.ImportDatastore(ctx, src, opts)
+	if err != nil || res != (gcsds.ImportResult{Imported: 20, Verified: 20}) {
+		t.Fatalf("ImportDatastore = %+v, %v", res, err)
+	}
+	for k, v := range values {
+		testPositive(t, ctx, gd, k, v)
+	}
+
+	// Imported blocks are skipped, and verified again.
+	var missing ds.Key
+	for k := range values {
+		missing = k
+		break
+	}
+	if err := gd.BucketHandle().Object(gd.ObjectPath(missing)).Delete(ctx); err != nil {
+		t.Fatalf("Failed to delete object: %v", err)
+	}
+	res, err = gd.ImportDatastore(ctx, src, opts)
+	var berr *gcsds.BatchError
+	if !errors.As(err, &berr) || len(berr.Errors) != 1 || !errors.Is(berr.Errors[missing], ds.ErrNotFound) {
+		t.Errorf("ImportDatastore returned %v, expected %v missing", err, missing)
+	}
+	if res != (gcsds.ImportResult{Skipped: 20, Verified: 20}) {
+		t.Errorf("ImportDatastore = %+v", res)
+	}
+}
+
+func TestImportDatastoreNamespaces(t *testing.T) {
+	ctx := context.Background()
+	// The leveldb datastore of a kubo repo, in memory.
+	src, err := leveldb.NewDatastore("", nil)
+	if err != nil {
+		t.Fatalf("leveldb: %v", err)
+	}
+	defer src.Close()
+	values := map[ds.Key][]byte{
+		ds.NewKey("/pins/index/a"):    []byte("pin"),
+		ds.NewKey("/local/filesroot"): []byte("root"),
+		ds.NewKey("/blocks/CIQA"):     []byte("block"),
+	}
+	for k, v := range values {
+		if err := src.Put(ctx, k, v); err != nil {
+			t.Fatalf("leveldb Put: %v", err)
+		}
+	}
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "importns" + randomKey().String(),
+		Workers:        3,
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	res, err := gd.ImportDatastore(ctx, src, gcsds.ImportOptions{Prefix: "/", Verify: true})
+	if err != nil || res.Imported != len(values) {
+		t.Fatalf("ImportDatastore = %+v, %v", res, err)
+	}
+	for k, v := range values {
+		testPositive(t, ctx, gd, k, v)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:             getTestBucket(t),
+		Prefix:             "heartbeat" + randomKey().String(),
+		DataCacheItems:     1000,
+		Heartbeat:          true,
+		HeartbeatTTL:       300 * time.Millisecond,
+		ReadOnlyOnConflict: true,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+
+	// The node that started later backs off.
+	if !gd2.ReadOnly() {
+		t.Fatalf("Second writer not read-only")
+	}
+	if err := gd2.Put(ctx, randomKey(), []byte("value")); !errors.Is(err, gcsds.ErrReadOnly) {
+		t.Fatalf("Put on read-only datastore: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if gd.ReadOnly() {
+		t.Fatalf("First writer read-only")
+	}
+	testPut(t, ctx, gd, randomKey(), []byte("value"))
+	nodes, err := gd.Nodes(ctx)
+	if err != nil || len(nodes) != 2 {
+		t.Fatalf("Nodes returned %v, %v", nodes, err)
+	}
+
+	// Closing removes the heartbeat.
+	gd2.Close()
+	nodes, err = gd.Nodes(ctx)
+	if err != nil || len(nodes) != 1 || nodes[0].Mode != "writer" || !nodes[0].Live() {
+		t.Fatalf("Nodes returned %+v, %v", nodes, err)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	gerr := &googleapi.Error{
+		Code:   http.StatusServiceUnavailable,
+		Header: http.Header{"X-Guploader-Uploadid": {"upload-id"}},
+	}
+	if id := gcsds.RequestID(fmt.Errorf("wrapped: %w", gerr)); id != "upload-id" {
+		t.Fatalf("RequestID = %q, expected upload-id", id)
+	}
+	if id := gcsds.RequestID(errors.New("local error")); id != "" {
+		t.Fatalf("RequestID of a local error = %q", id)
+	}
+	err := error(&gcsds.RequestError{Op: "read", Object: "ipfs/key", RequestID: "upload-id", Err: gerr})
+	if !strings.Contains(err.Error(), "upload-id") || gcsds.RequestID(err) != "upload-id" {
+		t.Fatalf("Request ID missing from %v", err)
+	}
+	var unwrapped *googleapi.Error
+	if !errors.As(err, &unwrapped) || unwrapped.Code != http.StatusServiceUnavailable {
+		t.Fatalf("RequestError doesn't unwrap to the GCS error")
+	}
+}
+
+func TestTxn(t *testing.T) {
+	ctx := context.Background()
+	gd1 := GetGCSDatastore(t)
+	gd2 := GetGCSDatastore(t)
+	key := randomKey()
+
+	// Both read the missing key, the second commit conflicts.
+	txn1, _ := gd1.NewTransaction(ctx, false)
+	txn2, _ := gd2.NewTransaction(ctx, false)
+	for _, txn := range []ds.Txn{txn1, txn2} {
+		if has, err := txn.Has(ctx, key); has || err != nil {
+			t.Fatalf("Has in transaction: %v %v", has, err)
+		}
+	}
+	if err := txn1.Put(ctx, key, []byte("one")); err != nil {
+		t.Fatalf("Put in transaction: %v", err)
+	}
+	if value, err := txn1.Get(ctx, key); string(value) != "one" || err != nil {
+		t.Fatalf("Transaction doesn't see its write: %q %v", value, err)
+	}
+	if err := txn2.Put(ctx, key, []byte("two")); err != nil {
+		t.Fatalf("Put in transaction: %v", err)
+	}
+	if err := txn1.Commit(ctx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := txn2.Commit(ctx); !errors.Is(err, gcsds.ErrTxnConflict) {
+		t.Fatalf("Conflicting commit returned %v", err)
+	}
+	txn2.Discard(ctx)
+	testPositive(t, ctx, gd1, key, []byte("one"))
+
+	// A key only read is checked on commit too.
+	other := randomKey()
+	txn, _ := gd1.NewTransaction(ctx, false)
+	if value, err := txn.Get(ctx, key); string(value) != "one" || err != nil {
+		t.Fatalf("Get in transaction: %q %v", value, err)
+	}
+	txn.Put(ctx, other, []byte("other"))
+	testPut(t, ctx, gd2, key, []byte("changed"))
+	if err := txn.Commit(ctx); !errors.Is(err, gcsds.ErrTxnConflict) {
+		t.Fatalf("Commit after a read key changed returned %v", err)
+	}
+	if has, _ := gd2.Has(ctx, other); has {
+		t.Fatal("Conflicting transaction wrote")
+	}
+
+	// Deletes are conditional.
+	txn, _ = gd1.NewTransaction(ctx, false)
+	if err := txn.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete in transaction: %v", err)
+	}
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	testNegative(t, ctx, gd1, key)
+
+	txn, _ = gd1.NewTransaction(ctx, true)
+	if err := txn.Put(ctx, key, []byte("x")); err != gcsds.ErrTxnReadOnly {
+		t.Fatalf("Put in read-only transaction returned %v", err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	key := randomKey()
+	value := []byte(randomSeq(100))
+	if err := gd.PutWithTTL(ctx, key, value, time.Hour); err != nil {
+		t.Fatalf("PutWithTTL: %v", err)
+	}
+	testPositive(t, ctx, gd, key, value)
+	expiration, err := gd.GetExpiration(ctx, key)
+	if err != nil || time.Until(expiration) < 59*time.Minute || time.Until(expiration) > time.Hour {
+		t.Fatalf("GetExpiration returned %v %v, expected in an hour", expiration, err)
+	}
+	attrs, err := gd.BucketHandle().Object(gd.ObjectPath(key)).Attrs(ctx)
+	if err != nil {
+		t.Fatalf("Failed to stat object: %v", err)
+	}
+	if d := expiration.Sub(attrs.CustomTime); d < 0 || d >= time.Second {
+		t.Fatalf("CustomTime is %v, expected %v", attrs.CustomTime, expiration)
+	}
+
+	// Expired values are gone, also for a node without loaded metadata.
+	if err := gd.SetTTL(ctx, key, 100*time.Millisecond); err != nil {
+		t.Fatalf("SetTTL: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	testNegative(t, ctx, gd, key)
+	if _, err := GetGCSDatastore(t).Get(ctx, key); err != ds.ErrNotFound {
+		t.Fatalf("Get of expired value returned %v", err)
+	}
+	if err := gd.SetTTL(ctx, key, time.Hour); err != ds.ErrNotFound {
+		t.Fatalf("SetTTL of expired value returned %v", err)
+	}
+
+	// A plain Put clears the TTL.
+	testPut(t, ctx, gd, key, value)
+	if expiration, err := gd.GetExpiration(ctx, key); err != nil || !expiration.IsZero() {
+		t.Fatalf("GetExpiration after Put returned %v %v", expiration, err)
+	}
+}
+
+func TestLifecycleGC(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:            getTestBucket(t),
+		Prefix:            "lifecycle-" + randomSeq(8),
+		DataCacheItems:    1000,
+		EphemeralPrefixes: []string{"/cache"},
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	attrs := func(key ds.Key) *storage.ObjectAttrs {
+		attrs, err := gd.BucketHandle().Object(gd.ObjectPath(key)).Attrs(ctx)
+		if err != nil {
+			t.Fatalf("Failed to stat object of %s: %v", key, err)
+		}
+		return attrs
+	}
+	value := []byte(randomSeq(100))
+	ephemeral := ds.NewKey("/cache").Child(randomKey())
+	pinned := randomKey()
+	testPut(t, ctx, gd, ephemeral, value)
+	testPut(t, ctx, gd, pinned, value)
+	if a := attrs(ephemeral); time.Since(a.CustomTime) > time.Minute || a.Metadata["unpinned"] == "" {
+		t.Fatalf("Ephemeral value not marked unpinned: %v, %v", a.CustomTime, a.Metadata)
+	}
+	if a := attrs(pinned); !a.CustomTime.IsZero() {
+		t.Fatalf("Value marked unpinned on write: %v", a.CustomTime)
+	}
+
+	if err := gd.MarkUnpinned(ctx, []ds.Key{pinned}); err != nil {
+		t.Fatalf("MarkUnpinned: %v", err)
+	}
+	if a := attrs(pinned); time.Since(a.CustomTime) > time.Minute {
+		t.Fatalf("CustomTime is %v, expected now", a.CustomTime)
+	}
+	// Unpinned values are served until the lifecycle rule deletes them,
+	// also by nodes loading the metadata.
+	other, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer other.Close()
+	if err := other.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	testPositive(t, ctx, other, pinned, value)
+	testPositive(t, ctx, other, ephemeral, value)
+
+	if err := gd.MarkPinned(ctx, []ds.Key{pinned, ephemeral}); err != nil {
+		t.Fatalf("MarkPinned: %v", err)
+	}
+	for _, key := range []ds.Key{pinned, ephemeral} {
+		if a := attrs(key); !a.CustomTime.IsZero() || a.Metadata["unpinned"] != "" {
+			t.Fatalf("Value of %s still marked unpinned: %v, %v", key, a.CustomTime, a.Metadata)
+		}
+		testPositive(t, ctx, gd, key, value)
+	}
+
+	missing := randomKey()
+	var batchErr *gcsds.BatchError
+	if err := gd.MarkUnpinned(ctx, []ds.Key{pinned, missing}); !errors.As(err, &batchErr) ||
+		len(batchErr.Errors) != 1 || batchErr.Errors[missing] != ds.ErrNotFound {
+		t.Fatalf("MarkUnpinned of a missing key returned %v", err)
+	}
+}
+
+func TestHoldPinned(t *testing.T) {
+	ctx := context.Background()
+	gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "hold-" + randomSeq(8),
+		DataCacheItems: 1000,
+		HoldPinned:     true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	// The emulator ignores holds, so they're only checked against GCS.
+	emulator := os.Getenv("STORAGE_EMULATOR_HOST") != ""
+	held := func(key ds.Key, want bool) bool {
+		attrs, err := gd.BucketHandle().Object(gd.ObjectPath(key)).Attrs(ctx)
+		if err != nil {
+			t.Fatalf("Failed to stat object of %s: %v", key, err)
+		}
+		return emulator || attrs.EventBasedHold == want
+	}
+	value := []byte(randomSeq(100))
+	pinned, other := randomKey(), randomKey()
+	testPut(t, ctx, gd, pinned, value)
+	testPut(t, ctx, gd, other, value)
+
+	if err := gd.MarkPinned(ctx, []ds.Key{pinned}); err != nil {
+		t.Fatalf("MarkPinned: %v", err)
+	}
+	if !held(pinned, true) || !held(other, false) {
+		t.Fatalf("MarkPinned didn't hold only %s", pinned)
+	}
+	if err := gd.MarkUnpinned(ctx, []ds.Key{pinned}); err != nil {
+		t.Fatalf("MarkUnpinned: %v", err)
+	}
+	if !held(pinned, false) {
+		t.Fatalf("MarkUnpinned didn't release the hold of %s", pinned)
+	}
+
+	if err := gd.SetEventBasedHold(ctx, []ds.Key{other}, true); err != nil {
+		t.Fatalf("SetEventBasedHold: %v", err)
+	}
+	if !held(other, true) {
+		t.Fatalf("SetEventBasedHold didn't hold %s", other)
+	}
+	if err := gd.SetEventBasedHold(ctx, []ds.Key{other}, false); err != nil {
+		t.Fatalf("SetEventBasedHold: %v", err)
+	}
+	if !held(other, false) {
+		t.Fatalf("SetEventBasedHold didn't release %s", other)
+	}
+	testDelete(t, ctx, gd, other)
+
+	missing := randomKey()
+	var batchErr *gcsds.BatchError
+	if err := gd.SetEventBasedHold(ctx, []ds.Key{pinned, missing}, true); !errors.As(err, &batchErr) ||
+		len(batchErr.Errors) != 1 || batchErr.Errors[missing] != ds.ErrNotFound {
+		t.Fatalf("SetEventBasedHold of a missing key returned %v", err)
+	}
+	if err := gd.SetEventBasedHold(ctx, []ds.Key{pinned}, false); err != nil {
+		t.Fatalf("SetEventBasedHold: %v", err)
+	}
+}
+
+func TestTouchOnRead(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:            getTestBucket(t),
+		Prefix:            "touch-" + randomSeq(8),
+		DataCacheItems:    1000,
+		EphemeralPrefixes: []string{"/cache"},
+		TouchInterval:     100 * time.Millisecond,
+		TouchMaxPerSecond: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	attrs := func(key ds.Key) *storage.ObjectAttrs {
+		attrs, err := gd.BucketHandle().Object(gd.ObjectPath(key)).Attrs(ctx)
+		if err != nil {
+			t.Fatalf("Failed to stat object of %s: %v", key, err)
+		}
+		return attrs
+	}
+	value := []byte(randomSeq(100))
+	ephemeral := ds.NewKey("/cache").Child(randomKey())
+	pinned := randomKey()
+	expiring := ds.NewKey("/cache").Child(randomKey())
+	testPut(t, ctx, gd, ephemeral, value)
+	testPut(t, ctx, gd, pinned, value)
+	if err := gd.PutWithTTL(ctx, expiring, value, time.Hour); err != nil {
+		t.Fatalf("PutWithTTL: %v", err)
+	}
+	// The metadata records when values were marked more precisely than
+	// the CustomTime.
+	marked, expiration := attrs(ephemeral).Metadata["unpinned"], attrs(expiring).CustomTime
+
+	time.Sleep(200 * time.Millisecond)
+	for _, key := range []ds.Key{ephemeral, pinned, expiring} {
+		testPositive(t, ctx, gd, key, value)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for gd.Stats().Touches == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if touched := attrs(ephemeral).Metadata["unpinned"]; touched == marked {
+		t.Fatalf("Unpinned value marked at %s not marked again on read, at %s", marked, touched)
+	}
+	if !attrs(pinned).CustomTime.IsZero() || !attrs(expiring).CustomTime.Equal(expiration) {
+		t.Fatalf("CustomTime of pinned or expiring value changed on read")
+	}
+	if n := gd.Stats().Touches; n != 1 {
+		t.Fatalf("Touched %d values, expected 1", n)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	keys := []ds.Key{randomKey(), randomKey(), randomKey()}
+	for _, key := range keys {
+		testPut(t, ctx, gd, key, []byte(randomSeq(10)))
+	}
+	if err := gd.Check(ctx); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	// Delete an object behind the datastore's back.
+	if err := gd.BucketHandle().Object(gd.ObjectPath(keys[1])).Delete(ctx); err != nil {
+		t.Fatalf("Failed to delete object: %v", err)
+	}
+	if err := gd.Check(ctx); !errors.Is(err, gcsds.ErrInconsistent) {
+		t.Fatalf("Check of inconsistent cache returned %v", err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	ctx := context.Background()
+	for _, repair := range []bool{false, true} {
+		config := gcsds.Config{
+			Bucket:         getTestBucket(t),
+			Prefix:         "scrub-" + randomSeq(8),
+			DataCacheItems: 1000,
+			ScrubRepair:    repair,
+		}
+		gd, err := gcsds.NewGCSDatastore(config)
+		if err != nil {
+			t.Fatalf("Failed to create data store: %v", err)
+		}
+		defer gd.Close()
+		good := []byte(randomSeq(100))
+		goodKey := blockKey(t, good)
+		testPut(t, ctx, gd, goodKey, good)
+		orphan := randomKey()
+		testPut(t, ctx, gd, orphan, []byte("orphan"))
+
+		// Behind the datastore's back, store a block that doesn't match
+		// its key and delete a cached key.
+		badKey := blockKey(t, []byte(randomSeq(100)))
+		w := gd.BucketHandle().Object(gd.ObjectPath(badKey)).NewWriter(ctx)
+		w.Write([]byte("corrupt"))
+		if err := w.Close(); err != nil {
+			t.Fatalf("Failed to write object: %v", err)
+		}
+		if err := gd.BucketHandle().Object(gd.ObjectPath(orphan)).Delete(ctx); err != nil {
+			t.Fatalf("Failed to delete object: %v", err)
+		}
+
+		err = gd.Scrub(ctx)
+		if repair {
+			if err != nil {
+				t.Fatalf("Scrub with repair: %v", err)
+			}
+			testNegative(t, ctx, gd, badKey)
+		} else {
+			var cerr *gcsds.CorruptError
+			if !errors.As(err, &cerr) || len(cerr.Keys) != 1 || cerr.Keys[0] != badKey.String() {
+				t.Fatalf("Scrub returned %v, expected %v corrupt", err, badKey)
+			}
+			if has, _ := gd.Has(ctx, badKey); !has {
+				t.Fatal("Scrub didn't add the listed object to the cache")
+			}
+		}
+		if has, _ := gd.Has(ctx, orphan); has {
+			t.Fatal("Scrub didn't remove the orphaned cache entry")
+		}
+		testPositive(t, ctx, gd, goodKey, good)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "fsck-" + randomSeq(8),
+		DataCacheItems: 1000,
+		// The corrupt block is packed, and the large one in its own object.
+		PackBlocks:       true,
+		PackMaxValueSize: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	blocks := ds.NewKey("/blocks")
+	good := []byte(randomSeq(100))
+	goodKey := blocks.Child(blockKey(t, good))
+	testPut(t, ctx, gd, goodKey, good)
+	badKey := blocks.Child(blockKey(t, []byte(randomSeq(100))))
+	testPut(t, ctx, gd, badKey, []byte("corrupt"))
+	badObject := blocks.Child(blockKey(t, []byte(randomSeq(100))))
+	testPut(t, ctx, gd, badObject, []byte(randomSeq(2000)))
+	// Not a block.
+	testPut(t, ctx, gd, blocks.ChildString("other"), []byte("other"))
+
+	res, err := gd.Fsck(ctx, gcsds.FsckOptions{})
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	expected := []string{badKey.String(), badObject.String()}
+	sort.Strings(expected)
+	if res.Checked != 4 || !reflect.DeepEqual(res.Corrupt, expected) {
+		t.Fatalf("Fsck = %+v, expected 4 checked and %v corrupt", res, expected)
+	}
+	testPositive(t, ctx, gd, badKey, []byte("corrupt"))
+
+	if _, err := gd.Fsck(ctx, gcsds.FsckOptions{Quarantine: config.Prefix + "/quarantine"}); err == nil {
+		t.Error("Fsck accepted a quarantine within the prefix")
+	}
+	quarantine := "quarantine-" + randomSeq(8)
+	if _, err := gd.Fsck(ctx, gcsds.FsckOptions{Quarantine: quarantine}); err != nil {
+		t.Fatalf("Fsck with quarantine: %v", err)
+	}
+	for _, k := range []ds.Key{badKey, badObject} {
+		testNegative(t, ctx, gd, k)
+		if _, err := gd.BucketHandle().Object(quarantine + k.String()).Attrs(ctx); err != nil {
+			t.Errorf("%v not quarantined: %v", k, err)
+		}
+	}
+	testPositive(t, ctx, gd, goodKey, good)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "gc-" + randomSeq(8),
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.CollectGarbage(ctx); err != gcsds.ErrMetadataNotLoaded {
+		t.Fatalf("CollectGarbage before LoadMetadata returned %v", err)
+	}
+	kept, expiring := randomKey(), randomKey()
+	testPut(t, ctx, gd, kept, []byte("kept"))
+	if err := gd.PutWithTTL(ctx, expiring, []byte("expiring"), 100*time.Millisecond); err != nil {
+		t.Fatalf("PutWithTTL: %v", err)
+	}
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	// Written by another node after the load.
+	other := randomKey()
+	w := gd.BucketHandle().Object(gd.ObjectPath(other)).NewWriter(ctx)
+	w.Write([]byte("other"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to write object: %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if err := gd.CollectGarbage(ctx); err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	for key, want := range map[ds.Key]bool{kept: true, expiring: false, other: true} {
+		_, err := gd.BucketHandle().Object(gd.ObjectPath(key)).Attrs(ctx)
+		if exists := err == nil; exists != want {
+			t.Errorf("Object of %v exists: %v, expected %v", key, exists, want)
+		}
+	}
+}
+
+func TestQueryPagination(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	prefix := "/page-" + randomSeq(8)
+	keys := []string{}
+	for i := 0; i < 25; i++ {
+		key := ds.NewKey(prefix + randomKey().String())
+		testPut(t, ctx, gd, key, []byte("x"))
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	for _, desc := range []bool{false, true} {
+		q := dsq.Query{Prefix: prefix, KeysOnly: true, Limit: 10}
+		if desc {
+			q.Orders = []dsq.Order{dsq.OrderByKeyDescending{}}
+		}
+		paged := []string{}
+		for ; ; q.Offset += q.Limit {
+			results, err := gd.Query(ctx, q)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			entries, err := results.Rest()
+			if err != nil {
+				t.Fatalf("Query.Rest: %v", err)
+			}
+			for _, e := range entries {
+				paged = append(paged, e.Key)
+			}
+			if len(entries) < q.Limit {
+				break
+			}
+		}
+		want := append([]string{}, keys...)
+		if desc {
+			sort.Sort(sort.Reverse(sort.StringSlice(want)))
+		}
+		if strings.Join(paged, ",") != strings.Join(want, ",") {
+			t.Fatalf("Pages (descending: %v) returned %v, expected %v", desc, paged, want)
+		}
+	}
+}
+
+func TestGetReader(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	key := randomKey()
+	value := []byte(randomSeq(1 << 20))
+	testPut(t, ctx, gd, key, value)
+	// Bypass the data cache of the writer.
+	for _, gd := range []*gcsds.GCSDatastore{gd, GetGCSDatastore(t)} {
+		r, err := gd.GetReader(ctx, key)
+		if err != nil {
+			t.Fatalf("GetReader: %v", err)
+		}
+		read, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(read, value) {
+			t.Fatalf("GetReader read %d bytes (%v), expected %d", len(read), err, len(value))
+		}
+	}
+	if _, err := gd.GetReader(ctx, randomKey()); err != ds.ErrNotFound {
+		t.Fatalf("GetReader of missing key returned %v", err)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	key := randomKey()
+	value := []byte(randomSeq(1000))
+	testPut(t, ctx, gd, key, value)
+	// A datastore with loaded metadata reads without a stat.
+	loaded := GetGCSDatastore(t)
+	if err := loaded.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	for _, gd := range []*gcsds.GCSDatastore{gd, GetGCSDatastore(t), loaded} {
+		for _, r := range []struct{ offset, length int64 }{{0, 10}, {100, 200}, {990, 100}, {500, -1}, {1000, -1}} {
+			end := int64(len(value))
+			if r.length >= 0 && r.offset+r.length < end {
+				end = r.offset + r.length
+			}
+			got, err := gd.GetRange(ctx, key, r.offset, r.length)
+			if err != nil || !bytes.Equal(got, value[r.offset:end]) {
+				t.Fatalf("GetRange(%d, %d) returned %d bytes (%v), expected %d", r.offset, r.length, len(got), err, end-r.offset)
+			}
+		}
+		if _, err := gd.GetRange(ctx, key, 1001, 1); err == nil {
+			t.Fatal("GetRange beyond the value succeeded")
+		}
+	}
+}
+
+func TestNewGCSDatastoreContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs",
+		DataCacheItems: 1000,
+	}
+	if _, err := gcsds.NewGCSDatastoreContext(ctx, config); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Opening with a cancelled context returned %v", err)
+	}
+	gd, err := gcsds.NewGCSDatastoreContext(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Failed to create data store: %v", err)
+	}
+	if err := gd.LoadMetadataContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Loading with a cancelled context returned %v", err)
+	}
+}
+
+func TestStrictHas(t *testing.T) {
+	ctx := context.Background()
+	prefix := "stricthas-" + randomSeq(8)
+	open := func(strict bool, negativeTTL time.Duration) *gcsds.GCSDatastore {
+		gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+			Bucket:           getTestBucket(t),
+			Prefix:           prefix,
+			DataCacheItems:   1000,
+			StrictHas:        strict,
+			NegativeCacheTTL: negativeTTL,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create data store: %v", err)
+		}
+		t.Cleanup(func() { gd.Close() })
+		if err := gd.LoadMetadata(); err != nil {
+			t.Fatalf("LoadMetadata: %v", err)
+		}
+		return gd
+	}
+	has := func(gd *gcsds.GCSDatastore, key ds.Key) bool {
+		has, err := gd.Has(ctx, key)
+		if err != nil {
+			t.Fatalf("Has(%s): %v", key, err)
+		}
+		return has
+	}
+	lax, strict, negative := open(false, 0), open(true, 0), open(true, time.Hour)
+	key := randomKey()
+	if has(negative, key) {
+		t.Fatalf("Has(%s) = true before it was written", key)
+	}
+
+	// Another node writes the key after the metadata was loaded.
+	testPut(t, ctx, open(false, 0), key, []byte(randomSeq(100)))
+	if has(lax, key) {
+		t.Fatal("Has checked GCS without StrictHas")
+	}
+	if !has(strict, key) {
+		t.Fatal("Has with StrictHas didn't find a key written by another node")
+	}
+	if has(negative, key) {
+		t.Fatal("Has with NegativeCacheTTL forgot a miss")
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	ctx := context.Background()
+	open := func() *gcsds.GCSDatastore {
+		gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+			Bucket:         getTestBucket(t),
+			Prefix:         "ipfs",
+			DataCacheItems: 1000,
+			// Keep values out of the data cache, so Get asks GCS.
+			DataCacheMaxValueSize: 1,
+			NegativeCacheTTL:      time.Hour,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create data store: %v", err)
+		}
+		t.Cleanup(func() { gd.Close() })
+		return gd
+	}
+	gd := open()
+	key := randomKey()
+	if _, err := gd.Get(ctx, key); err != ds.ErrNotFound {
+		t.Fatalf("Get(%s) before it was written returned %v", key, err)
+	}
+
+	// Another node writes the key, which isn't seen for NegativeCacheTTL.
+	testPut(t, ctx, open(), key, []byte(randomSeq(100)))
+	if _, err := gd.Get(ctx, key); err != ds.ErrNotFound {
+		t.Fatalf("Get(%s) forgot a miss: %v", key, err)
+	}
+	if _, err := gd.GetSize(ctx, key); err != ds.ErrNotFound {
+		t.Fatalf("GetSize(%s) forgot a miss: %v", key, err)
+	}
+
+	// Writing the key forgets the miss.
+	value := []byte(randomSeq(100))
+	testPut(t, ctx, gd, key, value)
+	if v, err := gd.Get(ctx, key); err != nil || !bytes.Equal(v, value) {
+		t.Fatalf("Get(%s) after writing it returned %v", key, err)
+	}
+}
+
+func TestGetSizeUncached(t *testing.T) {
+	ctx := context.Background()
+	gd := GetGCSDatastore(t)
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	// Another node writes the key after the metadata was loaded.
+	key := randomKey()
+	value := []byte(randomSeq(100))
+	testPut(t, ctx, GetGCSDatastore(t), key, value)
+	if size, err := gd.GetSize(ctx, key); err != nil || size != len(value) {
+		t.Fatalf("GetSize(%s) = %d, %v. Expected %d", key, size, err, len(value))
+	}
+	if _, err := gd.GetSize(ctx, randomKey()); err != ds.ErrNotFound {
+		t.Fatalf("GetSize of a missing key returned %v", err)
+	}
+}
+
+func TestSkipExistingBlocks(t *testing.T) {
+	ctx := context.Background()
+	open := func() *gcsds.GCSDatastore {
+		gd, err := gcsds.NewGCSDatastore(gcsds.Config{
+			Bucket:             getTestBucket(t),
+			Prefix:             "ipfs",
+			DataCacheItems:     1000,
+			SkipExistingBlocks: true,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create data store: %v", err)
+		}
+		t.Cleanup(func() { gd.Close() })
+		return gd
+	}
+	gd := open()
+	generation := func(key ds.Key) int64 {
+		attrs, err := gd.BucketHandle().Object(gd.ObjectPath(key)).Attrs(ctx)
+		if err != nil {
+			t.Fatalf("Attrs(%s): %v", key, err)
+		}
+		return attrs.Generation
+	}
+	value := []byte(randomSeq(100))
+	key := blockKey(t, value)
+	testPut(t, ctx, gd, key, value)
+	gen := generation(key)
+	// Known to the metadata cache.
+	testPut(t, ctx, gd, key, value)
+	// Unknown to the metadata cache, so the write fails its precondition.
+	other := open()
+	testPut(t, ctx, other, key, value)
+	if generation(key) != gen {
+		t.Fatal("Existing block uploaded again")
+	}
+	if skipped := gd.Stats().SkippedWrites + other.Stats().SkippedWrites; skipped != 2 {
+		t.Fatalf("%d writes skipped. Expected 2.", skipped)
+	}
+	testPositive(t, ctx, other, key, value)
+
+	// Keys that aren't blocks are overwritten.
+	key = randomKey()
+	testPut(t, ctx, gd, key, value)
+	gen = generation(key)
+	testPut(t, ctx, gd, key, value)
+	if generation(key) == gen {
+		t.Fatal("Value not uploaded again")
+	}
+}
+
+func TestLazyMetadata(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "lazy" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	keys := []ds.Key{ds.NewKey("/a"), ds.NewKey("/b/1"), ds.NewKey("/b/2")}
+	for _, key := range keys {
+		testPut(t, ctx, gd, key, []byte("value"))
+	}
+
+	config.LazyMetadata = true
+	lazy, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer lazy.Close()
+	for _, key := range keys {
+		testPositive(t, ctx, lazy, key, []byte("value"))
+	}
+	testNegative(t, ctx, lazy, ds.NewKey("/c"))
+	// Queries list GCS, and include the keys written through the
+	// datastore once.
+	testPut(t, ctx, lazy, ds.NewKey("/b/3"), []byte("value"))
+	for _, q := range []struct {
+		query dsq.Query
+		keys  []string
+	}{
+		{dsq.Query{KeysOnly: true}, []string{"/a", "/b/1", "/b/2", "/b/3"}},
+		{dsq.Query{Prefix: "/b", Orders: []dsq.Order{dsq.OrderByKeyDescending{}}, Limit: 2}, []string{"/b/3", "/b/2"}},
+	} {
+		res, err := lazy.Query(ctx, q.query)
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			t.Fatalf("Rest: %v", err)
+		}
+		got := []string{}
+		for _, e := range entries {
+			got = append(got, e.Key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(q.keys) {
+			t.Fatalf("Query(%v) returned %v, expected %v", q.query, got, q.keys)
+		}
+	}
+}
+
+func TestMetadataSnapshot(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:           getTestBucket(t),
+		Prefix:           "snapshot" + randomKey().String(),
+		DataCacheItems:   1000,
+		MetadataSnapshot: true,
+	}
+	gd1, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	if err := gd1.LoadMetadataSnapshot(ctx); err != storage.ErrObjectNotExist {
+		t.Fatalf("LoadMetadataSnapshot without snapshot: %v", err)
+	}
+	if err := gd1.SaveMetadataSnapshot(ctx); err == nil {
+		t.Errorf("SaveMetadataSnapshot before LoadMetadata succeeded")
+	}
+	if err := gd1.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	kept, deleted, added := randomKey(), randomKey(), randomKey()
+	testPut(t, ctx, gd1, kept, []byte("kept"))
+	testPut(t, ctx, gd1, deleted, []byte("deleted"))
+	if err := gd1.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	defer gd1.BucketHandle().Object(strings.TrimSuffix(config.Prefix, "/") + ".metadata").Delete(ctx)
+
+	// Another node changes the bucket after the snapshot.
+	other := config
+	other.MetadataSnapshot = false
+	gd2, err := gcsds.NewGCSDatastore(other)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd2.Close()
+	testDelete(t, ctx, gd2, deleted)
+	testPut(t, ctx, gd2, added, []byte("added"))
+
+	gd3, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd3.Close()
+	if err := gd3.LoadMetadataSnapshot(ctx); err != nil {
+		t.Fatalf("LoadMetadataSnapshot: %v", err)
+	}
+	if size, err := gd3.GetSize(ctx, kept); err != nil || size != 4 {
+		t.Errorf("GetSize(kept) from snapshot = %d, %v", size, err)
+	}
+	gd3.LoadMetadataInBackground()
+	if has, err := gd3.Has(ctx, added); err != nil || !has {
+		t.Errorf("Has(added) while loading = %v, %v", has, err)
+	}
+	// Query waits for the load, which reconciles the snapshot.
+	res, err := gd3.Query(ctx, dsq.Query{KeysOnly: true})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Key)
+	}
+	sort.Strings(got)
+	expected := []string{kept.String(), added.String()}
+	sort.Strings(expected)
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Query returned %v, expected %v", got, expected)
+	}
+	if has, err := gd3.Has(ctx, deleted); err != nil || has {
+		t.Errorf("Has(deleted) after load = %v, %v", has, err)
+	}
+}
+
+func TestRefreshMetadata(t *testing.T) {
+	ctx := context.Background()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "refresh" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	gd1, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd1.Close()
+	if err := gd1.RefreshMetadata(ctx); err == nil {
+		t.Errorf("RefreshMetadata before LoadMetadata succeeded")
+	}
+	kept, deleted, added := randomKey(), randomKey(), randomKey()
+	testPut(t, ctx, gd1, kept, []byte("kept"))
+	testPut(t, ctx, gd1, deleted, []byte("deleted"))
+	if err := gd1.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+
+	// Another node changes the bucket.
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd2.Close()
+	testDelete(t, ctx, gd2, deleted)
+	testPut(t, ctx, gd2, added, []byte("added"))
+	if has, err := gd1.Has(ctx, added); err != nil || has {
+		t.Errorf("Has(added) before refresh = %v, %v", has, err)
+	}
+
+	if err := gd1.RefreshMetadata(ctx); err != nil {
+		t.Fatalf("RefreshMetadata: %v", err)
+	}
+	for key, expected := range map[ds.Key]bool{kept: true, deleted: false, added: true} {
+		if has, err := gd1.Has(ctx, key); err != nil || has != expected {
+			t.Errorf("Has(%s) after refresh = %v, %v, expected %v", key, has, err, expected)
+		}
+	}
+	if size, err := gd1.GetSize(ctx, added); err != nil || size != 5 {
+		t.Errorf("GetSize(added) after refresh = %d, %v", size, err)
+	}
 }
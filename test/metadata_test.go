@@ -104,16 +104,20 @@ func TestIteratorTwoEntries(t *testing.T) {
 	}
 }
 
-// Offset not supported yet.
-// func TestIteratorOffset(t *testing.T) {
-//	md := metadataCacheWithEntries()
-//	it := md.Iterator("", 0)
-//	entries := getEntries(it)
-//	expected := md.Size() - 1
-//	if len(entries) != expected {
-//		t.Fatalf("Expected %d entries. Got: %d", expected, len(entries))
-//	}
-//}
+func TestIteratorOrder(t *testing.T) {
+	md := metadataCacheWithEntries()
+	for i := 0; i < 100; i++ {
+		md.Put(randomKey().String(), 1)
+	}
+	it := md.Iterator("", 0)
+	last := ""
+	for m := it(); m != nil; m = it() {
+		if m.Key <= last {
+			t.Fatalf("Key %v after %v", m.Key, last)
+		}
+		last = m.Key
+	}
+}
 
 func TestIteratorPrefix(t *testing.T) {
 	md := metadataCacheWithEntries()
@@ -134,3 +138,66 @@ func TestIteratorLimit(t *testing.T) {
 		t.Fatalf("Expected %d entries. Got: %d", expected, len(entries))
 	}
 }
+
+func TestBytes(t *testing.T) {
+	md := metadataCacheWithEntries()
+	expected := int64(1001 + 1002 + 1003)
+	if md.Bytes() != expected {
+		t.Fatalf("Expected %d bytes. Got: %d", expected, md.Bytes())
+	}
+	key := randomKey().String()
+	md.Put(key, 10)
+	md.Put(key, 20)
+	if md.Bytes() != expected+20 {
+		t.Fatalf("Expected %d bytes after overwrite. Got: %d", expected+20, md.Bytes())
+	}
+	md.Delete(key)
+	md.Delete(key)
+	if md.Bytes() != expected {
+		t.Fatalf("Expected %d bytes after delete. Got: %d", expected, md.Bytes())
+	}
+}
+
+func TestPrefixUsage(t *testing.T) {
+	md := metadataCacheWithEntries()
+	md.TrackPrefix("A")
+	u := md.PrefixUsage("A")
+	if u.Objects != 2 || u.Bytes != 1001+1002 {
+		t.Fatalf("Wrong usage for prefix A: %+v", u)
+	}
+	key := "A" + randomKey().String()
+	md.Put(key, 10)
+	md.Put("B"+randomKey().String(), 10)
+	u = md.PrefixUsage("A")
+	if u.Objects != 3 || u.Bytes != 1001+1002+10 {
+		t.Fatalf("Wrong usage for prefix A after Put: %+v", u)
+	}
+	md.Delete(key)
+	u = md.PrefixUsage("A")
+	if u.Objects != 2 || u.Bytes != 1001+1002 {
+		t.Fatalf("Wrong usage for prefix A after Delete: %+v", u)
+	}
+}
+
+func TestLoadEntry(t *testing.T) {
+	md := gcsds.NewMetadataCache()
+	md.StartLoading()
+	md.Put("/written", 10)
+	md.Delete("/deleted")
+	for _, key := range []string{"/written", "/deleted", "/listed"} {
+		md.LoadEntry(gcsds.Metadata{Key: key, Size: 1})
+	}
+	md.DoneLoading()
+	if m, err := md.Get("/written"); err != nil || m.Size != 10 {
+		t.Errorf("Listing overwrote a newer entry: %v %v", m, err)
+	}
+	if md.Has("/deleted") {
+		t.Errorf("Listing restored a deleted entry")
+	}
+	if !md.Has("/listed") {
+		t.Errorf("Listed entry missing")
+	}
+	if md.Bytes() != 11 {
+		t.Errorf("Expected 11 bytes. Got: %d", md.Bytes())
+	}
+}
@@ -0,0 +1,134 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// fakePubSub serves the pull and acknowledge requests of a subscription,
+// like the Pub/Sub emulator.
+type fakePubSub struct {
+	messages chan map[string]string
+	mu       sync.Mutex
+	acked    int
+}
+
+func (f *fakePubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, ":pull"):
+		var received []map[string]interface{}
+		select {
+		case attrs := <-f.messages:
+			received = append(received, map[string]interface{}{
+				"ackId":   attrs["objectId"],
+				"message": map[string]interface{}{"attributes": attrs},
+			})
+		case <-time.After(100 * time.Millisecond):
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"receivedMessages": received})
+	case strings.HasSuffix(r.URL.Path, ":acknowledge"):
+		var req struct{ AckIds []string }
+		json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		f.acked += len(req.AckIds)
+		f.mu.Unlock()
+		w.Write([]byte("{}"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakePubSub) ackedCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.acked
+}
+
+func TestNotifications(t *testing.T) {
+	ctx := context.Background()
+	pubsub := &fakePubSub{messages: make(chan map[string]string, 10)}
+	server := httptest.NewServer(pubsub)
+	defer server.Close()
+	t.Setenv("PUBSUB_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "notify" + randomKey().String(),
+		DataCacheItems: 1000,
+	}
+	other, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer other.Close()
+	deleted, added := randomKey(), randomKey()
+	testPut(t, ctx, other, deleted, []byte("deleted"))
+
+	config.NotificationSubscription = "projects/test/subscriptions/notify"
+	gd, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd.Close()
+	if err := gd.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+
+	// Another node changes the bucket, and the bucket notifies it.
+	testDelete(t, ctx, other, deleted)
+	testPut(t, ctx, other, added, []byte("added"))
+	notify := func(bucket string, key ds.Key, event string) {
+		pubsub.messages <- map[string]string{
+			"bucketId":  bucket,
+			"objectId":  other.ObjectPath(key),
+			"eventType": event,
+		}
+	}
+	notify(config.Bucket, deleted, "OBJECT_DELETE")
+	notify(config.Bucket, added, "OBJECT_FINALIZE")
+	notify("otherbucket", randomKey(), "OBJECT_FINALIZE")
+	pubsub.messages <- map[string]string{
+		"bucketId":  config.Bucket,
+		"objectId":  config.Prefix + ".lock",
+		"eventType": "OBJECT_FINALIZE",
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for pubsub.ackedCount() < 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d notifications acknowledged", pubsub.ackedCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if has, err := gd.Has(ctx, added); err != nil || !has {
+		t.Errorf("Has(added) = %v, %v", has, err)
+	}
+	if has, err := gd.Has(ctx, deleted); err != nil || has {
+		t.Errorf("Has(deleted) = %v, %v", has, err)
+	}
+	if st := gd.Stats(); st.Notifications != 2 || st.NotificationErrors != 0 {
+		t.Errorf("Stats: %d notifications, %d errors", st.Notifications, st.NotificationErrors)
+	}
+}
@@ -0,0 +1,71 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ipfs-shipyard/go-ds-gcs/plugin"
+)
+
+func TestPluginConfig(t *testing.T) {
+	parse := plugin.GCSPlugin{}.DatastoreConfigParser()
+	spec := func(extra map[string]interface{}) map[string]interface{} {
+		m := map[string]interface{}{
+			"type":    "gcsds",
+			"bucket":  "my-bucket",
+			"prefix":  "ipfs/",
+			"workers": 10.0,
+			"quotas":  []interface{}{map[string]interface{}{"prefix": "/tenant1", "maxbytes": 1000.0}},
+		}
+		for k, v := range extra {
+			m[k] = v
+		}
+		return m
+	}
+	if _, err := parse(spec(nil)); err != nil {
+		t.Fatalf("Failed to parse a valid config: %v", err)
+	}
+	for _, tc := range []struct {
+		extra map[string]interface{}
+		want  string
+	}{
+		{map[string]interface{}{"createBucket": true}, `unknown options "createBucket" (did you mean "createbucket"?)`},
+		{map[string]interface{}{"wrokers": 10.0, "frobnicate": true}, `unknown options "frobnicate", "wrokers" (did you mean "workers"?)`},
+		{map[string]interface{}{"quotas": []interface{}{map[string]interface{}{"prefix": "/t", "maxbyte": 1.0}}}, `quotas entry: unknown options "maxbyte" (did you mean "maxbytes"?)`},
+		{map[string]interface{}{"prefix": 42.0}, "prefix not a string"},
+		{map[string]interface{}{"bucket": true}, "bucket not a string"},
+		{map[string]interface{}{"bucket": ""}, "no bucket specified"},
+		{map[string]interface{}{"bucket": "My_Bucket"}, "only lowercase letters"},
+		{map[string]interface{}{"bucket": "ab"}, "not 3 to 222 characters long"},
+		{map[string]interface{}{"bucket": "-bucket"}, "start and end with a letter or digit"},
+		{map[string]interface{}{"bucket": "192.168.1.1"}, "an IP address"},
+		{map[string]interface{}{"bucket": "google-blocks"}, "contains google"},
+		{map[string]interface{}{"mirrorbucket": "Mirror"}, "mirrorbucket"},
+		{map[string]interface{}{"prefix": "ipfs/../other/"}, "contains a .. segment"},
+		{map[string]interface{}{"prefix": "ipfs\n"}, "control characters"},
+		{map[string]interface{}{"prefix": "ipfs\xff"}, "not valid UTF-8"},
+		{map[string]interface{}{"workers": "10"}, "workers not a number"},
+		{map[string]interface{}{"workers": 2.7}, "workers not an integer"},
+		{map[string]interface{}{"packsize": 1e20}, "packsize not an integer"},
+		{map[string]interface{}{"quotas": []interface{}{map[string]interface{}{"prefix": "/t", "maxbytes": 1.5}}}, "maxbytes not an integer"},
+	} {
+		_, err := parse(spec(tc.extra))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Parsing with %v returned %v, expected an error containing %q", tc.extra, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+)
+
+// fakeRedis serves GET, SET and DEL from a map.
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	fr := &fakeRedis{values: map[string][]byte{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr, l.Addr().String()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var size int
+			if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+				return
+			}
+			arg := make([]byte, size+2)
+			if _, err := io.ReadFull(r, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:size])
+		}
+		fr.mu.Lock()
+		switch args[0] {
+		case "GET":
+			if v, ok := fr.values[args[1]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case "SET":
+			fr.values[args[1]] = []byte(args[2])
+			fmt.Fprint(conn, "+OK\r\n")
+		case "DEL":
+			deleted := 0
+			if _, ok := fr.values[args[1]]; ok {
+				deleted = 1
+			}
+			delete(fr.values, args[1])
+			fmt.Fprintf(conn, ":%d\r\n", deleted)
+		default:
+			fmt.Fprint(conn, "-ERR unknown command\r\n")
+		}
+		fr.mu.Unlock()
+	}
+}
+
+func (fr *fakeRedis) len() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return len(fr.values)
+}
+
+func TestSharedCache(t *testing.T) {
+	ctx := context.Background()
+	fr, addr := startFakeRedis(t)
+	cache := gcsds.NewRedisCache(addr, time.Hour)
+	defer cache.Close()
+	config := gcsds.Config{
+		Bucket:         getTestBucket(t),
+		Prefix:         "ipfs",
+		DataCacheItems: 1000,
+		SharedCache:    cache,
+	}
+	gd1, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd1.Close()
+	gd2, err := gcsds.NewGCSDatastore(config)
+	if err != nil {
+		t.Fatalf("NewGCSDatastore: %v", err)
+	}
+	defer gd2.Close()
+
+	key := randomKey()
+	value := []byte(randomSeq(1000))
+	testPut(t, ctx, gd1, key, value)
+	if fr.len() != 1 {
+		t.Fatalf("Put didn't fill the shared cache")
+	}
+	// Served from the shared cache even with the object gone from GCS.
+	if err := gd1.BucketHandle().Object(gd1.ObjectPath(key)).Delete(ctx); err != nil {
+		t.Fatalf("Delete object: %v", err)
+	}
+	got, err := gd2.Get(ctx, key)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("Get(%s) = %d bytes, %v", key, len(got), err)
+	}
+	if st := gd2.Stats(); st.SharedCacheHits != 1 || st.SharedCacheErrors != 0 {
+		t.Errorf("Unexpected stats: hits %d errors %d", st.SharedCacheHits, st.SharedCacheErrors)
+	}
+
+	testDelete(t, ctx, gd1, key)
+	if fr.len() != 0 {
+		t.Errorf("Delete didn't invalidate the shared cache")
+	}
+	missing := randomKey()
+	if _, err := gd2.Get(ctx, missing); err == nil {
+		t.Errorf("Get(%s) of missing key succeeded", missing)
+	}
+	if st := gd2.Stats(); st.SharedCacheMisses != 1 {
+		t.Errorf("Expected 1 miss, got %d", st.SharedCacheMisses)
+	}
+}
@@ -0,0 +1,56 @@
+package test
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"errors"
+	"testing"
+
+	gcsds "github.com/ipfs-shipyard/go-ds-gcs"
+	"github.com/ipfs/boxo/datastore/dshelp"
+	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func blockKey(t *testing.T, value []byte) ds.Key {
+	hash, err := mh.Sum(value, mh.SHA2_256, -1)
+	if err != nil {
+		t.Fatalf("Failed to hash value: %v", err)
+	}
+	return dshelp.MultihashToDsKey(hash)
+}
+
+func TestVerifyMultihash(t *testing.T) {
+	value := []byte(randomSeq(100))
+	key := blockKey(t, value)
+	if err := gcsds.VerifyMultihash(key, value); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Blocks mounted below a namespace verify too.
+	if err := gcsds.VerifyMultihash(ds.NewKey("/blocks").Child(key), value); err != nil {
+		t.Fatalf("Unexpected error for namespaced key: %v", err)
+	}
+	err := gcsds.VerifyMultihash(key, []byte(randomSeq(100)))
+	if !errors.Is(err, gcsds.ErrHashMismatch) {
+		t.Fatalf("Expected ErrHashMismatch. Got: %v", err)
+	}
+}
+
+func TestVerifyMultihashNotABlock(t *testing.T) {
+	key := ds.NewKey("/local/pins")
+	if err := gcsds.VerifyMultihash(key, []byte(randomSeq(100))); err != nil {
+		t.Fatalf("Non-block key failed verification: %v", err)
+	}
+}
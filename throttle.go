@@ -0,0 +1,161 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// throttle limits the rate and concurrency of GCS requests, so that bursts
+// of work don't exceed the project's quotas and get 429 responses.
+type throttle struct {
+	// slots holds a token per request in flight, if limited.
+	slots chan struct{}
+	// interval is the time between requests, if limited. next is when the
+	// next request may start.
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+	// delayed counts the requests that had to wait.
+	delayed atomic.Int64
+}
+
+// newThrottle returns the throttle configured by cfg, or nil if requests
+// aren't limited.
+func newThrottle(cfg Config) *throttle {
+	if cfg.MaxRequestsPerSecond <= 0 && cfg.MaxConcurrentRequests <= 0 {
+		return nil
+	}
+	t := &throttle{}
+	if cfg.MaxRequestsPerSecond > 0 {
+		t.interval = time.Duration(float64(time.Second) / cfg.MaxRequestsPerSecond)
+	}
+	if cfg.MaxConcurrentRequests > 0 {
+		t.slots = make(chan struct{}, cfg.MaxConcurrentRequests)
+	}
+	return t
+}
+
+// wait waits until a request may start. Call release when it's done,
+// unless wait failed.
+func (t *throttle) wait(ctx context.Context) error {
+	waited := false
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+		default:
+			waited = true
+			select {
+			case t.slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	if t.interval > 0 {
+		t.mu.Lock()
+		now := time.Now()
+		if t.next.Before(now) {
+			t.next = now
+		}
+		delay := t.next.Sub(now)
+		t.next = t.next.Add(t.interval)
+		t.mu.Unlock()
+		if delay > 0 {
+			waited = true
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				t.release()
+				return ctx.Err()
+			}
+		}
+	}
+	if waited {
+		t.delayed.Add(1)
+	}
+	return nil
+}
+
+// throttled returns the number of requests delayed by t.
+func (t *throttle) throttled() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.delayed.Load()
+}
+
+// release ends a request started after wait.
+func (t *throttle) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// transport returns base, throttled by t. A request is in flight until its
+// response body is closed.
+func (t *throttle) transport(base http.RoundTripper) http.RoundTripper {
+	return &throttledTransport{base: base, t: t}
+}
+
+// httpClient returns an HTTP client configured by opts whose requests are
+// throttled by t.
+func (t *throttle) httpClient(ctx context.Context, opts ...option.ClientOption) (*http.Client, error) {
+	trans, err := htransport.NewTransport(ctx, t.transport(http.DefaultTransport), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: trans}, nil
+}
+
+type throttledTransport struct {
+	base http.RoundTripper
+	t    *throttle
+}
+
+func (tt *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := tt.t.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := tt.base.RoundTrip(req)
+	if err != nil {
+		tt.t.release()
+		return nil, err
+	}
+	resp.Body = &throttledBody{ReadCloser: resp.Body, t: tt.t}
+	return resp, nil
+}
+
+// throttledBody releases the request of a response when closed.
+type throttledBody struct {
+	io.ReadCloser
+	t    *throttle
+	once sync.Once
+}
+
+func (b *throttledBody) Close() error {
+	b.once.Do(b.t.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,125 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/storage"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// DefaultTouchMaxPerSecond is the default of Config.TouchMaxPerSecond.
+	DefaultTouchMaxPerSecond = 10
+	// touchCacheItems bounds the keys remembered as recently touched.
+	touchCacheItems = 100000
+	// touchQueueSize bounds the touches waiting for their turn. Reads
+	// beyond it don't touch.
+	touchQueueSize = 1000
+)
+
+// toucher refreshes the CustomTime of unpinned values as they are read,
+// see Config.TouchInterval.
+type toucher struct {
+	// touched holds when keys were last queued.
+	touched *lru.Cache
+	queue   chan string
+}
+
+// startTouching starts refreshing the CustomTime of values read, with
+// TouchInterval.
+func (gd *GCSDatastore) startTouching() error {
+	if gd.Config.TouchInterval <= 0 {
+		return nil
+	}
+	touched, err := lru.New(touchCacheItems)
+	if err != nil {
+		return err
+	}
+	gd.toucher = &toucher{touched: touched, queue: make(chan string, touchQueueSize)}
+	rate := gd.Config.TouchMaxPerSecond
+	if rate <= 0 {
+		rate = DefaultTouchMaxPerSecond
+	}
+	gd.background(func(ctx context.Context) {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		for {
+			select {
+			case key := <-gd.toucher.queue:
+				gd.touch(ctx, key)
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// touchOnRead queues the refresh of the CustomTime of key, which was just
+// read, unless it was queued less than TouchInterval ago or the queue is
+// full.
+func (gd *GCSDatastore) touchOnRead(key string) {
+	t := gd.toucher
+	if t == nil {
+		return
+	}
+	if last, ok := t.touched.Get(key); ok && time.Since(last.(time.Time)) < gd.Config.TouchInterval {
+		return
+	}
+	select {
+	case t.queue <- key:
+		t.touched.Add(key, time.Now())
+	default:
+		gd.stats.droppedTouches.Add(1)
+	}
+}
+
+// touch sets the CustomTime of the object of key to now if the value is
+// marked unpinned, and the CustomTime is older than TouchInterval. The
+// CustomTime of values with a TTL is their expiration, which is left
+// alone.
+func (gd *GCSDatastore) touch(ctx context.Context, key string) {
+	if _, ok := gd.packs.lookup(key); ok {
+		return
+	}
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key))
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return
+	}
+	if err != nil {
+		logger.Warnw("Failed to touch value", "key", key, "err", requestError("stat", obj.ObjectName(), err))
+		return
+	}
+	if !unpinned(attrs) || time.Since(attrs.CustomTime) < gd.Config.TouchInterval {
+		return
+	}
+	if _, ok := attrs.Metadata[expirationMetadataKey]; ok {
+		return
+	}
+	if err := gd.stampUnpinned(ctx, obj, attrs); err != nil {
+		logger.Warnw("Failed to touch value", "key", key, "err", err)
+		return
+	}
+	gd.stats.touches.Add(1)
+}
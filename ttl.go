@@ -0,0 +1,214 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+)
+
+var _ ds.TTLDatastore = (*GCSDatastore)(nil)
+
+// expirationMetadataKey is the object metadata key holding the time after
+// which a value expires, in RFC 3339 format.
+const expirationMetadataKey = "expiration"
+
+// objectExpiration returns when the value stored in an object expires, or
+// the zero time if it doesn't. The expiration recorded in the object's
+// metadata takes precedence over its CustomTime, which lifecycle rules can
+// act on but which can only move forward, and which is no expiration for
+// unpinned values.
+func objectExpiration(attrs *storage.ObjectAttrs) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, attrs.Metadata[expirationMetadataKey]); err == nil {
+		return t
+	}
+	if unpinned(attrs) {
+		return time.Time{}
+	}
+	return attrs.CustomTime
+}
+
+// expired reports whether a value expiring at t has expired.
+func expired(t time.Time) bool {
+	return !t.IsZero() && time.Now().After(t)
+}
+
+// expired reports whether the value of key is known to have expired.
+func (gd *GCSDatastore) expired(key string) bool {
+	md, err := gd.mdCache.Get(key)
+	return err == nil && expired(md.Expiration)
+}
+
+// cacheExpiration records the expiration of key in the metadata cache.
+func (gd *GCSDatastore) cacheExpiration(key string, t time.Time) {
+	if md, err := gd.mdCache.Get(key); err == nil {
+		md.Expiration = t
+		gd.mdCache.PutEntry(*md)
+	}
+}
+
+// unexpired returns the entries from next that haven't expired, skipping
+// the first offset of them and up to limit unless it's 0.
+func unexpired(next func() *Metadata, offset, limit int) func() *Metadata {
+	n := 0
+	return func() *Metadata {
+		if limit > 0 && n == offset+limit {
+			return nil
+		}
+		for m := next(); m != nil; m = next() {
+			if expired(m.Expiration) {
+				continue
+			}
+			if n++; n > offset {
+				return m
+			}
+		}
+		return nil
+	}
+}
+
+// PutWithTTL stores value under k until ttl from now. Expired values are
+// neither returned nor listed, but stay in the bucket until deleted, see
+// Config.TTLLifecycle. Unlike Put, PutWithTTL always returns once the value
+// is stored in GCS.
+func (gd *GCSDatastore) PutWithTTL(ctx context.Context, k ds.Key, value []byte, ttl time.Duration) error {
+	return gd.put(ctx, k, value, time.Now().Add(ttl))
+}
+
+// SetTTL makes the value of k expire ttl from now.
+func (gd *GCSDatastore) SetTTL(ctx context.Context, k ds.Key, ttl time.Duration) error {
+	if err := gd.checkWritable(); err != nil {
+		return err
+	}
+	key := k.String()
+	if err := gd.flushKey(ctx, key); err != nil {
+		return err
+	}
+	expiration := time.Now().Add(ttl)
+	if loc, ok := gd.packs.lookup(key); ok {
+		// Packs can't hold a TTL, so the value moves to an object.
+		value, err := gd.readPacked(ctx, key, loc)
+		if err != nil {
+			return err
+		}
+		if err := gd.writeObject(ctx, key, value, expiration); err != nil {
+			return requestError("write", gd.GCSPath(key), err)
+		}
+		gd.cacheExpiration(key, expiration)
+		return nil
+	}
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key))
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return ds.ErrNotFound
+	}
+	if err != nil {
+		return requestError("stat", obj.ObjectName(), err)
+	}
+	if expired(objectExpiration(attrs)) {
+		return ds.ErrNotFound
+	}
+	update := storage.ObjectAttrsToUpdate{Metadata: map[string]string{}}
+	for k, v := range attrs.Metadata {
+		update.Metadata[k] = v
+	}
+	update.Metadata[expirationMetadataKey] = expiration.UTC().Format(time.RFC3339Nano)
+	if expiration.After(attrs.CustomTime) {
+		update.CustomTime = expiration
+	}
+	// Don't set the TTL of a value written in the meantime.
+	_, err = obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).Update(ctx, update)
+	if err != nil {
+		return requestError("update", obj.ObjectName(), err)
+	}
+	gd.cacheExpiration(key, expiration)
+	return nil
+}
+
+// GetExpiration returns when the value of k expires, or the zero time if
+// it doesn't.
+func (gd *GCSDatastore) GetExpiration(ctx context.Context, k ds.Key) (time.Time, error) {
+	md, err := gd.mdCache.Get(k.String())
+	if err != nil && gd.metadataPending() {
+		md, err = gd.statObject(ctx, k.String())
+	}
+	if err == nil && expired(md.Expiration) {
+		err = ds.ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return md.Expiration, nil
+}
+
+// customTimeLifecycleRule returns the lifecycle rule deleting the values
+// under the prefix days after their CustomTime. Only values with a TTL or
+// marked unpinned have a CustomTime, so the rule doesn't touch other
+// objects. Lifecycle conditions have a resolution of days, so values are
+// deleted up to a day after that.
+func (gd *GCSDatastore) customTimeLifecycleRule(days int) storage.LifecycleRule {
+	return storage.LifecycleRule{
+		Action: storage.LifecycleAction{Type: storage.DeleteAction},
+		Condition: storage.LifecycleCondition{
+			DaysSinceCustomTime: int64(days),
+			MatchesPrefix:       []string{gd.listPrefix()},
+		},
+	}
+}
+
+// isTTLLifecycleRule reports whether rule deletes only expired or unpinned
+// values.
+func isTTLLifecycleRule(rule storage.LifecycleRule) bool {
+	c := rule.Condition
+	return rule.Action.Type == storage.DeleteAction && c.DaysSinceCustomTime > 0 &&
+		c.AgeInDays == 0 && c.CreatedBefore.IsZero() && c.NumNewerVersions == 0
+}
+
+// ensureCustomTimeLifecycle adds the lifecycle rule deleting values days
+// after their CustomTime to the bucket, for TTLLifecycle with a day or
+// GCLifecycleDays, unless it's there already. It replaces such rules for
+// other numbers of days under the prefix, which would delete unpinned
+// values early, or expired ones late. Failing to is logged, not fatal,
+// since the node may lack permission to update the bucket.
+func (gd *GCSDatastore) ensureCustomTimeLifecycle(ctx context.Context, days int) {
+	if gd.bucketAttrs == nil {
+		return
+	}
+	want := gd.customTimeLifecycleRule(days)
+	lifecycle := gd.bucketAttrs.Lifecycle
+	lifecycle.Rules = []storage.LifecycleRule{}
+	for _, rule := range gd.bucketAttrs.Lifecycle.Rules {
+		if isTTLLifecycleRule(rule) && len(rule.Condition.MatchesPrefix) == 1 &&
+			rule.Condition.MatchesPrefix[0] == want.Condition.MatchesPrefix[0] {
+			if rule.Condition.DaysSinceCustomTime == want.Condition.DaysSinceCustomTime {
+				return
+			}
+			continue
+		}
+		lifecycle.Rules = append(lifecycle.Rules, rule)
+	}
+	lifecycle.Rules = append(lifecycle.Rules, want)
+	bucket := gd.client.Bucket(gd.Config.Bucket).If(storage.BucketConditions{MetagenerationMatch: gd.bucketAttrs.MetaGeneration})
+	attrs, err := bucket.Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &lifecycle})
+	if err != nil {
+		logger.Warnf("Failed to add a lifecycle rule deleting values %d days after their CustomTime to bucket %s: %v", days, gd.Config.Bucket, err)
+		return
+	}
+	gd.bucketAttrs = attrs
+	logger.Infof("Added a lifecycle rule deleting values %d days after their CustomTime under %s to bucket %s.", days, gd.listPrefix(), gd.Config.Bucket)
+}
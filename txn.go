@@ -0,0 +1,338 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+var _ ds.TxnDatastore = (*GCSDatastore)(nil)
+
+var (
+	// ErrTxnConflict is returned by Commit when a key the transaction read
+	// or wrote was changed by another writer in the meantime.
+	ErrTxnConflict = errors.New("gcsds: transaction conflict")
+	// ErrTxnReadOnly is returned by writes to a read-only transaction.
+	ErrTxnReadOnly = errors.New("gcsds: read-only transaction")
+)
+
+// objectVersion identifies the state of an object. The version of a missing
+// object is zero, but for where its value is packed, if it is.
+type objectVersion struct {
+	gen, metagen int64
+	packed       packLoc
+}
+
+// exists reports whether there is a value, in an object or a pack.
+func (v objectVersion) exists() bool {
+	return v.gen != 0 || v.packed != packLoc{}
+}
+
+// conditions returns the preconditions that hold while the object is at v.
+func (v objectVersion) conditions() storage.Conditions {
+	if v.gen == 0 {
+		return storage.Conditions{DoesNotExist: true}
+	}
+	return storage.Conditions{GenerationMatch: v.gen, MetagenerationMatch: v.metagen}
+}
+
+// gcsTxn buffers writes until Commit, and records the version of every key
+// it accesses. Commit writes with GCS preconditions on those versions, so
+// that the transaction fails instead of overwriting changes made by other
+// writers, for example other kubo nodes sharing the prefix.
+type gcsTxn struct {
+	gd       *GCSDatastore
+	readOnly bool
+	mu       sync.Mutex
+	versions map[string]objectVersion
+	values   map[string][]byte
+	ops      map[ds.Key]batchOp
+}
+
+// NewTransaction returns a transaction. Reads in it bypass the caches and
+// go to GCS, so use transactions for mutable keys shared between writers
+// rather than for blocks.
+func (gd *GCSDatastore) NewTransaction(_ context.Context, readOnly bool) (ds.Txn, error) {
+	return &gcsTxn{
+		gd:       gd,
+		readOnly: readOnly,
+		versions: make(map[string]objectVersion),
+		values:   make(map[string][]byte),
+		ops:      make(map[ds.Key]batchOp),
+	}, nil
+}
+
+// get returns the value of k as seen by the transaction: its own write, or
+// the value first read from GCS.
+func (t *gcsTxn) get(ctx context.Context, k ds.Key) ([]byte, bool, error) {
+	if op, ok := t.ops[k]; ok {
+		return op.value, !op.delete, nil
+	}
+	key := k.String()
+	if _, ok := t.versions[key]; !ok {
+		if err := t.gd.flushKey(ctx, key); err != nil {
+			return nil, false, err
+		}
+		obj := t.gd.client.Bucket(t.gd.Config.Bucket).Object(t.gd.GCSPath(key))
+		value, v, err := t.gd.readVersion(ctx, key, obj)
+		if err != nil {
+			return nil, false, requestError("read", obj.ObjectName(), err)
+		}
+		if v.packed != (packLoc{}) {
+			if value, err = t.gd.readPacked(ctx, key, v.packed); err != nil {
+				return nil, false, err
+			}
+		}
+		t.versions[key], t.values[key] = v, value
+	}
+	return t.values[key], t.versions[key].exists(), nil
+}
+
+func (t *gcsTxn) Get(ctx context.Context, k ds.Key) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	value, exists, err := t.get(ctx, k)
+	if err == nil && !exists {
+		err = ds.ErrNotFound
+	}
+	return value, err
+}
+
+func (t *gcsTxn) Has(ctx context.Context, k ds.Key) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, exists, err := t.get(ctx, k)
+	return exists, err
+}
+
+func (t *gcsTxn) GetSize(ctx context.Context, k ds.Key) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	value, exists, err := t.get(ctx, k)
+	if err == nil && !exists {
+		err = ds.ErrNotFound
+	}
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+// Query queries the datastore. It doesn't see the transaction's writes, and
+// the keys it returns aren't checked on Commit.
+func (t *gcsTxn) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	return t.gd.Query(ctx, q)
+}
+
+func (t *gcsTxn) Put(ctx context.Context, k ds.Key, value []byte) error {
+	return t.write(ctx, k, batchOp{value: value})
+}
+
+func (t *gcsTxn) Delete(ctx context.Context, k ds.Key) error {
+	return t.write(ctx, k, batchOp{delete: true})
+}
+
+// write buffers op. A key written without being read is stat'ed first, so
+// that changes to it before Commit are conflicts too.
+func (t *gcsTxn) write(ctx context.Context, k ds.Key, op batchOp) error {
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := k.String()
+	if _, ok := t.versions[key]; !ok {
+		if err := t.gd.flushKey(ctx, key); err != nil {
+			return err
+		}
+		v, err := t.gd.objectVersion(ctx, key)
+		if err != nil {
+			return err
+		}
+		t.versions[key] = v
+	}
+	t.ops[k] = op
+	return nil
+}
+
+// Commit checks that the keys only read are unchanged, then applies the
+// writes, each on the condition that the key is unchanged. GCS has no
+// multi-object transactions, so a conflict detected while writing leaves
+// the writes before it applied. A conflict is reported as ErrTxnConflict.
+func (t *gcsTxn) Commit(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.ops) > 0 {
+		if err := t.gd.checkWritable(); err != nil {
+			return err
+		}
+	}
+	for key, v := range t.versions {
+		if _, ok := t.ops[ds.RawKey(key)]; ok {
+			continue
+		}
+		current, err := t.gd.objectVersion(ctx, key)
+		if err != nil {
+			return err
+		}
+		if current != v {
+			return fmt.Errorf("%w: %s", ErrTxnConflict, key)
+		}
+	}
+	keys := make([]ds.Key, 0, len(t.ops))
+	for k := range t.ops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	for _, k := range keys {
+		if err := t.apply(ctx, k, t.ops[k]); err != nil {
+			return err
+		}
+		delete(t.ops, k)
+	}
+	t.reset()
+	return nil
+}
+
+// apply writes op if k is still at the version the transaction saw.
+func (t *gcsTxn) apply(ctx context.Context, k ds.Key, op batchOp) error {
+	gd := t.gd
+	key := k.String()
+	v := t.versions[key]
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key))
+	if err := gd.flushKey(ctx, key); err != nil {
+		return err
+	}
+	if op.delete {
+		if v.gen == 0 {
+			// No object to delete, but the key must still be missing, or
+			// packed where it was.
+			current, err := gd.objectVersion(ctx, key)
+			if err != nil {
+				return err
+			}
+			if current != v {
+				return fmt.Errorf("%w: %s", ErrTxnConflict, key)
+			}
+			if !v.exists() {
+				return nil
+			}
+			if err := gd.packs.delete(ctx, key); err != nil {
+				return err
+			}
+			gd.deleted(ctx, key)
+			return nil
+		}
+		if gd.Config.TrashPrefix != "" {
+			if err := gd.moveToTrash(ctx, key); err != nil {
+				logger.Warnw("Failed to move object to trash", "key", key, "err", err)
+				return err
+			}
+		}
+		err := obj.If(v.conditions()).Delete(ctx)
+		if isPreconditionFailed(err) || err == storage.ErrObjectNotExist {
+			return fmt.Errorf("%w: %s", ErrTxnConflict, key)
+		}
+		if err != nil {
+			return gd.retainedError(ctx, key, requestError("delete", obj.ObjectName(), err))
+		}
+		if err := gd.packs.delete(ctx, key); err != nil {
+			return err
+		}
+		gd.deleted(ctx, key)
+		return nil
+	}
+	if gd.Config.VerifyPut {
+		if err := VerifyMultihash(k, op.value); err != nil {
+			return err
+		}
+	}
+	if err := gd.checkQuota(key, int64(len(op.value))); err != nil {
+		return err
+	}
+	w := gd.valueWriter(ctx, obj.If(v.conditions()))
+	gd.writeValue(w, key, op.value)
+	err := w.Close()
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("%w: %s", ErrTxnConflict, key)
+	}
+	if err != nil {
+		return requestError("write", obj.ObjectName(), checksumError(obj.ObjectName(), err))
+	}
+	// The object replaces a packed value.
+	if err := gd.packs.delete(ctx, key); err != nil {
+		return err
+	}
+	gd.stored(ctx, key, op.value)
+	return nil
+}
+
+// Discard drops the transaction's writes.
+func (t *gcsTxn) Discard(_ context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ops = make(map[ds.Key]batchOp)
+	t.reset()
+}
+
+func (t *gcsTxn) reset() {
+	t.versions = make(map[string]objectVersion)
+	t.values = make(map[string][]byte)
+}
+
+// objectVersion returns the current version of the object for key.
+func (gd *GCSDatastore) objectVersion(ctx context.Context, key string) (objectVersion, error) {
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key))
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		loc, _ := gd.packs.lookup(key)
+		return objectVersion{packed: loc}, nil
+	}
+	if err != nil {
+		return objectVersion{}, requestError("stat", obj.ObjectName(), err)
+	}
+	return objectVersion{gen: attrs.Generation, metagen: attrs.Metageneration}, nil
+}
+
+// readVersion reads obj, the object of key, and returns its value and
+// version. The value of a packed key isn't read.
+func (gd *GCSDatastore) readVersion(ctx context.Context, key string, obj *storage.ObjectHandle) ([]byte, objectVersion, error) {
+	r, err := obj.ReadCompressed(true).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		loc, _ := gd.packs.lookup(key)
+		return nil, objectVersion{packed: loc}, nil
+	}
+	if err != nil {
+		return nil, objectVersion{}, err
+	}
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return nil, objectVersion{}, checksumError(obj.ObjectName(), err)
+	}
+	if value, err = gd.decodeValue(r.Attrs.ContentEncoding, key, value); err != nil {
+		return nil, objectVersion{}, err
+	}
+	return value, objectVersion{gen: r.Attrs.Generation, metagen: r.Attrs.Metageneration}, nil
+}
@@ -0,0 +1,253 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+	"google.golang.org/api/iterator"
+)
+
+// ErrNotRecoverable is returned by ListDeleted for buckets that keep no
+// deleted objects.
+var ErrNotRecoverable = errors.New("gcsds: bucket has neither object versioning nor soft delete")
+
+// Recovery describes how a bucket keeps deleted objects restorable.
+type Recovery struct {
+	// Versioning keeps deleted objects as noncurrent versions, until a
+	// lifecycle rule deletes them.
+	Versioning bool
+	// SoftDelete is how long deleted objects are kept soft-deleted, 0 if
+	// soft delete is off.
+	SoftDelete time.Duration
+}
+
+// Recovery returns how the bucket keeps deleted objects restorable.
+func (gd *GCSDatastore) Recovery(ctx context.Context) (Recovery, error) {
+	var r Recovery
+	attrs, err := gd.client.Bucket(gd.Config.Bucket).Attrs(ctx)
+	if err != nil {
+		return r, requestError("get", gd.Config.Bucket, err)
+	}
+	r.Versioning = attrs.VersioningEnabled
+	// The storage client doesn't know soft delete.
+	var bucket struct {
+		SoftDeletePolicy struct {
+			RetentionDurationSeconds int64 `json:"retentionDurationSeconds,string"`
+		} `json:"softDeletePolicy"`
+	}
+	path := "/storage/v1/b/" + url.PathEscape(gd.Config.Bucket) + "?fields=softDeletePolicy"
+	if err := gd.batch.getJSON(ctx, path, &bucket); err != nil {
+		return r, requestError("get", gd.Config.Bucket, err)
+	}
+	r.SoftDelete = time.Duration(bucket.SoftDeletePolicy.RetentionDurationSeconds) * time.Second
+	return r, nil
+}
+
+// DeletedValue is a deleted value that the bucket can restore.
+type DeletedValue struct {
+	Key string
+	// Generation is the generation of the object holding the value.
+	Generation int64
+	Size       int64
+	// Deleted is when the value was deleted or overwritten.
+	Deleted time.Time
+	// SoftDeleted is set for soft-deleted objects, rather than noncurrent
+	// versions.
+	SoftDeleted bool
+}
+
+// ListDeleted returns the latest deleted value of each key under prefix
+// that has no value now, such as blocks removed by an accidental
+// `ipfs repo gc`, deleted after since unless it's zero, in key order. The
+// bucket must have object versioning or soft delete.
+func (gd *GCSDatastore) ListDeleted(ctx context.Context, prefix string, since time.Time) ([]DeletedValue, error) {
+	r, err := gd.Recovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !r.Versioning && r.SoftDelete == 0 {
+		return nil, ErrNotRecoverable
+	}
+	live := map[string]bool{}
+	latest := map[string]DeletedValue{}
+	add := func(v DeletedValue) {
+		if v.Deleted.After(since) && v.Deleted.After(latest[v.Key].Deleted) {
+			latest[v.Key] = v
+		}
+	}
+	if r.Versioning {
+		// Noncurrent versions are listed along with the live objects.
+		query := &storage.Query{Prefix: gd.namePrefix(prefix), Versions: true}
+		it := gd.client.Bucket(gd.Config.Bucket).Objects(ctx, query)
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, requestError("list", query.Prefix, err)
+			}
+			key := gd.keyOf(attrs.Name)
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if attrs.Deleted.IsZero() {
+				live[key] = true
+				continue
+			}
+			add(DeletedValue{Key: key, Generation: attrs.Generation, Size: objectSize(attrs), Deleted: attrs.Deleted})
+		}
+	} else {
+		next, listErr := gd.listMetadata(ctx, prefix)
+		for m := next(); m != nil; m = next() {
+			live[m.Key] = true
+		}
+		if err := listErr(); err != nil {
+			return nil, err
+		}
+	}
+	if r.SoftDelete > 0 {
+		if err := gd.listSoftDeleted(ctx, prefix, add); err != nil {
+			return nil, err
+		}
+	}
+	deleted := make([]DeletedValue, 0, len(latest))
+	for key, v := range latest {
+		if !live[key] && !gd.packs.has(key) {
+			deleted = append(deleted, v)
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].Key < deleted[j].Key })
+	return deleted, nil
+}
+
+// listSoftDeleted calls add with the soft-deleted objects under prefix,
+// listed with the JSON API since the storage client can't.
+func (gd *GCSDatastore) listSoftDeleted(ctx context.Context, prefix string, add func(DeletedValue)) error {
+	namePrefix := gd.namePrefix(prefix)
+	token := ""
+	for {
+		var page struct {
+			Items []struct {
+				Name            string            `json:"name"`
+				Generation      int64             `json:"generation,string"`
+				Size            int64             `json:"size,string"`
+				ContentEncoding string            `json:"contentEncoding"`
+				Metadata        map[string]string `json:"metadata"`
+				SoftDeleteTime  time.Time         `json:"softDeleteTime"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		query := url.Values{
+			"softDeleted": {"true"},
+			"prefix":      {namePrefix},
+			"fields":      {"items(name,generation,size,contentEncoding,metadata,softDeleteTime),nextPageToken"},
+		}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		path := "/storage/v1/b/" + url.PathEscape(gd.Config.Bucket) + "/o?" + query.Encode()
+		if err := gd.batch.getJSON(ctx, path, &page); err != nil {
+			return requestError("list", namePrefix, err)
+		}
+		for _, item := range page.Items {
+			key := gd.keyOf(item.Name)
+			if !strings.HasPrefix(key, prefix) || item.SoftDeleteTime.IsZero() {
+				continue
+			}
+			attrs := &storage.ObjectAttrs{Size: item.Size, ContentEncoding: item.ContentEncoding, Metadata: item.Metadata}
+			add(DeletedValue{Key: key, Generation: item.Generation, Size: objectSize(attrs), Deleted: item.SoftDeleteTime, SoftDeleted: true})
+		}
+		if token = page.NextPageToken; token == "" {
+			return nil
+		}
+	}
+}
+
+// Undelete restores deleted values, as listed by ListDeleted, unless their
+// key has a value again. Noncurrent versions are copied server-side, and
+// soft-deleted objects restored. It returns the number of values restored,
+// and a BatchError of the keys that failed.
+func (gd *GCSDatastore) Undelete(ctx context.Context, values []DeletedValue) (int, error) {
+	if err := gd.checkWritable(); err != nil {
+		return 0, err
+	}
+	var mu sync.Mutex
+	errs := map[ds.Key]error{}
+	restored := 0
+	sem := make(chan struct{}, gd.workers())
+	var wg sync.WaitGroup
+	for _, v := range values {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(v DeletedValue) {
+			defer func() { <-sem; wg.Done() }()
+			err := gd.undelete(ctx, v)
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				restored++
+			} else if !isPreconditionFailed(err) {
+				errs[ds.RawKey(v.Key)] = err
+			}
+		}(v)
+	}
+	wg.Wait()
+	if restored > 0 {
+		logger.Infof("Restored %d deleted values.", restored)
+	}
+	if len(errs) > 0 {
+		return restored, &BatchError{Errors: errs}
+	}
+	return restored, nil
+}
+
+// undelete restores v, unless its key has a value.
+func (gd *GCSDatastore) undelete(ctx context.Context, v DeletedValue) error {
+	name := gd.GCSPath(v.Key)
+	if v.SoftDeleted {
+		call := objectCall(http.MethodPost, gd.Config.Bucket, name, "")
+		call.path += fmt.Sprintf("/restore?generation=%d&ifGenerationMatch=0", v.Generation)
+		if err := gd.batch.do(ctx, []batchCall{call})[0]; err != nil {
+			if isPreconditionFailed(err) {
+				return err
+			}
+			return requestError("restore", name, err)
+		}
+	} else {
+		obj := gd.client.Bucket(gd.Config.Bucket).Object(name)
+		copier := gd.newCopier(obj.If(storage.Conditions{DoesNotExist: true}), obj.Generation(v.Generation))
+		if _, err := copier.Run(ctx); err != nil {
+			if isPreconditionFailed(err) {
+				return err
+			}
+			return requestError("copy", name, err)
+		}
+	}
+	gd.forgetMissing(v.Key)
+	_, err := gd.statObject(ctx, v.Key)
+	return err
+}
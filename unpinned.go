@@ -0,0 +1,206 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// unpinnedMetadataKey is the object metadata key marking a value unpinned,
+// holding when it was marked in RFC 3339 format. The object's CustomTime
+// is then that time, not an expiration, and the lifecycle rule of
+// Config.GCLifecycleDays deletes the object that many days after it.
+const unpinnedMetadataKey = "unpinned"
+
+// unpinned reports whether attrs are those of an object marked unpinned.
+func unpinned(attrs *storage.ObjectAttrs) bool {
+	_, ok := attrs.Metadata[unpinnedMetadataKey]
+	return ok
+}
+
+// ephemeral reports whether key is under one of Config.EphemeralPrefixes.
+func (gd *GCSDatastore) ephemeral(key string) bool {
+	for _, prefix := range gd.Config.EphemeralPrefixes {
+		if key == prefix || strings.HasPrefix(key, queryPrefix(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// markEphemeral marks the value of key written by w unpinned if it is
+// ephemeral and doesn't expire.
+func (gd *GCSDatastore) markEphemeral(w *storage.Writer, key string) {
+	if !w.CustomTime.IsZero() || !gd.ephemeral(key) {
+		return
+	}
+	if w.Metadata == nil {
+		w.Metadata = map[string]string{}
+	}
+	now := time.Now()
+	w.Metadata[unpinnedMetadataKey] = now.UTC().Format(time.RFC3339Nano)
+	w.CustomTime = now
+}
+
+// MarkUnpinned sets the CustomTime of the objects of keys, e.g. blocks no
+// longer pinned, to now, so that the lifecycle rule of
+// Config.GCLifecycleDays deletes them that many days later unless they are
+// marked pinned or rewritten in the meantime. Marking a value again pushes
+// its deletion back. Values are still returned until deleted. Values with
+// a TTL and packed values, which lifecycle rules can't delete one by one,
+// are left alone. Missing keys are reported in a BatchError.
+func (gd *GCSDatastore) MarkUnpinned(ctx context.Context, keys []ds.Key) error {
+	return gd.forEachObject(ctx, keys, gd.markUnpinned)
+}
+
+// MarkPinned undoes MarkUnpinned, and Config.EphemeralPrefixes, for the
+// values of keys, which the lifecycle rule of Config.GCLifecycleDays then
+// leaves alone. CustomTime can't be cleared, so marked objects are
+// rewritten in place, server-side. With Config.HoldPinned, it also places
+// event-based holds on them, which MarkUnpinned releases.
+func (gd *GCSDatastore) MarkPinned(ctx context.Context, keys []ds.Key) error {
+	return gd.forEachObject(ctx, keys, gd.markPinned)
+}
+
+// forEachObject calls f with the object of each key in parallel, after
+// writing any pending value of the key, skipping packed values, and returns a BatchError of the
+// keys for which it failed.
+func (gd *GCSDatastore) forEachObject(ctx context.Context, keys []ds.Key, f func(context.Context, string, *storage.ObjectHandle) error) error {
+	if err := gd.checkWritable(); err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	errs := map[ds.Key]error{}
+	sem := make(chan struct{}, gd.workers())
+	var wg sync.WaitGroup
+	for _, k := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(k ds.Key) {
+			defer func() { <-sem; wg.Done() }()
+			key := k.String()
+			err := gd.flushKey(ctx, key)
+			if _, ok := gd.packs.lookup(key); ok {
+				return
+			}
+			if err == nil {
+				err = f(ctx, key, gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key)))
+			}
+			if err == storage.ErrObjectNotExist {
+				err = ds.ErrNotFound
+			}
+			if err != nil {
+				mu.Lock()
+				errs[k] = err
+				mu.Unlock()
+			}
+		}(k)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return &BatchError{Errors: errs}
+	}
+	return nil
+}
+
+func (gd *GCSDatastore) markUnpinned(ctx context.Context, key string, obj *storage.ObjectHandle) error {
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	if gd.Config.HoldPinned && attrs.EventBasedHold {
+		if err := gd.setEventBasedHold(ctx, obj, false); err != nil {
+			return err
+		}
+	}
+	if _, ok := attrs.Metadata[expirationMetadataKey]; ok {
+		return nil
+	}
+	return gd.stampUnpinned(ctx, obj, attrs)
+}
+
+// stampUnpinned marks the object with attrs unpinned as of now.
+func (gd *GCSDatastore) stampUnpinned(ctx context.Context, obj *storage.ObjectHandle, attrs *storage.ObjectAttrs) error {
+	now := time.Now()
+	update := storage.ObjectAttrsToUpdate{Metadata: map[string]string{}, CustomTime: now}
+	for k, v := range attrs.Metadata {
+		update.Metadata[k] = v
+	}
+	update.Metadata[unpinnedMetadataKey] = now.UTC().Format(time.RFC3339Nano)
+	// Don't mark a value written in the meantime.
+	_, err := obj.If(storage.Conditions{GenerationMatch: attrs.Generation}).Update(ctx, update)
+	if err != nil && !isPreconditionFailed(err) {
+		return requestError("update", obj.ObjectName(), err)
+	}
+	return nil
+}
+
+func (gd *GCSDatastore) markPinned(ctx context.Context, key string, obj *storage.ObjectHandle) error {
+	if err := gd.clearUnpinned(ctx, obj); err != nil {
+		return err
+	}
+	if gd.Config.HoldPinned {
+		// The rewrite, if any, made a new generation without the hold.
+		return gd.setEventBasedHold(ctx, obj, true)
+	}
+	return nil
+}
+
+// clearUnpinned rewrites the object if it's marked unpinned, without the
+// mark.
+func (gd *GCSDatastore) clearUnpinned(ctx context.Context, obj *storage.ObjectHandle) error {
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+	if !unpinned(attrs) {
+		return nil
+	}
+	dst := obj.If(storage.Conditions{GenerationMatch: attrs.Generation})
+	copier := gd.newCopier(dst, obj.Generation(attrs.Generation))
+	copier.ObjectAttrs = rewriteAttrs(attrs)
+	copier.Metadata = map[string]string{}
+	for k, v := range attrs.Metadata {
+		if k != unpinnedMetadataKey {
+			copier.Metadata[k] = v
+		}
+	}
+	if _, ok := attrs.Metadata[expirationMetadataKey]; !ok {
+		copier.CustomTime = time.Time{}
+	}
+	rewritten, err := copier.Run(ctx)
+	if isPreconditionFailed(err) {
+		return nil
+	}
+	if err != nil {
+		return requestError("rewrite", obj.ObjectName(), err)
+	}
+	if !unpinned(rewritten) {
+		return nil
+	}
+	// Empty metadata isn't sent, which keeps that of the source.
+	update := storage.ObjectAttrsToUpdate{Metadata: map[string]string{unpinnedMetadataKey: ""}}
+	_, err = obj.If(storage.Conditions{GenerationMatch: rewritten.Generation}).Update(ctx, update)
+	if err != nil && !isPreconditionFailed(err) {
+		return requestError("update", obj.ObjectName(), err)
+	}
+	return nil
+}
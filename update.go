@@ -0,0 +1,112 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/storage"
+	ds "github.com/ipfs/go-datastore"
+)
+
+// Attempts Update makes before giving up with ErrConflict.
+const maxUpdateAttempts = 10
+
+// ErrConflict is returned by Update when other writers kept changing the
+// value.
+var ErrConflict = errors.New("gcsds: too many concurrent updates")
+
+// UpdateFunc computes the new value of a key from its current value, which
+// is nil if the key doesn't exist. It may be called several times.
+type UpdateFunc func(old []byte, exists bool) ([]byte, error)
+
+// Update atomically replaces the value of k with fn applied to it. The
+// value is read from GCS, bypassing the caches, and written only if the
+// object wasn't changed in between. Otherwise Update retries with the new
+// value. Use it for mutable keys written by several nodes, like the MFS
+// root, where Put would silently drop concurrent changes.
+func (gd *GCSDatastore) Update(ctx context.Context, k ds.Key, fn UpdateFunc) error {
+	if err := gd.checkWritable(); err != nil {
+		return err
+	}
+	key := k.String()
+	if err := gd.flushKey(ctx, key); err != nil {
+		return err
+	}
+	obj := gd.client.Bucket(gd.Config.Bucket).Object(gd.GCSPath(key))
+	for attempt := 1; ; attempt++ {
+		old, gen, err := gd.readGeneration(ctx, key, obj)
+		if err != nil {
+			return requestError("read", obj.ObjectName(), err)
+		}
+		value, err := fn(old, gen != 0)
+		if err != nil {
+			return err
+		}
+		if err := gd.checkQuota(key, int64(len(value))); err != nil {
+			return err
+		}
+		cond := storage.Conditions{GenerationMatch: gen}
+		if gen == 0 {
+			cond = storage.Conditions{DoesNotExist: true}
+		}
+		w := gd.valueWriter(ctx, obj.If(cond))
+		gd.writeValue(w, key, value)
+		err = w.Close()
+		if err == nil {
+			gd.stored(ctx, key, value)
+			return nil
+		}
+		if !isPreconditionFailed(err) {
+			return requestError("write", obj.ObjectName(), checksumError(obj.ObjectName(), err))
+		}
+		if attempt == maxUpdateAttempts {
+			logger.Warnw("Giving up update after conflicts", "key", key, "conflicts", attempt)
+			return ErrConflict
+		}
+		// Back off with jitter so that contending writers spread out.
+		delay := time.Duration(rand.Int63n(int64(10*time.Millisecond) << attempt))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readGeneration reads obj, the object of key, and returns its value and
+// generation. The generation of a missing object is 0.
+func (gd *GCSDatastore) readGeneration(ctx context.Context, key string, obj *storage.ObjectHandle) ([]byte, int64, error) {
+	r, err := obj.ReadCompressed(true).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, checksumError(obj.ObjectName(), err)
+	}
+	if value, err = gd.decodeValue(r.Attrs.ContentEncoding, key, value); err != nil {
+		return nil, 0, err
+	}
+	return value, r.Attrs.Generation, nil
+}
@@ -0,0 +1,52 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/boxo/datastore/dshelp"
+	ds "github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ErrHashMismatch is returned when a block value does not hash to the
+// multihash encoded in its key.
+var ErrHashMismatch = errors.New("gcsds: value does not match key multihash")
+
+// VerifyMultihash checks that value hashes to the multihash encoded in the
+// last component of k, as written by kubo's blockstore. Keys that don't
+// decode to a multihash are not blocks and always pass.
+func VerifyMultihash(k ds.Key, value []byte) error {
+	hash, err := dshelp.DsKeyToMultihash(ds.NewKey(k.BaseNamespace()))
+	if err != nil {
+		return nil
+	}
+	decoded, err := mh.Decode(hash)
+	if err != nil {
+		return nil
+	}
+	sum, err := mh.Sum(value, decoded.Code, decoded.Length)
+	if err != nil {
+		// Unsupported hash function. Nothing to verify against.
+		return nil
+	}
+	if !bytes.Equal(sum, hash) {
+		return fmt.Errorf("%w: key: %v", ErrHashMismatch, k)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package gcsds
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WAL segments are rotated beyond this size.
+const walSegmentSize = 64 << 20
+
+// walRecord is a buffered Put.
+type walRecord struct {
+	seq     uint64
+	key     string
+	value   []byte
+	segment *walSegment
+}
+
+// walSegment is a WAL file. It is deleted once none of its records are
+// pending.
+type walSegment struct {
+	path        string
+	outstanding int
+}
+
+// wal is the write-ahead log of buffered Puts: a directory of segment
+// files of checksummed records. Callers serialize access. The methods are
+// no-ops on a nil wal, so unbuffered modes need no checks.
+type wal struct {
+	dir       string
+	id        uint64
+	current   *walSegment
+	f         *os.File
+	size      int64
+	recovered []*walSegment
+}
+
+// openWAL opens the WAL in dir and returns the records of earlier runs,
+// oldest first. A torn record at the end of a segment, from a crash during
+// append, ends that segment.
+func openWAL(dir string) (*wal, []walRecord, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(names)
+	w := &wal{dir: dir}
+	records := []walRecord{}
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".wal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if id > w.id {
+			w.id = id
+		}
+		segment := &walSegment{path: name}
+		w.recovered = append(w.recovered, segment)
+		rs, err := readSegment(segment)
+		if err != nil {
+			return nil, nil, err
+		}
+		records = append(records, rs...)
+	}
+	if err := w.rotate(); err != nil {
+		return nil, nil, err
+	}
+	return w, records, nil
+}
+
+func readSegment(segment *walSegment) ([]walRecord, error) {
+	f, err := os.Open(segment.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	records := []walRecord{}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err != io.EOF {
+				logger.Warnf("Ignoring torn record at the end of %s.", segment.path)
+			}
+			return records, nil
+		}
+		size := binary.BigEndian.Uint32(header)
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) || size < 12 {
+			logger.Warnf("Ignoring torn record at the end of %s.", segment.path)
+			return records, nil
+		}
+		keyLen := binary.BigEndian.Uint32(body[8:])
+		if 12+uint64(keyLen) > uint64(size) {
+			return nil, fmt.Errorf("gcsds: corrupt WAL record in %s", segment.path)
+		}
+		records = append(records, walRecord{
+			seq:     binary.BigEndian.Uint64(body),
+			key:     string(body[12 : 12+keyLen]),
+			value:   body[12+keyLen:],
+			segment: segment,
+		})
+		segment.outstanding++
+	}
+}
+
+// rotate starts a new segment.
+func (w *wal) rotate() error {
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			return err
+		}
+		if w.current.outstanding == 0 {
+			os.Remove(w.current.path)
+		}
+	}
+	w.id++
+	segment := &walSegment{path: filepath.Join(w.dir, fmt.Sprintf("%020d.wal", w.id))}
+	f, err := os.OpenFile(segment.path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	w.current, w.f, w.size = segment, f, 0
+	return nil
+}
+
+// append durably writes r and returns the segment holding it.
+func (w *wal) append(r walRecord) (*walSegment, error) {
+	if w.size > walSegmentSize {
+		if err := w.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	body := make([]byte, 12, 12+len(r.key)+len(r.value))
+	binary.BigEndian.PutUint64(body, r.seq)
+	binary.BigEndian.PutUint32(body[8:], uint32(len(r.key)))
+	body = append(append(body, r.key...), r.value...)
+	record := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(record, uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(body))
+	record = append(record, body...)
+	if _, err := w.f.Write(record); err != nil {
+		return nil, err
+	}
+	if err := w.f.Sync(); err != nil {
+		return nil, err
+	}
+	w.size += int64(len(record))
+	w.current.outstanding++
+	return w.current, nil
+}
+
+// release marks a record of segment as no longer pending, and deletes the
+// segment when it was the last.
+func (w *wal) release(segment *walSegment) {
+	if w == nil || segment == nil {
+		return
+	}
+	segment.outstanding--
+	if segment.outstanding == 0 && segment != w.current {
+		if err := os.Remove(segment.path); err != nil {
+			logger.Warnf("Failed to remove WAL segment %s: %v", segment.path, err)
+		}
+	}
+}
+
+// dropUnused deletes recovered segments without pending records.
+func (w *wal) dropUnused() {
+	if w == nil {
+		return
+	}
+	for _, segment := range w.recovered {
+		if segment.outstanding == 0 {
+			os.Remove(segment.path)
+		}
+	}
+	w.recovered = nil
+}
+
+func (w *wal) close() error {
+	if w == nil {
+		return nil
+	}
+	return w.f.Close()
+}